@@ -59,14 +59,40 @@ func checkAuth(logger log.Logger, auth authable, o *oauth, repo userRepository)
 		if user != nil && user.ID != "" {
 			userId = user.ID
 		}
+		viaToken := false
 		if token != nil && userId == "" {
+			viaToken = true
 			userId = token.GetUserID()
+			if user, err = repo.lookupByUserId(userId); err != nil {
+				internalError(w, err)
+				return
+			}
 		}
 
-		if userId == "" {
+		// tokens outlive users who have been deleted
+		if userId == "" || user == nil {
 			w.WriteHeader(http.StatusForbidden)
 			return
 		}
+		if !user.EmailVerified {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		// OAuth2 tokens are limited to their scopes, cookies are for the user themselves
+		// and can access everything. Tokens without a scope don't pass any scope rule.
+		if viaToken {
+			scope := token.GetScope()
+			if required := o.requiredScope(r); required != "" && !scopeIncludes(scope, required) {
+				authFailures.With("method", "oauth2").Add(1)
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, required))
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			if scope != "" {
+				w.Header().Set("X-Scopes", scope)
+			}
+		}
 
 		w.Header().Set("X-User-Id", userId)
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
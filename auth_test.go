@@ -9,6 +9,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
+
+	"github.com/moov-io/base"
 
 	"github.com/go-kit/kit/log"
 )
@@ -23,11 +26,11 @@ func TestAuth__extractUserId(t *testing.T) {
 	knownUserId := generateID()
 
 	// Write our user
-	cookie, err := createCookie(knownUserId, auth)
+	cookie, err := createCookie(knownUserId, auth, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := auth.writeCookie(knownUserId, cookie); err != nil {
+	if err := auth.writeCookie(knownUserId, cookie, "", ""); err != nil {
 		t.Fatal(err)
 	}
 
@@ -93,6 +96,30 @@ func TestAuth__checkAuth(t *testing.T) {
 	if v := w.Header().Get("X-User-Id"); v != "" {
 		t.Error("expected empty X-User-Id")
 	}
+
+	// a token for a user who has since been deleted
+	u := &User{ID: generateID(), Email: "test@moov.io", EmailVerified: true, CreatedAt: base.NewTime(time.Now())}
+	if err := repo.upsert(u); err != nil {
+		t.Fatal(err)
+	}
+	_, token := createOAuthClient(t, o, u.ID)
+	check := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/auth/check", nil)
+		r.Header.Set("Authorization", "Bearer "+token.Access)
+		checkAuth(log.NewNopLogger(), auth, o.svc, repo)(w, r)
+		w.Flush()
+		return w
+	}
+	if w := check(); w.Code != http.StatusOK || w.Header().Get("X-User-Id") != u.ID {
+		t.Fatalf("got %d", w.Code)
+	}
+	if err := repo.deleteUser(u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if w := check(); w.Code != http.StatusForbidden || w.Header().Get("X-User-Id") != "" {
+		t.Errorf("got %d X-User-Id=%q", w.Code, w.Header().Get("X-User-Id"))
+	}
 }
 
 func TestAuth__forwardedPreflight(t *testing.T) {
@@ -0,0 +1,469 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	stderr "errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/moov-io/auth/pkg/oauthdb"
+	moovhttp "github.com/moov-io/base/http"
+
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/errors"
+)
+
+var (
+	errLoginRequired               = stderr.New("login required")
+	errInvalidConsent              = stderr.New("invalid consent form, please try again")
+	errPublicClientNeedsRedirect   = stderr.New("public clients need at least one redirect_uri")
+	errUnregisteredRedirectURI     = stderr.New("redirect_uri is not registered for this client")
+	errAuthorizationCodeNotAllowed = stderr.New("client has no registered redirect_uri values")
+
+	// oauthLoginURL is where users without a moov_auth cookie are sent from an authorization
+	// request, read from OAUTH2_LOGIN_URL. The authorization request is added as the return_to
+	// query parameter so the login page can send users back afterwards.
+	oauthLoginURL = os.Getenv("OAUTH2_LOGIN_URL")
+
+	// codeVerifierPattern is the PKCE code_verifier format (RFC 7636 section 4.1)
+	codeVerifierPattern = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+)
+
+// isPublicClient returns true for clients which can't keep a secret, like single page and
+// native apps. They're created without a secret and must use PKCE.
+func isPublicClient(client oauth2.ClientInfo) bool {
+	return client.GetSecret() == ""
+}
+
+// validateRedirectURI checks uri can be registered for a client. Plain http is only allowed
+// for loopback addresses and other schemes are allowed for native apps.
+func validateRedirectURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return fmt.Errorf("invalid redirect_uri %q: %v", uri, err)
+	}
+	if u.Scheme == "" || u.Fragment != "" || strings.Contains(uri, "#") {
+		return fmt.Errorf("invalid redirect_uri %q: must be an absolute URI without a fragment", uri)
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "https":
+		if u.Host == "" {
+			return fmt.Errorf("invalid redirect_uri %q: missing host", uri)
+		}
+	case "http":
+		host := u.Hostname()
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return fmt.Errorf("invalid redirect_uri %q: http is only allowed for localhost", uri)
+		}
+	}
+	return nil
+}
+
+// clientInfoHandler reads client credentials for token requests from HTTP Basic auth or
+// the client_id and client_secret parameters. Public clients only send their client_id.
+//
+// Secrets are checked here against their hash and the stored secret is returned, which is
+// what the oauth2 library compares against the client it reads.
+func (o *oauth) clientInfoHandler(r *http.Request) (string, string, error) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.FormValue("client_id"), r.FormValue("client_secret")
+	}
+	if clientID == "" {
+		return "", "", errors.ErrInvalidClient
+	}
+	client, err := o.clientStore.GetByID(clientID)
+	if err != nil {
+		return "", "", err
+	}
+	if client == nil {
+		return "", "", errors.ErrInvalidClient
+	}
+	if clientSecret == "" {
+		if !isPublicClient(client) {
+			return "", "", errors.ErrInvalidClient
+		}
+		return clientID, "", nil
+	}
+	if !oauthdb.VerifySecret(client.GetSecret(), clientSecret) {
+		return "", "", errors.ErrInvalidClient
+	}
+	return clientID, client.GetSecret(), nil
+}
+
+// clientAuthorizedHandler limits public clients to the authorization code and refresh token grants
+func (o *oauth) clientAuthorizedHandler(clientID string, grant oauth2.GrantType) (bool, error) {
+	client, err := o.clientStore.GetByID(clientID)
+	if err != nil || client == nil {
+		return false, err
+	}
+	if isPublicClient(client) {
+		return grant == oauth2.AuthorizationCode || grant == oauth2.Refreshing, nil
+	}
+	return true, nil
+}
+
+// authorizeRequest is an authorization code request (RFC 6749 section 4.1.1) from a client
+// acting on behalf of a user, optionally with PKCE (RFC 7636) and an OpenID Connect nonce.
+type authorizeRequest struct {
+	ResponseType        string
+	ClientID            string
+	RedirectURI         string
+	Scope               string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	Nonce               string
+
+	client oauth2.ClientInfo
+}
+
+func (req *authorizeRequest) values() url.Values {
+	return url.Values{
+		"response_type":         []string{req.ResponseType},
+		"client_id":             []string{req.ClientID},
+		"redirect_uri":          []string{req.RedirectURI},
+		"scope":                 []string{req.Scope},
+		"state":                 []string{req.State},
+		"code_challenge":        []string{req.CodeChallenge},
+		"code_challenge_method": []string{req.CodeChallengeMethod},
+		"nonce":                 []string{req.Nonce},
+	}
+}
+
+// readAuthorizeRequest finds the client and redirect_uri of an authorization request. Errors
+// from errors.ErrInvalidClient and errUnregisteredRedirectURI can't be sent to the client, so
+// they're shown to the user instead.
+func (o *oauth) readAuthorizeRequest(form url.Values) (*authorizeRequest, error) {
+	req := &authorizeRequest{
+		ResponseType:        form.Get("response_type"),
+		ClientID:            form.Get("client_id"),
+		RedirectURI:         form.Get("redirect_uri"),
+		Scope:               form.Get("scope"),
+		State:               form.Get("state"),
+		CodeChallenge:       form.Get("code_challenge"),
+		CodeChallengeMethod: form.Get("code_challenge_method"),
+		Nonce:               form.Get("nonce"),
+	}
+	if req.ClientID == "" {
+		return nil, errors.ErrInvalidClient
+	}
+	client, err := o.clientStore.GetByID(req.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		return nil, errors.ErrInvalidClient
+	}
+	req.client = client
+
+	// redirect_uri must exactly match a registered value, it can be left off when there's only one
+	uris, err := o.clientStore.GetRedirectURIs(req.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	if len(uris) == 0 {
+		return nil, errAuthorizationCodeNotAllowed
+	}
+	if req.RedirectURI == "" && len(uris) == 1 {
+		req.RedirectURI = uris[0]
+	}
+	for i := range uris {
+		if uris[i] == req.RedirectURI {
+			return req, nil
+		}
+	}
+	return nil, errUnregisteredRedirectURI
+}
+
+// checkAuthorizeRequest returns an OAuth2 error to send back to the client's redirect_uri
+func (o *oauth) checkAuthorizeRequest(req *authorizeRequest) error {
+	if req.ResponseType != oauth2.Code.String() {
+		return errors.ErrUnsupportedResponseType
+	}
+	if req.CodeChallenge != "" || req.CodeChallengeMethod != "" {
+		// only S256 is supported, "plain" offers no protection if the request is seen
+		if req.CodeChallengeMethod != "S256" || !codeVerifierPattern.MatchString(req.CodeChallenge) {
+			return errors.ErrInvalidRequest
+		}
+	} else if isPublicClient(req.client) {
+		return errors.ErrInvalidRequest
+	}
+
+	if err := validateScope(req.Scope); err != nil {
+		return errors.ErrInvalidScope
+	}
+	req.Scope = normalizeScope(req.Scope)
+	allowed, err := o.clientStore.GetScope(req.ClientID)
+	if err != nil {
+		o.logger.Log("authorize", fmt.Sprintf("problem reading scope for client %s: %v", req.ClientID, err))
+		return errors.ErrServerError
+	}
+	if !scopeAllows(allowed, o.withoutOIDCScopes(req.Scope)) {
+		return errors.ErrInvalidScope
+	}
+	if req.Scope == "" {
+		// clients get everything they're allowed unless they ask for less
+		req.Scope = allowed
+	}
+	return nil
+}
+
+// redirect sends the user back to the client with params added to the redirect_uri
+func (req *authorizeRequest) redirect(w http.ResponseWriter, r *http.Request, params url.Values) {
+	u, err := url.Parse(req.RedirectURI)
+	if err != nil {
+		problem(w, http.StatusBadRequest, errUnregisteredRedirectURI)
+		return
+	}
+	q := u.Query()
+	for k := range params {
+		q.Set(k, params.Get(k))
+	}
+	if req.State != "" {
+		q.Set("state", req.State)
+	}
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+func (req *authorizeRequest) redirectError(w http.ResponseWriter, r *http.Request, err error) {
+	req.redirect(w, r, url.Values{"error": []string{err.Error()}})
+}
+
+// consentToken protects the consent form from cross-site requests. It's bound to the user's
+// moov_auth cookie and every parameter of the authorization request.
+func consentToken(cookie *http.Cookie, req *authorizeRequest) string {
+	mac := hmac.New(sha256.New, []byte(cookie.Value))
+	mac.Write([]byte(req.values().Encode()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// loginRedirect sends users to OAUTH2_LOGIN_URL and back to the authorization request afterwards
+func loginRedirect(w http.ResponseWriter, r *http.Request) {
+	if oauthLoginURL == "" {
+		problem(w, http.StatusUnauthorized, errLoginRequired)
+		return
+	}
+	u, err := url.Parse(oauthLoginURL)
+	if err != nil {
+		internalError(w, fmt.Errorf("invalid OAUTH2_LOGIN_URL: %v", err))
+		return
+	}
+	q := u.Query()
+	q.Set("return_to", r.URL.RequestURI())
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// authorizeRequestHandler starts the authorization code flow (GET /oauth2/authorize?response_type=code)
+// by asking the logged in user to approve the client's request.
+func (o *oauth) authorizeRequestHandler(auth authable, repo userRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "oauth.authorizeRequestHandler")
+
+		req, err := o.readAuthorizeRequest(r.URL.Query())
+		if err != nil {
+			authorizeRequestProblem(w, err)
+			return
+		}
+		if err := o.checkAuthorizeRequest(req); err != nil {
+			req.redirectError(w, r, err)
+			return
+		}
+		user, err := getUserFromCookie(auth, repo, r)
+		if err != nil || user == nil {
+			loginRedirect(w, r)
+			return
+		}
+		if !user.EmailVerified {
+			problem(w, http.StatusForbidden, errEmailNotVerified)
+			return
+		}
+		name, err := o.clientStore.GetName(req.ClientID)
+		if err != nil {
+			internalError(w, fmt.Errorf("problem reading name of client %s: %v", req.ClientID, err))
+			return
+		}
+		if name == "" {
+			name = req.ClientID
+		}
+
+		data := consentPage{
+			Name:     name,
+			Domain:   req.client.GetDomain(),
+			Email:    user.Email,
+			Scopes:   strings.Fields(req.Scope),
+			Fields:   req.values(),
+			Token:    consentToken(extractCookie(r), req),
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; form-action 'self'; frame-ancestors 'none'")
+		w.WriteHeader(http.StatusOK)
+		if err := consentTemplate.Execute(w, data); err != nil {
+			o.logger.Log("authorize", fmt.Sprintf("problem rendering consent page: %v", err))
+		}
+	}
+}
+
+// authorizeDecisionHandler accepts the consent form (POST /oauth2/authorize) and redirects
+// back to the client with an authorization code or an access_denied error.
+func (o *oauth) authorizeDecisionHandler(auth authable, repo userRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "oauth.authorizeDecisionHandler")
+
+		if err := r.ParseForm(); err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+		req, err := o.readAuthorizeRequest(r.PostForm)
+		if err != nil {
+			authorizeRequestProblem(w, err)
+			return
+		}
+		user, err := getUserFromCookie(auth, repo, r)
+		if err != nil || user == nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if !user.EmailVerified {
+			problem(w, http.StatusForbidden, errEmailNotVerified)
+			return
+		}
+		// check the consent token before anything can change the request
+		token := r.PostForm.Get("consent_token")
+		if !hmac.Equal([]byte(token), []byte(consentToken(extractCookie(r), req))) {
+			problem(w, http.StatusForbidden, errInvalidConsent)
+			return
+		}
+		if err := o.checkAuthorizeRequest(req); err != nil {
+			req.redirectError(w, r, err)
+			return
+		}
+		if r.PostForm.Get("decision") != "allow" {
+			req.redirectError(w, r, errors.ErrAccessDenied)
+			return
+		}
+
+		ti, err := o.manager.GenerateAuthToken(oauth2.Code, &oauth2.TokenGenerateRequest{
+			ClientID:    req.ClientID,
+			UserID:      user.ID,
+			RedirectURI: req.RedirectURI,
+			Scope:       req.Scope,
+			Request:     r,
+		})
+		if err != nil {
+			o.logger.Log("authorize", fmt.Sprintf("problem creating authorization code for client %s: %v", req.ClientID, err))
+			req.redirectError(w, r, errors.ErrServerError)
+			return
+		}
+		err = o.tokenStore.SaveCodeRequest(ti.GetCode(), oauthdb.CodeRequest{
+			CodeChallenge:       req.CodeChallenge,
+			CodeChallengeMethod: req.CodeChallengeMethod,
+			Nonce:               req.Nonce,
+		})
+		if err != nil {
+			o.logger.Log("authorize", fmt.Sprintf("problem saving authorization code request for client %s: %v", req.ClientID, err))
+			o.tokenStore.RemoveByCode(ti.GetCode())
+			req.redirectError(w, r, errors.ErrServerError)
+			return
+		}
+		o.logger.Log("authorize", fmt.Sprintf("userId=%s authorized client %s for scope %q", user.ID, req.ClientID, req.Scope))
+
+		req.redirect(w, r, url.Values{"code": []string{ti.GetCode()}})
+	}
+}
+
+func authorizeRequestProblem(w http.ResponseWriter, err error) {
+	switch err {
+	case errors.ErrInvalidClient, errUnregisteredRedirectURI, errAuthorizationCodeNotAllowed:
+		problem(w, http.StatusBadRequest, err)
+	default:
+		internalError(w, fmt.Errorf("problem reading authorization request: %v", err))
+	}
+}
+
+// verifyCodeRequest checks the PKCE code_verifier sent when exchanging an authorization code
+// (RFC 7636 section 4.6) and returns the OpenID Connect nonce from the authorization request.
+// errors.ErrInvalidGrant is returned for verifiers which don't match.
+func (o *oauth) verifyCodeRequest(clientID string, code string, verifier string) (string, error) {
+	req, err := o.tokenStore.GetCodeRequest(code)
+	if err != nil {
+		return "", err
+	}
+	if req == nil || req.CodeChallenge == "" {
+		client, err := o.clientStore.GetByID(clientID)
+		if err != nil {
+			return "", err
+		}
+		if client != nil && isPublicClient(client) {
+			return "", errors.ErrInvalidGrant
+		}
+		if req == nil {
+			return "", nil
+		}
+		return req.Nonce, nil
+	}
+	if !codeVerifierPattern.MatchString(verifier) {
+		return "", errors.ErrInvalidGrant
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(req.CodeChallenge)) != 1 {
+		return "", errors.ErrInvalidGrant
+	}
+	return req.Nonce, nil
+}
+
+type consentPage struct {
+	Name     string // the client's name, or its ID when it has none
+	Domain   string
+	Email    string
+	Scopes   []string
+	Fields   url.Values
+	Token    string
+}
+
+var consentTemplate = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Authorize {{ .Name }}</title>
+<style>
+body { font-family: sans-serif; max-width: 32em; margin: 4em auto; padding: 0 1em; color: #222; }
+button { padding: 0.5em 1.5em; margin-right: 1em; }
+</style>
+</head>
+<body>
+<h1>Authorize application</h1>
+<p>The application <strong>{{ .Name }}</strong>{{ if .Domain }} ({{ .Domain }}){{ end }} wants to access your account, <strong>{{ .Email }}</strong>.</p>
+{{ if .Scopes }}<p>It's asking for:</p>
+<ul>
+{{ range .Scopes }}<li>{{ . }}</li>
+{{ end }}</ul>
+{{ else }}<p>It's asking for full access to your account.</p>
+{{ end }}<form method="post" action="">
+{{ range $name, $values := .Fields }}{{ range $values }}<input type="hidden" name="{{ $name }}" value="{{ . }}">
+{{ end }}{{ end }}<input type="hidden" name="consent_token" value="{{ .Token }}">
+<button type="submit" name="decision" value="allow">Allow</button>
+<button type="submit" name="decision" value="deny">Deny</button>
+</form>
+</body>
+</html>
+`))
@@ -0,0 +1,476 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moov-io/base"
+	"gopkg.in/oauth2.v3/models"
+)
+
+func TestAuthorize__validateRedirectURI(t *testing.T) {
+	valid := []string{
+		"https://app.moov.io/callback",
+		"https://app.moov.io/callback?foo=bar",
+		"http://localhost:8080/callback",
+		"http://127.0.0.1/callback",
+		"http://[::1]:9000/callback",
+		"io.moov.app:/oauth2redirect",
+	}
+	for i := range valid {
+		if err := validateRedirectURI(valid[i]); err != nil {
+			t.Errorf("%s: %v", valid[i], err)
+		}
+	}
+	invalid := []string{
+		"",
+		"/callback",
+		"https:///callback",
+		"https://app.moov.io/callback#frag",
+		"http://app.moov.io/callback",
+		"http://192.168.1.1/callback",
+	}
+	for i := range invalid {
+		if err := validateRedirectURI(invalid[i]); err == nil {
+			t.Errorf("%s: expected error", invalid[i])
+		}
+	}
+}
+
+type testAuthorizeFlow struct {
+	t *testing.T
+
+	o    *testOAuth
+	auth *testAuth
+	repo *testUserRepository
+
+	user   *User
+	cookie *http.Cookie
+}
+
+func (f *testAuthorizeFlow) cleanup() {
+	f.o.cleanup()
+	f.auth.cleanup()
+	f.repo.cleanup()
+}
+
+func createTestAuthorizeFlow(t *testing.T) *testAuthorizeFlow {
+	t.Helper()
+
+	o, err := createTestOAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &User{
+		ID:            generateID(),
+		Email:         "jane@moov.io",
+		FirstName:     "Jane",
+		LastName:      "Doe",
+		EmailVerified: true,
+		CreatedAt:     base.NewTime(time.Now()),
+	}
+	if err := repo.upsert(u); err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := createCookie(u.ID, auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testAuthorizeFlow{t: t, o: o, auth: auth, repo: repo, user: u, cookie: cookie}
+}
+
+// createClient registers a client owned by another user with redirect URIs
+func (f *testAuthorizeFlow) createClient(public bool, uris ...string) *models.Client {
+	f.t.Helper()
+
+	client, _ := createOAuthClient(f.t, f.o, generateID())
+	if public {
+		client.Secret = ""
+		if err := f.o.svc.clientStore.DeleteByID(client.ID); err != nil {
+			f.t.Fatal(err)
+		}
+		if err := f.o.svc.clientStore.Set(client.ID, client); err != nil {
+			f.t.Fatal(err)
+		}
+	}
+	if err := f.o.svc.clientStore.SetRedirectURIs(client.ID, uris); err != nil {
+		f.t.Fatal(err)
+	}
+	return client
+}
+
+// request starts an authorization request with the user's cookie if login is true
+func (f *testAuthorizeFlow) request(params url.Values, login bool) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/oauth2/authorize?"+params.Encode(), nil)
+	if login {
+		req.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", f.cookie.Value))
+	}
+	w := httptest.NewRecorder()
+	f.o.svc.authorizeRequestHandler(f.auth, f.repo)(w, req)
+	w.Flush()
+	return w
+}
+
+// decide submits the consent form for params with a valid consent token
+func (f *testAuthorizeFlow) decide(params url.Values, decision string) *url.URL {
+	f.t.Helper()
+
+	req, err := f.o.svc.readAuthorizeRequest(params)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	if err := f.o.svc.checkAuthorizeRequest(req); err != nil {
+		f.t.Fatal(err)
+	}
+	form := req.values()
+	form.Set("consent_token", consentToken(f.cookie, req))
+	form.Set("decision", decision)
+
+	w := f.post(form)
+	if w.Code != http.StatusFound {
+		f.t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	u, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return u
+}
+
+func (f *testAuthorizeFlow) post(form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/oauth2/authorize", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", f.cookie.Value))
+	w := httptest.NewRecorder()
+	f.o.svc.authorizeDecisionHandler(f.auth, f.repo)(w, req)
+	w.Flush()
+	return w
+}
+
+// exchange trades an authorization code for tokens without any moov_auth cookie
+func (f *testAuthorizeFlow) exchange(form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/oauth2/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	f.o.svc.tokenHandler(f.auth, f.repo)(w, req)
+	w.Flush()
+	return w
+}
+
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func TestAuthorize__badRequests(t *testing.T) {
+	f := createTestAuthorizeFlow(t)
+	defer f.cleanup()
+
+	client := f.createClient(false, "https://app.moov.io/callback")
+	noURIs := f.createClient(false)
+
+	cases := []url.Values{
+		{"response_type": {"code"}},
+		{"response_type": {"code"}, "client_id": {"missing"}},
+		{"response_type": {"code"}, "client_id": {client.ID}, "redirect_uri": {"https://evil.com/callback"}},
+		{"response_type": {"code"}, "client_id": {client.ID}, "redirect_uri": {"https://app.moov.io/callback/other"}},
+		{"response_type": {"code"}, "client_id": {noURIs.ID}},
+	}
+	for i := range cases {
+		if w := f.request(cases[i], true); w.Code != http.StatusBadRequest {
+			t.Errorf("%v: got %d", cases[i], w.Code)
+		}
+	}
+
+	// errors which are sent back to the client
+	cases = []url.Values{
+		{"response_type": {"token"}, "client_id": {client.ID}},
+		{"response_type": {"code"}, "client_id": {client.ID}, "code_challenge": {codeChallenge(generateID() + generateID())}, "code_challenge_method": {"plain"}},
+		{"response_type": {"code"}, "client_id": {client.ID}, "code_challenge": {"short"}, "code_challenge_method": {"S256"}},
+		{"response_type": {"code"}, "client_id": {client.ID}, "scope": {`bad"scope`}},
+	}
+	for i := range cases {
+		cases[i].Set("state", "xyz")
+		w := f.request(cases[i], true)
+		if w.Code != http.StatusFound {
+			t.Fatalf("%v: got %d", cases[i], w.Code)
+		}
+		u, _ := url.Parse(w.Header().Get("Location"))
+		if !strings.HasPrefix(u.String(), "https://app.moov.io/callback?") || u.Query().Get("error") == "" || u.Query().Get("state") != "xyz" {
+			t.Errorf("%v: redirected to %s", cases[i], u)
+		}
+	}
+}
+
+func TestAuthorize__login(t *testing.T) {
+	f := createTestAuthorizeFlow(t)
+	defer f.cleanup()
+
+	client := f.createClient(false, "https://app.moov.io/callback")
+	params := url.Values{"response_type": {"code"}, "client_id": {client.ID}}
+
+	defer func(u string) { oauthLoginURL = u }(oauthLoginURL)
+
+	oauthLoginURL = ""
+	if w := f.request(params, false); w.Code != http.StatusUnauthorized {
+		t.Errorf("got %d", w.Code)
+	}
+
+	oauthLoginURL = "https://moov.io/login?next=1"
+	w := f.request(params, false)
+	if w.Code != http.StatusFound {
+		t.Fatalf("got %d", w.Code)
+	}
+	u, _ := url.Parse(w.Header().Get("Location"))
+	if u.Host != "moov.io" || u.Query().Get("next") != "1" || u.Query().Get("return_to") != "/oauth2/authorize?"+params.Encode() {
+		t.Errorf("redirected to %s", u)
+	}
+}
+
+func TestAuthorize__consent(t *testing.T) {
+	f := createTestAuthorizeFlow(t)
+	defer f.cleanup()
+
+	client := f.createClient(false, "https://app.moov.io/callback", "https://app.moov.io/other")
+	if err := f.o.svc.clientStore.SetScope(client.ID, "ach:read ach:write"); err != nil {
+		t.Fatal(err)
+	}
+	params := url.Values{
+		"response_type": {"code"},
+		"client_id":     {client.ID},
+		"redirect_uri":  {"https://app.moov.io/other"},
+		"scope":         {"ach:read"},
+		"state":         {`"><script>`},
+	}
+	w := f.request(params, true)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("X-Frame-Options") != "DENY" {
+		t.Errorf("missing X-Frame-Options")
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "jane@moov.io") || !strings.Contains(body, "<li>ach:read</li>") || !strings.Contains(body, `name="consent_token"`) {
+		t.Errorf("unexpected consent page: %s", body)
+	}
+	if strings.Contains(body, "<script>") {
+		t.Errorf("state wasn't escaped: %s", body)
+	}
+
+	// named clients are shown by their name
+	if !strings.Contains(body, "<strong>"+client.ID+"</strong>") {
+		t.Errorf("expected client ID: %s", body)
+	}
+	if err := f.o.svc.clientStore.SetName(client.ID, "Payroll <Sync>"); err != nil {
+		t.Fatal(err)
+	}
+	if body := f.request(params, true).Body.String(); !strings.Contains(body, "<strong>Payroll &lt;Sync&gt;</strong>") {
+		t.Errorf("expected client name: %s", body)
+	}
+
+	// tampered and missing consent tokens
+	req, _ := f.o.svc.readAuthorizeRequest(params)
+	f.o.svc.checkAuthorizeRequest(req)
+	form := req.values()
+	form.Set("consent_token", consentToken(f.cookie, req))
+	form.Set("decision", "allow")
+	form.Set("scope", "ach:read ach:write")
+	if w := f.post(form); w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+	form.Del("consent_token")
+	if w := f.post(form); w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// deny
+	u := f.decide(params, "deny")
+	if u.Query().Get("error") != "access_denied" || u.Query().Get("state") != `"><script>` || u.Query().Get("code") != "" {
+		t.Errorf("redirected to %s", u)
+	}
+}
+
+func TestAuthorize__emailNotVerified(t *testing.T) {
+	f := createTestAuthorizeFlow(t)
+	defer f.cleanup()
+
+	if err := f.repo.writeApprovalCode(f.user.ID, generateID(), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	client := f.createClient(false, "https://app.moov.io/callback")
+	params := url.Values{"response_type": {"code"}, "client_id": {client.ID}}
+	if w := f.request(params, true); w.Code != http.StatusForbidden {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	req, err := f.o.svc.readAuthorizeRequest(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.o.svc.checkAuthorizeRequest(req)
+	form := req.values()
+	form.Set("consent_token", consentToken(f.cookie, req))
+	form.Set("decision", "allow")
+	w := f.post(form)
+	if w.Code != http.StatusForbidden || w.Header().Get("Location") != "" {
+		t.Errorf("got %d: %s", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestAuthorize__codeExchange(t *testing.T) {
+	f := createTestAuthorizeFlow(t)
+	defer f.cleanup()
+
+	client := f.createClient(false, "https://app.moov.io/callback")
+	if err := f.o.svc.clientStore.SetScope(client.ID, "ach:read ach:write"); err != nil {
+		t.Fatal(err)
+	}
+	verifier := generateID() + generateID()
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.ID},
+		"state":                 {"xyz"},
+		"code_challenge":        {codeChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	u := f.decide(params, "allow")
+	code := u.Query().Get("code")
+	if code == "" || u.Query().Get("state") != "xyz" || !strings.HasPrefix(u.String(), "https://app.moov.io/callback?") {
+		t.Fatalf("redirected to %s", u)
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {client.ID},
+		"client_secret": {client.Secret},
+		"redirect_uri":  {"https://app.moov.io/callback"},
+		"code":          {code},
+		"code_verifier": {generateID() + generateID()},
+	}
+	if w := f.exchange(form); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_grant") {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	form.Set("code_verifier", verifier)
+	w := f.exchange(form)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		Scope       string `json:"scope"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Scope != "ach:read ach:write" {
+		t.Errorf("got scope %q", resp.Scope)
+	}
+	ti, err := f.o.svc.tokenStore.GetByAccess(resp.AccessToken)
+	if err != nil || ti == nil {
+		t.Fatalf("ti=%v err=%v", ti, err)
+	}
+	if ti.GetUserID() != f.user.ID || ti.GetClientID() != client.ID {
+		t.Errorf("token issued for userId=%s client=%s", ti.GetUserID(), ti.GetClientID())
+	}
+
+	// codes are only used once
+	if w := f.exchange(form); w.Code == http.StatusOK {
+		t.Errorf("code was used twice")
+	}
+}
+
+func TestAuthorize__publicClient(t *testing.T) {
+	f := createTestAuthorizeFlow(t)
+	defer f.cleanup()
+
+	client := f.createClient(true, "io.moov.app:/oauth2redirect")
+
+	// PKCE is required
+	w := f.request(url.Values{"response_type": {"code"}, "client_id": {client.ID}}, true)
+	u, _ := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusFound || u.Query().Get("error") != "invalid_request" {
+		t.Errorf("got %d: %s", w.Code, u)
+	}
+
+	// public clients can't use other grants
+	w = f.exchange(url.Values{"grant_type": {"client_credentials"}, "client_id": {client.ID}})
+	if w.Code == http.StatusOK {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	verifier := generateID() + generateID()
+	u = f.decide(url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.ID},
+		"code_challenge":        {codeChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}, "allow")
+
+	w = f.exchange(url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {client.ID},
+		"redirect_uri":  {"io.moov.app:/oauth2redirect"},
+		"code":          {u.Query().Get("code")},
+		"code_verifier": {verifier},
+	})
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAuthorize__createClient(t *testing.T) {
+	f := createTestAuthorizeFlow(t)
+	defer f.cleanup()
+
+	create := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/oauth2/client", strings.NewReader(body))
+		r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", f.cookie.Value))
+		f.o.svc.createClientHandler(f.auth, f.repo)(w, r)
+		w.Flush()
+		return w
+	}
+
+	for _, body := range []string{`{"redirect_uris": ["http://moov.io/callback"]}`, `{"public": true}`} {
+		if w := create(body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d: %s", body, w.Code, w.Body.String())
+		}
+	}
+
+	w := create(`{"redirect_uris": ["http://localhost:8080/callback"], "public": true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	var clients []*client
+	if err := json.NewDecoder(w.Body).Decode(&clients); err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) != 1 || !clients[0].Public || clients[0].ClientSecret != "" || len(clients[0].RedirectURIs) != 1 {
+		t.Fatalf("unexpected clients: %#v", clients)
+	}
+	uris, err := f.o.svc.clientStore.GetRedirectURIs(clients[0].ClientID)
+	if err != nil || len(uris) != 1 || uris[0] != "http://localhost:8080/callback" {
+		t.Errorf("uris=%v err=%v", uris, err)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCBOR__decode(t *testing.T) {
+	// examples from RFC 7049 Appendix A
+	cases := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"00", int64(0)},
+		{"17", int64(23)},
+		{"1818", int64(24)},
+		{"1903e8", int64(1000)},
+		{"1a000f4240", int64(1000000)},
+		{"1b000000e8d4a51000", int64(1000000000000)},
+		{"20", int64(-1)},
+		{"3903e7", int64(-1000)},
+		{"f4", false},
+		{"f5", true},
+		{"f6", nil},
+		{"40", []byte{}},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"60", ""},
+		{"6449455446", "IETF"},
+		{"83010203", []interface{}{int64(1), int64(2), int64(3)}},
+		{"8301820203820405", []interface{}{int64(1), []interface{}{int64(2), int64(3)}, []interface{}{int64(4), int64(5)}}},
+		{"a201020304", map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(4)}},
+		{"a26161016162820203", map[interface{}]interface{}{"a": int64(1), "b": []interface{}{int64(2), int64(3)}}},
+	}
+	for i := range cases {
+		bs, _ := hex.DecodeString(cases[i].input)
+		v, rest, err := decodeCBOR(bs)
+		if err != nil {
+			t.Errorf("%s: %v", cases[i].input, err)
+			continue
+		}
+		if len(rest) > 0 {
+			t.Errorf("%s: %d trailing bytes", cases[i].input, len(rest))
+		}
+		if !reflect.DeepEqual(v, cases[i].expected) {
+			t.Errorf("%s: got %#v", cases[i].input, v)
+		}
+	}
+}
+
+func TestCBOR__rest(t *testing.T) {
+	v, rest, err := decodeCBOR([]byte{0x01, 0xff, 0xfe})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != int64(1) || !bytes.Equal(rest, []byte{0xff, 0xfe}) {
+		t.Errorf("v=%v rest=%x", v, rest)
+	}
+}
+
+func TestCBOR__errors(t *testing.T) {
+	cases := []string{
+		"",                   // empty
+		"18",                 // truncated argument
+		"4401",               // truncated byte string
+		"830102",             // truncated array
+		"a2010203",           // truncated map
+		"5f4101ff",           // indefinite length byte string
+		"c11a514b67b0",       // tag
+		"f93c00",             // half precision float
+		"1bffffffffffffffff", // overflows int64
+		"a1410101",           // byte string map key
+		strings.Repeat("81", cborMaxDepth+2) + "01", // nested too deeply
+	}
+	for i := range cases {
+		bs, _ := hex.DecodeString(cases[i])
+		if _, _, err := decodeCBOR(bs); err == nil {
+			t.Errorf("%s: expected error", cases[i])
+		}
+	}
+}
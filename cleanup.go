@@ -7,10 +7,16 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"os"
+	"path"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/moov-io/auth/pkg/oauthdb"
+
 	"github.com/go-kit/kit/log"
 )
 
@@ -25,11 +31,167 @@ var (
 	}()
 )
 
-func (s *sqliteUserRepository) startAsyncUserCleanup(ctx context.Context, logger log.Logger, interval time.Duration) {
+// cleanupRules choose which users are removed by the async user cleanup. A user is removed
+// when they match every rule which is set, and nobody is removed when no rules are set.
+type cleanupRules struct {
+	// emailDomains match the domain of a user's email, e.g. example.com or *.example.com
+	emailDomains []string
+
+	olderThan   time.Duration // created at least this long ago
+	unverified  bool          // never verified their email
+	inactiveFor time.Duration // haven't logged in or used a session for this long
+
+	// dryRun logs the users which would be removed instead of removing them
+	dryRun bool
+
+	// vacuum reclaims disk space in SQLite after users are removed
+	vacuum bool
+}
+
+// readCleanupRules reads the DEMO_CLEANUP_* environment variables. Invalid values are
+// an error rather than ignored, as an ignored rule would remove more users.
+func readCleanupRules() (cleanupRules, error) {
+	rules := cleanupRules{vacuum: true}
+
+	for _, domain := range strings.Split(os.Getenv("DEMO_CLEANUP_EMAIL_DOMAINS"), ",") {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain == "" {
+			continue
+		}
+		if _, err := path.Match(domain, ""); err != nil || strings.Contains(domain, "@") {
+			return rules, fmt.Errorf("invalid DEMO_CLEANUP_EMAIL_DOMAINS pattern %q", domain)
+		}
+		rules.emailDomains = append(rules.emailDomains, domain)
+	}
+
+	days := func(name string) (time.Duration, error) {
+		v := os.Getenv(name)
+		if v == "" {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid %s %q, expected a number of days", name, v)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	var err error
+	if rules.olderThan, err = days("DEMO_CLEANUP_OLDER_THAN_DAYS"); err != nil {
+		return rules, err
+	}
+	if rules.inactiveFor, err = days("DEMO_CLEANUP_INACTIVE_DAYS"); err != nil {
+		return rules, err
+	}
+
+	boolean := func(name string, value *bool) error {
+		if v := os.Getenv(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q", name, v)
+			}
+			*value = b
+		}
+		return nil
+	}
+	if err := boolean("DEMO_CLEANUP_UNVERIFIED", &rules.unverified); err != nil {
+		return rules, err
+	}
+	if err := boolean("DEMO_CLEANUP_DRY_RUN", &rules.dryRun); err != nil {
+		return rules, err
+	}
+	if err := boolean("DEMO_CLEANUP_VACUUM", &rules.vacuum); err != nil {
+		return rules, err
+	}
+	return rules, nil
+}
+
+// empty returns true when no rules are set, which removes nobody
+func (r cleanupRules) empty() bool {
+	return len(r.emailDomains) == 0 && r.olderThan <= 0 && !r.unverified && r.inactiveFor <= 0
+}
+
+func (r cleanupRules) String() string {
+	var rules []string
+	if len(r.emailDomains) > 0 {
+		rules = append(rules, fmt.Sprintf("email domains %s", strings.Join(r.emailDomains, ", ")))
+	}
+	if r.olderThan > 0 {
+		rules = append(rules, fmt.Sprintf("created over %.0f days ago", r.olderThan.Hours()/24))
+	}
+	if r.unverified {
+		rules = append(rules, "unverified")
+	}
+	if r.inactiveFor > 0 {
+		rules = append(rules, fmt.Sprintf("inactive for %.0f days", r.inactiveFor.Hours()/24))
+	}
+	return strings.Join(rules, " and ")
+}
+
+// userActivity is what cleanupRules are checked against
+type userActivity struct {
+	userId       string
+	email        string
+	createdAt    time.Time
+	lastActiveAt time.Time // zero if they've never logged in
+	verified     bool
+}
+
+func (r cleanupRules) matches(u userActivity, now time.Time) bool {
+	if r.empty() {
+		return false
+	}
+	if len(r.emailDomains) > 0 {
+		domain := strings.ToLower(u.email[strings.LastIndex(u.email, "@")+1:])
+		matched := false
+		for _, pattern := range r.emailDomains {
+			if ok, _ := path.Match(pattern, domain); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if r.olderThan > 0 && now.Sub(u.createdAt) < r.olderThan {
+		return false
+	}
+	if r.unverified && u.verified {
+		return false
+	}
+	if r.inactiveFor > 0 {
+		lastActive := u.createdAt
+		if u.lastActiveAt.After(lastActive) {
+			lastActive = u.lastActiveAt
+		}
+		if now.Sub(lastActive) < r.inactiveFor {
+			return false
+		}
+	}
+	return true
+}
+
+// userCleanup removes users matching rules along with their OAuth2 clients and tokens
+type userCleanup struct {
+	logger log.Logger
+	rules  cleanupRules
+
+	store       userStore
+	clientStore *oauthdb.ClientStore
+	tokenStore  *oauthdb.TokenStore
+}
+
+// startAsyncUserCleanup periodically runs cleanup
+func startAsyncUserCleanup(ctx context.Context, logger log.Logger, cleanup *userCleanup, interval time.Duration) {
 	if interval <= 0*time.Second {
 		logger.Log("user-cleanup", "Disabling async user cleanup")
 		return
 	}
+	if cleanup.rules.empty() {
+		logger.Log("user-cleanup", "No DEMO_CLEANUP_* rules set, disabling async user cleanup")
+		return
+	}
+	logger.Log("user-cleanup", fmt.Sprintf("Removing users matching %s every %v (dry run: %v)", cleanup.rules, interval, cleanup.rules.dryRun))
 
 	tick := time.NewTicker(interval)
 	defer tick.Stop()
@@ -37,10 +199,10 @@ func (s *sqliteUserRepository) startAsyncUserCleanup(ctx context.Context, logger
 	for {
 		select {
 		case <-tick.C:
-			if err := s.cleanup(); err != nil {
+			if n, err := cleanup.run(time.Now()); err != nil {
 				logger.Log("user-cleanup", fmt.Sprintf("error when cleaning up users: %v", err))
 			} else {
-				logger.Log("user-cleanup", "Done with user cleanup")
+				logger.Log("user-cleanup", fmt.Sprintf("Done with user cleanup, %d users matched", n))
 			}
 
 		case <-ctx.Done():
@@ -50,41 +212,166 @@ func (s *sqliteUserRepository) startAsyncUserCleanup(ctx context.Context, logger
 	}
 }
 
-func (s *sqliteUserRepository) cleanup() error {
-	clean := func(logger log.Logger, db *sql.DB, table string) error {
-		stmt, err := s.db.Prepare(fmt.Sprintf(`delete from %s where user_id in (select user_id from users where email like '%%example.com');`, table))
-		if err != nil {
-			return fmt.Errorf("cleanup: prepare %s: %v", table, err)
+// run removes the users matching c.rules, or only logs them in a dry run, and returns
+// how many matched.
+func (c *userCleanup) run(now time.Time) (int, error) {
+	if c.rules.empty() {
+		return 0, errors.New("cleanup: no rules set")
+	}
+	users, err := c.store.listUserActivity()
+	if err != nil {
+		return 0, fmt.Errorf("cleanup: listing users: %v", err)
+	}
+
+	// a user which fails to be deleted is logged and left for the next run
+	matched, failed := 0, 0
+	for _, u := range users {
+		if !c.rules.matches(u, now) {
+			continue
+		}
+		matched++
+		if c.rules.dryRun {
+			c.logger.Log("user-cleanup", fmt.Sprintf("dry run: would delete userId=%s email=%s", u.userId, u.email))
+			continue
 		}
-		res, err := stmt.Exec()
+		if err := c.deleteUser(u.userId); err != nil {
+			failed++
+			c.logger.Log("user-cleanup", fmt.Sprintf("problem deleting userId=%s: %v", u.userId, err))
+			continue
+		}
+		c.logger.Log("user-cleanup", fmt.Sprintf("deleted userId=%s email=%s", u.userId, u.email))
+	}
+
+	if matched > failed && !c.rules.dryRun && c.rules.vacuum {
+		if err := c.store.vacuum(); err != nil {
+			return matched, err
+		}
+	}
+	if failed > 0 {
+		return matched, fmt.Errorf("cleanup: failed to delete %d of %d users", failed, matched)
+	}
+	return matched, nil
+}
+
+// deleteUser removes a user along with their OAuth2 clients and every token issued for them
+// or to their clients. The OAuth2 stores can be separate databases so this can't be one
+// transaction. Instead the user is deleted last, so after a failure they still match and
+// the next run finishes removing them.
+func (c *userCleanup) deleteUser(userId string) error {
+	var clientIDs []string
+	if c.clientStore != nil {
+		clients, err := c.clientStore.GetByUserID(userId)
 		if err != nil {
-			return fmt.Errorf("cleanup: exec %s: %v", table, err)
+			return fmt.Errorf("reading oauth2 clients: %v", err)
 		}
-		if n, _ := res.RowsAffected(); n > 0 {
-			s.log.Log("cleanup", fmt.Sprintf("deleted %d %s rows", n, table))
+		for i := range clients {
+			clientIDs = append(clientIDs, clients[i].GetID())
 		}
-		return nil
 	}
+	if c.tokenStore != nil {
+		if err := c.tokenStore.RemoveUser(userId, clientIDs); err != nil {
+			return fmt.Errorf("revoking tokens: %v", err)
+		}
+	}
+	for _, id := range clientIDs {
+		if err := c.clientStore.DeleteByID(id); err != nil {
+			return fmt.Errorf("deleting client %s: %v", id, err)
+		}
+	}
+	return c.store.deleteUser(userId)
+}
 
-	if err := clean(s.log, s.db, "user_cookies"); err != nil {
-		return err
+func (s *sqlUserRepository) listUserActivity() ([]userActivity, error) {
+	query := `select u.user_id, u.email, u.created_at, ua.last_active_at,
+(select count(*) from user_approval_codes as uac where uac.user_id = u.user_id) as unverified
+from users as u
+left join user_activity as ua
+on u.user_id = ua.user_id`
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, err
 	}
-	if err := clean(s.log, s.db, "user_details"); err != nil {
-		return err
+	defer rows.Close()
+
+	var out []userActivity
+	for rows.Next() {
+		var u userActivity
+		var createdAt string
+		var lastActiveAt sql.NullString
+		var unverified int
+		if err := rows.Scan(&u.userId, &u.email, &createdAt, &lastActiveAt, &unverified); err != nil {
+			return nil, err
+		}
+		if u.createdAt, err = time.Parse(serializedTimestampFormat, createdAt); err != nil {
+			// without created_at the user could look older than they are
+			s.log.Log("user-cleanup", fmt.Sprintf("skipping userId=%s with bad users.created_at format %q: %v", u.userId, createdAt, err))
+			continue
+		}
+		if lastActiveAt.Valid {
+			if u.lastActiveAt, err = time.Parse(serializedTimestampFormat, lastActiveAt.String); err != nil {
+				// without last_active_at the user could look inactive when they aren't
+				s.log.Log("user-cleanup", fmt.Sprintf("skipping userId=%s with bad user_activity.last_active_at format %q: %v", u.userId, lastActiveAt.String, err))
+				continue
+			}
+		}
+		u.verified = unverified == 0
+		out = append(out, u)
 	}
-	if err := clean(s.log, s.db, "user_passwords"); err != nil {
+	return out, rows.Err()
+}
+
+// userTables are every table with a user_id column, deleted from in order by deleteUser
+var userTables = []string{
+	"user_sessions",
+	"user_totp",
+	"user_recovery_codes",
+	"user_mfa_challenges",
+	"user_webauthn_credentials",
+	"user_webauthn_challenges",
+	"user_password_resets",
+	"user_approval_codes",
+	"user_activity",
+	"user_details",
+	"user_passwords",
+	"user_password_history",
+	"users",
+}
+
+// deleteUser removes the user's rows from userTables, and their failed logins, in one transaction
+func (s *sqlUserRepository) deleteUser(userId string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
 		return err
 	}
-	if err := clean(s.log, s.db, "users"); err != nil {
-		return err
+	lockoutKeys := []string{userLockoutKey(userId)}
+	var email string
+	if err := tx.QueryRow(`select email from users where user_id = ?`, userId).Scan(&email); err == nil {
+		lockoutKeys = append(lockoutKeys, emailLockoutKey(email))
+	} else if err != sql.ErrNoRows {
+		tx.Rollback()
+		return fmt.Errorf("deleteUser: users: %v", err)
+	}
+	for _, key := range lockoutKeys {
+		if _, err := tx.Exec(`delete from login_attempts where attempt_key = ?`, key); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("deleteUser: login_attempts: %v", err)
+		}
 	}
+	for _, table := range userTables {
+		if _, err := tx.Exec(fmt.Sprintf(`delete from %s where user_id = ?`, table), userId); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("deleteUser: %s: %v", table, err)
+		}
+	}
+	return tx.Commit()
+}
 
-	// vacuum and reduce disk space.
-	stmt, err := s.db.Prepare("vacuum;")
-	if err != nil {
-		return fmt.Errorf("cleanup: prepare vacuum: %v", err)
+// vacuum reduces disk space, PostgreSQL runs autovacuum itself
+func (s *sqlUserRepository) vacuum() error {
+	if s.db.dialect != "sqlite3" {
+		return nil
 	}
-	if _, err := stmt.Exec(); err != nil {
+	if _, err := s.db.Exec("vacuum;"); err != nil {
 		return fmt.Errorf("cleanup: exec vacuum: %v", err)
 	}
 	return nil
@@ -0,0 +1,328 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/moov-io/auth/pkg/oauthdb"
+	"github.com/moov-io/base"
+
+	"github.com/go-kit/kit/log"
+	"gopkg.in/oauth2.v3/models"
+)
+
+func TestCleanupRules__read(t *testing.T) {
+	env := map[string]string{
+		"DEMO_CLEANUP_EMAIL_DOMAINS":   " Example.com, *.test ",
+		"DEMO_CLEANUP_OLDER_THAN_DAYS": "30",
+		"DEMO_CLEANUP_UNVERIFIED":      "true",
+		"DEMO_CLEANUP_INACTIVE_DAYS":   "90",
+		"DEMO_CLEANUP_DRY_RUN":         "yes",
+		"DEMO_CLEANUP_VACUUM":          "false",
+	}
+	setenv := func(overrides map[string]string) func() {
+		for k := range env {
+			os.Unsetenv(k)
+		}
+		for k, v := range overrides {
+			os.Setenv(k, v)
+		}
+		return func() {
+			for k := range env {
+				os.Unsetenv(k)
+			}
+		}
+	}
+
+	defer setenv(nil)()
+	rules, err := readCleanupRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rules.empty() || !rules.vacuum || rules.dryRun {
+		t.Errorf("unexpected default rules: %#v", rules)
+	}
+
+	// "yes" isn't a bool
+	setenv(env)
+	if _, err := readCleanupRules(); err == nil {
+		t.Error("expected error")
+	}
+	env["DEMO_CLEANUP_DRY_RUN"] = "1"
+	setenv(env)
+	rules, err = readCleanupRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules.emailDomains) != 2 || rules.emailDomains[0] != "example.com" || rules.emailDomains[1] != "*.test" {
+		t.Errorf("emailDomains=%v", rules.emailDomains)
+	}
+	if rules.olderThan != 30*24*time.Hour || rules.inactiveFor != 90*24*time.Hour || !rules.unverified || !rules.dryRun || rules.vacuum {
+		t.Errorf("unexpected rules: %#v", rules)
+	}
+	if s := rules.String(); s != "email domains example.com, *.test and created over 30 days ago and unverified and inactive for 90 days" {
+		t.Errorf("got %q", s)
+	}
+
+	// invalid values are errors, rather than ignored
+	for name, value := range map[string]string{
+		"DEMO_CLEANUP_EMAIL_DOMAINS":   "[example.com",
+		"DEMO_CLEANUP_OLDER_THAN_DAYS": "3O",
+		"DEMO_CLEANUP_INACTIVE_DAYS":   "-1",
+		"DEMO_CLEANUP_UNVERIFIED":      "sure",
+	} {
+		setenv(map[string]string{name: value})
+		if rules, err := readCleanupRules(); err == nil {
+			t.Errorf("%s=%s: expected error, got %#v", name, value, rules)
+		}
+	}
+}
+
+func TestCleanupRules__matches(t *testing.T) {
+	now := time.Now()
+	user := userActivity{
+		userId:       generateID(),
+		email:        "jane@Example.com",
+		createdAt:    now.Add(-60 * 24 * time.Hour),
+		lastActiveAt: now.Add(-10 * 24 * time.Hour),
+		verified:     true,
+	}
+
+	cases := []struct {
+		rules   cleanupRules
+		matches bool
+	}{
+		{cleanupRules{}, false}, // no rules, nobody matches
+		{cleanupRules{emailDomains: []string{"example.com"}}, true},
+		{cleanupRules{emailDomains: []string{"moov.io", "example.com"}}, true},
+		{cleanupRules{emailDomains: []string{"*.example.com"}}, false},
+		{cleanupRules{emailDomains: []string{"ample.com"}}, false}, // the whole domain must match
+		{cleanupRules{olderThan: 30 * 24 * time.Hour}, true},
+		{cleanupRules{olderThan: 90 * 24 * time.Hour}, false},
+		{cleanupRules{unverified: true}, false},
+		{cleanupRules{inactiveFor: 7 * 24 * time.Hour}, true},
+		{cleanupRules{inactiveFor: 30 * 24 * time.Hour}, false},
+		{cleanupRules{emailDomains: []string{"example.com"}, olderThan: 90 * 24 * time.Hour}, false}, // every rule must match
+	}
+	for i := range cases {
+		if got := cases[i].rules.matches(user, now); got != cases[i].matches {
+			t.Errorf("#%d: %s: got %v", i, cases[i].rules, got)
+		}
+	}
+
+	sub := user
+	sub.email = "jane@demo.example.com"
+	if !(cleanupRules{emailDomains: []string{"*.example.com"}}).matches(sub, now) {
+		t.Error("expected subdomain to match")
+	}
+
+	// users who never logged in are inactive since they signed up
+	never := user
+	never.lastActiveAt, never.verified = time.Time{}, false
+	if !(cleanupRules{inactiveFor: 30 * 24 * time.Hour, unverified: true}).matches(never, now) {
+		t.Error("expected match")
+	}
+}
+
+func TestUserCleanup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "userCleanup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	clientStore, err := setupOAuthClientStore("file:" + filepath.Join(dir, "oauth2_clients.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientStore.Close()
+	tokenStore, err := setupOAuthTokenStore("file:" + filepath.Join(dir, "oauth2_tokens.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tokenStore.Close()
+
+	store := newMemoryUserStore(log.NewNopLogger(), nil)
+	cleanup := &userCleanup{
+		logger:      log.NewNopLogger(),
+		rules:       cleanupRules{emailDomains: []string{"example.com"}, dryRun: true},
+		store:       store,
+		clientStore: clientStore,
+		tokenStore:  tokenStore,
+	}
+
+	var users []*User
+	for _, email := range []string{"demo@example.com", "jane@example.com.test"} {
+		u := &User{ID: generateID(), Email: email, CreatedAt: base.NewTime(time.Now())}
+		if err := store.upsert(u); err != nil {
+			t.Fatal(err)
+		}
+		client := &models.Client{ID: generateID(), Secret: generateID(), Domain: "http://localhost", UserID: u.ID}
+		if err := clientStore.Set(client.ID, client); err != nil {
+			t.Fatal(err)
+		}
+		token := &models.Token{ClientID: client.ID, UserID: u.ID, Access: generateID(), AccessCreateAt: time.Now(), AccessExpiresIn: time.Hour}
+		if err := tokenStore.Create(token); err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, u)
+	}
+	demo, other := users[0], users[1]
+
+	// a dry run removes nothing
+	if n, err := cleanup.run(time.Now()); n != 1 || err != nil {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+	if u, err := store.lookupByUserId(demo.ID); u == nil || err != nil {
+		t.Fatalf("u=%v err=%v", u, err)
+	}
+
+	cleanup.rules.dryRun = false
+	if n, err := cleanup.run(time.Now()); n != 1 || err != nil {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+	if u, err := store.lookupByUserId(demo.ID); u != nil || err != nil {
+		t.Errorf("demo user wasn't removed: u=%v err=%v", u, err)
+	}
+	if clients, err := clientStore.GetByUserID(demo.ID); len(clients) != 0 || err != nil {
+		t.Errorf("clients=%v err=%v", clients, err)
+	}
+
+	// other users keep their clients and tokens
+	if u, err := store.lookupByUserId(other.ID); u == nil || err != nil {
+		t.Errorf("u=%v err=%v", u, err)
+	}
+	clients, err := clientStore.GetByUserID(other.ID)
+	if len(clients) != 1 || err != nil {
+		t.Fatalf("clients=%v err=%v", clients, err)
+	}
+
+	// no rules removes nobody
+	cleanup.rules = cleanupRules{}
+	if n, err := cleanup.run(time.Now()); n != 0 || err == nil {
+		t.Errorf("n=%d err=%v", n, err)
+	}
+	if u, err := store.lookupByUserId(other.ID); u == nil || err != nil {
+		t.Errorf("u=%v err=%v", u, err)
+	}
+}
+
+func TestUserCleanup__tokens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "userCleanup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tokenStore, err := setupOAuthTokenStore("file:" + filepath.Join(dir, "oauth2_tokens.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tokenStore.Close()
+
+	store := newMemoryUserStore(log.NewNopLogger(), nil)
+	u := &User{ID: generateID(), Email: fmt.Sprintf("%s@example.com", generateID()), CreatedAt: base.NewTime(time.Now())}
+	if err := store.upsert(u); err != nil {
+		t.Fatal(err)
+	}
+	// a token issued to another user's client
+	token := &models.Token{ClientID: generateID(), UserID: u.ID, Access: generateID(), AccessCreateAt: time.Now(), AccessExpiresIn: time.Hour}
+	if err := tokenStore.Create(token); err != nil {
+		t.Fatal(err)
+	}
+	refresh := oauthdb.RefreshToken{Refresh: generateID(), Family: generateID(), ClientID: token.ClientID, UserID: u.ID}
+	if err := tokenStore.SaveRefreshToken(refresh); err != nil {
+		t.Fatal(err)
+	}
+
+	cleanup := &userCleanup{
+		logger:     log.NewNopLogger(),
+		rules:      cleanupRules{emailDomains: []string{"example.com"}},
+		store:      store,
+		tokenStore: tokenStore,
+	}
+	if n, err := cleanup.run(time.Now()); n != 1 || err != nil {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+	if tk, err := tokenStore.GetByAccess(token.Access); tk != nil || err != nil {
+		t.Errorf("token wasn't revoked: tk=%v err=%v", tk, err)
+	}
+	if rt, err := tokenStore.GetRefreshToken(refresh.Refresh); rt != nil || err != nil {
+		t.Errorf("refresh token family wasn't removed: rt=%v err=%v", rt, err)
+	}
+}
+
+// failingDeleteStore fails to delete one user
+type failingDeleteStore struct {
+	userStore
+
+	userId string
+}
+
+func (s *failingDeleteStore) deleteUser(userId string) error {
+	if userId == s.userId {
+		return errors.New("bad user")
+	}
+	return s.userStore.deleteUser(userId)
+}
+
+func TestUserCleanup__failure(t *testing.T) {
+	store := newMemoryUserStore(log.NewNopLogger(), nil)
+	var users []*User
+	for i := 0; i < 3; i++ {
+		u := &User{ID: generateID(), Email: fmt.Sprintf("%s@example.com", generateID()), CreatedAt: base.NewTime(time.Now())}
+		if err := store.upsert(u); err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, u)
+	}
+
+	// the other users are still removed
+	cleanup := &userCleanup{
+		logger: log.NewNopLogger(),
+		rules:  cleanupRules{emailDomains: []string{"example.com"}},
+		store:  &failingDeleteStore{userStore: store, userId: users[1].ID},
+	}
+	if n, err := cleanup.run(time.Now()); n != 3 || err == nil {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+	for i, u := range users {
+		if found, err := store.lookupByUserId(u.ID); err != nil || (found != nil) != (i == 1) {
+			t.Errorf("user #%d: found=%v err=%v", i, found, err)
+		}
+	}
+}
+
+func TestUserCleanup__badLastActive(t *testing.T) {
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+
+	u := &User{ID: generateID(), Email: "test@example.com", CreatedAt: base.NewTime(time.Now())}
+	if err := repo.upsert(u); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.db.Exec(`insert into user_activity (user_id, last_active_at) values (?, ?)`, u.ID, "yesterday"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the user is skipped rather than looking like they've never been active
+	activity, err := repo.listUserActivity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(activity) != 0 {
+		t.Errorf("activity=%#v", activity)
+	}
+}
@@ -2,7 +2,9 @@ module github.com/moov-io/auth
 
 require (
 	github.com/go-kit/kit v0.9.0
+	github.com/go-sql-driver/mysql v1.5.0
 	github.com/gorilla/mux v1.7.4
+	github.com/lib/pq v1.3.0
 	github.com/mattn/go-sqlite3 v1.13.0
 	github.com/moov-io/base v0.11.0
 	github.com/prometheus/client_golang v1.4.1
@@ -5,9 +5,11 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -15,6 +17,7 @@ import (
 	"time"
 
 	moovhttp "github.com/moov-io/base/http"
+	"github.com/moov-io/base/http/bind"
 
 	"github.com/gorilla/mux"
 )
@@ -35,12 +38,21 @@ var (
 	//
 	// The path is always set to /.
 	Domain string = os.Getenv("DOMAIN")
+
+	// PublicURL is the scheme and host users reach this service at. It's used
+	// when building links (such as in emails) back to auth.
+	// If empty "http://$DOMAIN:8081" is used.
+	PublicURL string = os.Getenv("PUBLIC_URL")
 )
 
 func init() {
 	if Domain == "" {
 		Domain = "localhost"
 	}
+	if PublicURL == "" {
+		PublicURL = fmt.Sprintf("http://%s%s", Domain, bind.HTTP("auth"))
+	}
+	PublicURL = strings.TrimSuffix(PublicURL, "/")
 }
 
 // read consumes an io.Reader (wrapping with io.LimitReader)
@@ -61,6 +73,16 @@ func internalError(w http.ResponseWriter, err error) {
 	}
 }
 
+// problem writes err as a JSON error with the provided HTTP status code.
+// Use moovhttp.Problem for the common '400 Bad Request' case.
+func problem(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": err.Error(),
+	})
+}
+
 // extractCookie attempts to pull out our cookie from the incoming request.
 // We use the contents to find the associated userId.
 func extractCookie(r *http.Request) *http.Cookie {
@@ -77,8 +99,9 @@ func extractCookie(r *http.Request) *http.Cookie {
 }
 
 // createCookie generates a new cookie and associates it with the provided
-// userId.
-func createCookie(userId string, auth authable) (*http.Cookie, error) {
+// userId. Each cookie is its own session, the request (which can be nil)
+// describes the client logging in.
+func createCookie(userId string, auth authable, r *http.Request) (*http.Cookie, error) {
 	cookie := &http.Cookie{
 		Domain:   Domain,
 		Expires:  time.Now().Add(cookieTTL),
@@ -88,12 +111,84 @@ func createCookie(userId string, auth authable) (*http.Cookie, error) {
 		Secure:   serveViaTLS,
 		Value:    generateID(),
 	}
-	if err := auth.writeCookie(userId, cookie); err != nil {
+	var userAgent, ipAddress string
+	if r != nil {
+		userAgent, ipAddress = r.UserAgent(), clientIP(r)
+	}
+	if err := auth.writeCookie(userId, cookie, userAgent, ipAddress); err != nil {
 		return nil, err
 	}
 	return cookie, nil
 }
 
+// trustedProxies are the load balancers and proxies in front of auth, read from
+// TRUSTED_PROXIES (comma separated IP addresses or CIDR ranges) by main.
+var trustedProxies []*net.IPNet
+
+func readTrustedProxies(v string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", s, err)
+		}
+		out = append(out, network)
+	}
+	return out, nil
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for i := range trustedProxies {
+		if trustedProxies[i].Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of the client making r. X-Forwarded-For and X-Real-Ip
+// are only read when a trusted proxy sent r, as clients can set them to anything.
+//
+// Proxies append the address they received a request from to X-Forwarded-For, so the
+// client is the rightmost address which isn't one of our proxies.
+func clientIP(r *http.Request) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	if !isTrustedProxy(peer) {
+		return peer
+	}
+	if v := strings.Join(r.Header["X-Forwarded-For"], ","); v != "" {
+		hops := strings.Split(v, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if hop != "" && (i == 0 || !isTrustedProxy(hop)) {
+				return hop
+			}
+		}
+	}
+	if v := strings.TrimSpace(r.Header.Get("X-Real-Ip")); v != "" {
+		return v
+	}
+	return peer
+}
+
 func addPingRoute(r *mux.Router) {
 	r.Methods("GET").Path("/ping").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w = wrapResponseWriter(w, r, "ping")
@@ -6,6 +6,7 @@ package main
 
 import (
 	"errors"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -37,7 +38,7 @@ func TestHTTP_createCookie(t *testing.T) {
 	defer auth.cleanup()
 
 	userId := generateID()
-	cookie, err := createCookie(userId, auth)
+	cookie, err := createCookie(userId, auth, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -47,6 +48,53 @@ func TestHTTP_createCookie(t *testing.T) {
 	}
 }
 
+func TestHTTP_clientIP(t *testing.T) {
+	defer func(proxies []*net.IPNet) { trustedProxies = proxies }(trustedProxies)
+	proxies, err := readTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustedProxies = proxies
+
+	r := httptest.NewRequest("GET", "/ping", nil)
+	r.RemoteAddr = "203.0.113.1:4567"
+	if ip := clientIP(r); ip != "203.0.113.1" {
+		t.Errorf("got %q", ip)
+	}
+
+	// headers from untrusted peers are ignored
+	r.Header.Set("X-Real-Ip", "198.51.100.1")
+	r.Header.Set("X-Forwarded-For", "198.51.100.2")
+	if ip := clientIP(r); ip != "203.0.113.1" {
+		t.Errorf("got %q", ip)
+	}
+
+	// behind a trusted proxy
+	r = httptest.NewRequest("GET", "/ping", nil)
+	r.RemoteAddr = "10.1.2.3:4567"
+	if ip := clientIP(r); ip != "10.1.2.3" {
+		t.Errorf("got %q", ip)
+	}
+	r.Header.Set("X-Real-Ip", "203.0.113.5")
+	if ip := clientIP(r); ip != "203.0.113.5" {
+		t.Errorf("got %q", ip)
+	}
+
+	// the client's own X-Forwarded-For value is skipped, our proxies appended the real address
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, 203.0.113.9, 192.168.1.1")
+	if ip := clientIP(r); ip != "203.0.113.9" {
+		t.Errorf("got %q", ip)
+	}
+	r.Header.Set("X-Forwarded-For", "10.0.0.2, 10.0.0.1")
+	if ip := clientIP(r); ip != "10.0.0.2" {
+		t.Errorf("got %q", ip)
+	}
+
+	if _, err := readTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("expected error")
+	}
+}
+
 func TestHTTP_internalError(t *testing.T) {
 	w := httptest.NewRecorder()
 	internalError(w, errors.New("problem Y"))
@@ -0,0 +1,140 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/errors"
+)
+
+var (
+	// introspectionClients are OAuth2 client IDs, read from OAUTH2_INTROSPECTION_CLIENTS as a
+	// comma separated list, which can introspect any token. Typically these are our resource
+	// servers. Other clients can only introspect tokens belonging to the same user.
+	introspectionClients = readIntrospectionClients(os.Getenv("OAUTH2_INTROSPECTION_CLIENTS"))
+)
+
+func readIntrospectionClients(v string) map[string]bool {
+	out := make(map[string]bool)
+	for _, id := range strings.Split(v, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			out[id] = true
+		}
+	}
+	return out
+}
+
+// introspection is the response of POST /oauth2/introspect (RFC 7662 section 2.2).
+// Inactive tokens only have Active set.
+type introspection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+}
+
+// introspectHandler describes an access or refresh token to an authenticated client (RFC 7662).
+// Unknown, expired and tokens the client can't see are all reported as inactive.
+func (o *oauth) introspectHandler(w http.ResponseWriter, r *http.Request) {
+	w = wrapResponseWriter(w, r, "oauth.introspectHandler")
+
+	if err := r.ParseForm(); err != nil {
+		problem(w, http.StatusBadRequest, errors.ErrInvalidRequest)
+		return
+	}
+	client, err := o.authenticateClient(r, false)
+	if err != nil {
+		if err == errors.ErrInvalidClient {
+			clientProblem(w, r)
+		} else {
+			internalError(w, fmt.Errorf("problem authenticating client: %v", err))
+		}
+		return
+	}
+	token := r.PostForm.Get("token")
+	if token == "" {
+		problem(w, http.StatusBadRequest, errors.ErrInvalidRequest)
+		return
+	}
+
+	// token_type_hint only changes which lookup we try first, unknown hints are ignored
+	lookups := []string{"access_token", "refresh_token"}
+	if r.PostForm.Get("token_type_hint") == "refresh_token" {
+		lookups[0], lookups[1] = lookups[1], lookups[0]
+	}
+	resp := &introspection{}
+	for _, tokenType := range lookups {
+		resp, err = o.introspectToken(client, tokenType, token, time.Now())
+		if err != nil {
+			internalError(w, fmt.Errorf("problem introspecting %s for client %s: %v", tokenType, client.GetID(), err))
+			return
+		}
+		if resp.Active {
+			break
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		internalError(w, err)
+		return
+	}
+}
+
+// introspectToken finds token by tokenType and describes it if it's active and visible to client
+func (o *oauth) introspectToken(client oauth2.ClientInfo, tokenType string, token string, now time.Time) (*introspection, error) {
+	var ti oauth2.TokenInfo
+	var err error
+	if tokenType == "refresh_token" {
+		ti, err = o.tokenStore.GetByRefresh(token)
+	} else {
+		ti, err = o.tokenStore.GetByAccess(token)
+	}
+	if err != nil || ti == nil {
+		return &introspection{}, err
+	}
+	if !introspectionClients[client.GetID()] && (client.GetUserID() == "" || client.GetUserID() != ti.GetUserID()) {
+		return &introspection{}, nil
+	}
+
+	resp := &introspection{
+		Active:   true,
+		Scope:    ti.GetScope(),
+		ClientID: ti.GetClientID(),
+		Subject:  ti.GetUserID(),
+	}
+	if tokenType == "refresh_token" {
+		// refresh tokens without an expiry never expire
+		resp.IssuedAt = ti.GetRefreshCreateAt().Unix()
+		if ti.GetRefreshExpiresIn() != 0 {
+			expiresAt := ti.GetRefreshCreateAt().Add(ti.GetRefreshExpiresIn())
+			if expiresAt.Before(now) {
+				return &introspection{}, nil
+			}
+			resp.ExpiresAt = expiresAt.Unix()
+		}
+		return resp, nil
+	}
+	expiresAt := ti.GetAccessCreateAt().Add(ti.GetAccessExpiresIn())
+	if expiresAt.Before(now) {
+		return &introspection{}, nil
+	}
+	resp.TokenType = "Bearer"
+	resp.IssuedAt = ti.GetAccessCreateAt().Unix()
+	resp.ExpiresAt = expiresAt.Unix()
+	return resp, nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/oauth2.v3/models"
+)
+
+func TestOAuth__introspectionClients(t *testing.T) {
+	clients := readIntrospectionClients(" foo,, bar ")
+	if len(clients) != 2 || !clients["foo"] || !clients["bar"] {
+		t.Errorf("got %v", clients)
+	}
+	if clients := readIntrospectionClients(""); len(clients) != 0 {
+		t.Errorf("got %v", clients)
+	}
+}
+
+func TestOAuth__introspect(t *testing.T) {
+	defer func(c map[string]bool) { introspectionClients = c }(introspectionClients)
+
+	o, err := createTestOAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.cleanup()
+
+	userId := generateID()
+	client, token := createOAuthClient(t, o, userId)
+	second, _ := createOAuthClient(t, o, userId)
+	resourceServer, _ := createOAuthClient(t, o, generateID())
+
+	token.Access = generateID()
+	token.Scope = "ach:read"
+	token.Refresh = generateID()
+	token.RefreshCreateAt = token.AccessCreateAt
+	token.RefreshExpiresIn = 24 * time.Hour
+	if err := o.tokenStore.Create(token); err != nil {
+		t.Fatal(err)
+	}
+	expired := &models.Token{
+		ClientID:        client.ID,
+		UserID:          userId,
+		Access:          generateID(),
+		AccessCreateAt:  time.Now().Add(-2 * time.Hour),
+		AccessExpiresIn: time.Hour,
+	}
+	if err := o.tokenStore.Create(expired); err != nil {
+		t.Fatal(err)
+	}
+
+	introspect := func(c *models.Client, form url.Values) (int, *introspection) {
+		r := httptest.NewRequest("POST", "/oauth2/introspect", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetBasicAuth(c.ID, c.Secret)
+		w := httptest.NewRecorder()
+		o.svc.introspectHandler(w, r)
+		w.Flush()
+
+		if w.Code != http.StatusOK {
+			return w.Code, nil
+		}
+		var resp introspection
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, &resp
+	}
+
+	// an active access token, introspected by another client of the same user
+	code, resp := introspect(second, url.Values{"token": {token.Access}})
+	if code != http.StatusOK || !resp.Active {
+		t.Fatalf("got %d: %#v", code, resp)
+	}
+	if resp.Scope != "ach:read" || resp.ClientID != client.ID || resp.Subject != userId || resp.TokenType != "Bearer" {
+		t.Errorf("unexpected introspection: %#v", resp)
+	}
+	if resp.IssuedAt == 0 || resp.ExpiresAt-resp.IssuedAt != int64((30*time.Minute).Seconds()) {
+		t.Errorf("iat=%d exp=%d", resp.IssuedAt, resp.ExpiresAt)
+	}
+
+	// public clients can't authenticate to introspect tokens
+	public := &models.Client{ID: generateID(), Domain: "api.moov.io", UserID: userId}
+	if err := o.svc.clientStore.Set(public.ID, public); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := introspect(public, url.Values{"token": {token.Access}}); code != http.StatusUnauthorized {
+		t.Errorf("got %d", code)
+	}
+
+	// refresh token
+	_, resp = introspect(client, url.Values{"token": {token.Refresh}, "token_type_hint": {"refresh_token"}})
+	if !resp.Active || resp.TokenType != "" || resp.ExpiresAt-resp.IssuedAt != int64((24*time.Hour).Seconds()) {
+		t.Errorf("unexpected introspection: %#v", resp)
+	}
+
+	// expired and unknown tokens
+	for _, tok := range []string{expired.Access, generateID()} {
+		_, resp = introspect(client, url.Values{"token": {tok}})
+		if *resp != (introspection{}) {
+			t.Errorf("expected inactive token: %#v", resp)
+		}
+	}
+
+	// other users' clients only see tokens as inactive unless they're allowed to introspect
+	if _, resp = introspect(resourceServer, url.Values{"token": {token.Access}}); resp.Active {
+		t.Error("expected inactive token")
+	}
+	introspectionClients = map[string]bool{resourceServer.ID: true}
+	if _, resp = introspect(resourceServer, url.Values{"token": {token.Access}}); !resp.Active || resp.Subject != userId {
+		t.Errorf("unexpected introspection: %#v", resp)
+	}
+
+	// bad requests
+	if code, _ := introspect(&models.Client{ID: client.ID, Secret: "wrong"}, url.Values{"token": {token.Access}}); code != http.StatusUnauthorized {
+		t.Errorf("got %d", code)
+	}
+	if code, _ := introspect(client, url.Values{}); code != http.StatusBadRequest {
+		t.Errorf("got %d", code)
+	}
+}
@@ -0,0 +1,310 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/generates"
+)
+
+var (
+	errNoJWTSigningKey = errors.New("no JWT signing key")
+)
+
+// jwtKey is a key loaded from JWT_KEYS_DIR. Keys with only a public part are published
+// in our JWKS, so tokens they signed still validate, but never sign new tokens.
+type jwtKey struct {
+	id  string // kid
+	alg string // RS256, ES256 or EdDSA
+
+	signer crypto.Signer // nil for public keys
+	public crypto.PublicKey
+}
+
+// jwtKeySet holds every key we publish and the one used to sign new tokens
+type jwtKeySet struct {
+	keys    []*jwtKey
+	signing *jwtKey
+}
+
+// readJWTKeys loads each PEM encoded key in dir, named <kid>.pem, where private keys are
+// PKCS#1, PKCS#8 or SEC 1 and public keys are PKIX. New tokens are signed by the private key
+// named signingKeyID, or the private key with the greatest kid when that's empty. Naming keys
+// by date (e.g. 2020-03-01.pem) makes rotation a matter of adding a newer key.
+//
+// An empty dir returns no keys, which leaves access tokens opaque.
+func readJWTKeys(dir string, signingKeyID string) (*jwtKeySet, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+
+	ks := &jwtKeySet{}
+	for i := range matches {
+		bs, err := ioutil.ReadFile(matches[i])
+		if err != nil {
+			return nil, err
+		}
+		key, err := parseJWTKey(strings.TrimSuffix(filepath.Base(matches[i]), ".pem"), bs)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", matches[i], err)
+		}
+		ks.keys = append(ks.keys, key)
+
+		if key.signer != nil && (signingKeyID == "" || signingKeyID == key.id) {
+			ks.signing = key
+		}
+	}
+	if ks.signing == nil {
+		if signingKeyID != "" {
+			return nil, fmt.Errorf("%v: private key %s not found in %s", errNoJWTSigningKey, signingKeyID, dir)
+		}
+		return nil, fmt.Errorf("%v: no private keys found in %s", errNoJWTSigningKey, dir)
+	}
+	return ks, nil
+}
+
+func parseJWTKey(kid string, bs []byte) (*jwtKey, error) {
+	block, _ := pem.Decode(bs)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	out := &jwtKey{id: kid}
+	if signer, ok := key.(crypto.Signer); ok {
+		out.signer = signer
+		key = signer.Public()
+	}
+	out.public = key
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if k.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA keys must be at least 2048 bits, got %d", k.N.BitLen())
+		}
+		out.alg = "RS256"
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("unsupported elliptic curve %s, only P-256 is supported", k.Curve.Params().Name)
+		}
+		out.alg = "ES256"
+	case ed25519.PublicKey:
+		out.alg = "EdDSA"
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return out, nil
+}
+
+// sign returns claims as a compact JWS signed by our signing key
+func (ks *jwtKeySet) sign(claims interface{}) (string, error) {
+	key := ks.signing
+	header, err := json.Marshal(map[string]string{
+		"alg": key.alg,
+		"kid": key.id,
+		"typ": "JWT",
+	})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := encodeSegment(header) + "." + encodeSegment(payload)
+
+	var sig []byte
+	switch k := key.signer.(type) {
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(input))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+
+	case *ecdsa.PrivateKey:
+		// JWS uses the fixed size r || s form rather than ASN.1 (RFC 7518 section 3.4)
+		digest := sha256.Sum256([]byte(input))
+		r, s, serr := ecdsa.Sign(rand.Reader, k, digest[:])
+		if serr != nil {
+			return "", serr
+		}
+		sig = append(padBytes(r.Bytes(), 32), padBytes(s.Bytes(), 32)...)
+
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(input))
+
+	default:
+		return "", fmt.Errorf("unsupported signing key %T", key.signer)
+	}
+	if err != nil {
+		return "", err
+	}
+	return input + "." + encodeSegment(sig), nil
+}
+
+func encodeSegment(bs []byte) string {
+	return base64.RawURLEncoding.EncodeToString(bs)
+}
+
+// padBytes left pads bs with zeros to n bytes, as big.Int drops leading zeros
+func padBytes(bs []byte, n int) []byte {
+	if len(bs) >= n {
+		return bs
+	}
+	return append(make([]byte, n-len(bs)), bs...)
+}
+
+// jsonWebKey is the public part of a jwtKey (RFC 7517)
+type jsonWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// EC and OKP
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	Y     string `json:"y,omitempty"`
+}
+
+func (k *jwtKey) jwk() jsonWebKey {
+	out := jsonWebKey{
+		KeyID:     k.id,
+		Use:       "sig",
+		Algorithm: k.alg,
+	}
+	switch pub := k.public.(type) {
+	case *rsa.PublicKey:
+		out.KeyType = "RSA"
+		out.N = encodeSegment(pub.N.Bytes())
+		out.E = encodeSegment(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		out.KeyType, out.Curve = "EC", "P-256"
+		out.X, out.Y = encodeSegment(padBytes(pub.X.Bytes(), 32)), encodeSegment(padBytes(pub.Y.Bytes(), 32))
+	case ed25519.PublicKey:
+		out.KeyType, out.Curve = "OKP", "Ed25519"
+		out.X = encodeSegment(pub)
+	}
+	return out
+}
+
+// jwksHandler publishes the public keys access tokens are signed with (GET /.well-known/jwks.json)
+func (o *oauth) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	w = wrapResponseWriter(w, r, "oauth.jwksHandler")
+
+	keys := make([]jsonWebKey, 0)
+	if o.jwtKeys != nil {
+		for i := range o.jwtKeys.keys {
+			keys = append(keys, o.jwtKeys.keys[i].jwk())
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys}); err != nil {
+		internalError(w, err)
+		return
+	}
+}
+
+// jwtAccessClaims are the claims of our JWT access tokens
+type jwtAccessClaims struct {
+	Issuer    string `json:"iss,omitempty"`
+	Subject   string `json:"sub"`
+	ClientID  string `json:"client_id"`
+	Scope     string `json:"scope,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	ID        string `json:"jti"`
+}
+
+// jwtAccessGenerate creates signed JWT access tokens with opaque refresh tokens
+type jwtAccessGenerate struct {
+	keys   *jwtKeySet
+	issuer string
+
+	refresh oauth2.AccessGenerate
+}
+
+func (g *jwtAccessGenerate) Token(data *oauth2.GenerateBasic, isGenRefresh bool) (string, string, error) {
+	_, refresh, err := g.refresh.Token(data, isGenRefresh)
+	if err != nil {
+		return "", "", err
+	}
+	access, err := g.keys.sign(&jwtAccessClaims{
+		Issuer:    g.issuer,
+		Subject:   data.UserID,
+		ClientID:  data.Client.GetID(),
+		Scope:     data.TokenInfo.GetScope(),
+		IssuedAt:  data.CreateAt.Unix(),
+		ExpiresAt: data.CreateAt.Add(data.TokenInfo.GetAccessExpiresIn()).Unix(),
+		ID:        generateID(),
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return access, refresh, nil
+}
+
+// useJWTAccessTokens switches access tokens from opaque strings to JWTs signed by keys.
+// Tokens are still stored, so revocation, introspection and /auth/check work as before.
+// issuer is the iss claim, and with keys it also makes us an OpenID Connect provider.
+func (o *oauth) useJWTAccessTokens(keys *jwtKeySet, issuer string) {
+	if keys == nil {
+		return
+	}
+	o.jwtKeys = keys
+	o.issuer = issuer
+	o.manager.MapAccessGenerate(&jwtAccessGenerate{
+		keys:    keys,
+		issuer:  issuer,
+		refresh: generates.NewAccessGenerate(),
+	})
+	o.logger.Log("oauth", fmt.Sprintf("signing JWT access tokens with %s key %s", keys.signing.alg, keys.signing.id))
+}
@@ -0,0 +1,309 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeJWTKey(t *testing.T, dir, kid string, key interface{}, public bool) {
+	t.Helper()
+
+	var block *pem.Block
+	if public {
+		bs, err := x509.MarshalPKIXPublicKey(key.(crypto.Signer).Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "PUBLIC KEY", Bytes: bs}
+	} else {
+		bs, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: bs}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, kid+".pem"), pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// createTestJWTKeys writes an RSA, ECDSA and Ed25519 key to a temp dir
+func createTestJWTKeys(t *testing.T) (string, map[string]crypto.Signer) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "jwt-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string]crypto.Signer{
+		"2020-01-rsa":     rsaKey,
+		"2020-02-ecdsa":   ecKey,
+		"2020-03-ed25519": edKey,
+	}
+	for kid, key := range keys {
+		writeJWTKey(t, dir, kid, key, false)
+	}
+	return dir, keys
+}
+
+// verifyTestJWT checks token's signature against the matching public key in jwks and decodes its claims
+func verifyTestJWT(t *testing.T, jwks []jsonWebKey, token string, claims interface{}) string {
+	t.Helper()
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("malformed JWT: %s", token)
+	}
+	decode := func(s string) []byte {
+		bs, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bs
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := json.Unmarshal(decode(parts[0]), &header); err != nil {
+		t.Fatal(err)
+	}
+	var jwk *jsonWebKey
+	for i := range jwks {
+		if jwks[i].KeyID == header.KeyID {
+			jwk = &jwks[i]
+		}
+	}
+	if jwk == nil || jwk.Algorithm != header.Algorithm {
+		t.Fatalf("no JWK for %#v", header)
+	}
+
+	input, sig := []byte(parts[0]+"."+parts[1]), decode(parts[2])
+	digest := sha256.Sum256(input)
+	bigInt := func(s string) *big.Int { return new(big.Int).SetBytes(decode(s)) }
+
+	var valid bool
+	switch jwk.KeyType {
+	case "RSA":
+		pub := &rsa.PublicKey{N: bigInt(jwk.N), E: int(bigInt(jwk.E).Int64())}
+		valid = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) == nil
+	case "EC":
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: bigInt(jwk.X), Y: bigInt(jwk.Y)}
+		valid = len(sig) == 64 && ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+	case "OKP":
+		valid = ed25519.Verify(ed25519.PublicKey(decode(jwk.X)), input, sig)
+	}
+	if !valid {
+		t.Fatalf("invalid %s signature", header.Algorithm)
+	}
+	if err := json.Unmarshal(decode(parts[1]), claims); err != nil {
+		t.Fatal(err)
+	}
+	return header.KeyID
+}
+
+func TestJWT__readKeys(t *testing.T) {
+	dir, keys := createTestJWTKeys(t)
+	defer os.RemoveAll(dir)
+
+	// a retired key which is only published
+	_, retired, _ := ed25519.GenerateKey(rand.Reader)
+	writeJWTKey(t, dir, "2020-04-retired", retired, true)
+
+	ks, err := readJWTKeys(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ks.keys) != 4 {
+		t.Fatalf("got %d keys", len(ks.keys))
+	}
+	if ks.signing.id != "2020-03-ed25519" {
+		t.Errorf("signing with %s", ks.signing.id)
+	}
+	algs := make(map[string]string)
+	for _, k := range ks.keys {
+		algs[k.id] = k.alg
+	}
+	if algs["2020-01-rsa"] != "RS256" || algs["2020-02-ecdsa"] != "ES256" || algs["2020-03-ed25519"] != "EdDSA" || algs["2020-04-retired"] != "EdDSA" {
+		t.Errorf("unexpected algorithms: %v", algs)
+	}
+
+	// pick a specific key
+	for kid := range keys {
+		ks, err := readJWTKeys(dir, kid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ks.signing.id != kid {
+			t.Errorf("signing with %s, expected %s", ks.signing.id, kid)
+		}
+	}
+	if _, err := readJWTKeys(dir, "2020-04-retired"); err == nil {
+		t.Error("expected error signing with a public key")
+	}
+	if _, err := readJWTKeys(dir, "missing"); err == nil {
+		t.Error("expected error")
+	}
+
+	// disabled
+	if ks, err := readJWTKeys("", ""); ks != nil || err != nil {
+		t.Errorf("ks=%v err=%v", ks, err)
+	}
+}
+
+func TestJWT__invalidKeys(t *testing.T) {
+	weakRSA, _ := rsa.GenerateKey(rand.Reader, 1024)
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+
+	for _, key := range []interface{}{weakRSA, p384} {
+		dir, err := ioutil.TempDir("", "jwt-keys")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		writeJWTKey(t, dir, "bad", key, false)
+		if _, err := readJWTKeys(dir, ""); err == nil {
+			t.Errorf("%T: expected error", key)
+		}
+	}
+
+	if _, err := parseJWTKey("bad", []byte("not a key")); err == nil {
+		t.Error("expected error")
+	}
+
+	// no keys at all
+	dir, err := ioutil.TempDir("", "jwt-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err := readJWTKeys(dir, ""); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestJWT__accessTokens(t *testing.T) {
+	dir, keys := createTestJWTKeys(t)
+	defer os.RemoveAll(dir)
+
+	o, err := createTestOAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.cleanup()
+
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	userId := generateID()
+	cookie, err := createCookie(userId, auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _ := createOAuthClient(t, o, userId)
+	if err := o.svc.clientStore.SetScope(client.ID, "ach:read"); err != nil {
+		t.Fatal(err)
+	}
+
+	// before JWTs are enabled no keys are published
+	w := httptest.NewRecorder()
+	o.svc.jwksHandler(w, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"keys":[]`) {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	for kid := range keys {
+		ks, err := readJWTKeys(dir, kid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		o.svc.useJWTAccessTokens(ks, "https://auth.moov.io")
+
+		// read our published keys
+		w := httptest.NewRecorder()
+		o.svc.jwksHandler(w, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+		var jwks struct {
+			Keys []jsonWebKey `json:"keys"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&jwks); err != nil {
+			t.Fatal(err)
+		}
+		if len(jwks.Keys) != len(keys) {
+			t.Fatalf("got %d keys", len(jwks.Keys))
+		}
+
+		// issue a token
+		url := fmt.Sprintf("/oauth2/token?grant_type=client_credentials&client_id=%s&client_secret=%s", client.ID, client.Secret)
+		req := httptest.NewRequest("POST", url, nil)
+		req.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+		w = httptest.NewRecorder()
+		o.svc.tokenHandler(auth, nil)(w, req)
+		w.Flush()
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d: %s", w.Code, w.Body.String())
+		}
+		var resp struct {
+			AccessToken string `json:"access_token"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		var claims jwtAccessClaims
+		if signedBy := verifyTestJWT(t, jwks.Keys, resp.AccessToken, &claims); signedBy != kid {
+			t.Errorf("signed by %s, expected %s", signedBy, kid)
+		}
+		if claims.Issuer != "https://auth.moov.io" || claims.Subject != userId || claims.ClientID != client.ID || claims.Scope != "ach:read" || claims.ID == "" {
+			t.Errorf("unexpected claims: %#v", claims)
+		}
+		if claims.ExpiresAt-claims.IssuedAt != int64((2 * time.Hour).Seconds()) {
+			t.Errorf("iat=%d exp=%d", claims.IssuedAt, claims.ExpiresAt)
+		}
+
+		// JWTs are still accepted as bearer tokens
+		req = httptest.NewRequest("GET", "/oauth2/authorize", nil)
+		req.Header.Set("Authorization", "Bearer "+resp.AccessToken)
+		if ti, err := o.svc.requestHasValidOAuthToken(req); err != nil || ti.GetUserID() != userId {
+			t.Errorf("ti=%v err=%v", ti, err)
+		}
+	}
+}
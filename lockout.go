@@ -0,0 +1,168 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+var (
+	errTooManyLoginAttempts = errors.New("too many failed login attempts, try again later")
+
+	// loginLockout is read from the environment:
+	//
+	//   LOGIN_MAX_FAILURES          failed logins for a user before they're locked out (default: 5, 0 disables)
+	//   LOGIN_MAX_IP_FAILURES       failed logins from an IP address before it's locked out (default: 50, 0 disables)
+	//   LOGIN_LOCKOUT_DURATION      first lockout, which doubles with each further failure (default: 1m)
+	//   LOGIN_MAX_LOCKOUT_DURATION  longest lockout (default: 1h)
+	//   LOGIN_FAILURE_WINDOW        failures are forgotten after this long without another (default: 24h)
+	loginLockout = readLockoutPolicy()
+)
+
+// lockoutPolicy limits password guessing by locking out users and IP addresses which
+// fail to login too often. Once over the threshold each failure doubles the lockout.
+type lockoutPolicy struct {
+	maxFailures   int
+	maxIPFailures int
+
+	duration    time.Duration
+	maxDuration time.Duration
+	window      time.Duration
+}
+
+func readLockoutPolicy() lockoutPolicy {
+	readInt := func(name string, def int) int {
+		if n, err := strconv.Atoi(os.Getenv(name)); err == nil {
+			return n
+		}
+		return def
+	}
+	readDuration := func(name string, def time.Duration) time.Duration {
+		if dur, err := time.ParseDuration(os.Getenv(name)); err == nil && dur > 0 {
+			return dur
+		}
+		return def
+	}
+	return lockoutPolicy{
+		maxFailures:   readInt("LOGIN_MAX_FAILURES", 5),
+		maxIPFailures: readInt("LOGIN_MAX_IP_FAILURES", 50),
+		duration:      readDuration("LOGIN_LOCKOUT_DURATION", 1*time.Minute),
+		maxDuration:   readDuration("LOGIN_MAX_LOCKOUT_DURATION", 1*time.Hour),
+		window:        readDuration("LOGIN_FAILURE_WINDOW", 24*time.Hour),
+	}
+}
+
+// threshold returns how many failures are allowed for key, zero means no limit
+func (p lockoutPolicy) threshold(key string) int {
+	if strings.HasPrefix(key, "ip:") {
+		return p.maxIPFailures
+	}
+	return p.maxFailures
+}
+
+// lockoutFor returns how long key is locked out after the given number of failures.
+func (p lockoutPolicy) lockoutFor(key string, failures int) time.Duration {
+	threshold := p.threshold(key)
+	if threshold <= 0 || failures < threshold {
+		return 0
+	}
+	exp := failures - threshold
+	if exp > 30 {
+		return p.maxDuration // avoid overflowing
+	}
+	dur := p.duration * time.Duration(math.Pow(2, float64(exp)))
+	if dur <= 0 || dur > p.maxDuration {
+		return p.maxDuration
+	}
+	return dur
+}
+
+// loginAttempts tracks failed logins for a user or IP address
+type loginAttempts struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// Keys for tracking failed logins. Emails which don't belong to a user are tracked
+// on their own so lockouts don't reveal which emails exist.
+func userLockoutKey(userId string) string {
+	return "user:" + userId
+}
+
+func emailLockoutKey(email string) string {
+	return "email:" + cleanEmail(email)
+}
+
+func ipLockoutKey(r *http.Request) string {
+	return "ip:" + clientIP(r)
+}
+
+// loginLockedFor returns how long until logins for every key are allowed again,
+// which is zero if they're allowed now.
+func loginLockedFor(auth authable, keys ...string) (time.Duration, error) {
+	var wait time.Duration
+	for _, key := range keys {
+		attempts, err := auth.readLoginAttempts(key)
+		if err != nil {
+			return 0, err
+		}
+		if attempts != nil {
+			if dur := time.Until(attempts.lockedUntil); dur > wait {
+				wait = dur
+			}
+		}
+	}
+	return wait, nil
+}
+
+// rejectLockedLogin responds with '429 Too Many Requests' if any key is locked out.
+// It returns true if the request was rejected.
+func rejectLockedLogin(w http.ResponseWriter, auth authable, keys ...string) bool {
+	wait, err := loginLockedFor(auth, keys...)
+	if err != nil {
+		internalError(w, fmt.Errorf("problem reading login attempts: %v", err))
+		return true
+	}
+	if wait <= 0 {
+		return false
+	}
+	authFailures.With("method", "web").Add(1)
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(wait.Seconds()))))
+	problem(w, http.StatusTooManyRequests, errTooManyLoginAttempts)
+	return true
+}
+
+// recordLoginFailure counts a failed login against each key, locking out any which
+// are over their threshold.
+func recordLoginFailure(logger log.Logger, auth authable, keys ...string) error {
+	now := time.Now()
+	for _, key := range keys {
+		key := key
+		attempts, err := auth.addLoginFailure(key, now, loginLockout.window, func(failures int) time.Duration {
+			return loginLockout.lockoutFor(key, failures)
+		})
+		if err != nil {
+			return err
+		}
+		if dur := loginLockout.lockoutFor(key, attempts.failures); dur > 0 {
+			lockoutType := strings.SplitN(key, ":", 2)[0]
+			authLockouts.With("type", lockoutType).Add(1)
+			if logger != nil {
+				logger.Log("login", fmt.Sprintf("locking out %s for %v after %d failed logins", key, dur, attempts.failures))
+			}
+		}
+	}
+	return nil
+}
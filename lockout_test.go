@@ -0,0 +1,265 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moov-io/base"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+func TestLockout__lockoutFor(t *testing.T) {
+	policy := lockoutPolicy{
+		maxFailures:   3,
+		maxIPFailures: 10,
+		duration:      time.Minute,
+		maxDuration:   10 * time.Minute,
+	}
+	cases := []struct {
+		key      string
+		failures int
+		expected time.Duration
+	}{
+		{"user:foo", 2, 0},
+		{"user:foo", 3, time.Minute},
+		{"user:foo", 4, 2 * time.Minute},
+		{"user:foo", 5, 4 * time.Minute},
+		{"user:foo", 7, 10 * time.Minute},
+		{"user:foo", 100, 10 * time.Minute},
+		{"ip:10.0.0.1", 9, 0},
+		{"ip:10.0.0.1", 10, time.Minute},
+	}
+	for _, tc := range cases {
+		if dur := policy.lockoutFor(tc.key, tc.failures); dur != tc.expected {
+			t.Errorf("%s after %d failures: got %v expected %v", tc.key, tc.failures, dur, tc.expected)
+		}
+	}
+
+	policy.maxFailures = 0
+	if dur := policy.lockoutFor("user:foo", 50); dur != 0 {
+		t.Errorf("expected lockouts to be disabled, got %v", dur)
+	}
+}
+
+func TestLockout__login(t *testing.T) {
+	defer func(p lockoutPolicy) { loginLockout = p }(loginLockout)
+	loginLockout = lockoutPolicy{
+		maxFailures:   3,
+		maxIPFailures: 100,
+		duration:      time.Minute,
+		maxDuration:   time.Hour,
+		window:        time.Hour,
+	}
+
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+
+	u := &User{
+		ID:            generateID(),
+		Email:         "test@moov.io",
+		EmailVerified: true,
+		CreatedAt:     base.NewTime(time.Now()),
+	}
+	if err := repo.upsert(u); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.writePassword(u.ID, "superlongpassword"); err != nil {
+		t.Fatal(err)
+	}
+
+	login := func(email, password string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		body := fmt.Sprintf(`{"email": %q, "password": %q}`, email, password)
+		r := httptest.NewRequest("POST", "/users/login", strings.NewReader(body))
+		loginRoute(log.NewNopLogger(), auth, repo)(w, r)
+		w.Flush()
+		return w
+	}
+
+	// a successful login clears earlier failures
+	for i := 0; i < 2; i++ {
+		if w := login("test@moov.io", "wrongpassword"); w.Code != http.StatusForbidden {
+			t.Fatalf("got %d: %s", w.Code, w.Body.String())
+		}
+	}
+	if w := login("test@moov.io", "superlongpassword"); w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if attempts, err := auth.readLoginAttempts(userLockoutKey(u.ID)); err != nil || attempts != nil {
+		t.Fatalf("expected failures to be cleared: %#v err=%v", attempts, err)
+	}
+
+	// lock the user out
+	for i := 0; i < 3; i++ {
+		if w := login("test@moov.io", "wrongpassword"); w.Code != http.StatusForbidden {
+			t.Fatalf("got %d: %s", w.Code, w.Body.String())
+		}
+	}
+	w := login("test@moov.io", "superlongpassword")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if n, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || n <= 0 || n > 60 {
+		t.Errorf("unexpected Retry-After: %q", w.Header().Get("Retry-After"))
+	}
+
+	// unknown emails are locked out the same way
+	for i := 0; i < 3; i++ {
+		if w := login("missing@moov.io", "wrongpassword"); w.Code != http.StatusForbidden {
+			t.Fatalf("got %d: %s", w.Code, w.Body.String())
+		}
+	}
+	if w := login("missing@moov.io", "wrongpassword"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	// once the lockout expires the next failure doubles it
+	expired := formatTimestamp(time.Now().Add(-1 * time.Second))
+	if _, err := auth.db.Exec(`update login_attempts set locked_until = ? where attempt_key = ?`, expired, userLockoutKey(u.ID)); err != nil {
+		t.Fatal(err)
+	}
+	if w := login("test@moov.io", "wrongpassword"); w.Code != http.StatusForbidden {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	w = login("test@moov.io", "superlongpassword")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if n, _ := strconv.Atoi(w.Header().Get("Retry-After")); n <= 60 || n > 120 {
+		t.Errorf("unexpected Retry-After: %q", w.Header().Get("Retry-After"))
+	}
+}
+
+func TestLockout__ip(t *testing.T) {
+	defer func(p lockoutPolicy) { loginLockout = p }(loginLockout)
+	loginLockout = lockoutPolicy{
+		maxFailures:   100,
+		maxIPFailures: 3,
+		duration:      time.Minute,
+		maxDuration:   time.Hour,
+		window:        time.Hour,
+	}
+
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+
+	login := func(email string, ip string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		body := fmt.Sprintf(`{"email": %q, "password": "wrongpassword"}`, email)
+		r := httptest.NewRequest("POST", "/users/login", strings.NewReader(body))
+		r.RemoteAddr = ip + ":4567"
+		loginRoute(log.NewNopLogger(), auth, repo)(w, r)
+		w.Flush()
+		return w
+	}
+
+	// guessing across several emails still locks out the IP address
+	for i := 0; i < 3; i++ {
+		if w := login(fmt.Sprintf("user%d@moov.io", i), "10.0.0.1"); w.Code != http.StatusForbidden {
+			t.Fatalf("got %d: %s", w.Code, w.Body.String())
+		}
+	}
+	if w := login("other@moov.io", "10.0.0.1"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if w := login("other@moov.io", "10.0.0.2"); w.Code != http.StatusForbidden {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	// a made up X-Forwarded-For doesn't get a new IP address past the lockout
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/users/login", strings.NewReader(`{"email": "other@moov.io", "password": "wrongpassword"}`))
+	r.RemoteAddr = "10.0.0.1:4567"
+	r.Header.Set("X-Forwarded-For", "203.0.113.77")
+	loginRoute(log.NewNopLogger(), auth, repo)(w, r)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestLockout__passwordChange(t *testing.T) {
+	defer func(p lockoutPolicy) { loginLockout = p }(loginLockout)
+	loginLockout = lockoutPolicy{
+		maxFailures:   3,
+		maxIPFailures: 100,
+		duration:      time.Minute,
+		maxDuration:   time.Hour,
+		window:        time.Hour,
+	}
+
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+
+	userId := generateID()
+	if err := repo.upsert(&User{ID: userId, Email: "test@moov.io", CreatedAt: base.NewTime(time.Now())}); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.writePassword(userId, "superlongpassword"); err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := createCookie(userId, auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	change := func(current string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		body := fmt.Sprintf(`{"currentPassword": %q, "newPassword": "anotherlongpassword"}`, current)
+		r := httptest.NewRequest("PUT", fmt.Sprintf("/users/%s/password", userId), strings.NewReader(body))
+		r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+		r = mux.SetURLVars(r, map[string]string{"user_id": userId})
+		passwordChangeRoute(log.NewNopLogger(), auth, repo, nil)(w, r)
+		w.Flush()
+		return w
+	}
+
+	for i := 0; i < 3; i++ {
+		if w := change("wrongpassword"); w.Code != http.StatusForbidden {
+			t.Fatalf("got %d: %s", w.Code, w.Body.String())
+		}
+	}
+	if w := change("superlongpassword"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if err := auth.checkPassword(userId, "superlongpassword"); err != nil {
+		t.Errorf("expected password to be unchanged: %v", err)
+	}
+}
@@ -51,6 +51,10 @@ func checkLogin(logger log.Logger, auth authable, repo userRepository) http.Hand
 			w.WriteHeader(http.StatusForbidden)
 			return
 		}
+		if err := populateMFA(auth, user); err != nil {
+			internalError(w, err)
+			return
+		}
 
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		if user != nil {
@@ -99,11 +103,24 @@ func loginRoute(logger log.Logger, auth authable, userService userRepository) ht
 
 		// find user by email
 		u, err := userService.lookupByEmail(login.Email)
+
+		// refuse to check passwords for users or IPs locked out after too many failures
+		lockoutKey, ipKey := emailLockoutKey(login.Email), ipLockoutKey(r)
+		if u != nil {
+			lockoutKey = userLockoutKey(u.ID)
+		}
+		if rejectLockedLogin(w, auth, lockoutKey, ipKey) {
+			return
+		}
+
 		if err != nil || u == nil {
 			// Mark this (and password check) as failure only because
 			// the user is involved at this point. Otherwise it's their
 			// developer's problem (i.e. bad json).
 			authFailures.With("method", "web").Add(1)
+			if err := recordLoginFailure(logger, auth, lockoutKey, ipKey); err != nil {
+				logger.Log("login", fmt.Sprintf("problem recording failed login: %v", err))
+			}
 			w.WriteHeader(http.StatusForbidden)
 			if err != nil {
 				logger.Log("login", fmt.Sprintf("problem looking up user email %q: %v", login.Email, err))
@@ -114,36 +131,63 @@ func loginRoute(logger log.Logger, auth authable, userService userRepository) ht
 		// find user by userId and password
 		if err := auth.checkPassword(u.ID, login.Password); err != nil {
 			authFailures.With("method", "web").Add(1)
+			if err := recordLoginFailure(logger, auth, lockoutKey, ipKey); err != nil {
+				logger.Log("login", fmt.Sprintf("problem recording failed login for userId=%s: %v", u.ID, err))
+			}
 			logger.Log("login", fmt.Sprintf("userId=%s failed: %v", u.ID, err))
 			w.WriteHeader(http.StatusForbidden)
 			return
 		}
-
-		// success route, let's finish!
-		authSuccesses.With("method", "web").Add(1)
-		cookie, err := createCookie(u.ID, auth)
-		if err != nil {
-			internalError(w, err)
+		if !u.EmailVerified {
+			authFailures.With("method", "web").Add(1)
+			problem(w, http.StatusForbidden, errEmailNotVerified)
 			return
 		}
-		if cookie == nil {
-			logger.Log("login", fmt.Sprintf("nil cookie for userId=%s", u.ID))
-			internalError(w, err)
+
+		// users with MFA enabled need to present their second factor before getting a cookie
+		methods, err := mfaMethods(auth, u.ID)
+		if err != nil {
+			internalError(w, fmt.Errorf("problem reading MFA status for userId=%s: %v", u.ID, err))
 			return
 		}
-		if err := auth.writeCookie(u.ID, cookie); err != nil {
-			internalError(w, err)
+		if len(methods) > 0 {
+			startMFAChallenge(w, auth, u.ID, methods)
 			return
 		}
 
-		http.SetCookie(w, cookie)
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.Header().Set("X-User-Id", u.ID)
-		w.WriteHeader(http.StatusOK)
+		completeLogin(w, r, logger, auth, u)
+	}
+}
 
-		if err := json.NewEncoder(w).Encode(u); err != nil {
-			internalError(w, err)
-			return
-		}
+// completeLogin sets a new session cookie for u and writes the user as the response.
+func completeLogin(w http.ResponseWriter, r *http.Request, logger log.Logger, auth authable, u *User) {
+	// success route, let's finish!
+	authSuccesses.With("method", "web").Add(1)
+	cookie, err := createCookie(u.ID, auth, r)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if cookie == nil {
+		logger.Log("login", fmt.Sprintf("nil cookie for userId=%s", u.ID))
+		internalError(w, err)
+		return
+	}
+	if err := populateMFA(auth, u); err != nil {
+		internalError(w, err)
+		return
+	}
+	if err := auth.deleteLoginAttempts(userLockoutKey(u.ID)); err != nil {
+		logger.Log("login", fmt.Sprintf("problem clearing failed logins for userId=%s: %v", u.ID, err))
+	}
+
+	http.SetCookie(w, cookie)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-User-Id", u.ID)
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(u); err != nil {
+		internalError(w, err)
+		return
 	}
 }
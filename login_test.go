@@ -8,10 +8,13 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/moov-io/base"
+
+	"github.com/go-kit/kit/log"
 )
 
 func TestLogin__forwardedPreflight(t *testing.T) {
@@ -75,11 +78,11 @@ func TestLogin__getUserFromCookie(t *testing.T) {
 	}
 
 	// Write user's cookie
-	cookie, err := createCookie(userId, auth)
+	cookie, err := createCookie(userId, auth, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := auth.writeCookie(userId, cookie); err != nil {
+	if err := auth.writeCookie(userId, cookie, "", ""); err != nil {
 		t.Fatal(err)
 	}
 
@@ -98,3 +101,52 @@ func TestLogin__getUserFromCookie(t *testing.T) {
 		t.Errorf("u.ID=%s user.ID=%s", u.ID, user.ID)
 	}
 }
+
+func TestLogin__unverifiedEmail(t *testing.T) {
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+
+	u := &User{
+		ID:        generateID(),
+		Email:     "test@moov.io",
+		CreatedAt: base.NewTime(time.Now()),
+	}
+	if err := repo.upsert(u); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.writePassword(u.ID, "superlongpassword"); err != nil {
+		t.Fatal(err)
+	}
+	code := generateID()
+	if err := repo.writeApprovalCode(u.ID, code, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	login := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/users/login", strings.NewReader(`{"email": "test@moov.io", "password": "superlongpassword"}`))
+		loginRoute(log.NewNopLogger(), auth, repo)(w, r)
+		w.Flush()
+		return w
+	}
+
+	if w := login(); w.Code != http.StatusForbidden {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	if _, err := repo.consumeApprovalCode(code); err != nil {
+		t.Fatal(err)
+	}
+	if w := login(); w.Code != http.StatusOK {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -6,6 +6,7 @@ package main
 
 import (
 	"net/http"
+	"strconv"
 
 	"github.com/go-kit/kit/log"
 	"github.com/gorilla/mux"
@@ -15,6 +16,8 @@ func addLogoutRoutes(router *mux.Router, logger log.Logger, auth authable) {
 	router.Methods("DELETE").Path("/users/login").HandlerFunc(logoutRoute(auth))
 }
 
+// logoutRoute invalidates the session making the request. Every session for the
+// user is invalidated if the 'all' query parameter is true.
 func logoutRoute(auth authable) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w = wrapResponseWriter(w, r, "logoutRoute")
@@ -25,7 +28,12 @@ func logoutRoute(auth authable) func(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if err := auth.invalidateCookies(userId); err != nil {
+		if all, _ := strconv.ParseBool(r.URL.Query().Get("all")); all {
+			err = auth.invalidateCookies(userId)
+		} else {
+			err = auth.invalidateCookie(extractCookie(r).Value)
+		}
+		if err != nil {
 			logger.Log("logout", err)
 			w.WriteHeader(http.StatusBadRequest)
 			return
@@ -68,7 +68,7 @@ func TestLogout__full(t *testing.T) {
 		Value:   data,
 		Expires: time.Now().Add(1 * time.Hour),
 	}
-	if err := auth.writeCookie(userId, cookie); err != nil {
+	if err := auth.writeCookie(userId, cookie, "", ""); err != nil {
 		t.Fatal(err)
 	}
 
@@ -98,3 +98,58 @@ func TestLogout__full(t *testing.T) {
 		t.Errorf("userId=%s", id)
 	}
 }
+
+func TestLogout__sessions(t *testing.T) {
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	userId := generateID()
+	laptop, err := createCookie(userId, auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	phone, err := createCookie(userId, auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tablet, err := createCookie(userId, auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// logout from the laptop, the other sessions remain
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("DELETE", "/users/login", nil)
+	r.Header.Set("Cookie", "moov_auth="+laptop.Value)
+	logoutRoute(auth)(w, r)
+	w.Flush()
+
+	if w.Code != 200 {
+		t.Errorf("got %d", w.Code)
+	}
+	if id, _ := auth.findUserId(laptop.Value); id != "" {
+		t.Errorf("laptop session: userId=%s", id)
+	}
+	if id, _ := auth.findUserId(phone.Value); id != userId {
+		t.Errorf("phone session: userId=%s", id)
+	}
+
+	// logout everywhere from the phone
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("DELETE", "/users/login?all=true", nil)
+	r.Header.Set("Cookie", "moov_auth="+phone.Value)
+	logoutRoute(auth)(w, r)
+	w.Flush()
+
+	if w.Code != 200 {
+		t.Errorf("got %d", w.Code)
+	}
+	for _, c := range []*http.Cookie{phone, tablet} {
+		if id, _ := auth.findUserId(c.Value); id != "" {
+			t.Errorf("session %s: userId=%s", c.Value, id)
+		}
+	}
+}
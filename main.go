@@ -23,7 +23,6 @@ import (
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/metrics/prometheus"
 	"github.com/gorilla/mux"
-	"github.com/mattn/go-sqlite3"
 	stdprometheus "github.com/prometheus/client_golang/prometheus"
 )
 
@@ -52,6 +51,10 @@ var (
 		Name: "auth_inactivations",
 		Help: "Count of inactivated auths (i.e. user logout)",
 	}, []string{"method"})
+	authLockouts = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "auth_lockouts",
+		Help: "Count of logins locked out after repeated failures",
+	}, []string{"type"})
 
 	internalServerErrors = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
 		Name: "http_errors",
@@ -70,6 +73,18 @@ var (
 		Name: "oauth2_token_generations",
 		Help: "Count of auth tokens created",
 	}, nil)
+	tokenRevocations = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "oauth2_token_revocations",
+		Help: "Count of auth tokens revoked by their client",
+	}, []string{"type"})
+	refreshTokenReuses = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "oauth2_refresh_token_reuses",
+		Help: "Count of used refresh tokens presented again, which revokes their token family",
+	}, nil)
+	expiredRowsPurged = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "expired_rows_purged",
+		Help: "Count of expired tokens, codes, sessions and challenges deleted",
+	}, []string{"table"})
 )
 
 func main() {
@@ -86,6 +101,16 @@ func main() {
 	}
 	logger = log.With(logger, "ts", log.DefaultTimestampUTC)
 	logger = log.With(logger, "caller", log.DefaultCaller)
+
+	// auth migrate <up|down|status> manages the database schemas and exits
+	if flag.Arg(0) == "migrate" {
+		if err := migrateCommand(flag.Args()[1:], os.Stdout); err != nil {
+			logger.Log("migrate", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	logger.Log("startup", fmt.Sprintf("Starting auth server version %s", Version))
 
 	// Listen for application termination.
@@ -111,21 +136,29 @@ func main() {
 	}()
 	defer adminServer.Shutdown()
 
-	// migrate database
-	if sqliteVersion, _, _ := sqlite3.Version(); sqliteVersion != "" {
-		logger.Log("main", fmt.Sprintf("sqlite version %s", sqliteVersion))
+	mfaKey, err := setupMFAKey(os.Getenv("MFA_ENCRYPTION_KEY"))
+	if err != nil {
+		logger.Log("main", fmt.Sprintf("Failed to setup MFA encryption: %v", err))
+		os.Exit(1)
 	}
-	db, err := createConnection(getSqlitePath())
+	if mfaKey == nil {
+		logger.Log("main", "MFA_ENCRYPTION_KEY is not set, MFA enrollment is disabled")
+	}
+
+	trustedProxies, err = readTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
 	if err != nil {
-		logger.Log("main", fmt.Errorf("database connection error: %v", err))
+		logger.Log("main", fmt.Sprintf("Failed to read TRUSTED_PROXIES: %v", err))
 		os.Exit(1)
 	}
-	if err := migrate(db, logger); err != nil {
-		logger.Log("main", fmt.Errorf("database migration error: %v", err))
+
+	// setup and migrate the database
+	store, err := setupUserStore(os.Getenv("DATABASE_DSN"), logger, mfaKey)
+	if err != nil {
+		logger.Log("main", err)
 		os.Exit(1)
 	}
 	defer func() {
-		if err := db.Close(); err != nil {
+		if err := store.close(); err != nil {
 			logger.Log("main", fmt.Errorf("database Close error: %v", err))
 			os.Exit(1)
 		}
@@ -146,6 +179,16 @@ func main() {
 		logger.Log("main", fmt.Sprintf("Failed to setup OAuth2 service: %v", err))
 		os.Exit(1)
 	}
+	if oauth.scopeRules, err = readScopeRules(os.Getenv("OAUTH2_SCOPE_RULES")); err != nil {
+		logger.Log("main", fmt.Sprintf("Failed to read OAuth2 scope rules: %v", err))
+		os.Exit(1)
+	}
+	jwtKeys, err := readJWTKeys(os.Getenv("JWT_KEYS_DIR"), os.Getenv("JWT_SIGNING_KEY_ID"))
+	if err != nil {
+		logger.Log("main", fmt.Sprintf("Failed to read JWT keys: %v", err))
+		os.Exit(1)
+	}
+	oauth.useJWTAccessTokens(jwtKeys, os.Getenv("JWT_ISSUER"))
 	defer func() {
 		if err := oauth.shutdown(); err != nil {
 			logger.Log("main", fmt.Errorf("oauth shutdown error: %v", err))
@@ -153,28 +196,53 @@ func main() {
 		}
 	}()
 
+	if err := setupBreachedPasswords(passwordRules.breachedDir); err != nil {
+		logger.Log("main", fmt.Sprintf("Failed to setup breached password checks: %v", err))
+		os.Exit(1)
+	}
+	if err := passwordHashing.validate(); err != nil {
+		logger.Log("main", fmt.Sprintf("Invalid password hashing settings: %v", err))
+		os.Exit(1)
+	}
+
 	// user services
-	authService := &auth{
-		db:  db,
-		log: logger,
+	cleanupRules, err := readCleanupRules()
+	if err != nil {
+		logger.Log("main", fmt.Sprintf("Failed to read demo cleanup rules: %v", err))
+		os.Exit(1)
 	}
-	userService := &sqliteUserRepository{
-		db:  db,
-		log: logger,
+	cleanup := &userCleanup{
+		logger:      logger,
+		rules:       cleanupRules,
+		store:       store,
+		clientStore: clientStore,
+		tokenStore:  tokenStore,
 	}
+	go startAsyncUserCleanup(context.Background(), logger, cleanup, demoCleanupInterval)
+	go startAsyncExpiredPurge(context.Background(), logger, expiredPurgeInterval, expiredPurgeBatchSize, store.purgeExpired, tokenStore.PurgeExpired)
 
-	go userService.startAsyncUserCleanup(context.Background(), logger, demoCleanupInterval)
+	mail, err := setupMailer(os.Getenv("EMAIL_SENDER"))
+	if err != nil {
+		logger.Log("main", fmt.Sprintf("Failed to setup email sender: %v", err))
+		os.Exit(1)
+	}
 
 	// api routes
 	router := mux.NewRouter()
 	moovhttp.AddCORSHandler(router)
 	addPingRoute(router)
-	addAuthRoutes(router, logger, authService, oauth, userService)
-	addOAuthRoutes(router, oauth, logger, authService)
-	addLoginRoutes(router, logger, authService, userService)
-	addLogoutRoutes(router, logger, authService)
-	addSignupRoutes(router, logger, authService, userService)
-	addUserProfileRoutes(router, logger, authService, userService)
+	addAuthRoutes(router, logger, store, oauth, store)
+	addOAuthRoutes(router, oauth, logger, store, store)
+	addLoginRoutes(router, logger, store, store)
+	addMFARoutes(router, logger, store, store)
+	addRecoveryCodeRoutes(router, logger, store)
+	addWebAuthnRoutes(router, logger, store, store)
+	addLogoutRoutes(router, logger, store)
+	addSignupRoutes(router, logger, store, store, mail)
+	addVerifyRoutes(router, logger, store, mail)
+	addPasswordRoutes(router, logger, store, store, oauth, mail)
+	addUserProfileRoutes(router, logger, store, store)
+	addSessionRoutes(router, logger, store)
 
 	// Check to see if our -http.addr flag has been overridden
 	if v := os.Getenv("HTTP_BIND_ADDRESS"); v != "" {
@@ -0,0 +1,805 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moov-io/base"
+
+	"github.com/go-kit/kit/log"
+)
+
+var (
+	errNoPassword = errors.New("no password found")
+)
+
+// memoryUserStore keeps everything in maps. It behaves like the SQL stores, including
+// hashing tokens and encrypting TOTP secrets, so it can stand in for them.
+type memoryUserStore struct {
+	mu  sync.Mutex
+	log log.Logger
+
+	// mfaKey encrypts TOTP secrets, MFA enrollment is disabled when nil
+	mfaKey cipher.AEAD
+
+	users           map[string]User // userId
+	approvalCodes   map[string]memoryToken
+	passwords       map[string]memoryPassword   // userId
+	passwordHistory map[string][]memoryPassword // userId, oldest first
+	passwordResets  map[string]memoryToken
+	sessions        map[string]*memorySession // session ID
+	totp            map[string]memoryTOTP     // userId
+	mfaChallenges   map[string]*memoryToken
+	recoveryCodes   map[string][]string // userId
+	webauthnChalls  map[string]memoryToken
+	webauthnCreds   map[string]webauthnCredential // credential ID
+	loginAttempts   map[string]loginAttempts
+	lastActive      map[string]time.Time // userId
+}
+
+func newMemoryUserStore(logger log.Logger, mfaKey cipher.AEAD) *memoryUserStore {
+	return &memoryUserStore{
+		log:             logger,
+		mfaKey:          mfaKey,
+		users:           make(map[string]User),
+		approvalCodes:   make(map[string]memoryToken),
+		passwords:       make(map[string]memoryPassword),
+		passwordHistory: make(map[string][]memoryPassword),
+		passwordResets:  make(map[string]memoryToken),
+		sessions:        make(map[string]*memorySession),
+		totp:            make(map[string]memoryTOTP),
+		mfaChallenges:   make(map[string]*memoryToken),
+		recoveryCodes:   make(map[string][]string),
+		webauthnChalls:  make(map[string]memoryToken),
+		webauthnCreds:   make(map[string]webauthnCredential),
+		loginAttempts:   make(map[string]loginAttempts),
+		lastActive:      make(map[string]time.Time),
+	}
+}
+
+// memoryToken is a hashed code, token or challenge issued to a user.
+// Tokens are keyed by their hash, except approval codes which are keyed by userId.
+type memoryToken struct {
+	hash       string
+	userId     string
+	ceremony   string // WebAuthn challenges only
+	attempts   int    // MFA challenges only
+	validUntil time.Time
+}
+
+func (t memoryToken) expired() bool {
+	return time.Now().After(t.validUntil)
+}
+
+type memoryPassword struct {
+	password, salt string
+}
+
+type memorySession struct {
+	session
+
+	userId     string
+	validUntil time.Time
+}
+
+type memoryTOTP struct {
+	secret    string // sealed with mfaKey
+	confirmed bool
+	lastStep  int64
+}
+
+func (m *memoryUserStore) close() error {
+	return nil
+}
+
+func (m *memoryUserStore) lookupByUserId(userId string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, exists := m.users[userId]
+	if !exists || u.Email == "" {
+		return nil, nil
+	}
+	_, unverified := m.approvalCodes[userId]
+	u.EmailVerified = !unverified
+	return &u, nil
+}
+
+func (m *memoryUserStore) lookupByEmail(email string) (*User, error) {
+	email = cleanEmail(email)
+
+	m.mu.Lock()
+	var userId string
+	for id, u := range m.users {
+		if u.cleanEmail() == email {
+			userId = id
+			break
+		}
+	}
+	m.mu.Unlock()
+
+	if userId == "" {
+		return nil, nil
+	}
+	return m.lookupByUserId(userId)
+}
+
+func (m *memoryUserStore) upsert(inc *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u := *inc
+	u.EmailVerified, u.MFAEnabled, u.RecoveryCodesRemaining = false, false, 0
+	m.users[u.ID] = u
+	return nil
+}
+
+func (m *memoryUserStore) writeApprovalCode(userId string, code string, validUntil time.Time) error {
+	code, err := hash(code)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.approvalCodes[userId] = memoryToken{hash: code, userId: userId, validUntil: validUntil}
+	return nil
+}
+
+func (m *memoryUserStore) consumeApprovalCode(code string) (string, error) {
+	code, err := hash(code)
+	if err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for userId, t := range m.approvalCodes {
+		if t.hash != code {
+			continue
+		}
+		if t.expired() {
+			return "", nil
+		}
+		delete(m.approvalCodes, userId)
+		return userId, nil
+	}
+	return "", nil
+}
+
+func (m *memoryUserStore) findUserId(data string) (string, error) {
+	data = strings.TrimSpace(data)
+	if data == "" {
+		return "", errNoCookieData
+	}
+	data, err := hash(data)
+	if err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, sess := range m.sessions {
+		if sess.data != data || !time.Now().Before(sess.validUntil) {
+			continue
+		}
+		if time.Since(sess.LastSeen.Time) > sessionLastSeenInterval {
+			sess.LastSeen = base.NewTime(time.Now())
+			m.lastActive[sess.userId] = sess.LastSeen.Time
+		}
+		return sess.userId, nil
+	}
+	return "", nil
+}
+
+// deleteSessions removes the sessions matching fn and returns how many were removed.
+// m.mu must be held.
+func (m *memoryUserStore) deleteSessions(fn func(sess *memorySession) bool) int {
+	n := 0
+	for id, sess := range m.sessions {
+		if fn(sess) {
+			delete(m.sessions, id)
+			n++
+		}
+	}
+	return n
+}
+
+func (m *memoryUserStore) invalidateCookie(data string) error {
+	data, err := hash(strings.TrimSpace(data))
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.deleteSessions(func(sess *memorySession) bool { return sess.data == data })
+	return nil
+}
+
+func (m *memoryUserStore) invalidateCookies(userId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := m.deleteSessions(func(sess *memorySession) bool { return sess.userId == userId })
+	m.log.Log("user", fmt.Sprintf("deleted %d cookies for userId=%s", n, userId))
+	return nil
+}
+
+func (m *memoryUserStore) invalidateOtherCookies(userId string, data string) error {
+	data, err := hash(strings.TrimSpace(data))
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := m.deleteSessions(func(sess *memorySession) bool { return sess.userId == userId && sess.data != data })
+	m.log.Log("user", fmt.Sprintf("deleted %d other cookies for userId=%s", n, userId))
+	return nil
+}
+
+func (m *memoryUserStore) listSessions(userId string) ([]*session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var sessions []*session
+	for _, sess := range m.sessions {
+		if sess.userId == userId && time.Now().Before(sess.validUntil) {
+			s := sess.session
+			sessions = append(sessions, &s)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeen.After(sessions[j].LastSeen.Time)
+	})
+	return sessions, nil
+}
+
+func (m *memoryUserStore) deleteSession(userId string, sessionId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if sess, exists := m.sessions[sessionId]; !exists || sess.userId != userId {
+		return errSessionNotFound
+	}
+	delete(m.sessions, sessionId)
+	return nil
+}
+
+func (m *memoryUserStore) writeCookie(userId string, cookie *http.Cookie, userAgent, ipAddress string) error {
+	data, err := hash(cookie.Value)
+	if err != nil {
+		return err
+	}
+	now := base.NewTime(time.Now())
+	sess := &memorySession{
+		session: session{
+			ID:        generateID(),
+			UserAgent: userAgent,
+			IPAddress: ipAddress,
+			CreatedAt: now,
+			LastSeen:  now,
+			ExpiresAt: base.NewTime(cookie.Expires),
+			data:      data,
+		},
+		userId:     userId,
+		validUntil: cookie.Expires,
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sessions[sess.ID] = sess
+	m.lastActive[userId] = now.Time
+	return nil
+}
+
+func (m *memoryUserStore) checkPassword(userId string, incoming string) error {
+	m.mu.Lock()
+	stored, exists := m.passwords[userId]
+	m.mu.Unlock()
+
+	if !exists {
+		fakePasswordCheck()
+		return errNoPassword
+	}
+	if err := verifyPassword(stored.password, stored.salt, incoming); err != nil {
+		return err
+	}
+
+	// upgrade old or weak hashes now that we have the password
+	if passwordHashing.needsRehash(stored.password, stored.salt) {
+		hashed, err := passwordHashing.hash(incoming)
+		if err != nil {
+			m.log.Log("user", fmt.Sprintf("problem upgrading password hash for userId=%s: %v", userId, err))
+			return nil
+		}
+		m.mu.Lock()
+		if m.passwords[userId] == stored {
+			m.passwords[userId] = memoryPassword{password: hashed}
+		}
+		m.mu.Unlock()
+	}
+	return nil
+}
+
+func (m *memoryUserStore) writePassword(userId string, pass string) error {
+	hashed, err := passwordHashing.hash(pass)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if previous, exists := m.passwords[userId]; exists {
+		history := append(m.passwordHistory[userId], previous)
+		if len(history) > passwordHistoryMax-1 {
+			history = history[len(history)-(passwordHistoryMax-1):]
+		}
+		m.passwordHistory[userId] = history
+	}
+	m.passwords[userId] = memoryPassword{password: hashed}
+	m.log.Log("user", fmt.Sprintf("userId=%s updated password", userId))
+	return nil
+}
+
+func (m *memoryUserStore) passwordUsedRecently(userId string, pass string, n int) (bool, error) {
+	if n <= 0 {
+		return false, nil
+	}
+
+	m.mu.Lock()
+	var candidates []memoryPassword
+	if current, exists := m.passwords[userId]; exists {
+		candidates = append(candidates, current)
+	}
+	history := m.passwordHistory[userId]
+	for i := len(history) - 1; i >= 0 && len(history)-i < n; i-- {
+		candidates = append(candidates, history[i])
+	}
+	m.mu.Unlock()
+
+	for _, p := range candidates {
+		if verifyPassword(p.password, p.salt, pass) == nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *memoryUserStore) writePasswordResetToken(userId string, token string, validUntil time.Time) error {
+	token, err := hash(token)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.passwordResets[token] = memoryToken{hash: token, userId: userId, validUntil: validUntil}
+	return nil
+}
+
+func (m *memoryUserStore) findPasswordResetToken(token string) (string, error) {
+	token, err := hash(token)
+	if err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, exists := m.passwordResets[token]
+	if !exists || t.expired() {
+		return "", nil
+	}
+	return t.userId, nil
+}
+
+func (m *memoryUserStore) consumePasswordResetToken(token string) (string, error) {
+	token, err := hash(token)
+	if err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, exists := m.passwordResets[token]
+	if !exists || t.expired() {
+		return "", nil
+	}
+
+	// tokens are single use, so drop this one and any others for the user
+	for key, other := range m.passwordResets {
+		if other.userId == t.userId {
+			delete(m.passwordResets, key)
+		}
+	}
+	return t.userId, nil
+}
+
+func (m *memoryUserStore) writeTOTP(userId string, secret string) error {
+	secret, err := sealSecret(m.mfaKey, userId, secret)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.totp[userId] = memoryTOTP{secret: secret}
+	return nil
+}
+
+func (m *memoryUserStore) readTOTP(userId string) (*totpEnrollment, error) {
+	m.mu.Lock()
+	t, exists := m.totp[userId]
+	m.mu.Unlock()
+
+	if !exists {
+		return nil, nil // not enrolled
+	}
+	secret, err := openSecret(m.mfaKey, userId, t.secret)
+	if err != nil {
+		return nil, err
+	}
+	return &totpEnrollment{secret: secret, confirmed: t.confirmed, lastStep: t.lastStep}, nil
+}
+
+func (m *memoryUserStore) confirmTOTP(userId string, step int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if t, exists := m.totp[userId]; exists {
+		t.confirmed, t.lastStep = true, step
+		m.totp[userId] = t
+	}
+	return nil
+}
+
+func (m *memoryUserStore) useTOTPStep(userId string, step int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, exists := m.totp[userId]
+	if !exists || t.lastStep >= step {
+		return false, nil
+	}
+	t.lastStep = step
+	m.totp[userId] = t
+	return true, nil
+}
+
+func (m *memoryUserStore) deleteTOTP(userId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.totp, userId)
+	return nil
+}
+
+func (m *memoryUserStore) writeMFAChallenge(userId string, challenge string, validUntil time.Time) error {
+	challenge, err := hash(challenge)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.mfaChallenges[challenge]; exists {
+		return errors.New("MFA challenge already exists")
+	}
+	m.mfaChallenges[challenge] = &memoryToken{hash: challenge, userId: userId, validUntil: validUntil}
+	return nil
+}
+
+func (m *memoryUserStore) findMFAChallenge(challenge string) (string, error) {
+	challenge, err := hash(challenge)
+	if err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, exists := m.mfaChallenges[challenge]
+	if !exists || t.attempts >= mfaChallengeMaxAttempts || t.expired() {
+		return "", nil
+	}
+	return t.userId, nil
+}
+
+func (m *memoryUserStore) failMFAChallenge(challenge string) error {
+	challenge, err := hash(challenge)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if t, exists := m.mfaChallenges[challenge]; exists {
+		t.attempts++
+	}
+	return nil
+}
+
+func (m *memoryUserStore) deleteMFAChallenge(challenge string) error {
+	challenge, err := hash(challenge)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.mfaChallenges, challenge)
+	return nil
+}
+
+func (m *memoryUserStore) writeRecoveryCodes(userId string, codes []string) error {
+	hashed := make([]string, len(codes))
+	for i := range codes {
+		code, err := hash(codes[i])
+		if err != nil {
+			return fmt.Errorf("problem hashing recovery code userId=%s, err=%v", userId, err)
+		}
+		hashed[i] = code
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(hashed) == 0 {
+		delete(m.recoveryCodes, userId)
+	} else {
+		m.recoveryCodes[userId] = hashed
+	}
+	return nil
+}
+
+func (m *memoryUserStore) useRecoveryCode(userId string, code string) (bool, error) {
+	code, err := hash(code)
+	if err != nil || code == "" {
+		return false, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var remaining []string
+	for _, c := range m.recoveryCodes[userId] {
+		if c != code {
+			remaining = append(remaining, c)
+		}
+	}
+	used := len(remaining) < len(m.recoveryCodes[userId])
+	m.recoveryCodes[userId] = remaining
+	return used, nil
+}
+
+func (m *memoryUserStore) countRecoveryCodes(userId string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.recoveryCodes[userId]), nil
+}
+
+func (m *memoryUserStore) writeWebAuthnChallenge(userId string, challenge string, ceremony string, validUntil time.Time) error {
+	challenge, err := hash(challenge)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.webauthnChalls[challenge]; exists {
+		return errors.New("WebAuthn challenge already exists")
+	}
+	m.webauthnChalls[challenge] = memoryToken{hash: challenge, userId: userId, ceremony: ceremony, validUntil: validUntil}
+	return nil
+}
+
+func (m *memoryUserStore) consumeWebAuthnChallenge(challenge string, ceremony string) (string, bool, error) {
+	challenge, err := hash(challenge)
+	if err != nil {
+		return "", false, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, exists := m.webauthnChalls[challenge]
+	if !exists || t.ceremony != ceremony {
+		return "", false, nil
+	}
+	// challenges are single use
+	delete(m.webauthnChalls, challenge)
+	if t.expired() {
+		return "", false, nil
+	}
+	return t.userId, true, nil
+}
+
+func (m *memoryUserStore) writeWebAuthnCredential(cred *webauthnCredential) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.webauthnCreds[cred.ID]; exists {
+		return fmt.Errorf("WebAuthn credential %s already exists", cred.ID)
+	}
+	c := *cred
+	c.publicKey = append([]byte(nil), cred.publicKey...)
+	c.LastUsed = c.CreatedAt
+	m.webauthnCreds[c.ID] = c
+	return nil
+}
+
+func (m *memoryUserStore) readWebAuthnCredential(credentialId string) (*webauthnCredential, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cred, exists := m.webauthnCreds[credentialId]
+	if !exists {
+		return nil, nil // no credential found
+	}
+	return &cred, nil
+}
+
+func (m *memoryUserStore) listWebAuthnCredentials(userId string) ([]*webauthnCredential, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var credentials []*webauthnCredential
+	for _, cred := range m.webauthnCreds {
+		if cred.userId == userId {
+			c := cred
+			credentials = append(credentials, &c)
+		}
+	}
+	sort.Slice(credentials, func(i, j int) bool {
+		return credentials[i].CreatedAt.Before(credentials[j].CreatedAt.Time)
+	})
+	return credentials, nil
+}
+
+func (m *memoryUserStore) updateWebAuthnCredential(credentialId string, signCount uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if cred, exists := m.webauthnCreds[credentialId]; exists {
+		cred.signCount = signCount
+		cred.LastUsed = base.NewTime(time.Now())
+		m.webauthnCreds[credentialId] = cred
+	}
+	return nil
+}
+
+func (m *memoryUserStore) deleteWebAuthnCredential(userId string, credentialId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if cred, exists := m.webauthnCreds[credentialId]; !exists || cred.userId != userId {
+		return errWebAuthnCredentialNotFound
+	}
+	delete(m.webauthnCreds, credentialId)
+	return nil
+}
+
+func (m *memoryUserStore) readLoginAttempts(key string) (*loginAttempts, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	attempts, exists := m.loginAttempts[key]
+	if !exists {
+		return nil, nil // no failed logins
+	}
+	return &attempts, nil
+}
+
+func (m *memoryUserStore) addLoginFailure(key string, now time.Time, window time.Duration, lockout func(failures int) time.Duration) (*loginAttempts, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	attempts := m.loginAttempts[key]
+	if now.Sub(attempts.lastFailure) > window {
+		attempts.failures = 0
+	}
+	attempts.failures++
+	attempts.lastFailure = now
+	if dur := lockout(attempts.failures); dur > 0 {
+		attempts.lockedUntil = now.Add(dur)
+	}
+	m.loginAttempts[key] = attempts
+	return &attempts, nil
+}
+
+func (m *memoryUserStore) deleteLoginAttempts(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.loginAttempts, key)
+	return nil
+}
+
+func (m *memoryUserStore) listUserActivity() ([]userActivity, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var out []userActivity
+	for userId, u := range m.users {
+		_, unverified := m.approvalCodes[userId]
+		out = append(out, userActivity{
+			userId:       userId,
+			email:        u.Email,
+			createdAt:    u.CreatedAt.Time,
+			lastActiveAt: m.lastActive[userId],
+			verified:     !unverified,
+		})
+	}
+	return out, nil
+}
+
+// deleteUser removes the same data as sqlUserRepository.deleteUser
+func (m *memoryUserStore) deleteUser(userId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.deleteSessions(func(sess *memorySession) bool { return sess.userId == userId })
+	delete(m.totp, userId)
+	delete(m.recoveryCodes, userId)
+	for id, cred := range m.webauthnCreds {
+		if cred.userId == userId {
+			delete(m.webauthnCreds, id)
+		}
+	}
+	for hash, t := range m.webauthnChalls {
+		if t.userId == userId {
+			delete(m.webauthnChalls, hash)
+		}
+	}
+	for hash, t := range m.mfaChallenges {
+		if t.userId == userId {
+			delete(m.mfaChallenges, hash)
+		}
+	}
+	for hash, t := range m.passwordResets {
+		if t.userId == userId {
+			delete(m.passwordResets, hash)
+		}
+	}
+	delete(m.approvalCodes, userId)
+	delete(m.lastActive, userId)
+	delete(m.passwords, userId)
+	delete(m.passwordHistory, userId)
+	delete(m.loginAttempts, userLockoutKey(userId))
+	if u, exists := m.users[userId]; exists {
+		delete(m.loginAttempts, emailLockoutKey(u.Email))
+	}
+	delete(m.users, userId)
+	return nil
+}
+
+func (m *memoryUserStore) vacuum() error {
+	return nil
+}
@@ -0,0 +1,444 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	moovhttp "github.com/moov-io/base/http"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// mfaChallengeTTL is how long a user has after entering their password to present their second factor
+	mfaChallengeTTL = 5 * time.Minute
+
+	// mfaChallengeMaxAttempts is how many wrong codes can be tried against a challenge
+	mfaChallengeMaxAttempts = 5
+)
+
+var (
+	// requireMFAForClients rejects OAuth2 client creation from users who haven't enrolled in MFA
+	requireMFAForClients, _ = strconv.ParseBool(os.Getenv("OAUTH2_CLIENTS_REQUIRE_MFA"))
+
+	errMFANotConfigured    = errors.New("MFA is not configured, set MFA_ENCRYPTION_KEY")
+	errMFAAlreadyEnabled   = errors.New("TOTP is already enabled")
+	errMFANotEnrolled      = errors.New("TOTP enrollment not found")
+	errMFARequired         = errors.New("MFA enrollment is required")
+	errInvalidMFACode      = errors.New("invalid MFA code")
+	errInvalidMFAChallenge = errors.New("invalid or expired MFA challenge")
+)
+
+// totpEnrollment is a user's TOTP secret. It's unconfirmed until the user
+// presents their first code, and only confirmed enrollments are used for login.
+type totpEnrollment struct {
+	secret    string // base32 encoded
+	confirmed bool
+
+	// lastStep is the most recent time step a code was accepted for, codes from
+	// this step or earlier are rejected to prevent replays.
+	lastStep int64
+}
+
+// setupMFAKey reads a hex encoded 256-bit key (MFA_ENCRYPTION_KEY) used to encrypt
+// TOTP secrets at rest. A nil AEAD is returned if no key is set, which disables MFA enrollment.
+//
+// Generate a key with: openssl rand -hex 32
+func setupMFAKey(v string) (cipher.AEAD, error) {
+	if v == "" {
+		return nil, nil
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(v))
+	if err != nil {
+		return nil, fmt.Errorf("invalid MFA_ENCRYPTION_KEY: %v", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("MFA_ENCRYPTION_KEY must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealSecret encrypts plaintext for userId. The userId is authenticated so a secret can't
+// be copied onto another user's row.
+func sealSecret(aead cipher.AEAD, userId string, plaintext string) (string, error) {
+	if aead == nil {
+		return "", errMFANotConfigured
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	out := aead.Seal(nonce, nonce, []byte(plaintext), []byte(userId))
+	return base64.StdEncoding.EncodeToString(out), nil
+}
+
+// openSecret decrypts a value from sealSecret.
+func openSecret(aead cipher.AEAD, userId string, ciphertext string) (string, error) {
+	if aead == nil {
+		return "", errMFANotConfigured
+	}
+	bs, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	if len(bs) < aead.NonceSize() {
+		return "", errors.New("encrypted secret is too short")
+	}
+	plaintext, err := aead.Open(nil, bs[:aead.NonceSize()], bs[aead.NonceSize():], []byte(userId))
+	if err != nil {
+		return "", fmt.Errorf("problem decrypting secret: %v", err)
+	}
+	return string(plaintext), nil
+}
+
+// mfaMethods returns the second factors a user has setup, which is empty if MFA isn't enabled.
+// Recovery codes aren't included as they're only a fallback.
+func mfaMethods(auth authable, userId string) ([]string, error) {
+	var methods []string
+
+	if enabled, err := totpEnabled(auth, userId); err != nil {
+		return nil, err
+	} else if enabled {
+		methods = append(methods, "totp")
+	}
+
+	credentials, err := auth.listWebAuthnCredentials(userId)
+	if err != nil {
+		return nil, err
+	}
+	if len(credentials) > 0 {
+		methods = append(methods, "webauthn")
+	}
+	return methods, nil
+}
+
+// mfaEnabled returns true if the user must present a second factor to login.
+func mfaEnabled(auth authable, userId string) (bool, error) {
+	methods, err := mfaMethods(auth, userId)
+	return len(methods) > 0, err
+}
+
+// populateMFA sets the MFA fields on u, which are stored by authable rather than userRepository.
+func populateMFA(auth authable, u *User) error {
+	if u == nil {
+		return nil
+	}
+	enabled, err := mfaEnabled(auth, u.ID)
+	if err != nil {
+		return err
+	}
+	u.MFAEnabled = enabled
+	if enabled {
+		u.RecoveryCodesRemaining, err = auth.countRecoveryCodes(u.ID)
+	}
+	return err
+}
+
+// totpEnabled returns true if the user has a confirmed TOTP enrollment.
+func totpEnabled(auth authable, userId string) (bool, error) {
+	enrollment, err := auth.readTOTP(userId)
+	if err != nil {
+		return false, err
+	}
+	return enrollment != nil && enrollment.confirmed, nil
+}
+
+// checkTOTP validates code against the user's confirmed enrollment and marks it as used.
+func checkTOTP(auth authable, userId string, code string) error {
+	enrollment, err := auth.readTOTP(userId)
+	if err != nil {
+		return err
+	}
+	if enrollment == nil || !enrollment.confirmed {
+		return errMFANotEnrolled
+	}
+	step, err := validateTOTP(enrollment.secret, strings.TrimSpace(code), time.Now())
+	if err != nil {
+		return err
+	}
+	if step <= enrollment.lastStep {
+		return errInvalidMFACode // wrong code, or one we've already seen
+	}
+	if ok, err := auth.useTOTPStep(userId, step); err != nil || !ok {
+		if err != nil {
+			return err
+		}
+		return errInvalidMFACode
+	}
+	return nil
+}
+
+func addMFARoutes(router *mux.Router, logger log.Logger, auth authable, userService userRepository) {
+	router.Methods("POST").Path("/users/login/mfa").HandlerFunc(loginMFARoute(logger, auth, userService))
+
+	router.Methods("POST").Path("/users/{user_id}/mfa/totp").HandlerFunc(enrollTOTPRoute(logger, auth, userService))
+	router.Methods("POST").Path("/users/{user_id}/mfa/totp/confirm").HandlerFunc(confirmTOTPRoute(logger, auth))
+	router.Methods("DELETE").Path("/users/{user_id}/mfa/totp").HandlerFunc(deleteTOTPRoute(logger, auth))
+}
+
+type mfaChallengeResponse struct {
+	MFARequired bool     `json:"mfaRequired"`
+	Challenge   string   `json:"challenge"`
+	Methods     []string `json:"methods"`
+}
+
+// startMFAChallenge is called once a user with MFA enabled has presented their password.
+// The response contains a challenge which must be sent along with a code to /users/login/mfa,
+// or used to start a WebAuthn assertion.
+func startMFAChallenge(w http.ResponseWriter, auth authable, userId string, methods []string) {
+	challenge := generateID()
+	if challenge == "" {
+		internalError(w, errors.New("unable to generate MFA challenge"))
+		return
+	}
+	if err := auth.writeMFAChallenge(userId, challenge, time.Now().Add(mfaChallengeTTL)); err != nil {
+		internalError(w, fmt.Errorf("problem writing MFA challenge: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(mfaChallengeResponse{MFARequired: true, Challenge: challenge, Methods: methods}); err != nil {
+		internalError(w, err)
+		return
+	}
+}
+
+type loginMFARequest struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+// loginMFARoute completes a login started by loginRoute for users with MFA enabled.
+func loginMFARoute(logger log.Logger, auth authable, userService userRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "loginMFARoute")
+
+		var req loginMFARequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if req.Challenge == "" || req.Code == "" {
+			moovhttp.Problem(w, errors.New("missing challenge or code"))
+			return
+		}
+
+		userId, err := auth.findMFAChallenge(req.Challenge)
+		if err != nil {
+			internalError(w, fmt.Errorf("problem reading MFA challenge: %v", err))
+			return
+		}
+		if userId == "" {
+			authFailures.With("method", "web").Add(1)
+			problem(w, http.StatusForbidden, errInvalidMFAChallenge)
+			return
+		}
+
+		lockoutKey, ipKey := userLockoutKey(userId), ipLockoutKey(r)
+		if rejectLockedLogin(w, auth, lockoutKey, ipKey) {
+			return
+		}
+		if err := checkSecondFactor(logger, auth, userId, req.Code); err != nil {
+			authFailures.With("method", "web").Add(1)
+			if err := recordLoginFailure(logger, auth, lockoutKey, ipKey); err != nil {
+				logger.Log("login", fmt.Sprintf("problem recording failed MFA for userId=%s: %v", userId, err))
+			}
+			logger.Log("login", fmt.Sprintf("userId=%s failed MFA: %v", userId, err))
+			if err := auth.failMFAChallenge(req.Challenge); err != nil {
+				logger.Log("login", fmt.Sprintf("problem recording failed MFA challenge for userId=%s: %v", userId, err))
+			}
+			problem(w, http.StatusForbidden, errInvalidMFACode)
+			return
+		}
+		if err := auth.deleteMFAChallenge(req.Challenge); err != nil {
+			internalError(w, fmt.Errorf("problem deleting MFA challenge: %v", err))
+			return
+		}
+
+		u, err := userService.lookupByUserId(userId)
+		if err != nil || u == nil {
+			internalError(w, fmt.Errorf("problem looking up userId=%s: %v", userId, err))
+			return
+		}
+		completeLogin(w, r, logger, auth, u)
+	}
+}
+
+type totpEnrollmentResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// enrollTOTPRoute generates a new TOTP secret for the user. It's not used for login
+// until confirmed with a code from the user's authenticator.
+func enrollTOTPRoute(logger log.Logger, auth authable, userService userRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "enrollTOTPRoute")
+
+		u, err := getUserFromCookie(auth, userService, r)
+		if err != nil || u == nil || u.ID != mux.Vars(r)["user_id"] {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		enabled, err := totpEnabled(auth, u.ID)
+		if err != nil {
+			internalError(w, fmt.Errorf("problem reading TOTP enrollment: %v", err))
+			return
+		}
+		if enabled {
+			problem(w, http.StatusConflict, errMFAAlreadyEnabled)
+			return
+		}
+
+		secret, err := generateTOTPSecret()
+		if err != nil {
+			internalError(w, fmt.Errorf("problem generating TOTP secret: %v", err))
+			return
+		}
+		if err := auth.writeTOTP(u.ID, secret); err != nil {
+			if err == errMFANotConfigured {
+				moovhttp.Problem(w, err)
+				return
+			}
+			internalError(w, fmt.Errorf("problem writing TOTP secret: %v", err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(totpEnrollmentResponse{Secret: secret, URI: totpURI(secret, u.Email)}); err != nil {
+			internalError(w, err)
+			return
+		}
+	}
+}
+
+type totpCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// confirmTOTPRoute enables a pending TOTP enrollment once the user presents a valid code.
+func confirmTOTPRoute(logger log.Logger, auth authable) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "confirmTOTPRoute")
+
+		userId, err := extractUserId(auth, r)
+		if err != nil || userId != mux.Vars(r)["user_id"] {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		var req totpCodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		enrollment, err := auth.readTOTP(userId)
+		if err != nil {
+			internalError(w, fmt.Errorf("problem reading TOTP enrollment: %v", err))
+			return
+		}
+		if enrollment == nil {
+			problem(w, http.StatusNotFound, errMFANotEnrolled)
+			return
+		}
+		if enrollment.confirmed {
+			problem(w, http.StatusConflict, errMFAAlreadyEnabled)
+			return
+		}
+
+		step, err := validateTOTP(enrollment.secret, strings.TrimSpace(req.Code), time.Now())
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if step == 0 {
+			moovhttp.Problem(w, errInvalidMFACode)
+			return
+		}
+		if err := auth.confirmTOTP(userId, step); err != nil {
+			internalError(w, fmt.Errorf("problem confirming TOTP enrollment: %v", err))
+			return
+		}
+		logger.Log("mfa", fmt.Sprintf("userId=%s enabled TOTP", userId))
+
+		// Recovery codes let the user login if they lose their authenticator
+		issueRecoveryCodes(w, auth, userId)
+	}
+}
+
+// deleteTOTPRoute disables TOTP for the user. A current code (or recovery code) is
+// required so a stolen cookie alone can't remove the second factor.
+func deleteTOTPRoute(logger log.Logger, auth authable) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "deleteTOTPRoute")
+
+		userId, err := extractUserId(auth, r)
+		if err != nil || userId != mux.Vars(r)["user_id"] {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		var req totpCodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if enabled, err := totpEnabled(auth, userId); err != nil || !enabled {
+			if err != nil {
+				internalError(w, fmt.Errorf("problem reading TOTP enrollment: %v", err))
+				return
+			}
+			problem(w, http.StatusNotFound, errMFANotEnrolled)
+			return
+		}
+		lockoutKey, ipKey := userLockoutKey(userId), ipLockoutKey(r)
+		if rejectLockedLogin(w, auth, lockoutKey, ipKey) {
+			return
+		}
+		if err := checkSecondFactor(logger, auth, userId, req.Code); err != nil {
+			authFailures.With("method", "web").Add(1)
+			if err := recordLoginFailure(logger, auth, lockoutKey, ipKey); err != nil {
+				logger.Log("login", fmt.Sprintf("problem recording failed MFA for userId=%s: %v", userId, err))
+			}
+			logger.Log("mfa", fmt.Sprintf("userId=%s failed to disable TOTP: %v", userId, err))
+			problem(w, http.StatusForbidden, errInvalidMFACode)
+			return
+		}
+		if err := auth.deleteTOTP(userId); err != nil {
+			internalError(w, fmt.Errorf("problem deleting TOTP enrollment: %v", err))
+			return
+		}
+		if err := removeUnusedRecoveryCodes(auth, userId); err != nil {
+			internalError(w, fmt.Errorf("problem deleting recovery codes: %v", err))
+			return
+		}
+		logger.Log("mfa", fmt.Sprintf("userId=%s disabled TOTP", userId))
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/cipher"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moov-io/base"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+var (
+	testMFAKey = func() cipher.AEAD {
+		aead, err := setupMFAKey(strings.Repeat("ab", 32))
+		if err != nil {
+			panic(err)
+		}
+		return aead
+	}()
+)
+
+// currentTOTPCode returns a valid code for secret, offset by some number of time steps
+func currentTOTPCode(t *testing.T, secret string, offset int64) string {
+	t.Helper()
+
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return totpCode(key, totpStep(time.Now())+offset)
+}
+
+func TestMFA__setupMFAKey(t *testing.T) {
+	if aead, err := setupMFAKey(""); aead != nil || err != nil {
+		t.Errorf("aead=%v err=%v", aead, err)
+	}
+	if _, err := setupMFAKey("zz"); err == nil {
+		t.Error("expected error")
+	}
+	if _, err := setupMFAKey(strings.Repeat("ab", 16)); err == nil {
+		t.Error("expected error for short key")
+	}
+}
+
+func TestMFA__secrets(t *testing.T) {
+	sealed, err := sealSecret(testMFAKey, "user1", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(sealed, "secret") {
+		t.Errorf("secret not encrypted: %s", sealed)
+	}
+	if v, err := openSecret(testMFAKey, "user1", sealed); err != nil || v != "secret" {
+		t.Errorf("v=%q err=%v", v, err)
+	}
+	// secrets are bound to their user
+	if _, err := openSecret(testMFAKey, "user2", sealed); err == nil {
+		t.Error("expected error")
+	}
+	if _, err := sealSecret(nil, "user1", "secret"); err != errMFANotConfigured {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestMFA__challenges(t *testing.T) {
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	userId := generateID()
+
+	expired := generateID()
+	if err := auth.writeMFAChallenge(userId, expired, time.Now().Add(-1*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := auth.findMFAChallenge(expired); err != nil || id != "" {
+		t.Errorf("id=%q err=%v", id, err)
+	}
+
+	challenge := generateID()
+	if err := auth.writeMFAChallenge(userId, challenge, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < mfaChallengeMaxAttempts; i++ {
+		if id, err := auth.findMFAChallenge(challenge); err != nil || id != userId {
+			t.Fatalf("attempt #%d: id=%q err=%v", i, id, err)
+		}
+		if err := auth.failMFAChallenge(challenge); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// too many attempts
+	if id, err := auth.findMFAChallenge(challenge); err != nil || id != "" {
+		t.Errorf("id=%q err=%v", id, err)
+	}
+}
+
+func TestMFA__loginWithTOTP(t *testing.T) {
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+
+	u := &User{
+		ID:        generateID(),
+		Email:     "test@moov.io",
+		CreatedAt: base.NewTime(time.Now()),
+	}
+	if err := repo.upsert(u); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.writePassword(u.ID, "superlongpassword"); err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := createCookie(u.ID, auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	addLoginRoutes(router, log.NewNopLogger(), auth, repo)
+	addMFARoutes(router, log.NewNopLogger(), auth, repo)
+
+	call := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+		router.ServeHTTP(w, r)
+		w.Flush()
+		return w
+	}
+	login := func() *httptest.ResponseRecorder {
+		return call("POST", "/users/login", `{"email": "test@moov.io", "password": "superlongpassword"}`)
+	}
+
+	// enroll
+	w := call("POST", fmt.Sprintf("/users/%s/mfa/totp", u.ID), "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	var enrollment totpEnrollmentResponse
+	if err := json.NewDecoder(w.Body).Decode(&enrollment); err != nil {
+		t.Fatal(err)
+	}
+	if enrollment.Secret == "" || !strings.Contains(enrollment.URI, enrollment.Secret) {
+		t.Fatalf("unexpected enrollment: %#v", enrollment)
+	}
+
+	// not used for login until confirmed
+	if w := login(); w.Code != http.StatusOK {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	confirm := fmt.Sprintf("/users/%s/mfa/totp/confirm", u.ID)
+	if w := call("POST", confirm, `{"code": "000000"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	code := currentTOTPCode(t, enrollment.Secret, -1)
+	if w := call("POST", confirm, fmt.Sprintf(`{"code": %q}`, code)); w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	// can't enroll twice
+	if w := call("POST", fmt.Sprintf("/users/%s/mfa/totp", u.ID), ""); w.Code != http.StatusConflict {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	// login now requires a second step
+	w = login()
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if v := w.Header().Get("Set-Cookie"); v != "" {
+		t.Errorf("unexpected cookie: %s", v)
+	}
+	var challenge mfaChallengeResponse
+	if err := json.NewDecoder(w.Body).Decode(&challenge); err != nil {
+		t.Fatal(err)
+	}
+	if !challenge.MFARequired || challenge.Challenge == "" {
+		t.Fatalf("unexpected challenge: %#v", challenge)
+	}
+
+	loginMFA := func(code string) *httptest.ResponseRecorder {
+		return call("POST", "/users/login/mfa", fmt.Sprintf(`{"challenge": %q, "code": %q}`, challenge.Challenge, code))
+	}
+	if w := loginMFA("000000"); w.Code != http.StatusForbidden {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	// the code used to confirm enrollment can't be replayed
+	if w := loginMFA(code); w.Code != http.StatusForbidden {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	w = loginMFA(currentTOTPCode(t, enrollment.Secret, 0))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Header().Get("Set-Cookie"), "moov_auth=") {
+		t.Errorf("expected cookie, got %q", w.Header().Get("Set-Cookie"))
+	}
+	var user User
+	if err := json.NewDecoder(w.Body).Decode(&user); err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != u.ID || !user.MFAEnabled {
+		t.Errorf("unexpected user: %#v", user)
+	}
+	// challenges are single use
+	if w := loginMFA(currentTOTPCode(t, enrollment.Secret, 1)); w.Code != http.StatusForbidden {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	// disable TOTP
+	totp := fmt.Sprintf("/users/%s/mfa/totp", u.ID)
+	if w := call("DELETE", totp, `{"code": "000000"}`); w.Code != http.StatusForbidden {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	if w := call("DELETE", totp, fmt.Sprintf(`{"code": %q}`, currentTOTPCode(t, enrollment.Secret, 1))); w.Code != http.StatusOK {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	if w := login(); w.Code != http.StatusOK {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestMFA__otherUser(t *testing.T) {
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+
+	cookie, err := createCookie(generateID(), auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	addMFARoutes(router, log.NewNopLogger(), auth, repo)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", fmt.Sprintf("/users/%s/mfa/totp", generateID()), nil)
+	r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+	router.ServeHTTP(w, r)
+	w.Flush()
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/moov-io/auth/pkg/oauthdb"
+	"github.com/moov-io/auth/pkg/schema"
+)
+
+const migrateUsage = `usage: auth migrate <command> [flags]
+
+  status                        show the applied and pending migrations of each schema
+  up [-schema name]             apply pending migrations
+  down -schema name [-steps n]  roll back the last n migrations of a schema
+       [-force]                 also roll back the migration creating the schema's tables,
+                                and past migrations which can't be reverted
+
+Databases are read from DATABASE_DSN, OAUTH2_CLIENTS_DSN and OAUTH2_TOKENS_DSN.`
+
+// migrateCommand runs 'auth migrate' against the databases auth is configured with.
+func migrateCommand(args []string, out io.Writer) error {
+	migrators, err := openMigrators(os.Getenv("DATABASE_DSN"), os.Getenv("OAUTH2_CLIENTS_DSN"), os.Getenv("OAUTH2_TOKENS_DSN"))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for i := range migrators {
+			migrators[i].DB.Close()
+		}
+	}()
+	return runMigrateCommand(args, migrators, out)
+}
+
+// openMigrators returns a schema.Migrator for each database. An in-memory user store
+// has nothing to migrate and is skipped.
+func openMigrators(usersDSN, clientsDSN, tokensDSN string) ([]*schema.Migrator, error) {
+	var migrators []*schema.Migrator
+	closeAll := func() {
+		for i := range migrators {
+			migrators[i].DB.Close()
+		}
+	}
+
+	if usersDSN != "memory:" {
+		db, err := openDatabase(usersDSN)
+		if err != nil {
+			return nil, fmt.Errorf("database connection error: %v", err)
+		}
+		migrators = append(migrators, newUserMigrator(db, logger))
+	}
+
+	if clientsDSN == "" {
+		clientsDSN = defaultOAuth2ClientsDSN
+	}
+	m, err := oauthdb.NewClientStoreMigrator(clientsDSN)
+	if err != nil {
+		closeAll()
+		return nil, fmt.Errorf("oauth2 clients connection error: %v", err)
+	}
+	migrators = append(migrators, m)
+
+	if tokensDSN == "" {
+		tokensDSN = defaultOAuth2TokensDSN
+	}
+	m, err = oauthdb.NewTokenStoreMigrator(tokensDSN)
+	if err != nil {
+		closeAll()
+		return nil, fmt.Errorf("oauth2 tokens connection error: %v", err)
+	}
+	migrators = append(migrators, m)
+
+	return migrators, nil
+}
+
+func runMigrateCommand(args []string, migrators []*schema.Migrator, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	fs := flag.NewFlagSet("migrate "+args[0], flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	schemaName := fs.String("schema", "", "Schema to migrate (auth, oauth2_clients or oauth2_tokens)")
+	steps := fs.Int("steps", 1, "Number of migrations to roll back")
+	force := fs.Bool("force", false, "Roll back the baseline migration, dropping every table, and past irreversible migrations")
+	if err := fs.Parse(args[1:]); err != nil {
+		return fmt.Errorf("%v\n\n%s", err, migrateUsage)
+	}
+
+	if *schemaName != "" {
+		var found []*schema.Migrator
+		for i := range migrators {
+			if migrators[i].Schema == *schemaName {
+				found = append(found, migrators[i])
+			}
+		}
+		if len(found) == 0 {
+			return fmt.Errorf("unknown schema %q", *schemaName)
+		}
+		migrators = found
+	}
+
+	switch args[0] {
+	case "status":
+		// handled below
+	case "up":
+		for i := range migrators {
+			if err := migrators[i].Up(); err != nil {
+				return err
+			}
+		}
+	case "down":
+		if *schemaName == "" {
+			return errors.New("migrate down requires -schema")
+		}
+		if *steps < 1 {
+			return fmt.Errorf("invalid -steps %d", *steps)
+		}
+		for i := range migrators {
+			migrators[i].ForceDown = *force
+			if err := migrators[i].Down(*steps); err != nil {
+				if errors.Is(err, schema.ErrBaselineMigration) || errors.Is(err, schema.ErrIrreversible) {
+					return fmt.Errorf("%v (use -force to roll back anyway)", err)
+				}
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unknown command %q\n\n%s", args[0], migrateUsage)
+	}
+	return printMigrationStatus(migrators, out)
+}
+
+func printMigrationStatus(migrators []*schema.Migrator, out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SCHEMA\tVERSION\tLATEST\tSTATUS")
+	for i := range migrators {
+		status, err := migrators[i].Status()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", status.Schema, status.Current, status.Latest, describeStatus(status))
+	}
+	return w.Flush()
+}
+
+func describeStatus(status *schema.Status) string {
+	if status.Current > status.Latest {
+		return "newer than this binary"
+	}
+	if len(status.Pending) == 0 {
+		return "up to date"
+	}
+	var pending []string
+	for i := range status.Pending {
+		pending = append(pending, fmt.Sprintf("%d (%s)", status.Pending[i].Version, status.Pending[i].Name))
+	}
+	return "pending: " + strings.Join(pending, ", ")
+}
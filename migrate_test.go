@@ -0,0 +1,143 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/moov-io/auth/pkg/schema"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestMigrate__command(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	migrators, err := openMigrators("file:"+filepath.Join(dir, "auth.db"), "file:"+filepath.Join(dir, "clients.db"), "file:"+filepath.Join(dir, "tokens.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for i := range migrators {
+			migrators[i].DB.Close()
+		}
+	}()
+	if len(migrators) != 3 {
+		t.Fatalf("got %d migrators", len(migrators))
+	}
+
+	var buf bytes.Buffer
+	if err := runMigrateCommand([]string{"status"}, migrators, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "pending: 1 (initial schema), 2 (password resets)") {
+		t.Errorf("unexpected status:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	if err := runMigrateCommand([]string{"up"}, migrators, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "pending") || strings.Count(buf.String(), "up to date") != 3 {
+		t.Errorf("unexpected status:\n%s", buf.String())
+	}
+
+	// the token cleanup migration can't be reverted, and the baseline drops every table
+	for _, steps := range []string{"2", "3"} {
+		err := runMigrateCommand([]string{"down", "-schema", "oauth2_tokens", "-steps", steps}, migrators, &buf)
+		if err == nil || !strings.Contains(err.Error(), "-force") {
+			t.Errorf("down %s steps: expected error, got %v", steps, err)
+		}
+	}
+
+	buf.Reset()
+	if err := runMigrateCommand([]string{"down", "-schema", "oauth2_tokens", "-steps", "2", "-force"}, migrators, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "oauth2_tokens  1") {
+		t.Errorf("unexpected status:\n%s", buf.String())
+	}
+	if status, _ := migrators[0].Status(); status.Current != status.Latest {
+		t.Errorf("auth schema shouldn't be rolled back: %#v", status)
+	}
+
+	// bad invocations
+	for _, args := range [][]string{
+		nil,
+		{"sideways"},
+		{"down"},
+		{"down", "-schema", "auth", "-steps", "0"},
+		{"up", "-schema", "other"},
+		{"up", "-bogus"},
+	} {
+		if err := runMigrateCommand(args, migrators, &buf); err == nil {
+			t.Errorf("%v: expected error", args)
+		}
+	}
+}
+
+func TestMigrate__memory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	migrators, err := openMigrators("memory:", "file:"+filepath.Join(dir, "clients.db"), "file:"+filepath.Join(dir, "tokens.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range migrators {
+		migrators[i].DB.Close()
+	}
+	if len(migrators) != 2 {
+		t.Errorf("expected the in-memory user store to be skipped, got %d migrators", len(migrators))
+	}
+}
+
+func TestMigrate__tooNew(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dsn := "file:" + filepath.Join(dir, "auth.db")
+	db, err := openDatabase(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// a newer binary has applied a migration we don't know about
+	m := newUserMigrator(db, nil)
+	m.Migrations = append(append([]schema.Migration{}, migrations...), schema.Migration{
+		Version: len(migrations) + 1,
+		Name:    "from the future",
+		Up:      map[string][]string{"": {`create table future(id);`}},
+	})
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := setupUserStore(dsn, log.NewNopLogger(), nil)
+	if err == nil {
+		store.close()
+		t.Fatal("expected error")
+	}
+	if !errors.Is(err, schema.ErrSchemaTooNew) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
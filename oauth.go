@@ -8,7 +8,9 @@ import (
 	"encoding/json"
 	stderr "errors"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -25,33 +27,50 @@ import (
 )
 
 var (
-	errNoClientId = stderr.New("missing client_id")
+	errNoClientId           = stderr.New("missing client_id")
+	errClientNotFound       = stderr.New("OAuth2 client not found")
+	errClientNameTooLong    = fmt.Errorf("client name can't be longer than %d characters", maxClientNameLength)
+	errPublicClientNoSecret = stderr.New("public clients don't have a secret")
 )
 
+const maxClientNameLength = 100
+
 type oauth struct {
 	manager     *manage.Manager
 	clientStore *oauthdb.ClientStore
-	tokenStore  oauth2.TokenStore
+	tokenStore  *oauthdb.TokenStore
 	server      *server.Server
 
+	// scopeRules map requests checked by /auth/check to the scope they require
+	scopeRules []scopeRule
+
+	// jwtKeys sign access tokens when set, otherwise tokens are opaque
+	jwtKeys *jwtKeySet
+	issuer  string
+
 	logger log.Logger
 }
 
-func setupOAuthTokenStore(connStr string) (oauth2.TokenStore, error) {
+const (
+	defaultOAuth2TokensDSN  = "file:oauth2_tokens.db"
+	defaultOAuth2ClientsDSN = "file:oauth2_clients.db"
+)
+
+func setupOAuthTokenStore(connStr string) (*oauthdb.TokenStore, error) {
 	if connStr == "" {
-		connStr = "file:oauth2_tokens.db"
+		connStr = defaultOAuth2TokensDSN
 	}
 	return oauthdb.NewTokenStoreDB(connStr)
 }
 
 func setupOAuthClientStore(connStr string) (*oauthdb.ClientStore, error) {
 	if connStr == "" {
-		connStr = "file:oauth2_clients.db"
+		connStr = defaultOAuth2ClientsDSN
 	}
 	return oauthdb.NewClientStoreDB(connStr)
 }
 
-func setupOAuthServer(logger log.Logger, clientStore *oauthdb.ClientStore, tokenStore oauth2.TokenStore) (*oauth, error) {
+func setupOAuthServer(logger log.Logger, clientStore *oauthdb.ClientStore, tokenStore *oauthdb.TokenStore) (*oauth, error) {
 	out := &oauth{
 		logger: logger,
 	}
@@ -71,13 +90,30 @@ func setupOAuthServer(logger log.Logger, clientStore *oauthdb.ClientStore, token
 	out.manager.SetAuthorizeCodeTokenCfg(cfg)
 	out.manager.SetClientTokenCfg(cfg)
 
+	// Refresh tokens are rotated, so each one can only be used once. See useRefreshToken
+	// for how reuse is detected.
+	out.manager.SetRefreshTokenCfg(&manage.RefreshingConfig{
+		IsGenerateRefresh:  true,
+		IsRemoveAccess:     true,
+		IsRemoveRefreshing: true,
+	})
+
 	// Setup oauth2 clients database
 	out.clientStore = clientStore
 	out.manager.MapClientStorage(out.clientStore)
 
 	out.server = server.NewDefaultServer(out.manager)
 	out.server.SetAllowGetAccessRequest(true)
-	out.server.SetClientInfoHandler(server.ClientFormHandler)
+	out.server.SetClientInfoHandler(out.clientInfoHandler)
+	out.server.SetClientAuthorizedHandler(out.clientAuthorizedHandler)
+	out.server.SetClientScopeHandler(out.clientScopeHandler)
+	out.server.SetRefreshingScopeHandler(refreshingScopeHandler)
+
+	// redirect_uri values are matched exactly against each client's registered
+	// values in readAuthorizeRequest rather than by the client's domain
+	out.manager.SetValidateURIHandler(func(baseURI, redirectURI string) error {
+		return nil
+	})
 	out.server.SetInternalErrorHandler(func(err error) (re *errors.Response) {
 		logger.Log("internal-error", err.Error())
 		return
@@ -94,17 +130,28 @@ func setupOAuthServer(logger log.Logger, clientStore *oauthdb.ClientStore, token
 }
 
 // addOAuthRoutes includes our oauth2 routes on the provided mux.Router
-func addOAuthRoutes(r *mux.Router, o *oauth, logger log.Logger, auth authable) {
+func addOAuthRoutes(r *mux.Router, o *oauth, logger log.Logger, auth authable, repo userRepository) {
+	r.Methods("GET").Path("/oauth2/authorize").Queries("response_type", "{response_type}").HandlerFunc(o.authorizeRequestHandler(auth, repo))
 	r.Methods("GET").Path("/oauth2/authorize").HandlerFunc(o.authorizeHandler)
+	r.Methods("POST").Path("/oauth2/authorize").HandlerFunc(o.authorizeDecisionHandler(auth, repo))
 	r.Methods("GET").Path("/oauth2/clients").HandlerFunc(o.getClientsForUserId(auth))
-	r.Methods("POST").Path("/oauth2/client").HandlerFunc(o.createClientHandler(auth))
+	r.Methods("POST").Path("/oauth2/client").HandlerFunc(o.createClientHandler(auth, repo))
+	r.Methods("DELETE").Path("/oauth2/clients/{client_id}").HandlerFunc(o.deleteClientHandler(auth))
+	r.Methods("POST").Path("/oauth2/clients/{client_id}/secret").HandlerFunc(o.rotateClientSecretHandler(auth))
 
 	// Check token routes
 	if o.server.Config.AllowGetAccessRequest {
 		// only open up GET if the server config asks for it
-		r.Methods("GET").Path("/oauth2/token").HandlerFunc(o.tokenHandler(auth))
+		r.Methods("GET").Path("/oauth2/token").HandlerFunc(o.tokenHandler(auth, repo))
 	}
-	r.Methods("POST").Path("/oauth2/token").HandlerFunc(o.tokenHandler(auth))
+	r.Methods("POST").Path("/oauth2/token").HandlerFunc(o.tokenHandler(auth, repo))
+	r.Methods("POST").Path("/oauth2/revoke").HandlerFunc(o.revokeHandler)
+	r.Methods("POST").Path("/oauth2/introspect").HandlerFunc(o.introspectHandler)
+	r.Methods("GET").Path("/.well-known/jwks.json").HandlerFunc(o.jwksHandler)
+
+	// OpenID Connect
+	r.Methods("GET").Path("/.well-known/openid-configuration").HandlerFunc(o.openIDConfigurationHandler)
+	r.Methods("GET", "POST").Path("/userinfo").HandlerFunc(o.userInfoHandler(repo))
 }
 
 // requestHasValidOAuthToken hooks into the go-oauth2 methods to validate
@@ -125,7 +172,8 @@ func (o *oauth) requestHasValidOAuthToken(r *http.Request) (oauth2.TokenInfo, er
 }
 
 // authorizeHandler checks the request for appropriate oauth information
-// and returns "200 OK" if the token is valid.
+// and returns "200 OK" if the token is valid. Requests with a response_type
+// start the authorization code flow in authorizeRequestHandler instead.
 func (o *oauth) authorizeHandler(w http.ResponseWriter, r *http.Request) {
 	w = wrapResponseWriter(w, r, "oauth.authorizeHandler")
 
@@ -143,17 +191,12 @@ func (o *oauth) authorizeHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // tokenHandler passes off the request down to our oauth2 library to
-// generate a token (or return an error).
-func (o *oauth) tokenHandler(auth authable) http.HandlerFunc {
+// generate a token (or return an error). Tokens with the "openid" scope
+// come with an ID token when we're an OpenID Connect provider.
+func (o *oauth) tokenHandler(auth authable, repo userRepository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w = wrapResponseWriter(w, r, "oauth.tokenHandler")
 
-		userId, err := extractUserId(auth, r)
-		if err != nil {
-			moovhttp.Problem(w, err)
-			return
-		}
-
 		// This block is copied from o.server.HandleTokenRequest
 		// We needed to inspect what's going on a bit.
 		gt, tgr, verr := o.server.ValidationTokenRequest(r)
@@ -161,12 +204,88 @@ func (o *oauth) tokenHandler(auth authable) http.HandlerFunc {
 			moovhttp.Problem(w, verr)
 			return
 		}
+
+		// Authorization codes and refresh tokens were issued for a user already,
+		// otherwise tokens are for the user logged in.
+		var userId, nonce, family string
+		var err error
+		switch gt {
+		case oauth2.AuthorizationCode:
+			if nonce, err = o.verifyCodeRequest(tgr.ClientID, tgr.Code, r.FormValue("code_verifier")); err != nil {
+				if err == errors.ErrInvalidGrant {
+					moovhttp.Problem(w, err)
+				} else {
+					internalError(w, fmt.Errorf("problem reading authorization code request: %v", err))
+				}
+				return
+			}
+
+		case oauth2.Refreshing:
+			// the oauth2 server only checks a narrower scope against the refreshed token's
+			if tgr.Scope != "" {
+				allowed, err := o.clientScopeHandler(tgr.ClientID, tgr.Scope)
+				if err != nil {
+					internalError(w, fmt.Errorf("problem reading scope for client %s: %v", tgr.ClientID, err))
+					return
+				}
+				if !allowed {
+					moovhttp.Problem(w, errors.ErrInvalidScope)
+					return
+				}
+			}
+			if family, err = o.useRefreshToken(tgr); err != nil {
+				if err == errors.ErrInvalidGrant || err == errors.ErrInvalidClient {
+					moovhttp.Problem(w, err)
+				} else {
+					internalError(w, fmt.Errorf("problem reading refresh token: %v", err))
+				}
+				return
+			}
+
+		default:
+			userId, err = extractUserId(auth, r)
+			if err != nil {
+				moovhttp.Problem(w, err)
+				return
+			}
+			// set the user before generating tokens so it's included in signed access tokens
+			tgr.UserID = userId
+
+			// tokens get every scope their client is allowed unless they ask for fewer
+			if tgr.Scope == "" {
+				if tgr.Scope, err = o.clientStore.GetScope(tgr.ClientID); err != nil {
+					internalError(w, fmt.Errorf("problem reading scope for client %s: %v", tgr.ClientID, err))
+					return
+				}
+			}
+		}
 		ti, verr := o.server.GetAccessToken(gt, tgr)
 		if verr != nil {
+			if gt == oauth2.Refreshing {
+				// the refresh token wasn't rotated, so it can be tried again
+				if err := o.tokenStore.ReleaseRefreshToken(tgr.Refresh); err != nil {
+					o.logger.Log("oauth", fmt.Sprintf("problem releasing refresh token for client %s: %v", tgr.ClientID, err))
+				}
+			}
 			moovhttp.Problem(w, verr)
 			return
 		}
+		if ti.GetRefresh() != "" {
+			if err := o.saveRefreshToken(ti, family); err != nil {
+				internalError(w, fmt.Errorf("problem saving refresh token for client %s: %v", tgr.ClientID, err))
+				return
+			}
+		}
+		if userId == "" {
+			userId = ti.GetUserID()
+		}
 		data := o.server.GetTokenData(ti)
+		if o.oidcEnabled() && scopeIncludes(ti.GetScope(), "openid") {
+			if data["id_token"], err = o.idToken(repo, ti, nonce); err != nil {
+				internalError(w, err)
+				return
+			}
+		}
 		bs, err := json.Marshal(data)
 		if err != nil {
 			moovhttp.Problem(w, err)
@@ -198,64 +317,94 @@ func (o *oauth) tokenHandler(auth authable) http.HandlerFunc {
 }
 
 // createClientHandler will create an oauth client for the authenticated user.
+// Users can have many clients, each created with its own name, scope and redirect URIs.
 //
 // This method extracts the user from the cookies in r.
-func (o *oauth) createClientHandler(auth authable) http.HandlerFunc {
+func (o *oauth) createClientHandler(auth authable, repo userRepository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w = wrapResponseWriter(w, r, "oauth.createTokenHandler")
 
-		userId, err := auth.findUserId(extractCookie(r).Value)
-		if err != nil {
+		user, err := getUserFromCookie(auth, repo, r)
+		if err != nil || user == nil {
 			// user not found, return
 			w.WriteHeader(http.StatusForbidden)
 			return
 		}
-
-		// TODO(adam): don't create tokens if user hasn't gone through email verification
-
-		records, err := o.clientStore.GetByUserID(userId)
-		if err != nil && !strings.Contains(err.Error(), "not found") {
-			internalError(w, err)
+		if !user.EmailVerified {
+			problem(w, http.StatusForbidden, errEmailNotVerified)
 			return
 		}
-		if len(records) == 0 { // nothing found, so fake one
-			records = append(records, &models.Client{})
+		if requireMFAForClients {
+			if enabled, err := mfaEnabled(auth, user.ID); err != nil || !enabled {
+				if err != nil {
+					internalError(w, fmt.Errorf("problem reading MFA status for userId=%s: %v", user.ID, err))
+					return
+				}
+				problem(w, http.StatusForbidden, errMFARequired)
+				return
+			}
 		}
+		userId := user.ID
 
-		clients := make([]*models.Client, len(records))
-		for i := range records {
-			err = o.clientStore.DeleteByID(records[i].GetID())
-			if err != nil && !strings.Contains(err.Error(), "not found") {
-				internalError(w, err)
+		// clients can be limited to a set of scopes, otherwise they're unrestricted
+		var req createClientRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			moovhttp.Problem(w, err)
+			return
+		}
+		if err := validateScope(req.Scope); err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+		scope := normalizeScope(req.Scope)
+		name := strings.TrimSpace(req.Name)
+		if len(name) > maxClientNameLength {
+			moovhttp.Problem(w, errClientNameTooLong)
+			return
+		}
+		for i := range req.RedirectURIs {
+			if err := validateRedirectURI(req.RedirectURIs[i]); err != nil {
+				moovhttp.Problem(w, err)
 				return
 			}
+		}
+		if req.Public && len(req.RedirectURIs) == 0 {
+			moovhttp.Problem(w, errPublicClientNeedsRedirect)
+			return
+		}
 
-			clients[i] = &models.Client{
-				ID:     generateID()[:12],
-				Secret: generateID(),
-				Domain: Domain,
-				UserID: userId,
-			}
+		c := &models.Client{
+			ID:     generateID()[:12],
+			Secret: generateID(),
+			Domain: Domain,
+			UserID: userId,
+		}
+		if req.Public {
+			c.Secret = ""
+		}
 
-			// Write client into oauth clients db.
-			if err := o.clientStore.Set(clients[i].GetID(), clients[i]); err != nil {
-				internalError(w, err)
-				return
-			}
+		// Write client into oauth clients db.
+		if err := o.clientStore.Create(c, name, scope, req.RedirectURIs); err != nil {
+			internalError(w, err)
+			return
 		}
 
 		// metrics
 		clientGenerations.Add(1)
+		o.logger.Log("oauth", fmt.Sprintf("userId=%s created client %s", userId, c.GetID()))
 
-		// render back new clients
+		// render back the new client
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		var responseClients []*client
-		for i := range clients {
-			responseClients = append(responseClients, &client{
-				ClientID:     clients[i].ID,
-				ClientSecret: clients[i].Secret,
-				Domain:       clients[i].Domain,
-			})
+		responseClients := []*client{
+			{
+				ClientID:     c.ID,
+				ClientSecret: c.Secret,
+				Domain:       c.Domain,
+				Name:         name,
+				Scope:        scope,
+				RedirectURIs: req.RedirectURIs,
+				Public:       req.Public,
+			},
 		}
 		if err := json.NewEncoder(w).Encode(responseClients); err != nil {
 			internalError(w, err)
@@ -264,10 +413,47 @@ func (o *oauth) createClientHandler(auth authable) http.HandlerFunc {
 	}
 }
 
+type createClientRequest struct {
+	// Name describes where the client is used, e.g. "prod billing"
+	Name string `json:"name"`
+
+	// Scope is a space delimited list of scopes the client can request, empty for any
+	Scope string `json:"scope"`
+
+	// RedirectURIs are where users can be sent back to with an authorization code
+	RedirectURIs []string `json:"redirect_uris"`
+
+	// Public clients, like single page and native apps, have no secret and must use PKCE
+	Public bool `json:"public"`
+}
+
+// client is an OAuth2 client as rendered to its user. The plaintext secret is only
+// included when a client is created or its secret is rotated, after that it's masked.
 type client struct {
-	ClientID     string `json:"client_id"`
-	ClientSecret string `json:"client_secret"`
-	Domain       string `json:"domain"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Domain       string   `json:"domain"`
+	Name         string   `json:"name,omitempty"`
+	Scope        string   `json:"scope,omitempty"`
+	RedirectURIs []string `json:"redirect_uris,omitempty"`
+	Public       bool     `json:"public,omitempty"`
+}
+
+// maskSecret returns the hint of a stored client secret, e.g. "****3f9a"
+func maskSecret(stored string) string {
+	if stored == "" {
+		return ""
+	}
+	return "****" + oauthdb.SecretHint(stored)
+}
+
+// revokeUserTokens removes every OAuth2 token issued for userId
+func (o *oauth) revokeUserTokens(userId string) error {
+	if err := o.tokenStore.RemoveByUserID(userId); err != nil {
+		return err
+	}
+	o.logger.Log("oauth", fmt.Sprintf("revoked OAuth2 tokens for userId=%s", userId))
+	return nil
 }
 
 func (o *oauth) shutdown() error {
@@ -297,10 +483,29 @@ func (o *oauth) getClientsForUserId(auth authable) http.HandlerFunc {
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		var responseClients []*client
 		for i := range clients {
+			scope, err := o.clientStore.GetScope(clients[i].GetID())
+			if err != nil {
+				internalError(w, err)
+				return
+			}
+			uris, err := o.clientStore.GetRedirectURIs(clients[i].GetID())
+			if err != nil {
+				internalError(w, err)
+				return
+			}
+			name, err := o.clientStore.GetName(clients[i].GetID())
+			if err != nil {
+				internalError(w, err)
+				return
+			}
 			responseClients = append(responseClients, &client{
 				ClientID:     clients[i].GetID(),
-				ClientSecret: clients[i].GetSecret(),
+				ClientSecret: maskSecret(clients[i].GetSecret()),
 				Domain:       clients[i].GetDomain(),
+				Name:         name,
+				Scope:        scope,
+				RedirectURIs: uris,
+				Public:       isPublicClient(clients[i]),
 			})
 		}
 		w.WriteHeader(http.StatusOK)
@@ -310,3 +515,131 @@ func (o *oauth) getClientsForUserId(auth authable) http.HandlerFunc {
 		}
 	}
 }
+
+// getUserClient returns the client matching the client_id route variable if it belongs to userId
+func (o *oauth) getUserClient(r *http.Request, userId string) (oauth2.ClientInfo, error) {
+	client, err := o.clientStore.GetByID(mux.Vars(r)["client_id"])
+	if err != nil {
+		return nil, err
+	}
+	if client == nil || client.GetUserID() != userId {
+		return nil, errClientNotFound
+	}
+	return client, nil
+}
+
+// deleteClientHandler removes one of the user's clients and every token issued to it
+func (o *oauth) deleteClientHandler(auth authable) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "oauth.deleteClientHandler")
+
+		userId, err := extractUserId(auth, r)
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		client, err := o.getUserClient(r, userId)
+		if err != nil {
+			if err == errClientNotFound {
+				problem(w, http.StatusNotFound, err)
+				return
+			}
+			internalError(w, fmt.Errorf("problem reading client: %v", err))
+			return
+		}
+
+		if err := o.tokenStore.RemoveByClientID(client.GetID()); err != nil {
+			internalError(w, fmt.Errorf("problem revoking tokens for client %s: %v", client.GetID(), err))
+			return
+		}
+		if err := o.clientStore.DeleteByID(client.GetID()); err != nil {
+			internalError(w, fmt.Errorf("problem deleting client %s: %v", client.GetID(), err))
+			return
+		}
+		o.logger.Log("oauth", fmt.Sprintf("userId=%s deleted client %s", userId, client.GetID()))
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// rotateClientSecretHandler replaces the secret of one of the user's clients. Tokens already
+// issued to the client are revoked, as the old secret may have leaked, unless the
+// revoke_tokens query parameter is false.
+func (o *oauth) rotateClientSecretHandler(auth authable) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "oauth.rotateClientSecretHandler")
+
+		userId, err := extractUserId(auth, r)
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		c, err := o.getUserClient(r, userId)
+		if err != nil {
+			if err == errClientNotFound {
+				problem(w, http.StatusNotFound, err)
+				return
+			}
+			internalError(w, fmt.Errorf("problem reading client: %v", err))
+			return
+		}
+		if isPublicClient(c) {
+			moovhttp.Problem(w, errPublicClientNoSecret)
+			return
+		}
+		revokeTokens := true
+		if v := r.URL.Query().Get("revoke_tokens"); v != "" {
+			if revokeTokens, err = strconv.ParseBool(v); err != nil {
+				problem(w, http.StatusBadRequest, fmt.Errorf("invalid revoke_tokens: %q", v))
+				return
+			}
+		}
+
+		secret := generateID()
+		if err := o.clientStore.SetSecret(c.GetID(), secret); err != nil {
+			internalError(w, fmt.Errorf("problem rotating secret for client %s: %v", c.GetID(), err))
+			return
+		}
+		clientGenerations.Add(1)
+		o.logger.Log("oauth", fmt.Sprintf("userId=%s rotated secret for client %s", userId, c.GetID()))
+
+		if revokeTokens {
+			if err := o.tokenStore.RemoveByClientID(c.GetID()); err != nil {
+				internalError(w, fmt.Errorf("problem revoking tokens for client %s: %v", c.GetID(), err))
+				return
+			}
+			o.logger.Log("oauth", fmt.Sprintf("revoked OAuth2 tokens for client %s", c.GetID()))
+		}
+
+		name, err := o.clientStore.GetName(c.GetID())
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		scope, err := o.clientStore.GetScope(c.GetID())
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		uris, err := o.clientStore.GetRedirectURIs(c.GetID())
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		err = json.NewEncoder(w).Encode(&client{
+			ClientID:     c.GetID(),
+			ClientSecret: secret,
+			Domain:       c.GetDomain(),
+			Name:         name,
+			Scope:        scope,
+			RedirectURIs: uris,
+		})
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+	}
+}
@@ -16,7 +16,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/moov-io/base"
+
 	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
 	"gopkg.in/oauth2.v3"
 	"gopkg.in/oauth2.v3/models"
 )
@@ -194,7 +197,7 @@ func TestOAuth__tokenHandlerNoAuth(t *testing.T) {
 
 	// Make our request
 	w := httptest.NewRecorder()
-	o.svc.tokenHandler(auth)(w, req)
+	o.svc.tokenHandler(auth, nil)(w, req)
 	w.Flush()
 
 	if w.Code != http.StatusBadRequest {
@@ -221,7 +224,7 @@ func TestOAuth__tokenHandler(t *testing.T) {
 	userId := generateID()
 
 	// Write a cookie
-	cookie, err := createCookie(userId, auth)
+	cookie, err := createCookie(userId, auth, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -239,7 +242,7 @@ func TestOAuth__tokenHandler(t *testing.T) {
 
 	// Make our request
 	w := httptest.NewRecorder()
-	o.svc.tokenHandler(auth)(w, req)
+	o.svc.tokenHandler(auth, nil)(w, req)
 	w.Flush()
 
 	if w.Code != http.StatusOK {
@@ -261,7 +264,7 @@ func TestOAuth__getClientsForUserId(t *testing.T) {
 	defer auth.cleanup()
 
 	userId := generateID()
-	cookie, err := createCookie(userId, auth)
+	cookie, err := createCookie(userId, auth, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -292,4 +295,218 @@ func TestOAuth__getClientsForUserId(t *testing.T) {
 	if c.ID != clients[0].ClientID {
 		t.Errorf("c.ID=%s clients[0].ClientID=%s", c.ID, clients[0].ClientID)
 	}
+	if clients[0].ClientSecret != "****"+c.Secret[len(c.Secret)-4:] {
+		t.Errorf("secret wasn't masked: %s", clients[0].ClientSecret)
+	}
+}
+
+func TestOAuth__hashedClientSecrets(t *testing.T) {
+	o, err := createTestOAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.cleanup()
+
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	userId := generateID()
+	cookie, err := createCookie(userId, auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := createOAuthClient(t, o, userId)
+
+	stored, err := o.svc.clientStore.GetByID(c.ID)
+	if err != nil || stored == nil {
+		t.Fatalf("stored=%v err=%v", stored, err)
+	}
+	if stored.GetSecret() == c.Secret {
+		t.Fatal("secret stored in plaintext")
+	}
+
+	token := func(secret string) int {
+		url := fmt.Sprintf("/oauth2/token?grant_type=client_credentials&client_id=%s&client_secret=%s", c.ID, secret)
+		req := httptest.NewRequest("POST", url, nil)
+		req.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+		w := httptest.NewRecorder()
+		o.svc.tokenHandler(auth, nil)(w, req)
+		w.Flush()
+		return w.Code
+	}
+	if code := token(c.Secret); code != http.StatusOK {
+		t.Errorf("got %d", code)
+	}
+	// the stored hash isn't a credential
+	for _, secret := range []string{stored.GetSecret(), "wrong"} {
+		if code := token(secret); code == http.StatusOK {
+			t.Errorf("%s: got %d", secret, code)
+		}
+	}
+}
+
+func TestOAuth__multipleClients(t *testing.T) {
+	o, err := createTestOAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.cleanup()
+
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+
+	u := &User{ID: generateID(), Email: "test@moov.io", EmailVerified: true, CreatedAt: base.NewTime(time.Now())}
+	if err := repo.upsert(u); err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := createCookie(u.ID, auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	addOAuthRoutes(router, o.svc, log.NewNopLogger(), auth, repo)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+		router.ServeHTTP(w, r)
+		w.Flush()
+		return w
+	}
+	list := func() []*client {
+		w := do("GET", "/oauth2/clients", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d: %s", w.Code, w.Body.String())
+		}
+		var clients []*client
+		if err := json.NewDecoder(w.Body).Decode(&clients); err != nil {
+			t.Fatal(err)
+		}
+		return clients
+	}
+
+	if w := do("POST", "/oauth2/client", fmt.Sprintf(`{"name": "%s"}`, strings.Repeat("a", maxClientNameLength+1))); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	created := make(map[string]*client)
+	for _, name := range []string{"prod billing", "staging CI"} {
+		w := do("POST", "/oauth2/client", fmt.Sprintf(`{"name": "%s"}`, name))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d: %s", w.Code, w.Body.String())
+		}
+		var clients []*client
+		if err := json.NewDecoder(w.Body).Decode(&clients); err != nil {
+			t.Fatal(err)
+		}
+		if len(clients) != 1 || clients[0].Name != name || clients[0].ClientSecret == "" {
+			t.Fatalf("unexpected clients: %#v", clients)
+		}
+		created[name] = clients[0]
+	}
+	prod, staging := created["prod billing"], created["staging CI"]
+
+	clients := list()
+	if len(clients) != 2 {
+		t.Fatalf("got %d clients", len(clients))
+	}
+	for i := range clients {
+		if c := created[clients[i].Name]; c == nil || c.ClientID != clients[i].ClientID {
+			t.Errorf("unexpected client: %#v", clients[i])
+		}
+	}
+
+	issue := func(clientID string) *models.Token {
+		token := &models.Token{
+			ClientID:        clientID,
+			UserID:          u.ID,
+			Access:          generateID(),
+			AccessCreateAt:  time.Now(),
+			AccessExpiresIn: 30 * time.Minute,
+		}
+		if err := o.tokenStore.Create(token); err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	// rotate one secret, which revokes its tokens
+	stagingToken, prodToken := issue(staging.ClientID), issue(prod.ClientID)
+	w := do("POST", fmt.Sprintf("/oauth2/clients/%s/secret", staging.ClientID), "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	var rotated client
+	if err := json.NewDecoder(w.Body).Decode(&rotated); err != nil {
+		t.Fatal(err)
+	}
+	if rotated.ClientID != staging.ClientID || rotated.Name != "staging CI" || rotated.ClientSecret == "" || rotated.ClientSecret == staging.ClientSecret {
+		t.Errorf("unexpected client: %#v", rotated)
+	}
+	masked := func(secret string) string { return "****" + secret[len(secret)-4:] }
+	for _, c := range list() {
+		if c.ClientID == prod.ClientID && c.ClientSecret != masked(prod.ClientSecret) {
+			t.Errorf("prod billing secret changed: %s", c.ClientSecret)
+		}
+		if c.ClientID == staging.ClientID && c.ClientSecret != masked(rotated.ClientSecret) {
+			t.Errorf("staging CI secret wasn't rotated: %s", c.ClientSecret)
+		}
+	}
+	if ti, err := o.tokenStore.GetByAccess(stagingToken.Access); err != nil || ti != nil {
+		t.Errorf("ti=%v err=%v", ti, err)
+	}
+	if ti, err := o.tokenStore.GetByAccess(prodToken.Access); err != nil || ti == nil {
+		t.Errorf("prod billing token was revoked: err=%v", err)
+	}
+
+	// tokens can be kept when rotating
+	stagingToken = issue(staging.ClientID)
+	if w := do("POST", fmt.Sprintf("/oauth2/clients/%s/secret?revoke_tokens=false", staging.ClientID), ""); w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if ti, err := o.tokenStore.GetByAccess(stagingToken.Access); err != nil || ti == nil {
+		t.Errorf("staging CI token was revoked: err=%v", err)
+	}
+	if w := do("POST", fmt.Sprintf("/oauth2/clients/%s/secret?revoke_tokens=maybe", staging.ClientID), ""); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	// delete one, along with its tokens
+	if w := do("DELETE", fmt.Sprintf("/oauth2/clients/%s", prod.ClientID), ""); w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if clients := list(); len(clients) != 1 || clients[0].ClientID != staging.ClientID {
+		t.Errorf("unexpected clients: %#v", clients)
+	}
+	if ti, err := o.tokenStore.GetByAccess(prodToken.Access); err != nil || ti != nil {
+		t.Errorf("ti=%v err=%v", ti, err)
+	}
+
+	// other users' and missing clients
+	other, _ := createOAuthClient(t, o, generateID())
+	for _, id := range []string{other.ID, prod.ClientID} {
+		if w := do("DELETE", fmt.Sprintf("/oauth2/clients/%s", id), ""); w.Code != http.StatusNotFound {
+			t.Errorf("got %d", w.Code)
+		}
+		if w := do("POST", fmt.Sprintf("/oauth2/clients/%s/secret", id), ""); w.Code != http.StatusNotFound {
+			t.Errorf("got %d", w.Code)
+		}
+	}
+	if c, err := o.svc.clientStore.GetByID(other.ID); err != nil || c == nil {
+		t.Errorf("c=%v err=%v", c, err)
+	}
 }
@@ -0,0 +1,210 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/oauth2.v3"
+)
+
+// oidcScopes are the OpenID Connect scopes we support. Clients are always allowed to request
+// them since they only expose the user's own profile.
+var oidcScopes = []string{"openid", "profile", "email"}
+
+// oidcEnabled returns true if we can act as an OpenID Connect provider, which needs keys
+// to sign ID tokens and an issuer (JWT_KEYS_DIR and JWT_ISSUER).
+func (o *oauth) oidcEnabled() bool {
+	return o.jwtKeys != nil && o.issuer != ""
+}
+
+// withoutOIDCScopes removes OpenID Connect scopes from scope when we're an OIDC provider
+func (o *oauth) withoutOIDCScopes(scope string) string {
+	if !o.oidcEnabled() {
+		return scope
+	}
+	var out []string
+	for _, token := range strings.Fields(scope) {
+		oidc := false
+		for i := range oidcScopes {
+			oidc = oidc || token == oidcScopes[i]
+		}
+		if !oidc {
+			out = append(out, token)
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+// userInfo holds the standard claims (OpenID Connect Core section 5.1) we release for a user.
+// Profile claims need the "profile" scope and email claims need "email".
+type userInfo struct {
+	Subject string `json:"sub"`
+
+	Name       string `json:"name,omitempty"`
+	GivenName  string `json:"given_name,omitempty"`
+	FamilyName string `json:"family_name,omitempty"`
+
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+}
+
+func newUserInfo(u *User, scope string) userInfo {
+	info := userInfo{Subject: u.ID}
+	if scopeIncludes(scope, "profile") {
+		info.Name = strings.TrimSpace(u.FirstName + " " + u.LastName)
+		info.GivenName = u.FirstName
+		info.FamilyName = u.LastName
+	}
+	if scopeIncludes(scope, "email") {
+		verified := u.EmailVerified
+		info.Email = u.Email
+		info.EmailVerified = &verified
+	}
+	return info
+}
+
+// idTokenClaims are the claims of an ID token (OpenID Connect Core section 2)
+type idTokenClaims struct {
+	Issuer    string `json:"iss"`
+	Audience  string `json:"aud"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	Nonce     string `json:"nonce,omitempty"`
+
+	userInfo
+}
+
+// idToken returns a signed ID token for the user ti was issued to. It expires along with
+// the access token.
+func (o *oauth) idToken(repo userRepository, ti oauth2.TokenInfo, nonce string) (string, error) {
+	u, err := repo.lookupByUserId(ti.GetUserID())
+	if err != nil {
+		return "", fmt.Errorf("problem reading user for ID token: %v", err)
+	}
+	if u == nil {
+		return "", fmt.Errorf("userId=%s not found for ID token", ti.GetUserID())
+	}
+	issuedAt := ti.GetAccessCreateAt()
+	if issuedAt.IsZero() {
+		issuedAt = time.Now()
+	}
+	return o.jwtKeys.sign(&idTokenClaims{
+		Issuer:    o.issuer,
+		Audience:  ti.GetClientID(),
+		IssuedAt:  issuedAt.Unix(),
+		ExpiresAt: issuedAt.Add(ti.GetAccessExpiresIn()).Unix(),
+		Nonce:     nonce,
+		userInfo:  newUserInfo(u, ti.GetScope()),
+	})
+}
+
+// openIDConfiguration is our OpenID Provider Metadata (OpenID Connect Discovery section 3)
+type openIDConfiguration struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserInfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	RevocationEndpoint    string `json:"revocation_endpoint"`
+	IntrospectionEndpoint string `json:"introspection_endpoint"`
+
+	ScopesSupported                  []string `json:"scopes_supported"`
+	ResponseTypesSupported           []string `json:"response_types_supported"`
+	GrantTypesSupported              []string `json:"grant_types_supported"`
+	SubjectTypesSupported            []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethods         []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported    []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                  []string `json:"claims_supported"`
+}
+
+// openIDConfigurationHandler serves GET /.well-known/openid-configuration
+func (o *oauth) openIDConfigurationHandler(w http.ResponseWriter, r *http.Request) {
+	w = wrapResponseWriter(w, r, "oauth.openIDConfigurationHandler")
+
+	if !o.oidcEnabled() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	issuer := strings.TrimSuffix(o.issuer, "/")
+
+	var grantTypes []string
+	for _, gt := range o.server.Config.AllowedGrantTypes {
+		grantTypes = append(grantTypes, gt.String())
+	}
+	cfg := openIDConfiguration{
+		Issuer:                o.issuer,
+		AuthorizationEndpoint: issuer + "/oauth2/authorize",
+		TokenEndpoint:         issuer + "/oauth2/token",
+		UserInfoEndpoint:      issuer + "/userinfo",
+		JWKSURI:               issuer + "/.well-known/jwks.json",
+		RevocationEndpoint:    issuer + "/oauth2/revoke",
+		IntrospectionEndpoint: issuer + "/oauth2/introspect",
+
+		ScopesSupported:                  oidcScopes,
+		ResponseTypesSupported:           []string{"code"},
+		GrantTypesSupported:              grantTypes,
+		SubjectTypesSupported:            []string{"public"},
+		IDTokenSigningAlgValuesSupported: []string{o.jwtKeys.signing.alg},
+		TokenEndpointAuthMethods:         []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:    []string{"S256"},
+		ClaimsSupported:                  []string{"sub", "iss", "aud", "iat", "exp", "nonce", "name", "given_name", "family_name", "email", "email_verified"},
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(cfg); err != nil {
+		internalError(w, err)
+		return
+	}
+}
+
+// userInfoHandler returns claims about the user an access token with the "openid" scope
+// was issued to (OpenID Connect Core section 5.3).
+func (o *oauth) userInfoHandler(repo userRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "oauth.userInfoHandler")
+
+		if !o.oidcEnabled() {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		ti, err := o.requestHasValidOAuthToken(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if !scopeIncludes(ti.GetScope(), "openid") {
+			w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="openid"`)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		u, err := repo.lookupByUserId(ti.GetUserID())
+		if err != nil {
+			internalError(w, fmt.Errorf("problem reading userId=%s for userinfo: %v", ti.GetUserID(), err))
+			return
+		}
+		if u == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(newUserInfo(u, ti.GetScope())); err != nil {
+			internalError(w, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/moov-io/base"
+)
+
+func TestOIDC__disabled(t *testing.T) {
+	o, err := createTestOAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.cleanup()
+
+	w := httptest.NewRecorder()
+	o.svc.openIDConfigurationHandler(w, httptest.NewRequest("GET", "/.well-known/openid-configuration", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	o.svc.userInfoHandler(nil)(w, httptest.NewRequest("GET", "/userinfo", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// OIDC scopes aren't special
+	if v := o.svc.withoutOIDCScopes("openid ach:read"); v != "openid ach:read" {
+		t.Errorf("got %q", v)
+	}
+}
+
+func TestOIDC__provider(t *testing.T) {
+	dir, _ := createTestJWTKeys(t)
+	defer os.RemoveAll(dir)
+
+	o, err := createTestOAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.cleanup()
+
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+
+	ks, err := readJWTKeys(dir, "2020-02-ecdsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.svc.useJWTAccessTokens(ks, "https://auth.moov.io/")
+
+	// discovery
+	w := httptest.NewRecorder()
+	o.svc.openIDConfigurationHandler(w, httptest.NewRequest("GET", "/.well-known/openid-configuration", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+	var cfg openIDConfiguration
+	if err := json.NewDecoder(w.Body).Decode(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Issuer != "https://auth.moov.io/" || cfg.UserInfoEndpoint != "https://auth.moov.io/userinfo" || cfg.JWKSURI != "https://auth.moov.io/.well-known/jwks.json" {
+		t.Errorf("unexpected configuration: %#v", cfg)
+	}
+	if len(cfg.IDTokenSigningAlgValuesSupported) != 1 || cfg.IDTokenSigningAlgValuesSupported[0] != "ES256" {
+		t.Errorf("unexpected algorithms: %v", cfg.IDTokenSigningAlgValuesSupported)
+	}
+
+	u := &User{
+		ID:            generateID(),
+		Email:         "jane@moov.io",
+		FirstName:     "Jane",
+		LastName:      "Doe",
+		EmailVerified: true,
+		CreatedAt:     base.NewTime(time.Now()),
+	}
+	if err := repo.upsert(u); err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := createCookie(u.ID, auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _ := createOAuthClient(t, o, u.ID)
+
+	// OIDC scopes are allowed even for restricted clients
+	if err := o.svc.clientStore.SetScope(client.ID, "ach:read"); err != nil {
+		t.Fatal(err)
+	}
+
+	token := func(scope string) (string, string) {
+		url := fmt.Sprintf("/oauth2/token?grant_type=client_credentials&client_id=%s&client_secret=%s&scope=%s", client.ID, client.Secret, scope)
+		req := httptest.NewRequest("POST", url, nil)
+		req.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+		w := httptest.NewRecorder()
+		o.svc.tokenHandler(auth, repo)(w, req)
+		w.Flush()
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d: %s", w.Code, w.Body.String())
+		}
+		var resp struct {
+			AccessToken string `json:"access_token"`
+			IDToken     string `json:"id_token"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.AccessToken, resp.IDToken
+	}
+	userinfo := func(access string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		req := httptest.NewRequest("GET", "/userinfo", nil)
+		if access != "" {
+			req.Header.Set("Authorization", "Bearer "+access)
+		}
+		w := httptest.NewRecorder()
+		o.svc.userInfoHandler(repo)(w, req)
+		w.Flush()
+
+		claims := make(map[string]interface{})
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&claims); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w, claims
+	}
+
+	jwks := []jsonWebKey{ks.signing.jwk()}
+
+	access, idToken := token("openid+profile+email+ach:read")
+	if idToken == "" {
+		t.Fatal("expected ID token")
+	}
+	var claims idTokenClaims
+	verifyTestJWT(t, jwks, idToken, &claims)
+	if claims.Issuer != "https://auth.moov.io/" || claims.Audience != client.ID || claims.Subject != u.ID || claims.ExpiresAt <= claims.IssuedAt {
+		t.Errorf("unexpected claims: %#v", claims)
+	}
+	if claims.Name != "Jane Doe" || claims.GivenName != "Jane" || claims.FamilyName != "Doe" || claims.Email != "jane@moov.io" || claims.EmailVerified == nil || !*claims.EmailVerified {
+		t.Errorf("unexpected profile claims: %#v", claims.userInfo)
+	}
+
+	w, info := userinfo(access)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+	if info["sub"] != u.ID || info["name"] != "Jane Doe" || info["email"] != "jane@moov.io" || info["email_verified"] != true {
+		t.Errorf("unexpected userinfo: %v", info)
+	}
+
+	// only the requested claims are released
+	access, idToken = token("openid")
+	claims = idTokenClaims{}
+	verifyTestJWT(t, jwks, idToken, &claims)
+	if claims.Subject != u.ID || claims.Name != "" || claims.Email != "" || claims.EmailVerified != nil {
+		t.Errorf("unexpected claims: %#v", claims)
+	}
+	if _, info = userinfo(access); len(info) != 1 || info["sub"] != u.ID {
+		t.Errorf("unexpected userinfo: %v", info)
+	}
+
+	// tokens without openid don't get ID tokens or userinfo
+	access, idToken = token("ach:read")
+	if idToken != "" {
+		t.Error("unexpected ID token")
+	}
+	if w, _ := userinfo(access); w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+	if w, _ := userinfo(""); w.Code != http.StatusUnauthorized {
+		t.Errorf("got %d", w.Code)
+	}
+}
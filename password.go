@@ -0,0 +1,247 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	moovhttp "github.com/moov-io/base/http"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+const (
+	passwordResetTTL = 1 * time.Hour
+)
+
+var (
+	// passwordResetURL is the page users are linked to from password reset emails.
+	// The token is appended as a query parameter. If empty the token is included
+	// as text in the email.
+	passwordResetURL = os.Getenv("PASSWORD_RESET_URL")
+
+	errInvalidResetToken    = errors.New("invalid or expired password reset token")
+	errWrongCurrentPassword = errors.New("current password is incorrect")
+)
+
+func addPasswordRoutes(router *mux.Router, logger log.Logger, auth authable, userService userRepository, o *oauth, mail mailer) {
+	router.Methods("POST").Path("/users/password/reset").HandlerFunc(passwordResetRoute(logger, auth, userService, mail))
+	router.Methods("POST").Path("/users/password/reset/confirm").HandlerFunc(passwordResetConfirmRoute(logger, auth, userService, o))
+	router.Methods("PUT").Path("/users/{user_id}/password").HandlerFunc(passwordChangeRoute(logger, auth, userService, o))
+}
+
+type passwordResetRequest struct {
+	Email string `json:"email"`
+}
+
+// passwordResetRoute emails the user a single use token to set a new password. The
+// response is the same whether or not the email exists so it can't be used to discover users.
+func passwordResetRoute(logger log.Logger, auth authable, userService userRepository, mail mailer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "passwordResetRoute")
+
+		var req passwordResetRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := validateEmail(req.Email); err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+
+		u, err := userService.lookupByEmail(req.Email)
+		if err != nil {
+			internalError(w, fmt.Errorf("problem looking up user email %q: %v", req.Email, err))
+			return
+		}
+		if u != nil {
+			if err := sendPasswordResetEmail(auth, mail, u); err != nil {
+				internalError(w, fmt.Errorf("problem sending password reset email: %v", err))
+				return
+			}
+			logger.Log("password", fmt.Sprintf("userId=%s requested a password reset", u.ID))
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("{}"))
+	}
+}
+
+func sendPasswordResetEmail(auth authable, mail mailer, u *User) error {
+	token := generateID()
+	if token == "" {
+		return errors.New("unable to generate password reset token")
+	}
+	if err := auth.writePasswordResetToken(u.ID, token, time.Now().Add(passwordResetTTL)); err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Use the following token to reset your password:\n\n  %s", token)
+	if passwordResetURL != "" {
+		body = fmt.Sprintf("Reset your password by visiting the following link:\n\n  %s?token=%s", passwordResetURL, token)
+	}
+	return mail.send(&email{
+		to:      u.Email,
+		subject: "Reset your password",
+		body:    fmt.Sprintf("%s\n\nThis expires in %v. If you didn't ask to reset your password you can ignore this email.", body, passwordResetTTL),
+	})
+}
+
+type passwordResetConfirmRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// passwordResetConfirmRoute sets a new password for the user owning the reset token. Every
+// cookie and OAuth2 token for the user is invalidated afterwards.
+func passwordResetConfirmRoute(logger log.Logger, auth authable, userService userRepository, o *oauth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "passwordResetConfirmRoute")
+
+		var req passwordResetConfirmRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if req.Token == "" {
+			moovhttp.Problem(w, errInvalidResetToken)
+			return
+		}
+
+		// check the new password before using the token so the user can try again
+		userId, err := auth.findPasswordResetToken(req.Token)
+		if err != nil {
+			internalError(w, fmt.Errorf("problem reading password reset token: %v", err))
+			return
+		}
+		if userId == "" {
+			moovhttp.Problem(w, errInvalidResetToken)
+			return
+		}
+		u, err := userService.lookupByUserId(userId)
+		if err != nil || u == nil {
+			internalError(w, fmt.Errorf("problem looking up userId=%s: %v", userId, err))
+			return
+		}
+		if err := passwordRules.check(auth, u, req.Password); err != nil {
+			passwordProblem(w, err)
+			return
+		}
+
+		if userId, err = auth.consumePasswordResetToken(req.Token); err != nil {
+			internalError(w, fmt.Errorf("problem reading password reset token: %v", err))
+			return
+		}
+		if userId == "" {
+			moovhttp.Problem(w, errInvalidResetToken) // used by a concurrent request, or expired since we found it
+			return
+		}
+
+		if err := auth.writePassword(userId, req.Password); err != nil {
+			internalError(w, fmt.Errorf("problem writing user credentials: %v", err))
+			return
+		}
+
+		// Anyone else who had access to the account is now logged out
+		if err := auth.invalidateCookies(userId); err != nil {
+			internalError(w, fmt.Errorf("problem invalidating cookies: %v", err))
+			return
+		}
+		if err := o.revokeUserTokens(userId); err != nil {
+			internalError(w, fmt.Errorf("problem revoking OAuth2 tokens: %v", err))
+			return
+		}
+		authInactivations.With("method", "password-reset").Add(1)
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("{}"))
+	}
+}
+
+type passwordChangeRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+
+	// RevokeOtherSessions logs out every other cookie and revokes all OAuth2 tokens
+	// for the user. The session making this request stays logged in.
+	RevokeOtherSessions bool `json:"revokeOtherSessions"`
+}
+
+// passwordChangeRoute lets an authenticated user set a new password after presenting their current one.
+func passwordChangeRoute(logger log.Logger, auth authable, userService userRepository, o *oauth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "passwordChangeRoute")
+
+		userId, err := extractUserId(auth, r)
+		if err != nil || userId != mux.Vars(r)["user_id"] {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		var req passwordChangeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// guessing the current password is limited the same as logging in
+		lockoutKeys := []string{userLockoutKey(userId), ipLockoutKey(r)}
+		if rejectLockedLogin(w, auth, lockoutKeys...) {
+			return
+		}
+		if err := auth.checkPassword(userId, req.CurrentPassword); err != nil {
+			authFailures.With("method", "web").Add(1)
+			if err := recordLoginFailure(logger, auth, lockoutKeys...); err != nil {
+				logger.Log("password", fmt.Sprintf("problem recording failed password change for userId=%s: %v", userId, err))
+			}
+			logger.Log("password", fmt.Sprintf("userId=%s failed password change: %v", userId, err))
+			problem(w, http.StatusForbidden, errWrongCurrentPassword)
+			return
+		}
+		if err := auth.deleteLoginAttempts(userLockoutKey(userId)); err != nil {
+			logger.Log("password", fmt.Sprintf("problem clearing failed logins for userId=%s: %v", userId, err))
+		}
+
+		u, err := userService.lookupByUserId(userId)
+		if err != nil || u == nil {
+			internalError(w, fmt.Errorf("problem looking up userId=%s: %v", userId, err))
+			return
+		}
+		if err := passwordRules.check(auth, u, req.NewPassword); err != nil {
+			passwordProblem(w, err)
+			return
+		}
+		if err := auth.writePassword(userId, req.NewPassword); err != nil {
+			internalError(w, fmt.Errorf("problem writing user credentials: %v", err))
+			return
+		}
+
+		if req.RevokeOtherSessions {
+			if err := auth.invalidateOtherCookies(userId, extractCookie(r).Value); err != nil {
+				internalError(w, fmt.Errorf("problem invalidating cookies: %v", err))
+				return
+			}
+
+			if err := o.revokeUserTokens(userId); err != nil {
+				internalError(w, fmt.Errorf("problem revoking OAuth2 tokens: %v", err))
+				return
+			}
+			authInactivations.With("method", "password-change").Add(1)
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("{}"))
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moov-io/base"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+func TestPassword__resetTokens(t *testing.T) {
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	userId := generateID()
+
+	// expired tokens don't work
+	token := generateID()
+	if err := auth.writePasswordResetToken(userId, token, time.Now().Add(-1*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := auth.consumePasswordResetToken(token); err != nil || id != "" {
+		t.Errorf("id=%q err=%v", id, err)
+	}
+
+	// write two valid tokens, using one removes both
+	first, second := generateID(), generateID()
+	if err := auth.writePasswordResetToken(userId, first, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.writePasswordResetToken(userId, second, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := auth.consumePasswordResetToken(second); err != nil || id != userId {
+		t.Errorf("id=%q err=%v", id, err)
+	}
+	if id, err := auth.consumePasswordResetToken(first); err != nil || id != "" {
+		t.Errorf("id=%q err=%v", id, err)
+	}
+	if id, err := auth.consumePasswordResetToken(second); err != nil || id != "" {
+		t.Errorf("id=%q err=%v", id, err)
+	}
+}
+
+func TestPassword__reset(t *testing.T) {
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+
+	o, err := createTestOAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.cleanup()
+
+	u := &User{
+		ID:        generateID(),
+		Email:     "test@moov.io",
+		CreatedAt: base.NewTime(time.Now()),
+	}
+	if err := repo.upsert(u); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.writePassword(u.ID, "superlongpassword"); err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := createCookie(u.ID, auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, token := createOAuthClient(t, o, u.ID)
+
+	// request a reset
+	mail := &testMailer{}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/users/password/reset", strings.NewReader(`{"email": "test@moov.io"}`))
+	passwordResetRoute(log.NewNopLogger(), auth, repo, mail)(w, r)
+	w.Flush()
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	msg := mail.last()
+	if msg == nil || msg.to != u.Email {
+		t.Fatalf("unexpected email: %#v", msg)
+	}
+	idx := strings.Index(msg.body, "password:")
+	if idx < 0 {
+		t.Fatalf("no token in %q", msg.body)
+	}
+	resetToken := strings.Fields(msg.body[idx+len("password:"):])[0]
+
+	// weak passwords are rejected (and don't use the token)
+	confirm := func(password string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		body := fmt.Sprintf(`{"token": %q, "password": %q}`, resetToken, password)
+		r := httptest.NewRequest("POST", "/users/password/reset/confirm", strings.NewReader(body))
+		passwordResetConfirmRoute(log.NewNopLogger(), auth, repo, o.svc)(w, r)
+		w.Flush()
+		return w
+	}
+	if w := confirm("short"); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	if w := confirm("anotherlongpassword"); w.Code != http.StatusOK {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	// tokens are single use
+	if w := confirm("yetanotherpassword"); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	// new password works and everything else was revoked
+	if err := auth.checkPassword(u.ID, "anotherlongpassword"); err != nil {
+		t.Error(err)
+	}
+	if id, _ := auth.findUserId(cookie.Value); id != "" {
+		t.Errorf("expected cookie to be invalidated, found userId=%s", id)
+	}
+	if ti, err := o.tokenStore.GetByAccess(token.Access); err != nil || ti != nil {
+		t.Errorf("expected token to be revoked: ti=%v err=%v", ti, err)
+	}
+}
+
+func TestPassword__change(t *testing.T) {
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+
+	o, err := createTestOAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.cleanup()
+
+	userId := generateID()
+	if err := repo.upsert(&User{ID: userId, Email: "test@moov.io", CreatedAt: base.NewTime(time.Now())}); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.writePassword(userId, "superlongpassword"); err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := createCookie(userId, auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, token := createOAuthClient(t, o, userId)
+
+	router := mux.NewRouter()
+	addPasswordRoutes(router, log.NewNopLogger(), auth, repo, o.svc, &testMailer{})
+
+	change := func(userId, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("PUT", fmt.Sprintf("/users/%s/password", userId), strings.NewReader(body))
+		r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+		router.ServeHTTP(w, r)
+		w.Flush()
+		return w
+	}
+
+	// another user's password can't be changed
+	if w := change(generateID(), `{"currentPassword": "superlongpassword", "newPassword": "anotherlongpassword"}`); w.Code != http.StatusForbidden {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	// wrong current password
+	if w := change(userId, `{"currentPassword": "wrongpassword", "newPassword": "anotherlongpassword"}`); w.Code != http.StatusForbidden {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	// invalid new password
+	if w := change(userId, `{"currentPassword": "superlongpassword", "newPassword": "short"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	// change without revoking anything
+	if w := change(userId, `{"currentPassword": "superlongpassword", "newPassword": "anotherlongpassword"}`); w.Code != http.StatusOK {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	if err := auth.checkPassword(userId, "anotherlongpassword"); err != nil {
+		t.Error(err)
+	}
+	if ti, err := o.tokenStore.GetByAccess(token.Access); err != nil || ti == nil {
+		t.Errorf("expected token: ti=%v err=%v", ti, err)
+	}
+
+	// login from another device and then change the password, revoking other sessions
+	other, err := createCookie(userId, auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := change(userId, `{"currentPassword": "anotherlongpassword", "newPassword": "yetanotherpassword", "revokeOtherSessions": true}`)
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	if ti, err := o.tokenStore.GetByAccess(token.Access); err != nil || ti != nil {
+		t.Errorf("expected token to be revoked: ti=%v err=%v", ti, err)
+	}
+	if id, _ := auth.findUserId(other.Value); id != "" {
+		t.Errorf("expected other session to be revoked, found userId=%q", id)
+	}
+	if id, _ := auth.findUserId(cookie.Value); id != userId {
+		t.Errorf("current session resolved to userId=%q", id)
+	}
+}
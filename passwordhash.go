@@ -0,0 +1,288 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	passwordSaltLength = 16
+	passwordKeyLength  = 32
+)
+
+var (
+	errPasswordMismatch        = errors.New("password does not match")
+	errUnknownPasswordHash     = errors.New("unknown password hash format")
+	errUnknownHashingAlgorithm = errors.New("unknown password hashing algorithm")
+
+	// passwordHashing is read from the environment:
+	//
+	//   PASSWORD_HASH_ALGORITHM   argon2id, scrypt or bcrypt (default: bcrypt)
+	//   PASSWORD_BCRYPT_COST      (default: 10)
+	//   PASSWORD_ARGON2_MEMORY    memory in KiB (default: 65536)
+	//   PASSWORD_ARGON2_TIME      iterations (default: 3)
+	//   PASSWORD_ARGON2_THREADS   (default: 2)
+	//   PASSWORD_SCRYPT_LN        log2 of the CPU/memory cost (default: 15)
+	//   PASSWORD_SCRYPT_R         block size (default: 8)
+	//   PASSWORD_SCRYPT_P         parallelization (default: 1)
+	//
+	// Stored hashes which are weaker than these settings are replaced after the next successful login.
+	passwordHashing = readPasswordHasher()
+)
+
+// passwordHasher creates self-describing password hashes in the PHC string format, e.g.
+//
+//	$argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+//	$scrypt$ln=15,r=8,p=1$<salt>$<hash>
+//
+// bcrypt hashes ($2a$10$...) already describe themselves and are stored as-is.
+type passwordHasher struct {
+	algorithm string
+
+	bcryptCost int
+
+	argon2Memory  uint32
+	argon2Time    uint32
+	argon2Threads uint8
+
+	scryptLogN int
+	scryptR    int
+	scryptP    int
+}
+
+func readPasswordHasher() passwordHasher {
+	readInt := func(name string, def int) int {
+		if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n > 0 {
+			return n
+		}
+		return def
+	}
+	h := passwordHasher{
+		algorithm:     strings.ToLower(os.Getenv("PASSWORD_HASH_ALGORITHM")),
+		bcryptCost:    readInt("PASSWORD_BCRYPT_COST", bcryptCostFactor),
+		argon2Memory:  uint32(readInt("PASSWORD_ARGON2_MEMORY", 64*1024)),
+		argon2Time:    uint32(readInt("PASSWORD_ARGON2_TIME", 3)),
+		argon2Threads: uint8(readInt("PASSWORD_ARGON2_THREADS", 2)),
+		scryptLogN:    readInt("PASSWORD_SCRYPT_LN", 15),
+		scryptR:       readInt("PASSWORD_SCRYPT_R", 8),
+		scryptP:       readInt("PASSWORD_SCRYPT_P", 1),
+	}
+	if h.algorithm == "" {
+		h.algorithm = "bcrypt"
+	}
+	return h
+}
+
+// validate checks the settings by hashing a throwaway password
+func (h passwordHasher) validate() error {
+	switch h.algorithm {
+	case "argon2id", "scrypt", "bcrypt":
+	default:
+		return fmt.Errorf("%v: %q", errUnknownHashingAlgorithm, h.algorithm)
+	}
+	_, err := h.hash(generateID())
+	return err
+}
+
+// hash returns pass hashed with the configured algorithm and a new random salt
+func (h passwordHasher) hash(pass string) (string, error) {
+	switch h.algorithm {
+	case "bcrypt":
+		bs, err := bcrypt.GenerateFromPassword([]byte(pass), h.bcryptCost)
+		return string(bs), err
+
+	case "argon2id":
+		salt, err := passwordSalt()
+		if err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(pass), salt, h.argon2Time, h.argon2Memory, h.argon2Threads, passwordKeyLength)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.argon2Memory, h.argon2Time, h.argon2Threads, encodePHC(salt), encodePHC(key)), nil
+
+	case "scrypt":
+		salt, err := passwordSalt()
+		if err != nil {
+			return "", err
+		}
+		key, err := scrypt.Key([]byte(pass), salt, 1<<uint(h.scryptLogN), h.scryptR, h.scryptP, passwordKeyLength)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", h.scryptLogN, h.scryptR, h.scryptP, encodePHC(salt), encodePHC(key)), nil
+	}
+	return "", errUnknownHashingAlgorithm
+}
+
+// needsRehash returns true if the stored hash uses another algorithm or weaker settings than
+// configured. Hashes with a separate salt are from before hashes were self-describing and
+// always need replacing.
+func (h passwordHasher) needsRehash(stored string, salt string) bool {
+	if salt != "" {
+		return true
+	}
+	p, err := parsePasswordHash(stored)
+	if err != nil || p.algorithm != h.algorithm {
+		return true
+	}
+	switch p.algorithm {
+	case "bcrypt":
+		return p.bcryptCost < h.bcryptCost
+	case "argon2id":
+		return p.argon2Memory < h.argon2Memory || p.argon2Time < h.argon2Time || p.argon2Threads < h.argon2Threads
+	case "scrypt":
+		return p.scryptLogN < h.scryptLogN || p.scryptR < h.scryptR || p.scryptP < h.scryptP
+	}
+	return true
+}
+
+// parsedPasswordHash is a stored hash along with the settings it was created with
+type parsedPasswordHash struct {
+	passwordHasher
+
+	salt []byte
+	key  []byte
+}
+
+func parsePasswordHash(stored string) (*parsedPasswordHash, error) {
+	var p parsedPasswordHash
+	parts := strings.Split(stored, "$")
+	if len(parts) < 4 || parts[0] != "" {
+		return nil, errUnknownPasswordHash
+	}
+
+	switch parts[1] {
+	case "2a", "2b", "2y":
+		cost, err := bcrypt.Cost([]byte(stored))
+		if err != nil {
+			return nil, err
+		}
+		p.algorithm, p.bcryptCost = "bcrypt", cost
+		return &p, nil
+
+	case "argon2id":
+		if len(parts) != 6 {
+			return nil, errUnknownPasswordHash
+		}
+		var version int
+		if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+			return nil, fmt.Errorf("unsupported argon2id version: %s", parts[2])
+		}
+		if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.argon2Memory, &p.argon2Time, &p.argon2Threads); err != nil {
+			return nil, fmt.Errorf("invalid argon2id parameters: %v", err)
+		}
+		if p.argon2Time < 1 || p.argon2Threads < 1 {
+			return nil, fmt.Errorf("invalid argon2id parameters: %s", parts[3])
+		}
+		p.algorithm = "argon2id"
+		return p.decodeSaltAndKey(parts[4], parts[5])
+
+	case "scrypt":
+		if len(parts) != 5 {
+			return nil, errUnknownPasswordHash
+		}
+		if _, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &p.scryptLogN, &p.scryptR, &p.scryptP); err != nil {
+			return nil, fmt.Errorf("invalid scrypt parameters: %v", err)
+		}
+		if p.scryptLogN <= 0 || p.scryptLogN >= 32 {
+			return nil, fmt.Errorf("invalid scrypt cost: ln=%d", p.scryptLogN)
+		}
+		p.algorithm = "scrypt"
+		return p.decodeSaltAndKey(parts[3], parts[4])
+	}
+	return nil, errUnknownPasswordHash
+}
+
+func (p *parsedPasswordHash) decodeSaltAndKey(salt, key string) (*parsedPasswordHash, error) {
+	var err error
+	if p.salt, err = decodePHC(salt); err != nil {
+		return nil, fmt.Errorf("invalid %s salt: %v", p.algorithm, err)
+	}
+	if p.key, err = decodePHC(key); err != nil || len(p.key) == 0 {
+		return nil, fmt.Errorf("invalid %s hash: %v", p.algorithm, err)
+	}
+	return p, nil
+}
+
+// verifyPassword checks pass against a stored hash. salt is only set for hashes
+// created before they were self-describing, which were bcrypt(pass + salt).
+func verifyPassword(stored string, salt string, pass string) error {
+	if salt != "" {
+		if err := bcrypt.CompareHashAndPassword([]byte(stored), []byte(pass+salt)); err != nil {
+			return errPasswordMismatch
+		}
+		return nil
+	}
+
+	p, err := parsePasswordHash(stored)
+	if err != nil {
+		return err
+	}
+	var key []byte
+	switch p.algorithm {
+	case "bcrypt":
+		if err := bcrypt.CompareHashAndPassword([]byte(stored), []byte(pass)); err != nil {
+			return errPasswordMismatch
+		}
+		return nil
+
+	case "argon2id":
+		key = argon2.IDKey([]byte(pass), p.salt, p.argon2Time, p.argon2Memory, p.argon2Threads, uint32(len(p.key)))
+
+	case "scrypt":
+		key, err = scrypt.Key([]byte(pass), p.salt, 1<<uint(p.scryptLogN), p.scryptR, p.scryptP, len(p.key))
+		if err != nil {
+			return err
+		}
+	}
+	if subtle.ConstantTimeCompare(key, p.key) != 1 {
+		return errPasswordMismatch
+	}
+	return nil
+}
+
+var (
+	fakePasswordHashOnce sync.Once
+	fakePasswordHash     string
+)
+
+// fakePasswordCheck verifies a throwaway password against a hash created with the
+// configured settings. In an attempt to make happy and sad paths take "approximately"
+// the same time.
+func fakePasswordCheck() {
+	fakePasswordHashOnce.Do(func() {
+		fakePasswordHash, _ = passwordHashing.hash(generateID())
+	})
+	verifyPassword(fakePasswordHash, "", generateID())
+}
+
+func passwordSalt() ([]byte, error) {
+	salt := make([]byte, passwordSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// PHC strings use standard base64 without padding
+func encodePHC(bs []byte) string {
+	return base64.RawStdEncoding.EncodeToString(bs)
+}
+
+func decodePHC(s string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(s)
+}
@@ -0,0 +1,176 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testPasswordHashers are cheap settings for each algorithm
+var testPasswordHashers = map[string]passwordHasher{
+	"bcrypt":   {algorithm: "bcrypt", bcryptCost: bcrypt.MinCost},
+	"argon2id": {algorithm: "argon2id", argon2Memory: 1024, argon2Time: 1, argon2Threads: 1},
+	"scrypt":   {algorithm: "scrypt", scryptLogN: 4, scryptR: 8, scryptP: 1},
+}
+
+func TestPasswordHash__roundTrip(t *testing.T) {
+	for name, h := range testPasswordHashers {
+		if err := h.validate(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		hashed, err := h.hash("superlongpassword")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !strings.HasPrefix(hashed, "$") {
+			t.Errorf("%s: unexpected hash %q", name, hashed)
+		}
+		if err := verifyPassword(hashed, "", "superlongpassword"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if err := verifyPassword(hashed, "", "wrongpassword"); err != errPasswordMismatch {
+			t.Errorf("%s: expected mismatch, got %v", name, err)
+		}
+		if h.needsRehash(hashed, "") {
+			t.Errorf("%s: fresh hash shouldn't need rehashing", name)
+		}
+
+		// salts are random
+		other, _ := h.hash("superlongpassword")
+		if other == hashed {
+			t.Errorf("%s: identical hashes", name)
+		}
+	}
+
+	if err := (passwordHasher{algorithm: "md5"}).validate(); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestPasswordHash__knownHashes(t *testing.T) {
+	// argon2id from the reference implementation's CLI, scrypt from Python's hashlib.scrypt
+	cases := map[string]string{
+		"$argon2id$v=19$m=64,t=1,p=1$c29tZXNhbHQ$ZVrRXqxlLcWfcXCnMyv0m4Rpvh/bnCi7":     "password",
+		"$scrypt$ln=4,r=8,p=1$c29tZXNhbHQ$7xe5L3Roj67jYaBKf3ePT2Y6rVHHGUWO44Z8iz+O6PQ": "password",
+	}
+	for stored, pass := range cases {
+		if err := verifyPassword(stored, "", pass); err != nil {
+			t.Errorf("%s: %v", stored, err)
+		}
+	}
+}
+
+func TestPasswordHash__needsRehash(t *testing.T) {
+	configured := passwordHasher{algorithm: "argon2id", argon2Memory: 2048, argon2Time: 2, argon2Threads: 1}
+
+	legacy, err := bcrypt.GenerateFromPassword([]byte("superlongpassword"+"salt"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !configured.needsRehash(string(legacy), "salt") {
+		t.Error("legacy hashes always need rehashing")
+	}
+
+	weaker, _ := testPasswordHashers["argon2id"].hash("superlongpassword")
+	if !configured.needsRehash(weaker, "") {
+		t.Error("expected weaker argon2id hash to need rehashing")
+	}
+	bcrypted, _ := testPasswordHashers["bcrypt"].hash("superlongpassword")
+	if !configured.needsRehash(bcrypted, "") {
+		t.Error("expected bcrypt hash to need rehashing")
+	}
+	stronger, _ := passwordHasher{algorithm: "argon2id", argon2Memory: 4096, argon2Time: 2, argon2Threads: 1}.hash("superlongpassword")
+	if configured.needsRehash(stronger, "") {
+		t.Error("stronger hashes shouldn't be downgraded")
+	}
+
+	// raising the bcrypt cost
+	if !(passwordHasher{algorithm: "bcrypt", bcryptCost: bcrypt.MinCost + 1}).needsRehash(bcrypted, "") {
+		t.Error("expected bcrypt hash with lower cost to need rehashing")
+	}
+}
+
+func TestPasswordHash__invalid(t *testing.T) {
+	cases := []string{
+		"",
+		"plaintext",
+		"$md5$abc$def",
+		"$argon2id$v=16$m=1024,t=1,p=1$c29tZXNhbHQ$c29tZXNhbHQ",
+		"$argon2id$v=19$m=1024,t=0,p=1$c29tZXNhbHQ$c29tZXNhbHQ",
+		"$argon2id$v=19$m=1024,t=1,p=0$c29tZXNhbHQ$c29tZXNhbHQ",
+		"$argon2id$v=19$m=1024,t=1,p=1$c29tZXNhbHQ$",
+		"$argon2id$v=19$m=1024,t=1,p=1$!!!$c29tZXNhbHQ",
+		"$scrypt$ln=40,r=8,p=1$c29tZXNhbHQ$c29tZXNhbHQ",
+		"$scrypt$r=8$c29tZXNhbHQ$c29tZXNhbHQ",
+	}
+	for _, stored := range cases {
+		if err := verifyPassword(stored, "", "password"); err == nil || err == errPasswordMismatch {
+			t.Errorf("%q: expected parse error, got %v", stored, err)
+		}
+	}
+}
+
+func TestPasswordHash__upgradeOnLogin(t *testing.T) {
+	defer func(h passwordHasher) { passwordHashing = h }(passwordHashing)
+	passwordHashing = testPasswordHashers["bcrypt"]
+
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	readHash := func(userId string) (string, string) {
+		var stored, salt string
+		if err := auth.db.QueryRow(`select password, salt from user_passwords where user_id = ?`, userId).Scan(&stored, &salt); err != nil {
+			t.Fatal(err)
+		}
+		return stored, salt
+	}
+
+	// passwords written before hashes were self-describing
+	userId := generateID()
+	legacy, err := bcrypt.GenerateFromPassword([]byte("superlongpassword"+"abc123"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.db.Exec(`insert into user_passwords (user_id, password, salt) values (?, ?, ?)`, userId, string(legacy), "abc123"); err != nil {
+		t.Fatal(err)
+	}
+
+	// failed logins don't change anything
+	if err := auth.checkPassword(userId, "wrongpassword"); err == nil {
+		t.Fatal("expected error")
+	}
+	if stored, _ := readHash(userId); stored != string(legacy) {
+		t.Errorf("hash changed after failed login: %s", stored)
+	}
+
+	if err := auth.checkPassword(userId, "superlongpassword"); err != nil {
+		t.Fatal(err)
+	}
+	stored, salt := readHash(userId)
+	if salt != "" || stored == string(legacy) || !strings.HasPrefix(stored, "$2a$") {
+		t.Errorf("expected upgraded hash: %s (salt=%q)", stored, salt)
+	}
+
+	// switch algorithms
+	passwordHashing = testPasswordHashers["argon2id"]
+	if err := auth.checkPassword(userId, "superlongpassword"); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ = readHash(userId); !strings.HasPrefix(stored, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Errorf("expected argon2id hash: %s", stored)
+	}
+	if err := auth.checkPassword(userId, "superlongpassword"); err != nil {
+		t.Error(err)
+	}
+	if again, _ := readHash(userId); again != stored {
+		t.Error("hash shouldn't change when it's up to date")
+	}
+}
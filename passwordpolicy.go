@@ -0,0 +1,276 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// passwordHistoryMax is how many passwords, including the current one, are kept for each user
+	passwordHistoryMax = 24
+)
+
+var (
+	// passwordRules is read from the environment:
+	//
+	//   PASSWORD_MIN_LENGTH               (default and minimum: 8)
+	//   PASSWORD_MAX_LENGTH               (default: 128)
+	//   PASSWORD_REQUIRE_CLASSES          comma separated list of lower, upper, digit and symbol (default: none)
+	//   PASSWORD_DISALLOW_PERSONAL_INFO   reject passwords containing the user's email or name (default: true)
+	//   PASSWORD_HISTORY                  reject reusing the last N passwords, up to 24 (default: 0)
+	//   PASSWORD_BREACHED_DIR             directory of known-breached password hashes (default: disabled)
+	passwordRules = readPasswordPolicy()
+)
+
+// passwordPolicy is checked whenever a user chooses a new password. Existing passwords
+// aren't checked at login, so the policy can be tightened without locking users out.
+type passwordPolicy struct {
+	minLength int
+	maxLength int
+
+	requireLower  bool
+	requireUpper  bool
+	requireDigit  bool
+	requireSymbol bool
+
+	disallowPersonalInfo bool
+
+	// history is how many previous passwords (including the current one) can't be reused
+	history int
+
+	breachedDir string
+}
+
+func readPasswordPolicy() passwordPolicy {
+	policy := passwordPolicy{
+		minLength:            minPasswordLength,
+		maxLength:            128,
+		disallowPersonalInfo: true,
+		breachedDir:          os.Getenv("PASSWORD_BREACHED_DIR"),
+	}
+	if n, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH")); err == nil && n > minPasswordLength {
+		policy.minLength = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("PASSWORD_MAX_LENGTH")); err == nil && n > 0 {
+		policy.maxLength = n
+	}
+	for _, class := range strings.Split(os.Getenv("PASSWORD_REQUIRE_CLASSES"), ",") {
+		switch strings.ToLower(strings.TrimSpace(class)) {
+		case "lower":
+			policy.requireLower = true
+		case "upper":
+			policy.requireUpper = true
+		case "digit":
+			policy.requireDigit = true
+		case "symbol":
+			policy.requireSymbol = true
+		}
+	}
+	if v, err := strconv.ParseBool(os.Getenv("PASSWORD_DISALLOW_PERSONAL_INFO")); err == nil {
+		policy.disallowPersonalInfo = v
+	}
+	if n, err := strconv.Atoi(os.Getenv("PASSWORD_HISTORY")); err == nil && n > 0 {
+		policy.history = n
+		if n > passwordHistoryMax {
+			policy.history = passwordHistoryMax
+		}
+	}
+	return policy
+}
+
+// passwordRuleFailure describes one rule a password failed
+type passwordRuleFailure struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// passwordPolicyError is returned when a password doesn't meet the policy
+type passwordPolicyError struct {
+	Failures []passwordRuleFailure
+}
+
+func (e *passwordPolicyError) Error() string {
+	var msgs []string
+	for i := range e.Failures {
+		msgs = append(msgs, e.Failures[i].Message)
+	}
+	return fmt.Sprintf("password does not meet requirements: %s", strings.Join(msgs, ", "))
+}
+
+// passwordProblem responds with the rules a password failed, or an internal error if
+// the policy couldn't be checked.
+func passwordProblem(w http.ResponseWriter, err error) {
+	var policyErr *passwordPolicyError
+	if !errors.As(err, &policyErr) {
+		internalError(w, fmt.Errorf("problem checking password policy: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":    policyErr.Error(),
+		"failures": policyErr.Failures,
+	})
+}
+
+// check returns a *passwordPolicyError listing every rule pass fails. Other errors mean
+// the policy couldn't be checked. u is the user choosing the password, which is used
+// for personal information and history checks. Signups pass a user without an ID.
+func (p passwordPolicy) check(auth authable, u *User, pass string) error {
+	var failures []passwordRuleFailure
+	fail := func(rule string, format string, args ...interface{}) {
+		failures = append(failures, passwordRuleFailure{
+			Rule:    rule,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	n := utf8.RuneCountInString(pass)
+	if n < p.minLength {
+		fail("minLength", "must be at least %d characters", p.minLength)
+	}
+	if p.maxLength > 0 && n > p.maxLength {
+		fail("maxLength", "must be at most %d characters", p.maxLength)
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, r := range pass {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		case !unicode.IsLetter(r):
+			symbol = true
+		}
+	}
+	if p.requireLower && !lower {
+		fail("lower", "must contain a lowercase letter")
+	}
+	if p.requireUpper && !upper {
+		fail("upper", "must contain an uppercase letter")
+	}
+	if p.requireDigit && !digit {
+		fail("digit", "must contain a digit")
+	}
+	if p.requireSymbol && !symbol {
+		fail("symbol", "must contain a symbol")
+	}
+
+	if p.disallowPersonalInfo && u != nil && containsPersonalInfo(u, pass) {
+		fail("personalInfo", "must not contain your email address or name")
+	}
+
+	if p.history > 0 && u != nil && u.ID != "" {
+		reused, err := auth.passwordUsedRecently(u.ID, pass, p.history)
+		if err != nil {
+			return err
+		}
+		if reused {
+			fail("history", "must not be one of your last %d passwords", p.history)
+		}
+	}
+
+	if p.breachedDir != "" {
+		breached, err := passwordBreached(p.breachedDir, pass)
+		if err != nil {
+			return err
+		}
+		if breached {
+			fail("breached", "has appeared in a known data breach")
+		}
+	}
+
+	if len(failures) > 0 {
+		return &passwordPolicyError{Failures: failures}
+	}
+	return nil
+}
+
+// containsPersonalInfo returns true if pass contains the user's email, the part before
+// the @, or their first or last name. Very short values are ignored.
+func containsPersonalInfo(u *User, pass string) bool {
+	pass = strings.ToLower(pass)
+
+	var values []string
+	if email := strings.ToLower(strings.TrimSpace(u.Email)); email != "" {
+		values = append(values, email)
+		if idx := strings.Index(email, "@"); idx > 0 {
+			values = append(values, email[:idx])
+		}
+	}
+	values = append(values, strings.ToLower(strings.TrimSpace(u.FirstName)), strings.ToLower(strings.TrimSpace(u.LastName)))
+
+	for _, v := range values {
+		if utf8.RuneCountInString(v) >= 3 && strings.Contains(pass, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// passwordBreached checks pass against a local copy of known-breached passwords. dir is laid
+// out like the Pwned Passwords range API: one file per 5 character uppercase hex prefix of the
+// password's SHA-1 hash (e.g. 21BD1), with "SUFFIX:COUNT" lines for the remaining characters.
+//
+// Only the prefix file is read so the full hash is never compared against the whole set.
+func passwordBreached(dir string, pass string) (bool, error) {
+	sum := sha1.Sum([]byte(pass))
+	digest := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := digest[:5], digest[5:]
+
+	fd, err := os.Open(filepath.Join(dir, prefix))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil // no breached passwords with this prefix
+		}
+		return false, err
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		parts := strings.SplitN(strings.TrimSpace(scanner.Text()), ":", 2)
+		if !strings.EqualFold(parts[0], suffix) {
+			continue
+		}
+		// padding entries have a count of zero
+		if len(parts) == 2 && strings.TrimSpace(parts[1]) == "0" {
+			return false, nil
+		}
+		return true, nil
+	}
+	return false, scanner.Err()
+}
+
+// setupBreachedPasswords verifies the breached passwords directory exists, if one is configured.
+func setupBreachedPasswords(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func policyFailures(t *testing.T, err error) []string {
+	t.Helper()
+	if err == nil {
+		return nil
+	}
+	var policyErr *passwordPolicyError
+	if !errors.As(err, &policyErr) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var rules []string
+	for i := range policyErr.Failures {
+		rules = append(rules, policyErr.Failures[i].Rule)
+	}
+	return rules
+}
+
+func TestPasswordPolicy__check(t *testing.T) {
+	policy := passwordPolicy{
+		minLength:            10,
+		maxLength:            20,
+		requireLower:         true,
+		requireUpper:         true,
+		requireDigit:         true,
+		requireSymbol:        true,
+		disallowPersonalInfo: true,
+	}
+	u := &User{Email: "jane.doe@moov.io", FirstName: "Jane", LastName: "Doe"}
+
+	cases := []struct {
+		pass     string
+		expected []string
+	}{
+		{"Correct-Horse-9", nil},
+		{"Sh0rt!", []string{"minLength"}},
+		{"Much-Too-Long-Password-1", []string{"maxLength"}},
+		{"alllowercase", []string{"upper", "digit", "symbol"}},
+		{"ALLUPPERCASE1!", []string{"lower"}},
+		{"Jane-Rocks-2020", []string{"personalInfo"}},
+		{"Hello-jane.doe1", []string{"personalInfo"}},
+		{"", []string{"minLength", "lower", "upper", "digit", "symbol"}},
+	}
+	for _, tc := range cases {
+		rules := policyFailures(t, policy.check(nil, u, tc.pass))
+		if !reflect.DeepEqual(rules, tc.expected) {
+			t.Errorf("%q: got %v expected %v", tc.pass, rules, tc.expected)
+		}
+	}
+
+	// short names aren't checked
+	u = &User{Email: "al@moov.io", FirstName: "Al"}
+	if rules := policyFailures(t, policy.check(nil, u, "Always-Valid1")); rules != nil {
+		t.Errorf("unexpected failures: %v", rules)
+	}
+}
+
+func TestPasswordPolicy__history(t *testing.T) {
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	policy := passwordPolicy{minLength: 8, history: 3}
+	u := &User{ID: generateID()}
+
+	// signups have no history
+	if err := policy.check(auth, &User{}, "password-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pass := range []string{"password-1", "password-2", "password-3", "password-4"} {
+		if err := auth.writePassword(u.ID, pass); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for pass, reused := range map[string]bool{
+		"password-1": false, // older than the last 3
+		"password-2": true,
+		"password-3": true,
+		"password-4": true, // current password
+		"password-5": false,
+	} {
+		rules := policyFailures(t, policy.check(auth, u, pass))
+		if reused != reflect.DeepEqual(rules, []string{"history"}) {
+			t.Errorf("%s: got %v", pass, rules)
+		}
+	}
+
+	// old passwords are trimmed
+	for i := 0; i < passwordHistoryMax; i++ {
+		if err := auth.writePassword(u.ID, "password-6"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var count int
+	if err := auth.db.QueryRow(`select count(*) from user_password_history where user_id = ?`, u.ID).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != passwordHistoryMax-1 {
+		t.Errorf("got %d previous passwords", count)
+	}
+}
+
+func TestPasswordPolicy__breached(t *testing.T) {
+	dir, err := ioutil.TempDir("", "breached-passwords")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// SHA-1 of "password" is 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8
+	lines := "0018A45C4D1DEF81644B54AB7F969B88D65:1\r\n1E4C9B93F3F0682250B6CF8331B7EE68FD8:3861493\r\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "5BAA6"), []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// SHA-1 of "password1" is E38AD214943DAAD1D64C102FAEC29DE4AFE9DA3D, listed as padding
+	if err := ioutil.WriteFile(filepath.Join(dir, "E38AD"), []byte("214943DAAD1D64C102FAEC29DE4AFE9DA3D:0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for pass, expected := range map[string]bool{
+		"password":          true,
+		"password1":         false,
+		"superlongpassword": false, // prefix file doesn't exist
+	} {
+		breached, err := passwordBreached(dir, pass)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if breached != expected {
+			t.Errorf("%s: got %v", pass, breached)
+		}
+	}
+
+	policy := passwordPolicy{minLength: 8, breachedDir: dir}
+	if rules := policyFailures(t, policy.check(nil, nil, "password")); !reflect.DeepEqual(rules, []string{"breached"}) {
+		t.Errorf("got %v", rules)
+	}
+
+	if err := setupBreachedPasswords(dir); err != nil {
+		t.Error(err)
+	}
+	if err := setupBreachedPasswords(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestPasswordPolicy__problem(t *testing.T) {
+	w := httptest.NewRecorder()
+	passwordProblem(w, passwordPolicy{minLength: 8}.check(nil, nil, "short"))
+	w.Flush()
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Error    string                `json:"error"`
+		Failures []passwordRuleFailure `json:"failures"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(resp.Error, "at least 8 characters") {
+		t.Errorf("unexpected error: %q", resp.Error)
+	}
+	if len(resp.Failures) != 1 || resp.Failures[0].Rule != "minLength" {
+		t.Errorf("unexpected failures: %#v", resp.Failures)
+	}
+
+	// other errors are internal
+	w = httptest.NewRecorder()
+	passwordProblem(w, errors.New("bad thing"))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("got %d", w.Code)
+	}
+}
@@ -7,7 +7,6 @@ package oauthdb
 import (
 	"fmt"
 	"io/ioutil"
-	"path/filepath"
 	"testing"
 
 	"gopkg.in/oauth2.v3/models"
@@ -26,9 +25,11 @@ func createTestClientStore() (*testClientStore, error) {
 	if err != nil {
 		return nil, err
 	}
-	path := filepath.Join(dir, "oauth_clients.db")
-
-	cs, err := NewClientStoreDB(fmt.Sprintf("file:%s", path))
+	dsn, err := testDSN(dir, fmt.Sprintf("oauth_clients-%s.db", generateID()))
+	if err != nil {
+		return nil, err
+	}
+	cs, err := NewClientStoreDB(dsn)
 	if err != nil {
 		return nil, err
 	}
@@ -95,3 +96,200 @@ func TestClientStore(t *testing.T) {
 		t.Fatalf("expected nothing, but got client=%v err=%v", client, err)
 	}
 }
+
+func TestClientStore__Scope(t *testing.T) {
+	cs, err := createTestClientStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+
+	c := &models.Client{
+		ID:     generateID(),
+		Secret: generateID(),
+		Domain: "api.moov.io",
+		UserID: generateID(),
+	}
+	if err := cs.Set(c.ID, c); err != nil {
+		t.Fatal(err)
+	}
+
+	// clients start unrestricted
+	if scope, err := cs.GetScope(c.ID); err != nil || scope != "" {
+		t.Fatalf("scope=%q err=%v", scope, err)
+	}
+
+	if err := cs.SetScope(c.ID, "ach:read ach:write"); err != nil {
+		t.Fatal(err)
+	}
+	if scope, err := cs.GetScope(c.ID); err != nil || scope != "ach:read ach:write" {
+		t.Errorf("scope=%q err=%v", scope, err)
+	}
+	if err := cs.SetScope(c.ID, "ach:read"); err != nil {
+		t.Fatal(err)
+	}
+	if scope, err := cs.GetScope(c.ID); err != nil || scope != "ach:read" {
+		t.Errorf("scope=%q err=%v", scope, err)
+	}
+
+	// deleting the client removes its scopes
+	if err := cs.DeleteByID(c.ID); err != nil {
+		t.Fatal(err)
+	}
+	if scope, err := cs.GetScope(c.ID); err != nil || scope != "" {
+		t.Errorf("scope=%q err=%v", scope, err)
+	}
+}
+
+func TestClientStore__Create(t *testing.T) {
+	cs, err := createTestClientStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+
+	c := &models.Client{
+		ID:     generateID(),
+		Secret: generateID(),
+		Domain: "api.moov.io",
+		UserID: generateID(),
+	}
+	uris := []string{"https://app.example.com/callback", "https://app.example.com/callback"}
+	if err := cs.Create(c, "prod billing", "ach:read", uris); err != nil {
+		t.Fatal(err)
+	}
+	if client, err := cs.GetByID(c.ID); err != nil || client == nil || !VerifySecret(client.GetSecret(), c.Secret) {
+		t.Fatalf("client=%v err=%v", client, err)
+	}
+	if name, err := cs.GetName(c.ID); err != nil || name != "prod billing" {
+		t.Errorf("name=%q err=%v", name, err)
+	}
+	if scope, err := cs.GetScope(c.ID); err != nil || scope != "ach:read" {
+		t.Errorf("scope=%q err=%v", scope, err)
+	}
+	if got, err := cs.GetRedirectURIs(c.ID); err != nil || len(got) != 1 || got[0] != uris[0] {
+		t.Errorf("uris=%v err=%v", got, err)
+	}
+
+	// nothing is kept when a write fails
+	if _, err := cs.db.Exec(`drop table oauth2_client_redirect_uris`); err != nil {
+		t.Fatal(err)
+	}
+	c.ID = generateID()
+	if err := cs.Create(c, "staging CI", "ach:read", uris); err == nil {
+		t.Fatal("expected error")
+	}
+	if client, err := cs.GetByID(c.ID); err != nil || client != nil {
+		t.Errorf("client=%v err=%v", client, err)
+	}
+	if scope, err := cs.GetScope(c.ID); err != nil || scope != "" {
+		t.Errorf("scope=%q err=%v", scope, err)
+	}
+}
+
+func TestClientStore__RedirectURIs(t *testing.T) {
+	cs, err := createTestClientStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+
+	c := &models.Client{
+		ID:     generateID(),
+		Secret: generateID(),
+		Domain: "api.moov.io",
+		UserID: generateID(),
+	}
+	if err := cs.Set(c.ID, c); err != nil {
+		t.Fatal(err)
+	}
+
+	if uris, err := cs.GetRedirectURIs(c.ID); err != nil || len(uris) != 0 {
+		t.Fatalf("uris=%v err=%v", uris, err)
+	}
+	if err := cs.SetRedirectURIs(c.ID, []string{"https://moov.io/cb", "https://example.com/cb", "https://moov.io/cb"}); err != nil {
+		t.Fatal(err)
+	}
+	uris, err := cs.GetRedirectURIs(c.ID)
+	if err != nil || len(uris) != 2 || uris[0] != "https://example.com/cb" || uris[1] != "https://moov.io/cb" {
+		t.Errorf("uris=%v err=%v", uris, err)
+	}
+
+	// replace
+	if err := cs.SetRedirectURIs(c.ID, []string{"http://localhost:8080/cb"}); err != nil {
+		t.Fatal(err)
+	}
+	if uris, err := cs.GetRedirectURIs(c.ID); err != nil || len(uris) != 1 || uris[0] != "http://localhost:8080/cb" {
+		t.Errorf("uris=%v err=%v", uris, err)
+	}
+
+	// deleting the client removes them
+	if err := cs.DeleteByID(c.ID); err != nil {
+		t.Fatal(err)
+	}
+	if uris, err := cs.GetRedirectURIs(c.ID); err != nil || len(uris) != 0 {
+		t.Errorf("uris=%v err=%v", uris, err)
+	}
+}
+
+func TestClientStore__Multiple(t *testing.T) {
+	cs, err := createTestClientStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+
+	userId := generateID()
+	var ids []string
+	for i := 0; i < 3; i++ {
+		c := &models.Client{
+			ID:     generateID(),
+			Secret: generateID(),
+			Domain: "api.moov.io",
+			UserID: userId,
+		}
+		if err := cs.Set(c.ID, c); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, c.ID)
+	}
+	if err := cs.SetName(ids[0], "prod billing"); err != nil {
+		t.Fatal(err)
+	}
+
+	clients, err := cs.GetByUserID(userId)
+	if err != nil || len(clients) != 3 {
+		t.Fatalf("clients=%v err=%v", clients, err)
+	}
+	if name, err := cs.GetName(ids[0]); err != nil || name != "prod billing" {
+		t.Errorf("name=%q err=%v", name, err)
+	}
+	if name, err := cs.GetName(ids[1]); err != nil || name != "" {
+		t.Errorf("name=%q err=%v", name, err)
+	}
+
+	// rotate one secret
+	if err := cs.SetSecret(ids[1], "new-secret"); err != nil {
+		t.Fatal(err)
+	}
+	for i := range ids {
+		client, err := cs.GetByID(ids[i])
+		if err != nil || client == nil {
+			t.Fatalf("client=%v err=%v", client, err)
+		}
+		if (i == 1) != VerifySecret(client.GetSecret(), "new-secret") {
+			t.Errorf("client %d has secret %q", i, client.GetSecret())
+		}
+	}
+
+	// delete one
+	if err := cs.DeleteByID(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if clients, err := cs.GetByUserID(userId); err != nil || len(clients) != 2 {
+		t.Errorf("clients=%v err=%v", clients, err)
+	}
+	if name, err := cs.GetName(ids[0]); err != nil || name != "" {
+		t.Errorf("name=%q err=%v", name, err)
+	}
+}
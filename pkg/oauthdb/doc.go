@@ -5,8 +5,17 @@
 // Package oauthdb implements ClientStore and TokenStore from gopkg.in/oauth2.v3
 // using Go's sql.DB
 //
-// The implementation is tested with SQLite, but should work with other SQL engines
-// as we attempt to use platform agnostic SQL queries.
+// SQLite (file:...), PostgreSQL (postgres://...) and MySQL (mysql://...) are supported and
+// picked from the connection string. Queries are written with ? placeholders and rewritten
+// for each database. The tests run against SQLite, and also against PostgreSQL and MySQL
+// servers when OAUTHDB_TEST_POSTGRES_DSN and OAUTHDB_TEST_MYSQL_DSN are set. There are no
+// in-process stand-ins for either server, as emulating them with SQLite hides the differences
+// the tests are there to catch. Without the variables only SQLite is tested, and the other
+// dialects are reported as skipped by TestDatabase__servers.
+//
+// Tables are created and changed by numbered migrations (see the schema package) which
+// NewClientStoreDB and NewTokenStoreDB apply. NewClientStoreMigrator and NewTokenStoreMigrator
+// return them for running by hand.
 //
 // A few extra operations on ClientStore have been added though, such as Set and
 // GetByUserId. These were needed for ourusecase as we're mutating
@@ -0,0 +1,56 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package oauthdb
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	// secretHashPrefix marks client secrets stored as "sha256$<hint>$<hex digest>"
+	secretHashPrefix = "sha256$"
+
+	// secretHintLength is how many trailing characters of a secret are kept to tell them apart
+	secretHintLength = 4
+)
+
+// HashSecret returns the form a client secret is stored in. Secrets we generate are random,
+// so a fast hash is enough to keep them from being read out of the database.
+//
+// Empty secrets (public clients) and secrets which are already hashed are returned as-is.
+func HashSecret(secret string) string {
+	if secret == "" || strings.HasPrefix(secret, secretHashPrefix) {
+		return secret
+	}
+	hint := secret
+	if len(hint) > secretHintLength {
+		hint = hint[len(hint)-secretHintLength:]
+	}
+	sum := sha256.Sum256([]byte(secret))
+	return fmt.Sprintf("%s%s$%s", secretHashPrefix, hint, hex.EncodeToString(sum[:]))
+}
+
+// VerifySecret returns true if secret matches the stored form of a client's secret.
+// Empty secrets never match.
+func VerifySecret(stored string, secret string) bool {
+	if stored == "" || secret == "" || strings.HasPrefix(secret, secretHashPrefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(HashSecret(secret))) == 1
+}
+
+// SecretHint returns the last few characters of a stored secret, so users can tell their
+// secrets apart without them being shown.
+func SecretHint(stored string) string {
+	parts := strings.Split(strings.TrimPrefix(stored, secretHashPrefix), "$")
+	if len(parts) != 2 {
+		return ""
+	}
+	return parts[0]
+}
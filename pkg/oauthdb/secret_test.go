@@ -0,0 +1,79 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package oauthdb
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/oauth2.v3/models"
+)
+
+func TestSecret(t *testing.T) {
+	secret := generateID()
+	stored := HashSecret(secret)
+	if stored == secret || strings.Contains(stored, secret) || !strings.HasPrefix(stored, secretHashPrefix) {
+		t.Fatalf("got %q", stored)
+	}
+	if HashSecret(stored) != stored {
+		t.Error("hashed twice")
+	}
+	if HashSecret("") != "" {
+		t.Error("public clients have no secret")
+	}
+
+	if !VerifySecret(stored, secret) {
+		t.Error("expected match")
+	}
+	for _, attempt := range []string{"", generateID(), stored, strings.ToUpper(secret)} {
+		if VerifySecret(stored, attempt) {
+			t.Errorf("%q shouldn't match", attempt)
+		}
+	}
+	if VerifySecret("", "") {
+		t.Error("empty secrets shouldn't match")
+	}
+
+	if hint := SecretHint(stored); hint != secret[len(secret)-4:] {
+		t.Errorf("got hint %q", hint)
+	}
+	if hint := SecretHint(""); hint != "" {
+		t.Errorf("got hint %q", hint)
+	}
+}
+
+func TestClientStore__hashPlaintextSecrets(t *testing.T) {
+	cs, err := createTestClientStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+
+	// clients written before secrets were hashed
+	secret := generateID()
+	legacy := &models.Client{ID: generateID(), Secret: secret, Domain: "api.moov.io", UserID: generateID()}
+	public := &models.Client{ID: generateID(), Domain: "api.moov.io", UserID: generateID()}
+	for _, c := range []*models.Client{legacy, public} {
+		_, err := cs.db.Exec(cs.dialect.rebind(`insert into oauth2_clients (id, secret, domain, user_id, created_at) values (?, ?, ?, ?, ?);`), c.ID, c.Secret, c.Domain, c.UserID, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := cs.migrate(); err != nil {
+		t.Fatal(err)
+	}
+	client, err := cs.GetByID(legacy.ID)
+	if err != nil || client == nil {
+		t.Fatalf("client=%v err=%v", client, err)
+	}
+	if client.GetSecret() == secret || !VerifySecret(client.GetSecret(), secret) {
+		t.Errorf("got secret %q", client.GetSecret())
+	}
+	if client, err := cs.GetByID(public.ID); err != nil || client.GetSecret() != "" {
+		t.Errorf("client=%v err=%v", client, err)
+	}
+}
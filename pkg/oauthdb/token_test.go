@@ -7,7 +7,6 @@ package oauthdb
 import (
 	"fmt"
 	"io/ioutil"
-	"path/filepath"
 	"testing"
 	"time"
 
@@ -27,9 +26,11 @@ func createTestTokenStore() (*testTokenStore, error) {
 	if err != nil {
 		return nil, err
 	}
-	path := filepath.Join(dir, "oauth2_tokens.db")
-
-	ts, err := NewTokenStoreDB(fmt.Sprintf("file:%s", path))
+	dsn, err := testDSN(dir, fmt.Sprintf("oauth2_tokens-%s.db", generateID()))
+	if err != nil {
+		return nil, err
+	}
+	ts, err := NewTokenStoreDB(dsn)
 	if err != nil {
 		return nil, err
 	}
@@ -79,6 +80,11 @@ func TestTokenStore__Create(t *testing.T) {
 	if token2.GetUserID() != tk.GetUserID() {
 		t.Fatalf("expected userId to update, but didn't")
 	}
+
+	// expirations are relative to when the token was issued
+	if !token2.GetAccessCreateAt().Equal(tk.AccessCreateAt) {
+		t.Errorf("created at %v, expected %v", token2.GetAccessCreateAt(), tk.AccessCreateAt)
+	}
 }
 
 func TestTokenStore__ByAccess(t *testing.T) {
@@ -169,6 +175,45 @@ func TestTokenStore__ByCode(t *testing.T) {
 	}
 }
 
+func TestTokenStore__CodeRequest(t *testing.T) {
+	ts, err := createTestTokenStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	tk := &models.Token{
+		ClientID:      generateID(),
+		UserID:        generateID(),
+		Code:          generateID(),
+		CodeCreateAt:  time.Now(),
+		CodeExpiresIn: 10 * time.Minute,
+	}
+	if err := ts.Create(tk); err != nil {
+		t.Fatal(err)
+	}
+
+	if req, err := ts.GetCodeRequest(tk.Code); err != nil || req != nil {
+		t.Fatalf("req=%v err=%v", req, err)
+	}
+	saved := CodeRequest{CodeChallenge: "challenge", CodeChallengeMethod: "S256", Nonce: "nonce"}
+	if err := ts.SaveCodeRequest(tk.Code, saved); err != nil {
+		t.Fatal(err)
+	}
+	req, err := ts.GetCodeRequest(tk.Code)
+	if err != nil || req == nil || *req != saved {
+		t.Fatalf("req=%v err=%v", req, err)
+	}
+
+	// removed with the code
+	if err := ts.RemoveByCode(tk.Code); err != nil {
+		t.Fatal(err)
+	}
+	if req, err := ts.GetCodeRequest(tk.Code); err != nil || req != nil {
+		t.Errorf("req=%v err=%v", req, err)
+	}
+}
+
 func TestTokenStore__ByRefresh(t *testing.T) {
 	ts, err := createTestTokenStore()
 	if err != nil {
@@ -212,3 +257,347 @@ func TestTokenStore__ByRefresh(t *testing.T) {
 		t.Fatalf("expected nothing, but got token=%v err=%v", token, err)
 	}
 }
+
+func TestTokenStore__RemoveByUserID(t *testing.T) {
+	ts, err := createTestTokenStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	userId := generateID()
+	var tokens []*models.Token
+	for i := 0; i < 2; i++ {
+		tk := &models.Token{
+			ClientID:        generateID(),
+			UserID:          userId,
+			Access:          generateID(),
+			AccessCreateAt:  time.Now().Add(-1 * time.Second), // in the past
+			AccessExpiresIn: 30 * time.Minute,                 // the future
+		}
+		if err := ts.Create(tk); err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, tk)
+	}
+
+	// a token for another user which shouldn't be removed
+	other := &models.Token{
+		ClientID:        generateID(),
+		UserID:          generateID(),
+		Access:          generateID(),
+		AccessCreateAt:  time.Now().Add(-1 * time.Second),
+		AccessExpiresIn: 30 * time.Minute,
+	}
+	if err := ts.Create(other); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ts.RemoveByUserID(userId); err != nil {
+		t.Fatal(err)
+	}
+	for i := range tokens {
+		token, err := ts.GetByAccess(tokens[i].Access)
+		if err != nil || token != nil {
+			t.Fatalf("expected nothing, but got token=%v err=%v", token, err)
+		}
+	}
+	if token, err := ts.GetByAccess(other.Access); err != nil || token == nil {
+		t.Fatalf("expected token, but got token=%v err=%v", token, err)
+	}
+}
+
+func TestTokenStore__RefreshFamily(t *testing.T) {
+	ts, err := createTestTokenStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	if rt, err := ts.GetRefreshToken(generateID()); err != nil || rt != nil {
+		t.Fatalf("rt=%v err=%v", rt, err)
+	}
+
+	family, clientID, userID := generateID(), generateID(), generateID()
+	var tokens []*models.Token
+	for i := 0; i < 2; i++ {
+		tk := &models.Token{
+			ClientID:        clientID,
+			UserID:          userID,
+			Access:          generateID(),
+			AccessCreateAt:  time.Now(),
+			AccessExpiresIn: time.Hour,
+			Refresh:         generateID(),
+		}
+		if err := ts.Create(tk); err != nil {
+			t.Fatal(err)
+		}
+		if err := ts.SaveRefreshToken(RefreshToken{Refresh: tk.Refresh, Family: family, ClientID: clientID, UserID: userID}); err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, tk)
+	}
+
+	rt, err := ts.GetRefreshToken(tokens[0].Refresh)
+	if err != nil || rt == nil {
+		t.Fatalf("rt=%v err=%v", rt, err)
+	}
+	if rt.Family != family || rt.ClientID != clientID || rt.UserID != userID || rt.UsedAt != nil || rt.CreatedAt.IsZero() {
+		t.Errorf("unexpected refresh token: %#v", rt)
+	}
+
+	// only the first use succeeds
+	if ok, err := ts.UseRefreshToken(tokens[0].Refresh); !ok || err != nil {
+		t.Fatalf("ok=%v err=%v", ok, err)
+	}
+	if ok, err := ts.UseRefreshToken(tokens[0].Refresh); ok || err != nil {
+		t.Fatalf("ok=%v err=%v", ok, err)
+	}
+	if rt, _ := ts.GetRefreshToken(tokens[0].Refresh); rt.UsedAt == nil {
+		t.Error("expected used_at")
+	}
+	if err := ts.ReleaseRefreshToken(tokens[0].Refresh); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := ts.UseRefreshToken(tokens[0].Refresh); !ok || err != nil {
+		t.Fatalf("ok=%v err=%v", ok, err)
+	}
+
+	// other tokens stay
+	other := &models.Token{ClientID: clientID, UserID: userID, Access: generateID(), AccessCreateAt: time.Now(), Refresh: generateID()}
+	if err := ts.Create(other); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ts.RemoveByRefreshFamily(family); err != nil {
+		t.Fatal(err)
+	}
+	for i := range tokens {
+		if tk, err := ts.GetByAccess(tokens[i].Access); err != nil || tk != nil {
+			t.Errorf("tk=%v err=%v", tk, err)
+		}
+	}
+	if tk, err := ts.GetByAccess(other.Access); err != nil || tk == nil {
+		t.Errorf("tk=%v err=%v", tk, err)
+	}
+}
+
+func TestTokenStore__RemoveByClientID(t *testing.T) {
+	ts, err := createTestTokenStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	userId, clientId := generateID(), generateID()
+	var tokens []*models.Token
+	for _, id := range []string{clientId, generateID()} {
+		tk := &models.Token{
+			ClientID:        id,
+			UserID:          userId,
+			Access:          generateID(),
+			AccessCreateAt:  time.Now().Add(-1 * time.Second),
+			AccessExpiresIn: 30 * time.Minute,
+		}
+		if err := ts.Create(tk); err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, tk)
+	}
+
+	if err := ts.RemoveByClientID(clientId); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := ts.GetByAccess(tokens[0].Access); err != nil || token != nil {
+		t.Fatalf("expected nothing, but got token=%v err=%v", token, err)
+	}
+	// the user's token for another client stays
+	if token, err := ts.GetByAccess(tokens[1].Access); err != nil || token == nil {
+		t.Fatalf("expected token, but got token=%v err=%v", token, err)
+	}
+}
+
+func TestTokenStore__RemoveUser(t *testing.T) {
+	ts, err := createTestTokenStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	// the user's own token, another user's token from the user's client and an unrelated token
+	userId, clientId := generateID(), generateID()
+	var tokens []*models.Token
+	for _, ids := range [][2]string{{generateID(), userId}, {clientId, generateID()}, {generateID(), generateID()}} {
+		tk := &models.Token{
+			ClientID:         ids[0],
+			UserID:           ids[1],
+			Code:             generateID(),
+			CodeCreateAt:     time.Now(),
+			CodeExpiresIn:    10 * time.Minute,
+			Access:           generateID(),
+			AccessCreateAt:   time.Now(),
+			AccessExpiresIn:  30 * time.Minute,
+			Refresh:          generateID(),
+			RefreshCreateAt:  time.Now(),
+			RefreshExpiresIn: time.Hour,
+		}
+		if err := ts.Create(tk); err != nil {
+			t.Fatal(err)
+		}
+		if err := ts.SaveCodeRequest(tk.Code, CodeRequest{Nonce: "nonce"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := ts.SaveRefreshToken(RefreshToken{Refresh: tk.Refresh, Family: generateID(), ClientID: tk.ClientID, UserID: tk.UserID}); err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, tk)
+	}
+
+	if err := ts.RemoveUser(userId, []string{clientId}); err != nil {
+		t.Fatal(err)
+	}
+	for i, tk := range tokens {
+		removed := i < 2
+		if token, err := ts.GetByAccess(tk.Access); err != nil || (token == nil) != removed {
+			t.Errorf("token #%d: token=%v err=%v", i, token, err)
+		}
+		if req, err := ts.GetCodeRequest(tk.Code); err != nil || (req == nil) != removed {
+			t.Errorf("code request #%d: req=%v err=%v", i, req, err)
+		}
+		if rt, err := ts.GetRefreshToken(tk.Refresh); err != nil || (rt == nil) != removed {
+			t.Errorf("refresh token #%d: rt=%v err=%v", i, rt, err)
+		}
+	}
+}
+
+func TestTokenStore__tokenExpiresAt(t *testing.T) {
+	now := time.Now()
+
+	// code only
+	tk := &models.Token{Code: generateID(), CodeCreateAt: now, CodeExpiresIn: 10 * time.Minute}
+	if exp := tokenExpiresAt(tk); exp == nil || !exp.Equal(now.Add(10*time.Minute)) {
+		t.Errorf("got %v", exp)
+	}
+
+	// the latest expiry is used
+	tk = &models.Token{Access: generateID(), AccessCreateAt: now, AccessExpiresIn: time.Hour, Refresh: generateID(), RefreshCreateAt: now, RefreshExpiresIn: 72 * time.Hour}
+	if exp := tokenExpiresAt(tk); exp == nil || !exp.Equal(now.Add(72*time.Hour)) {
+		t.Errorf("got %v", exp)
+	}
+
+	// a refresh token without an expiry never expires
+	tk.RefreshExpiresIn = 0
+	if exp := tokenExpiresAt(tk); exp != nil {
+		t.Errorf("got %v", exp)
+	}
+}
+
+func TestTokenStore__PurgeExpired(t *testing.T) {
+	ts, err := createTestTokenStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	// expired codes and tokens, some in a refresh family
+	family := generateID()
+	created := time.Now().Add(-2 * time.Hour)
+	var expired []*models.Token
+	for i := 0; i < 5; i++ {
+		tk := &models.Token{ClientID: generateID(), Code: generateID(), CodeCreateAt: created, CodeExpiresIn: 10 * time.Minute}
+		if i%2 == 0 {
+			tk = &models.Token{ClientID: generateID(), Access: generateID(), AccessCreateAt: created, AccessExpiresIn: time.Hour, Refresh: generateID(), RefreshExpiresIn: time.Hour}
+		}
+		if err := ts.Create(tk); err != nil {
+			t.Fatal(err)
+		}
+		if tk.Code != "" {
+			if err := ts.SaveCodeRequest(tk.Code, CodeRequest{Nonce: "nonce"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if tk.Refresh != "" {
+			if err := ts.SaveRefreshToken(RefreshToken{Refresh: tk.Refresh, Family: family}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expired = append(expired, tk)
+	}
+
+	// an access token which has expired, but its refresh token hasn't
+	live := &models.Token{ClientID: generateID(), Access: generateID(), AccessCreateAt: created, AccessExpiresIn: time.Hour, Refresh: generateID(), RefreshExpiresIn: 72 * time.Hour}
+	if err := ts.Create(live); err != nil {
+		t.Fatal(err)
+	}
+	liveFamily := generateID()
+	for _, refresh := range []string{generateID(), live.Refresh} { // a used refresh token and its replacement
+		if err := ts.SaveRefreshToken(RefreshToken{Refresh: refresh, Family: liveFamily}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	purged, err := ts.PurgeExpired(time.Now(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged["oauth2_tokens"] != 5 || purged["oauth2_code_requests"] != 2 || purged["oauth2_refresh_tokens"] != 3 {
+		t.Errorf("purged=%v", purged)
+	}
+	for i := range expired {
+		if tk, err := ts.GetByCode(expired[i].Code); expired[i].Code != "" && (tk != nil || err != nil) {
+			t.Errorf("tk=%v err=%v", tk, err)
+		}
+		if tk, err := ts.GetByAccess(expired[i].Access); expired[i].Access != "" && (tk != nil || err != nil) {
+			t.Errorf("tk=%v err=%v", tk, err)
+		}
+	}
+	if tk, err := ts.GetByRefresh(live.Refresh); tk == nil || err != nil {
+		t.Errorf("tk=%v err=%v", tk, err)
+	}
+	if rt, err := ts.GetRefreshToken(live.Refresh); rt == nil || err != nil {
+		t.Errorf("rt=%v err=%v", rt, err)
+	}
+
+	// nothing left to purge
+	purged, err = ts.PurgeExpired(time.Now(), 2)
+	if err != nil || len(purged) != 0 {
+		t.Errorf("purged=%v err=%v", purged, err)
+	}
+	if _, err := ts.PurgeExpired(time.Now(), 0); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestTokenStore__backfillExpiresAt(t *testing.T) {
+	ts, err := createTestTokenStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	m := newMigrator(ts.db, ts.dialect, tokenStoreSchema, tokenMigrations)
+	if err := m.Down(1); err != nil {
+		t.Fatal(err)
+	}
+
+	// a token written before expires_at existed
+	access, created := generateID(), time.Now().Add(-time.Hour)
+	query := `insert into oauth2_tokens (client_id, user_id, redirect_uri, scope, code, code_expires_in, access, access_expires_in, refresh, refresh_expires_in, created_at) values (?, ?, '', '', '', '0s', ?, '2h0m0s', '', '0s', ?);`
+	if _, err := ts.db.Exec(query, generateID(), generateID(), access, created); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	var expiresAt time.Time
+	if err := ts.db.QueryRow(`select expires_at from oauth2_tokens where access = ?`, access).Scan(&expiresAt); err != nil {
+		t.Fatal(err)
+	}
+	if !expiresAt.Equal(created.Add(2 * time.Hour)) {
+		t.Errorf("expiresAt=%v", expiresAt)
+	}
+	if tk, err := ts.GetByAccess(access); tk == nil || err != nil {
+		t.Errorf("tk=%v err=%v", tk, err)
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package schema
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Rebind replaces the ? placeholders in query with the dialect's own. Only PostgreSQL
+// differs, using $1, $2, etc.
+func Rebind(dialect string, query string) string {
+	if dialect != "postgres" {
+		return query
+	}
+	var buf strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			buf.WriteString(fmt.Sprintf("$%d", n))
+			continue
+		}
+		buf.WriteRune(c)
+	}
+	return buf.String()
+}
+
+// Upsert returns a query inserting columns into table, which replaces the existing row
+// when keys conflict. Keys must be a primary key or unique constraint of table. The query
+// has ? placeholders, so it needs Rebind for PostgreSQL.
+func Upsert(dialect string, table string, keys []string, columns ...string) string {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	if dialect != "postgres" {
+		return fmt.Sprintf("replace into %s (%s) values (%s)", table, strings.Join(columns, ", "), placeholders)
+	}
+	var updates []string
+	for _, col := range columns {
+		key := false
+		for i := range keys {
+			key = key || col == keys[i]
+		}
+		if !key {
+			updates = append(updates, fmt.Sprintf("%s = excluded.%s", col, col))
+		}
+	}
+	return fmt.Sprintf("insert into %s (%s) values (%s) on conflict (%s) do update set %s", table, strings.Join(columns, ", "), placeholders, strings.Join(keys, ", "), strings.Join(updates, ", "))
+}
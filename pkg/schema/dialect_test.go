@@ -0,0 +1,33 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package schema
+
+import (
+	"testing"
+)
+
+func TestRebind(t *testing.T) {
+	query := `delete from schema_migrations where schema_name = ? and version = ?`
+	for _, dialect := range []string{"sqlite3", "mysql"} {
+		if q := Rebind(dialect, query); q != query {
+			t.Errorf("%s: got %s", dialect, q)
+		}
+	}
+	if q := Rebind("postgres", query); q != `delete from schema_migrations where schema_name = $1 and version = $2` {
+		t.Errorf("got %s", q)
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	for _, dialect := range []string{"sqlite3", "mysql"} {
+		if q := Upsert(dialect, "oauth2_client_names", []string{"client_id"}, "client_id", "name"); q != `replace into oauth2_client_names (client_id, name) values (?, ?)` {
+			t.Errorf("%s: got %s", dialect, q)
+		}
+	}
+	q := Upsert("postgres", "oauth2_client_names", []string{"client_id"}, "client_id", "name")
+	if q != `insert into oauth2_client_names (client_id, name) values (?, ?) on conflict (client_id) do update set name = excluded.name` {
+		t.Errorf("got %s", q)
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package schema
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"time"
+)
+
+const (
+	// defaultLockTimeout is used when Migrator.LockTimeout isn't set
+	defaultLockTimeout = time.Minute
+
+	// staleLockAge is how old a SQLite lock row must be before it's taken over. Advisory
+	// locks on the other databases are released when their connection closes, but a row
+	// is left behind by a process which crashed while migrating.
+	staleLockAge = 10 * time.Minute
+)
+
+// lockName identifies the lock on m.Schema
+func (m *Migrator) lockName() string {
+	return "schema_migrations." + m.Schema
+}
+
+// lockID is lockName as a key for PostgreSQL's advisory locks
+func (m *Migrator) lockID() int64 {
+	h := fnv.New64a()
+	h.Write([]byte(m.lockName()))
+	return int64(h.Sum64())
+}
+
+// lock waits for other processes migrating m.Schema to finish and locks it until the
+// returned func is called.
+func (m *Migrator) lock() (func(), error) {
+	timeout := m.LockTimeout
+	if timeout <= 0 {
+		timeout = defaultLockTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	switch m.Dialect {
+	case "postgres":
+		return m.postgresLock(ctx)
+	case "mysql":
+		return m.mysqlLock(ctx, int(timeout.Seconds()))
+	default:
+		return m.rowLock(ctx)
+	}
+}
+
+// postgresLock holds a session level advisory lock on a connection set aside for it
+func (m *Migrator) postgresLock(ctx context.Context) (func(), error) {
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("schema: problem locking %s: %v", m.Schema, err)
+	}
+	if _, err := conn.ExecContext(ctx, `select pg_advisory_lock($1)`, m.lockID()); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("schema: problem locking %s: %v", m.Schema, err)
+	}
+	return func() {
+		if _, err := conn.ExecContext(context.Background(), `select pg_advisory_unlock($1)`, m.lockID()); err != nil {
+			m.log(fmt.Sprintf("problem unlocking %s: %v", m.Schema, err))
+		}
+		conn.Close()
+	}, nil
+}
+
+// mysqlLock is like postgresLock, but GET_LOCK returns 0 when it times out rather than an error
+func (m *Migrator) mysqlLock(ctx context.Context, timeoutSeconds int) (func(), error) {
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("schema: problem locking %s: %v", m.Schema, err)
+	}
+	var locked sql.NullInt64
+	if err := conn.QueryRowContext(ctx, `select get_lock(?, ?)`, m.lockName(), timeoutSeconds).Scan(&locked); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("schema: problem locking %s: %v", m.Schema, err)
+	}
+	if locked.Int64 != 1 {
+		conn.Close()
+		return nil, fmt.Errorf("schema: timed out waiting for another process migrating %s", m.Schema)
+	}
+	return func() {
+		if _, err := conn.ExecContext(context.Background(), `select release_lock(?)`, m.lockName()); err != nil {
+			m.log(fmt.Sprintf("problem unlocking %s: %v", m.Schema, err))
+		}
+		conn.Close()
+	}, nil
+}
+
+// rowLock inserts a row into schema_migrations_lock, which fails while another process
+// has one for the schema. SQLite has no advisory locks and its write lock can't be held
+// across the transactions each migration is applied in.
+func (m *Migrator) rowLock(ctx context.Context) (func(), error) {
+	if _, err := m.DB.ExecContext(ctx, `create table if not exists schema_migrations_lock(schema_name text primary key, locked_at datetime)`); err != nil {
+		return nil, fmt.Errorf("schema: problem creating schema_migrations_lock: %v", err)
+	}
+	for {
+		// the database may also be busy with the other process's migrations, so every error is retried
+		stale := time.Now().UTC().Add(-staleLockAge)
+		_, err := m.DB.ExecContext(ctx, `delete from schema_migrations_lock where schema_name = ? and locked_at < ?`, m.Schema, stale)
+		if err == nil {
+			_, err = m.DB.ExecContext(ctx, `insert into schema_migrations_lock (schema_name, locked_at) values (?, ?)`, m.Schema, time.Now().UTC())
+			if err == nil {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("schema: timed out waiting for another process migrating %s: %v", m.Schema, err)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	return func() {
+		if _, err := m.DB.Exec(`delete from schema_migrations_lock where schema_name = ?`, m.Schema); err != nil {
+			m.log(fmt.Sprintf("problem unlocking %s: %v", m.Schema, err))
+		}
+	}, nil
+}
@@ -0,0 +1,296 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+// Package schema applies numbered database migrations and records them in a
+// schema_migrations table.
+//
+// Each database can hold several schemas (e.g. users and OAuth2 tokens) which are versioned
+// separately. A Migrator refuses to run against a schema which is newer than its migrations,
+// so an older binary never writes to tables it doesn't understand.
+package schema
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+var (
+	// ErrSchemaTooNew is returned when the database has migrations applied which are
+	// newer than the Migrator knows about.
+	ErrSchemaTooNew = errors.New("database schema is newer than this binary")
+
+	// ErrBaselineMigration is returned by Down for a Baseline migration unless the
+	// Migrator has ForceDown set.
+	ErrBaselineMigration = errors.New("reverting the baseline migration drops every table")
+
+	// ErrIrreversible is returned by Down for a migration without Down statements unless
+	// the Migrator has ForceDown set.
+	ErrIrreversible = errors.New("migration can't be reverted")
+)
+
+// Migration is a numbered change to a schema.
+//
+// Up and Down hold the statements for each dialect ("sqlite3", "postgres" or "mysql").
+// Statements under "" are used for dialects without their own. A migration without Down
+// statements (e.g. one which deletes rows) is irreversible.
+type Migration struct {
+	Version int
+	Name    string
+
+	Up   map[string][]string
+	Down map[string][]string
+
+	// Baseline is set on the migration which creates a schema's tables, as reverting it
+	// drops all of their data.
+	Baseline bool
+
+	// UpFunc is optional and runs after Up's statements in the same transaction, for
+	// changes SQL can't express (e.g. backfilling a column from values parsed in Go).
+	UpFunc func(tx *sql.Tx, dialect string) error
+}
+
+func (m Migration) statements(byDialect map[string][]string, dialect string) []string {
+	if stmts, exists := byDialect[dialect]; exists {
+		return stmts
+	}
+	return byDialect[""]
+}
+
+// Migrator applies Migrations to one schema of a database.
+type Migrator struct {
+	DB      *sql.DB
+	Dialect string // sqlite3, postgres or mysql
+
+	// Schema is the name migrations are recorded under in schema_migrations
+	Schema     string
+	Migrations []Migration
+
+	// ForceDown lets Down revert Baseline migrations, and roll back past irreversible
+	// migrations leaving their changes in place.
+	ForceDown bool
+
+	// LockTimeout is how long Up and Down wait for another process migrating the same
+	// schema, one minute if it's zero.
+	LockTimeout time.Duration
+
+	// Logger is optional
+	Logger log.Logger
+}
+
+// Status describes which migrations have been applied to a schema.
+type Status struct {
+	Schema  string
+	Current int // zero if nothing has been applied
+	Latest  int
+
+	Applied []AppliedMigration
+	Pending []Migration
+}
+
+// AppliedMigration is a row in schema_migrations
+type AppliedMigration struct {
+	Version   int
+	Name      string
+	AppliedAt time.Time
+}
+
+var tableQueries = map[string]string{
+	"sqlite3":  `create table if not exists schema_migrations(schema_name text, version integer, name text, applied_at datetime, primary key (schema_name, version))`,
+	"postgres": `create table if not exists schema_migrations(schema_name text, version integer, name text, applied_at timestamptz, primary key (schema_name, version))`,
+	"mysql":    `create table if not exists schema_migrations(schema_name varchar(255), version integer, name varchar(255), applied_at datetime(6), primary key (schema_name, version))`,
+}
+
+func (m *Migrator) log(msg string) {
+	if m.Logger != nil {
+		m.Logger.Log("schema", msg)
+	}
+}
+
+func (m *Migrator) latest() int {
+	latest := 0
+	for i := range m.Migrations {
+		if m.Migrations[i].Version > latest {
+			latest = m.Migrations[i].Version
+		}
+	}
+	return latest
+}
+
+func (m *Migrator) validate() error {
+	if m.DB == nil {
+		return errors.New("schema: missing *sql.DB")
+	}
+	if _, exists := tableQueries[m.Dialect]; !exists {
+		return fmt.Errorf("schema: unknown dialect %q", m.Dialect)
+	}
+	for i := range m.Migrations {
+		if m.Migrations[i].Version != i+1 {
+			return fmt.Errorf("schema: %s migration #%d has version %d, versions must count up from 1", m.Schema, i, m.Migrations[i].Version)
+		}
+	}
+	return nil
+}
+
+// Status returns the applied and pending migrations of the schema.
+func (m *Migrator) Status() (*Status, error) {
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	if _, err := m.DB.Exec(tableQueries[m.Dialect]); err != nil {
+		return nil, fmt.Errorf("schema: problem creating schema_migrations: %v", err)
+	}
+
+	rows, err := m.DB.Query(Rebind(m.Dialect, `select version, name, applied_at from schema_migrations where schema_name = ? order by version asc`), m.Schema)
+	if err != nil {
+		return nil, fmt.Errorf("schema: problem reading schema_migrations: %v", err)
+	}
+	defer rows.Close()
+
+	status := &Status{Schema: m.Schema, Latest: m.latest()}
+	for rows.Next() {
+		var applied AppliedMigration
+		if err := rows.Scan(&applied.Version, &applied.Name, &applied.AppliedAt); err != nil {
+			return nil, fmt.Errorf("schema: Status: rows.Scan: %v", err)
+		}
+		status.Applied = append(status.Applied, applied)
+		status.Current = applied.Version
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range m.Migrations {
+		if m.Migrations[i].Version > status.Current {
+			status.Pending = append(status.Pending, m.Migrations[i])
+		}
+	}
+	return status, nil
+}
+
+// Up applies every pending migration in order. ErrSchemaTooNew is returned (and nothing
+// is applied) if the database has migrations newer than m.Migrations.
+//
+// The schema is locked while migrating, so when several instances start at once one
+// applies the migrations and the others wait for it.
+func (m *Migrator) Up() error {
+	if err := m.validate(); err != nil {
+		return err
+	}
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// read the status once locked, as another process may have just migrated
+	status, err := m.Status()
+	if err != nil {
+		return err
+	}
+	if status.Current > status.Latest {
+		return fmt.Errorf("%s is at version %d but only %d is known: %w", m.Schema, status.Current, status.Latest, ErrSchemaTooNew)
+	}
+	for _, migration := range status.Pending {
+		if err := m.apply(migration, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Down reverts the last steps migrations which have been applied. The schema is locked
+// like it is for Up.
+func (m *Migrator) Down(steps int) error {
+	if err := m.validate(); err != nil {
+		return err
+	}
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	status, err := m.Status()
+	if err != nil {
+		return err
+	}
+	if status.Current > status.Latest {
+		return fmt.Errorf("%s is at version %d but only %d is known: %w", m.Schema, status.Current, status.Latest, ErrSchemaTooNew)
+	}
+	var reverting []Migration
+	for i := 0; i < steps && status.Current-i > 0; i++ {
+		reverting = append(reverting, m.Migrations[status.Current-i-1])
+	}
+	// check every step first so we don't stop part way through
+	for _, migration := range reverting {
+		if err := m.checkReversible(migration); err != nil {
+			return err
+		}
+	}
+	for _, migration := range reverting {
+		if err := m.apply(migration, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) checkReversible(migration Migration) error {
+	if m.ForceDown {
+		return nil
+	}
+	if migration.Baseline {
+		return fmt.Errorf("%s migration %d (%s): %w", m.Schema, migration.Version, migration.Name, ErrBaselineMigration)
+	}
+	if len(migration.statements(migration.Down, m.Dialect)) == 0 {
+		return fmt.Errorf("%s migration %d (%s): %w", m.Schema, migration.Version, migration.Name, ErrIrreversible)
+	}
+	return nil
+}
+
+// apply runs a migration's Up (or Down) statements and records it in one transaction.
+// MySQL commits schema changes as they're made, so a failed migration there can leave
+// its earlier statements applied.
+func (m *Migrator) apply(migration Migration, up bool) error {
+	stmts, direction := migration.statements(migration.Up, m.Dialect), "up"
+	if !up {
+		stmts, direction = migration.statements(migration.Down, m.Dialect), "down"
+	}
+
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	for i, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("schema: %s migration %d (%s) %s statement #%d had problem: %v", m.Schema, migration.Version, migration.Name, direction, i, err)
+		}
+	}
+
+	if up && migration.UpFunc != nil {
+		if err := migration.UpFunc(tx, m.Dialect); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("schema: %s migration %d (%s) had problem: %v", m.Schema, migration.Version, migration.Name, err)
+		}
+	}
+
+	if up {
+		_, err = tx.Exec(Rebind(m.Dialect, `insert into schema_migrations (schema_name, version, name, applied_at) values (?, ?, ?, ?)`), m.Schema, migration.Version, migration.Name, time.Now())
+	} else {
+		_, err = tx.Exec(Rebind(m.Dialect, `delete from schema_migrations where schema_name = ? and version = ?`), m.Schema, migration.Version)
+	}
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("schema: problem recording %s migration %d: %v", m.Schema, migration.Version, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	m.log(fmt.Sprintf("%s migration %d (%s) %s", m.Schema, migration.Version, migration.Name, direction))
+	return nil
+}
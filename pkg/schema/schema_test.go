@@ -0,0 +1,377 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package schema
+
+import (
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var testMigrations = []Migration{
+	{
+		Version: 1,
+		Name:     "create widgets",
+		Up:       map[string][]string{"": {`create table widgets(id primary key, name);`}},
+		Down:     map[string][]string{"": {`drop table widgets;`}},
+		Baseline: true,
+	},
+	{
+		Version: 2,
+		Name:    "create gadgets",
+		Up: map[string][]string{
+			"sqlite3":  {`create table gadgets(id primary key);`},
+			"postgres": {`create table gadgets(id text primary key);`},
+		},
+		Down: map[string][]string{"": {`drop table gadgets;`}},
+	},
+}
+
+func createTestMigrator(t *testing.T) (*Migrator, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "schema.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Migrator{DB: db, Dialect: "sqlite3", Schema: "widgets", Migrations: testMigrations}
+	return m, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func tableExists(t *testing.T, db *sql.DB, name string) bool {
+	t.Helper()
+
+	var n int
+	if err := db.QueryRow(`select count(*) from sqlite_master where type = 'table' and name = ?`, name).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n > 0
+}
+
+func TestMigrator(t *testing.T) {
+	m, cleanup := createTestMigrator(t)
+	defer cleanup()
+
+	status, err := m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Current != 0 || status.Latest != 2 || len(status.Pending) != 2 {
+		t.Errorf("unexpected status: %#v", status)
+	}
+
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if !tableExists(t, m.DB, "widgets") || !tableExists(t, m.DB, "gadgets") {
+		t.Error("expected tables to be created")
+	}
+	status, err = m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Current != 2 || len(status.Applied) != 2 || len(status.Pending) != 0 {
+		t.Errorf("unexpected status: %#v", status)
+	}
+	if status.Applied[0].Name != "create widgets" || status.Applied[0].AppliedAt.IsZero() {
+		t.Errorf("unexpected applied migration: %#v", status.Applied[0])
+	}
+
+	// Up again is a no-op
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	// roll back one step
+	if err := m.Down(1); err != nil {
+		t.Fatal(err)
+	}
+	if !tableExists(t, m.DB, "widgets") || tableExists(t, m.DB, "gadgets") {
+		t.Error("expected only gadgets to be dropped")
+	}
+	status, _ = m.Status()
+	if status.Current != 1 || len(status.Pending) != 1 {
+		t.Errorf("unexpected status: %#v", status)
+	}
+
+	// rolling back more steps than applied stops at zero
+	m.ForceDown = true
+	if err := m.Down(5); err != nil {
+		t.Fatal(err)
+	}
+	if tableExists(t, m.DB, "widgets") {
+		t.Error("expected widgets to be dropped")
+	}
+	status, _ = m.Status()
+	if status.Current != 0 || len(status.Applied) != 0 {
+		t.Errorf("unexpected status: %#v", status)
+	}
+}
+
+func TestMigrator__schemas(t *testing.T) {
+	m, cleanup := createTestMigrator(t)
+	defer cleanup()
+
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	// another schema in the same database is versioned separately
+	other := &Migrator{DB: m.DB, Dialect: "sqlite3", Schema: "sprockets", Migrations: []Migration{
+		{Version: 1, Name: "create sprockets", Up: map[string][]string{"": {`create table sprockets(id);`}}},
+	}}
+	status, err := other.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Current != 0 || len(status.Pending) != 1 {
+		t.Errorf("unexpected status: %#v", status)
+	}
+	if err := other.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := m.Status(); status.Current != 2 {
+		t.Errorf("unexpected status: %#v", status)
+	}
+}
+
+func TestMigrator__tooNew(t *testing.T) {
+	m, cleanup := createTestMigrator(t)
+	defer cleanup()
+
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	// an older binary only knows about the first migration
+	older := &Migrator{DB: m.DB, Dialect: "sqlite3", Schema: "widgets", Migrations: testMigrations[:1]}
+	if err := older.Up(); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("expected ErrSchemaTooNew, got %v", err)
+	}
+	if err := older.Down(1); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("expected ErrSchemaTooNew, got %v", err)
+	}
+	if !tableExists(t, m.DB, "gadgets") {
+		t.Error("expected gadgets to be left alone")
+	}
+}
+
+func TestMigrator__failed(t *testing.T) {
+	m, cleanup := createTestMigrator(t)
+	defer cleanup()
+
+	m.Migrations = append(m.Migrations, Migration{
+		Version: 3,
+		Name:    "broken",
+		Up: map[string][]string{"": {
+			`create table doohickeys(id);`,
+			`create tabel oops;`,
+		}},
+	})
+	if err := m.Up(); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// earlier migrations are applied, the broken one is rolled back
+	status, err := m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Current != 2 || len(status.Pending) != 1 {
+		t.Errorf("unexpected status: %#v", status)
+	}
+	if tableExists(t, m.DB, "doohickeys") {
+		t.Error("expected doohickeys to be rolled back")
+	}
+}
+
+func TestMigrator__validate(t *testing.T) {
+	m, cleanup := createTestMigrator(t)
+	defer cleanup()
+
+	m.Migrations = []Migration{testMigrations[1]}
+	if err := m.Up(); err == nil {
+		t.Error("expected error for migrations not starting at 1")
+	}
+
+	m.Migrations = testMigrations
+	m.Dialect = "oracle"
+	if _, err := m.Status(); err == nil {
+		t.Error("expected error for unknown dialect")
+	}
+}
+
+func TestMigrator__upFunc(t *testing.T) {
+	m, cleanup := createTestMigrator(t)
+	defer cleanup()
+
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.DB.Exec(`insert into widgets (id, name) values ('1', 'Widget')`); err != nil {
+		t.Fatal(err)
+	}
+
+	var dialect string
+	m.Migrations = append(m.Migrations, Migration{
+		Version: 3,
+		Name:    "lowercase names",
+		Up:      map[string][]string{"": {`alter table widgets add column lower_name;`}},
+		UpFunc: func(tx *sql.Tx, d string) error {
+			dialect = d
+			_, err := tx.Exec(`update widgets set lower_name = lower(name)`)
+			return err
+		},
+	})
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	var name string
+	if err := m.DB.QueryRow(`select lower_name from widgets where id = '1'`).Scan(&name); err != nil {
+		t.Fatal(err)
+	}
+	if name != "widget" || dialect != "sqlite3" {
+		t.Errorf("name=%q dialect=%q", name, dialect)
+	}
+
+	// a failing UpFunc rolls back the migration
+	m.Migrations = append(m.Migrations, Migration{
+		Version: 4,
+		Name:    "broken",
+		Up:      map[string][]string{"": {`create table doohickeys(id);`}},
+		UpFunc:  func(tx *sql.Tx, d string) error { return errors.New("bad") },
+	})
+	if err := m.Up(); err == nil {
+		t.Fatal("expected error")
+	}
+	if tableExists(t, m.DB, "doohickeys") {
+		t.Error("expected doohickeys to be rolled back")
+	}
+	if status, _ := m.Status(); status.Current != 3 {
+		t.Errorf("unexpected status: %#v", status)
+	}
+}
+
+func TestMigrator__concurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// several processes starting at once, each with its own connections
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		db, err := sql.Open("sqlite3", filepath.Join(dir, "schema.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		wg.Add(1)
+		go func(db *sql.DB) {
+			defer wg.Done()
+			m := &Migrator{DB: db, Dialect: "sqlite3", Schema: "widgets", Migrations: testMigrations}
+			errs <- m.Up()
+		}(db)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestMigrator__lock(t *testing.T) {
+	m, cleanup := createTestMigrator(t)
+	defer cleanup()
+
+	unlock, err := m.lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := &Migrator{DB: m.DB, Dialect: "sqlite3", Schema: "widgets", Migrations: testMigrations, LockTimeout: 200 * time.Millisecond}
+	if err := other.Up(); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("expected to time out, got %v", err)
+	}
+
+	// other schemas aren't locked
+	gizmos := &Migrator{DB: m.DB, Dialect: "sqlite3", Schema: "gizmos", LockTimeout: 200 * time.Millisecond}
+	if err := gizmos.Up(); err != nil {
+		t.Error(err)
+	}
+
+	unlock()
+	if err := other.Up(); err != nil {
+		t.Error(err)
+	}
+
+	// a lock left behind by a crashed process is taken over once it's stale
+	if _, err := m.lock(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.DB.Exec(`update schema_migrations_lock set locked_at = ?`, time.Now().UTC().Add(-staleLockAge-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Down(1); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMigrator__irreversible(t *testing.T) {
+	m, cleanup := createTestMigrator(t)
+	defer cleanup()
+
+	m.Migrations = append(m.Migrations, Migration{
+		Version: 3,
+		Name:    "remove unnamed widgets",
+		Up:      map[string][]string{"": {`delete from widgets where name is null;`}},
+	})
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is reverted when a step can't be
+	if err := m.Down(2); !errors.Is(err, ErrIrreversible) {
+		t.Errorf("expected ErrIrreversible, got %v", err)
+	}
+	if status, _ := m.Status(); status.Current != 3 {
+		t.Errorf("unexpected status: %#v", status)
+	}
+
+	// forced past the irreversible migration, but not the baseline
+	m.ForceDown = true
+	if err := m.Down(2); err != nil {
+		t.Fatal(err)
+	}
+	if !tableExists(t, m.DB, "widgets") || tableExists(t, m.DB, "gadgets") {
+		t.Error("expected only gadgets to be dropped")
+	}
+	m.ForceDown = false
+	if err := m.Down(1); !errors.Is(err, ErrBaselineMigration) {
+		t.Errorf("expected ErrBaselineMigration, got %v", err)
+	}
+	if !tableExists(t, m.DB, "widgets") {
+		t.Error("expected widgets to be kept")
+	}
+}
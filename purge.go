@@ -0,0 +1,158 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+var (
+	expiredPurgeInterval = func() time.Duration {
+		if v := os.Getenv("EXPIRED_PURGE_INTERVAL"); v != "" {
+			if dur, err := time.ParseDuration(v); err == nil {
+				return dur
+			}
+		}
+		return time.Hour
+	}()
+
+	expiredPurgeBatchSize = func() int {
+		if v := os.Getenv("EXPIRED_PURGE_BATCH_SIZE"); v != "" {
+			if n, err := strconv.Atoi(v); err == nil && n > 0 {
+				return n
+			}
+		}
+		return 500
+	}()
+)
+
+// purgeFunc deletes rows which expired before now, batchSize rows at a time, and returns
+// how many were deleted from each table.
+type purgeFunc func(now time.Time, batchSize int) (map[string]int64, error)
+
+// startAsyncExpiredPurge periodically deletes expired rows with each purge func
+func startAsyncExpiredPurge(ctx context.Context, logger log.Logger, interval time.Duration, batchSize int, purges ...purgeFunc) {
+	if interval <= 0*time.Second {
+		logger.Log("expired-purge", "Disabling async purge of expired tokens and sessions")
+		return
+	}
+
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			purgeExpired(logger, time.Now(), batchSize, purges...)
+
+		case <-ctx.Done():
+			logger.Log("expired-purge", "Shutting down async purge of expired tokens and sessions")
+			return
+		}
+	}
+}
+
+// purgeExpired runs each purge func once, counting the rows deleted in expiredRowsPurged.
+// An error from one purge func doesn't stop the others.
+func purgeExpired(logger log.Logger, now time.Time, batchSize int, purges ...purgeFunc) {
+	for i := range purges {
+		purged, err := purges[i](now, batchSize)
+		for table, n := range purged {
+			if n > 0 {
+				expiredRowsPurged.With("table", table).Add(float64(n))
+				logger.Log("expired-purge", fmt.Sprintf("deleted %d expired %s rows", n, table))
+			}
+		}
+		if err != nil {
+			logger.Log("expired-purge", fmt.Sprintf("error when purging expired rows: %v", err))
+		}
+	}
+}
+
+// expiringTables are the tables purgeExpired deletes from, keyed by their primary key
+var expiringTables = []struct {
+	table, key string
+}{
+	{"user_sessions", "session_id"},
+	{"user_password_resets", "token"},
+	{"user_mfa_challenges", "challenge"},
+	{"user_webauthn_challenges", "challenge"},
+}
+
+func (a *auth) purgeExpired(now time.Time, batchSize int) (map[string]int64, error) {
+	if batchSize <= 0 {
+		return nil, fmt.Errorf("purgeExpired: invalid batch size %d", batchSize)
+	}
+	purged := make(map[string]int64)
+	for _, t := range expiringTables {
+		query := fmt.Sprintf(`delete from %s where %s in (select %s from %s where valid_until < ? limit ?)`, t.table, t.key, t.key, t.table)
+		for {
+			res, err := a.db.Exec(query, formatTimestamp(now), batchSize)
+			if err != nil {
+				return purged, fmt.Errorf("purgeExpired: %s: %v", t.table, err)
+			}
+			n, _ := res.RowsAffected()
+			purged[t.table] += n
+			if n < int64(batchSize) {
+				break
+			}
+		}
+	}
+
+	// Failed logins are forgotten once they're outside the lockout window and any lockout is over.
+	query := `delete from login_attempts where attempt_key in (select attempt_key from login_attempts where last_failure < ? and locked_until < ? limit ?)`
+	forgetBefore := formatTimestamp(now.Add(-loginLockout.window))
+	for {
+		res, err := a.db.Exec(query, forgetBefore, formatTimestamp(now), batchSize)
+		if err != nil {
+			return purged, fmt.Errorf("purgeExpired: login_attempts: %v", err)
+		}
+		n, _ := res.RowsAffected()
+		purged["login_attempts"] += n
+		if n < int64(batchSize) {
+			break
+		}
+	}
+	return purged, nil
+}
+
+func (m *memoryUserStore) purgeExpired(now time.Time, batchSize int) (map[string]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	purged := make(map[string]int64)
+	purged["user_sessions"] = int64(m.deleteSessions(func(sess *memorySession) bool { return sess.validUntil.Before(now) }))
+	for hash, t := range m.passwordResets {
+		if t.validUntil.Before(now) {
+			delete(m.passwordResets, hash)
+			purged["user_password_resets"]++
+		}
+	}
+	for hash, t := range m.mfaChallenges {
+		if t.validUntil.Before(now) {
+			delete(m.mfaChallenges, hash)
+			purged["user_mfa_challenges"]++
+		}
+	}
+	for hash, t := range m.webauthnChalls {
+		if t.validUntil.Before(now) {
+			delete(m.webauthnChalls, hash)
+			purged["user_webauthn_challenges"]++
+		}
+	}
+	for key, attempts := range m.loginAttempts {
+		if now.Sub(attempts.lastFailure) > loginLockout.window && attempts.lockedUntil.Before(now) {
+			delete(m.loginAttempts, key)
+			purged["login_attempts"]++
+		}
+	}
+	return purged, nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestPurgeExpired(t *testing.T) {
+	now := time.Now()
+
+	var calls []string
+	first := func(when time.Time, batchSize int) (map[string]int64, error) {
+		if !when.Equal(now) || batchSize != 10 {
+			t.Errorf("when=%v batchSize=%d", when, batchSize)
+		}
+		calls = append(calls, "first")
+		return map[string]int64{"user_sessions": 2}, errors.New("bad")
+	}
+	second := func(when time.Time, batchSize int) (map[string]int64, error) {
+		calls = append(calls, "second")
+		return map[string]int64{"oauth2_tokens": 0}, nil
+	}
+
+	// an error doesn't stop the other purges
+	purgeExpired(log.NewNopLogger(), now, 10, first, second)
+	if len(calls) != 2 {
+		t.Errorf("calls=%v", calls)
+	}
+}
+
+func TestPurgeExpired__async(t *testing.T) {
+	purged := make(chan struct{}, 10)
+	purge := func(now time.Time, batchSize int) (map[string]int64, error) {
+		purged <- struct{}{}
+		return nil, nil
+	}
+
+	// disabled
+	startAsyncExpiredPurge(context.Background(), log.NewNopLogger(), 0, 10, purge)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		startAsyncExpiredPurge(ctx, log.NewNopLogger(), 10*time.Millisecond, 10, purge)
+		close(done)
+	}()
+	select {
+	case <-purged:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for purge")
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for shutdown")
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// recoveryCodeCount is how many recovery codes are generated at once
+	recoveryCodeCount = 10
+)
+
+var (
+	recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// generateRecoveryCodes returns a new set of one-time codes formatted as xxxxx-xxxxx
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		bs := make([]byte, 7) // 56 bits, 10 characters are kept
+		if _, err := rand.Read(bs); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(recoveryCodeEncoding.EncodeToString(bs))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode strips formatting users may have added or dropped when typing a code
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// checkSecondFactor accepts either a TOTP code or one of the user's recovery codes,
+// recovery codes are removed once used.
+func checkSecondFactor(logger log.Logger, auth authable, userId string, code string) error {
+	err := checkTOTP(auth, userId, code)
+	if err == nil {
+		return nil
+	}
+	used, e := auth.useRecoveryCode(userId, normalizeRecoveryCode(code))
+	if e != nil {
+		return e
+	}
+	if !used {
+		return err
+	}
+	if logger != nil {
+		remaining, _ := auth.countRecoveryCodes(userId)
+		logger.Log("mfa", fmt.Sprintf("userId=%s used a recovery code, %d remaining", userId, remaining))
+	}
+	return nil
+}
+
+// removeUnusedRecoveryCodes deletes the user's recovery codes once they have no second factor left.
+func removeUnusedRecoveryCodes(auth authable, userId string) error {
+	enabled, err := mfaEnabled(auth, userId)
+	if err != nil || enabled {
+		return err
+	}
+	return auth.writeRecoveryCodes(userId, nil)
+}
+
+func addRecoveryCodeRoutes(router *mux.Router, logger log.Logger, auth authable) {
+	router.Methods("POST").Path("/users/{user_id}/mfa/recovery-codes").HandlerFunc(regenerateRecoveryCodesRoute(logger, auth))
+}
+
+type recoveryCodesResponse struct {
+	Codes []string `json:"codes"`
+}
+
+// replaceRecoveryCodes generates and saves a new set of recovery codes for the user.
+// This is the only time the codes are available as only their hashes are stored.
+func replaceRecoveryCodes(auth authable, userId string) ([]string, error) {
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, fmt.Errorf("problem generating recovery codes: %v", err)
+	}
+	normalized := make([]string, len(codes))
+	for i := range codes {
+		normalized[i] = normalizeRecoveryCode(codes[i])
+	}
+	if err := auth.writeRecoveryCodes(userId, normalized); err != nil {
+		return nil, fmt.Errorf("problem writing recovery codes: %v", err)
+	}
+	return codes, nil
+}
+
+// issueRecoveryCodes replaces the user's recovery codes and writes the new set as the response.
+func issueRecoveryCodes(w http.ResponseWriter, auth authable, userId string) {
+	codes, err := replaceRecoveryCodes(auth, userId)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(recoveryCodesResponse{Codes: codes}); err != nil {
+		internalError(w, err)
+		return
+	}
+}
+
+// regenerateRecoveryCodesRoute invalidates the user's recovery codes and returns a new set.
+func regenerateRecoveryCodesRoute(logger log.Logger, auth authable) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "regenerateRecoveryCodesRoute")
+
+		userId, err := extractUserId(auth, r)
+		if err != nil || userId != mux.Vars(r)["user_id"] {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		enabled, err := mfaEnabled(auth, userId)
+		if err != nil {
+			internalError(w, fmt.Errorf("problem reading MFA status: %v", err))
+			return
+		}
+		if !enabled {
+			problem(w, http.StatusNotFound, errors.New("MFA is not enabled"))
+			return
+		}
+
+		logger.Log("mfa", fmt.Sprintf("userId=%s regenerated recovery codes", userId))
+		issueRecoveryCodes(w, auth, userId)
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moov-io/base"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+func TestRecoveryCodes__generate(t *testing.T) {
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Errorf("got %d codes", len(codes))
+	}
+	format := regexp.MustCompile(`^[a-z2-7]{5}-[a-z2-7]{5}$`)
+	seen := make(map[string]bool)
+	for i := range codes {
+		if !format.MatchString(codes[i]) {
+			t.Errorf("unexpected code format: %q", codes[i])
+		}
+		if seen[codes[i]] {
+			t.Errorf("duplicate code: %q", codes[i])
+		}
+		seen[codes[i]] = true
+	}
+
+	if v := normalizeRecoveryCode(" ABCDE-fghij "); v != "abcdefghij" {
+		t.Errorf("got %q", v)
+	}
+}
+
+func TestRecoveryCodes__storage(t *testing.T) {
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	userId := generateID()
+	if err := auth.writeRecoveryCodes(userId, []string{"first", "second"}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := auth.countRecoveryCodes(userId); err != nil || n != 2 {
+		t.Errorf("n=%d err=%v", n, err)
+	}
+
+	// codes are single use
+	if ok, err := auth.useRecoveryCode(userId, "first"); err != nil || !ok {
+		t.Errorf("ok=%v err=%v", ok, err)
+	}
+	if ok, err := auth.useRecoveryCode(userId, "first"); err != nil || ok {
+		t.Errorf("ok=%v err=%v", ok, err)
+	}
+	// and only for their user
+	if ok, err := auth.useRecoveryCode(generateID(), "second"); err != nil || ok {
+		t.Errorf("ok=%v err=%v", ok, err)
+	}
+
+	// writing a new set replaces the old one
+	if err := auth.writeRecoveryCodes(userId, []string{"third"}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := auth.useRecoveryCode(userId, "second"); err != nil || ok {
+		t.Errorf("ok=%v err=%v", ok, err)
+	}
+	if err := auth.writeRecoveryCodes(userId, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := auth.countRecoveryCodes(userId); err != nil || n != 0 {
+		t.Errorf("n=%d err=%v", n, err)
+	}
+}
+
+func TestRecoveryCodes__login(t *testing.T) {
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+
+	u := &User{
+		ID:        generateID(),
+		Email:     "test@moov.io",
+		CreatedAt: base.NewTime(time.Now()),
+	}
+	if err := repo.upsert(u); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.writePassword(u.ID, "superlongpassword"); err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := createCookie(u.ID, auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	addLoginRoutes(router, log.NewNopLogger(), auth, repo)
+	addMFARoutes(router, log.NewNopLogger(), auth, repo)
+	addRecoveryCodeRoutes(router, log.NewNopLogger(), auth)
+
+	call := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+		router.ServeHTTP(w, r)
+		w.Flush()
+		return w
+	}
+	readCodes := func(w *httptest.ResponseRecorder) []string {
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d: %s", w.Code, w.Body.String())
+		}
+		var resp recoveryCodesResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Codes) != recoveryCodeCount {
+			t.Fatalf("got %d codes", len(resp.Codes))
+		}
+		return resp.Codes
+	}
+
+	// no recovery codes without MFA
+	regenerate := fmt.Sprintf("/users/%s/mfa/recovery-codes", u.ID)
+	if w := call("POST", regenerate, ""); w.Code != http.StatusNotFound {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	// enroll, confirming returns the recovery codes
+	w := call("POST", fmt.Sprintf("/users/%s/mfa/totp", u.ID), "")
+	var enrollment totpEnrollmentResponse
+	if err := json.NewDecoder(w.Body).Decode(&enrollment); err != nil {
+		t.Fatal(err)
+	}
+	body := fmt.Sprintf(`{"code": %q}`, currentTOTPCode(t, enrollment.Secret, 0))
+	codes := readCodes(call("POST", fmt.Sprintf("/users/%s/mfa/totp/confirm", u.ID), body))
+
+	loginWithCode := func(code string) *httptest.ResponseRecorder {
+		w := call("POST", "/users/login", `{"email": "test@moov.io", "password": "superlongpassword"}`)
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("got %d: %s", w.Code, w.Body.String())
+		}
+		var challenge mfaChallengeResponse
+		if err := json.NewDecoder(w.Body).Decode(&challenge); err != nil {
+			t.Fatal(err)
+		}
+		return call("POST", "/users/login/mfa", fmt.Sprintf(`{"challenge": %q, "code": %q}`, challenge.Challenge, code))
+	}
+
+	// recovery codes work once, with or without formatting
+	w = loginWithCode(strings.ToUpper(strings.Replace(codes[0], "-", "", 1)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	var user User
+	if err := json.NewDecoder(w.Body).Decode(&user); err != nil {
+		t.Fatal(err)
+	}
+	if !user.MFAEnabled || user.RecoveryCodesRemaining != recoveryCodeCount-1 {
+		t.Errorf("mfaEnabled=%v recoveryCodesRemaining=%d", user.MFAEnabled, user.RecoveryCodesRemaining)
+	}
+	if w := loginWithCode(codes[0]); w.Code != http.StatusForbidden {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	// regenerating invalidates the old codes
+	fresh := readCodes(call("POST", regenerate, ""))
+	if w := loginWithCode(codes[1]); w.Code != http.StatusForbidden {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	if w := loginWithCode(fresh[0]); w.Code != http.StatusOK {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	// a recovery code can disable TOTP, which removes the rest of them
+	if w := call("DELETE", fmt.Sprintf("/users/%s/mfa/totp", u.ID), fmt.Sprintf(`{"code": %q}`, fresh[1])); w.Code != http.StatusOK {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	if n, err := auth.countRecoveryCodes(u.ID); err != nil || n != 0 {
+		t.Errorf("n=%d err=%v", n, err)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/moov-io/auth/pkg/oauthdb"
+
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/errors"
+)
+
+// useRefreshToken checks a refresh token grant before the token is rotated and returns the
+// family it belongs to. Every refresh token can only be used once, so a used token showing up
+// again means it was copied. When that happens every token in its family is revoked, which
+// logs out both the attacker and the legitimate client (RFC 6819 section 5.2.2.3).
+//
+// Rotated tokens keep the scope of the token they replace, or a narrower one the client
+// asks for, so a family's scope never grows (see refreshingScopeHandler).
+//
+// Refresh tokens issued before families were tracked return an empty family and start a
+// new one when they're rotated.
+func (o *oauth) useRefreshToken(tgr *oauth2.TokenGenerateRequest) (string, error) {
+	rt, err := o.tokenStore.GetRefreshToken(tgr.Refresh)
+	if err != nil {
+		return "", err
+	}
+	if rt == nil {
+		return "", nil
+	}
+	// only the client a token was issued to can trigger revoking its family, clientInfoHandler
+	// has already checked the client's secret
+	if rt.ClientID != tgr.ClientID {
+		return "", errors.ErrInvalidGrant
+	}
+
+	fresh, err := o.tokenStore.UseRefreshToken(rt.Refresh)
+	if err != nil {
+		return "", err
+	}
+	if !fresh {
+		if err := o.tokenStore.RemoveByRefreshFamily(rt.Family); err != nil {
+			return "", fmt.Errorf("problem revoking refresh token family %s: %v", rt.Family, err)
+		}
+		refreshTokenReuses.Add(1)
+		o.logger.Log("security", fmt.Sprintf("refresh token reused by client %s for userId=%s, revoked token family %s", rt.ClientID, rt.UserID, rt.Family))
+		return "", errors.ErrInvalidGrant
+	}
+	return rt.Family, nil
+}
+
+// saveRefreshToken records the refresh token of ti in family, or a new family when empty.
+func (o *oauth) saveRefreshToken(ti oauth2.TokenInfo, family string) error {
+	if family == "" {
+		family = generateID()
+	}
+	return o.tokenStore.SaveRefreshToken(oauthdb.RefreshToken{
+		Refresh:  ti.GetRefresh(),
+		Family:   family,
+		ClientID: ti.GetClientID(),
+		UserID:   ti.GetUserID(),
+	})
+}
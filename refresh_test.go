@@ -0,0 +1,142 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRefresh__rotation(t *testing.T) {
+	o, err := createTestOAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.cleanup()
+
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	userId := generateID()
+	cookie, err := createCookie(userId, auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _ := createOAuthClient(t, o, userId)
+	if err := o.svc.clientStore.SetScope(client.ID, "ach:read ach:write"); err != nil {
+		t.Fatal(err)
+	}
+
+	type tokens struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		Scope        string `json:"scope"`
+	}
+	token := func(form url.Values, withCookie bool) (*httptest.ResponseRecorder, tokens) {
+		req := httptest.NewRequest("POST", "/oauth2/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if withCookie {
+			req.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+		}
+		w := httptest.NewRecorder()
+		o.svc.tokenHandler(auth, nil)(w, req)
+		w.Flush()
+
+		var resp tokens
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w, resp
+	}
+	refreshScope := func(refreshToken, secret, scope string) (*httptest.ResponseRecorder, tokens) {
+		return token(url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {client.ID},
+			"client_secret": {secret},
+			"refresh_token": {refreshToken},
+			"scope":         {scope},
+		}, false)
+	}
+	refresh := func(refreshToken, secret string) (*httptest.ResponseRecorder, tokens) {
+		return refreshScope(refreshToken, secret, "")
+	}
+
+	w, first := token(url.Values{"grant_type": {"client_credentials"}, "client_id": {client.ID}, "client_secret": {client.Secret}}, true)
+	if w.Code != http.StatusOK || first.RefreshToken == "" {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	rt, err := o.svc.tokenStore.GetRefreshToken(first.RefreshToken)
+	if err != nil || rt == nil || rt.Family == "" || rt.UserID != userId {
+		t.Fatalf("rt=%#v err=%v", rt, err)
+	}
+
+	// a wrong secret doesn't use up the refresh token
+	if w, _ := refresh(first.RefreshToken, "wrong"); w.Code == http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+
+	// rotate
+	w, second := refresh(first.RefreshToken, client.Secret)
+	if w.Code != http.StatusOK || second.RefreshToken == "" || second.RefreshToken == first.RefreshToken {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if first.Scope != "ach:read ach:write" || second.Scope != first.Scope {
+		t.Errorf("rotated token changed scope from %q to %q", first.Scope, second.Scope)
+	}
+	if next, err := o.svc.tokenStore.GetRefreshToken(second.RefreshToken); err != nil || next == nil || next.Family != rt.Family {
+		t.Fatalf("next=%#v err=%v", next, err)
+	}
+	if ti, err := o.svc.tokenStore.GetByAccess(second.AccessToken); err != nil || ti == nil || ti.GetUserID() != userId {
+		t.Fatalf("ti=%v err=%v", ti, err)
+	}
+	if ti, err := o.svc.tokenStore.GetByAccess(first.AccessToken); err != nil || ti != nil {
+		t.Errorf("old access token wasn't removed: ti=%v err=%v", ti, err)
+	}
+
+	// the client can narrow the scope, but it can't grow back
+	w, third := refreshScope(second.RefreshToken, client.Secret, "ach:read")
+	if w.Code != http.StatusOK || third.Scope != "ach:read" {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if ti, err := o.svc.tokenStore.GetByAccess(third.AccessToken); err != nil || ti == nil || ti.GetScope() != "ach:read" {
+		t.Fatalf("ti=%v err=%v", ti, err)
+	}
+	if w, _ := refreshScope(third.RefreshToken, client.Secret, "ach:read ach:write"); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_scope") {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	// an unrelated token family
+	w, other := token(url.Values{"grant_type": {"client_credentials"}, "client_id": {client.ID}, "client_secret": {client.Secret}}, true)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	// reusing the first refresh token revokes the whole family
+	if w, _ := refresh(first.RefreshToken, client.Secret); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_grant") {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	if ti, err := o.svc.tokenStore.GetByAccess(third.AccessToken); err != nil || ti != nil {
+		t.Errorf("family wasn't revoked: ti=%v err=%v", ti, err)
+	}
+	if w, _ := refresh(third.RefreshToken, client.Secret); w.Code == http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	if ti, err := o.svc.tokenStore.GetByAccess(other.AccessToken); err != nil || ti == nil {
+		t.Errorf("ti=%v err=%v", ti, err)
+	}
+	if w, _ := refresh(other.RefreshToken, client.Secret); w.Code != http.StatusOK {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+}
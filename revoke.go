@@ -0,0 +1,129 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/moov-io/auth/pkg/oauthdb"
+
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/errors"
+)
+
+// authenticateClient reads client credentials from HTTP Basic auth or the client_id and
+// client_secret form parameters (RFC 6749 section 2.3.1) and checks them against our clients.
+//
+// Public clients have no secret to authenticate with, so when allowPublic is true they're
+// identified by client_id alone (RFC 7009 section 2.1). Otherwise they're rejected.
+func (o *oauth) authenticateClient(r *http.Request, allowPublic bool) (oauth2.ClientInfo, error) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID == "" {
+		return nil, errors.ErrInvalidClient
+	}
+	client, err := o.clientStore.GetByID(clientID)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		return nil, errors.ErrInvalidClient
+	}
+	if isPublicClient(client) {
+		if allowPublic && clientSecret == "" {
+			return client, nil
+		}
+		return nil, errors.ErrInvalidClient
+	}
+	if !oauthdb.VerifySecret(client.GetSecret(), clientSecret) {
+		return nil, errors.ErrInvalidClient
+	}
+	return client, nil
+}
+
+// clientProblem responds to a failed client authentication (RFC 6749 section 5.2)
+func clientProblem(w http.ResponseWriter, r *http.Request) {
+	authFailures.With("method", "oauth2").Add(1)
+	if _, _, ok := r.BasicAuth(); ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth2"`)
+	}
+	problem(w, http.StatusUnauthorized, errors.ErrInvalidClient)
+}
+
+// revokeHandler removes an access or refresh token issued to the authenticated client
+// (RFC 7009). Both tokens of a pair are stored together, so revoking one revokes the other.
+// Public clients only send their client_id, and can only revoke their own tokens.
+//
+// Unknown tokens, and tokens issued to other clients, are answered with "200 OK" so
+// callers can't learn which tokens exist.
+func (o *oauth) revokeHandler(w http.ResponseWriter, r *http.Request) {
+	w = wrapResponseWriter(w, r, "oauth.revokeHandler")
+
+	if err := r.ParseForm(); err != nil {
+		problem(w, http.StatusBadRequest, errors.ErrInvalidRequest)
+		return
+	}
+	client, err := o.authenticateClient(r, true)
+	if err != nil {
+		if err == errors.ErrInvalidClient {
+			clientProblem(w, r)
+		} else {
+			internalError(w, fmt.Errorf("problem authenticating client: %v", err))
+		}
+		return
+	}
+	token := r.PostForm.Get("token")
+	if token == "" {
+		problem(w, http.StatusBadRequest, errors.ErrInvalidRequest)
+		return
+	}
+
+	// token_type_hint only changes which lookup we try first, unknown hints are ignored
+	lookups := []string{"access_token", "refresh_token"}
+	if r.PostForm.Get("token_type_hint") == "refresh_token" {
+		lookups[0], lookups[1] = lookups[1], lookups[0]
+	}
+	for _, tokenType := range lookups {
+		revoked, err := o.revokeToken(client.GetID(), tokenType, token)
+		if err != nil {
+			internalError(w, fmt.Errorf("problem revoking %s for client %s: %v", tokenType, client.GetID(), err))
+			return
+		}
+		if revoked {
+			tokenRevocations.With("type", tokenType).Add(1)
+			break
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// revokeToken removes the token pair found by tokenType and returns true if it was issued to clientID
+func (o *oauth) revokeToken(clientID string, tokenType string, token string) (bool, error) {
+	var ti oauth2.TokenInfo
+	var err error
+	if tokenType == "refresh_token" {
+		ti, err = o.tokenStore.GetByRefresh(token)
+	} else {
+		ti, err = o.tokenStore.GetByAccess(token)
+	}
+	if err != nil || ti == nil || ti.GetClientID() != clientID {
+		return false, err
+	}
+	if tokenType == "refresh_token" {
+		err = o.tokenStore.RemoveByRefresh(token)
+	} else {
+		err = o.tokenStore.RemoveByAccess(token)
+	}
+	if err != nil {
+		return false, err
+	}
+	o.logger.Log("oauth", fmt.Sprintf("revoked %s for client %s userId=%s", tokenType, clientID, ti.GetUserID()))
+	return true, nil
+}
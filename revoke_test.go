@@ -0,0 +1,149 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/oauth2.v3/models"
+)
+
+func TestOAuth__revoke(t *testing.T) {
+	o, err := createTestOAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.cleanup()
+
+	userId := generateID()
+	client, token := createOAuthClient(t, o, userId)
+	other, otherToken := createOAuthClient(t, o, generateID())
+
+	// pair a refresh token with another access token
+	paired := &models.Token{
+		ClientID:         client.ID,
+		UserID:           userId,
+		Access:           generateID(),
+		AccessCreateAt:   time.Now(),
+		AccessExpiresIn:  time.Hour,
+		Refresh:          generateID(),
+		RefreshCreateAt:  time.Now(),
+		RefreshExpiresIn: 24 * time.Hour,
+	}
+	if err := o.tokenStore.Create(paired); err != nil {
+		t.Fatal(err)
+	}
+
+	revoke := func(clientID, secret string, form url.Values, basic bool) *httptest.ResponseRecorder {
+		if !basic {
+			form.Set("client_id", clientID)
+			form.Set("client_secret", secret)
+		}
+		r := httptest.NewRequest("POST", "/oauth2/revoke", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if basic {
+			r.SetBasicAuth(clientID, secret)
+		}
+		w := httptest.NewRecorder()
+		o.svc.revokeHandler(w, r)
+		w.Flush()
+		return w
+	}
+	exists := func(access string) bool {
+		ti, err := o.tokenStore.GetByAccess(access)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ti != nil
+	}
+
+	// bad client credentials
+	w := revoke(client.ID, "wrong", url.Values{"token": {token.Access}}, true)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := revoke("", "", url.Values{"token": {token.Access}}, false); w.Code != http.StatusUnauthorized {
+		t.Errorf("got %d", w.Code)
+	}
+	if !exists(token.Access) {
+		t.Fatal("token revoked without client credentials")
+	}
+
+	// missing token
+	if w := revoke(client.ID, client.Secret, url.Values{}, true); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// tokens issued to other clients and unknown tokens are left alone, but look revoked
+	if w := revoke(client.ID, client.Secret, url.Values{"token": {otherToken.Access}}, true); w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	if !exists(otherToken.Access) {
+		t.Error("revoked another client's token")
+	}
+	if w := revoke(client.ID, client.Secret, url.Values{"token": {generateID()}}, true); w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// access token
+	if w := revoke(client.ID, client.Secret, url.Values{"token": {token.Access}}, false); w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	if exists(token.Access) {
+		t.Error("expected access token to be revoked")
+	}
+
+	// refresh token, the hint is optional
+	w = revoke(client.ID, client.Secret, url.Values{"token": {paired.Refresh}, "token_type_hint": {"refresh_token"}}, true)
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	if exists(paired.Access) {
+		t.Error("expected paired access token to be revoked")
+	}
+	if ti, _ := o.tokenStore.GetByRefresh(paired.Refresh); ti != nil {
+		t.Error("expected refresh token to be revoked")
+	}
+
+	if w := revoke(other.ID, other.Secret, url.Values{"token": {otherToken.Access}, "token_type_hint": {"refresh_token"}}, true); w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	if exists(otherToken.Access) {
+		t.Error("expected access token to be revoked with the wrong hint")
+	}
+
+	// public clients only send their client_id
+	public, publicToken := createOAuthClient(t, o, userId)
+	public.Secret = ""
+	if err := o.svc.clientStore.Set(public.ID, public); err != nil {
+		t.Fatal(err)
+	}
+	_, confidentialToken := createOAuthClient(t, o, userId)
+	if w := revoke(public.ID, "", url.Values{"token": {confidentialToken.Access}}, false); w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	if !exists(confidentialToken.Access) {
+		t.Error("public client revoked another client's token")
+	}
+	if w := revoke(public.ID, "guess", url.Values{"token": {publicToken.Access}}, true); w.Code != http.StatusUnauthorized {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := revoke(public.ID, "", url.Values{"token": {publicToken.Access}}, false); w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	if exists(publicToken.Access) {
+		t.Error("expected public client's token to be revoked")
+	}
+
+	// confidential clients still need their secret
+	if w := revoke(client.ID, "", url.Values{"token": {confidentialToken.Access}}, false); w.Code != http.StatusUnauthorized {
+		t.Errorf("got %d", w.Code)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+var (
+	errInvalidScope = errors.New("invalid scope")
+)
+
+// validateScope checks scope is a space delimited list of scope tokens (RFC 6749 section 3.3)
+func validateScope(scope string) error {
+	for _, token := range strings.Fields(scope) {
+		for _, c := range token {
+			// scope-token = 1*( %x21 / %x23-5B / %x5D-7E )
+			if c < 0x21 || c > 0x7e || c == '"' || c == '\\' {
+				return fmt.Errorf("%v: %q", errInvalidScope, token)
+			}
+		}
+	}
+	return nil
+}
+
+// normalizeScope removes duplicate and extra whitespace from scope and sorts it
+func normalizeScope(scope string) string {
+	seen := make(map[string]bool)
+	var tokens []string
+	for _, token := range strings.Fields(scope) {
+		if !seen[token] {
+			seen[token] = true
+			tokens = append(tokens, token)
+		}
+	}
+	sort.Strings(tokens)
+	return strings.Join(tokens, " ")
+}
+
+// scopeAllows returns true if every token in requested is part of allowed. It checks token
+// requests against a client's scope, where clients created before scopes existed have an
+// empty scope and can request anything.
+func scopeAllows(allowed string, requested string) bool {
+	if strings.TrimSpace(allowed) == "" {
+		return true
+	}
+	tokens := make(map[string]bool)
+	for _, token := range strings.Fields(allowed) {
+		tokens[token] = true
+	}
+	for _, token := range strings.Fields(requested) {
+		if !tokens[token] {
+			return false
+		}
+	}
+	return true
+}
+
+// scopeIncludes returns true if token is one of the scopes in scope
+func scopeIncludes(scope string, token string) bool {
+	for _, t := range strings.Fields(scope) {
+		if t == token {
+			return true
+		}
+	}
+	return false
+}
+
+// clientScopeHandler rejects token requests asking for scopes the client isn't allowed.
+// It's called by the oauth2 server for every token request. OpenID Connect scopes are
+// always allowed.
+func (o *oauth) clientScopeHandler(clientID, scope string) (bool, error) {
+	allowed, err := o.clientStore.GetScope(clientID)
+	if err != nil {
+		return false, err
+	}
+	return scopeAllows(allowed, o.withoutOIDCScopes(scope)), nil
+}
+
+// refreshingScopeHandler rejects refresh token requests asking for scopes the refreshed
+// token didn't have, so a token's scope can only be narrowed when it's refreshed. The
+// client's scope is checked in tokenHandler, as the oauth2 server doesn't pass the client.
+func refreshingScopeHandler(newScope, oldScope string) (bool, error) {
+	return scopeAllows(oldScope, newScope), nil
+}
+
+// scopeRule requires a scope for requests matching a method and path prefix
+type scopeRule struct {
+	method string // "*" matches every method
+	prefix string
+	scope  string
+}
+
+// readScopeRules reads the file at path (set with OAUTH2_SCOPE_RULES) where each line
+// is a method, path prefix and the scope required for matching requests. For example:
+//
+//	# method  path           scope
+//	GET       /v1/ach/files  ach:read
+//	*         /v1/ach/files  ach:write
+//
+// Blank lines and lines starting with # are ignored. An empty path returns no rules.
+func readScopeRules(path string) ([]scopeRule, error) {
+	if path == "" {
+		return nil, nil
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	var rules []scopeRule
+	scanner := bufio.NewScanner(fd)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s line %d: expected method, path and scope", path, line)
+		}
+		if !strings.HasPrefix(fields[1], "/") {
+			return nil, fmt.Errorf("%s line %d: path must start with /", path, line)
+		}
+		if err := validateScope(fields[2]); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, line, err)
+		}
+		rules = append(rules, scopeRule{
+			method: strings.ToUpper(fields[0]),
+			prefix: fields[1],
+			scope:  fields[2],
+		})
+	}
+	return rules, scanner.Err()
+}
+
+// requiredScope returns the scope needed for the request our proxy is checking, or an
+// empty string if none is required. The longest matching path prefix wins and rules for
+// a specific method win over "*" rules with the same prefix.
+func (o *oauth) requiredScope(r *http.Request) string {
+	uri := r.Header.Get("X-Forwarded-Uri")
+	if uri == "" || len(o.scopeRules) == 0 {
+		return ""
+	}
+	if idx := strings.IndexAny(uri, "?#"); idx >= 0 {
+		uri = uri[:idx]
+	}
+	method := strings.ToUpper(r.Header.Get("X-Forwarded-Method"))
+	if method == "" {
+		method = r.Method
+	}
+
+	var best *scopeRule
+	for i := range o.scopeRules {
+		rule := &o.scopeRules[i]
+		if rule.method != "*" && rule.method != method {
+			continue
+		}
+		if !pathHasPrefix(uri, rule.prefix) {
+			continue
+		}
+		if best == nil || len(rule.prefix) > len(best.prefix) || (len(rule.prefix) == len(best.prefix) && best.method == "*") {
+			best = rule
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	return best.scope
+}
+
+// pathHasPrefix matches whole path segments, so /v1/ach matches /v1/ach/files but not /v1/achx
+func pathHasPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
@@ -0,0 +1,433 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moov-io/base"
+
+	"github.com/go-kit/kit/log"
+	"gopkg.in/oauth2.v3/models"
+)
+
+func TestScope__validate(t *testing.T) {
+	for _, scope := range []string{"", "ach:read", "ach:read  ach:write", "a!#$%&'()*+,-./:;<=>?@[]^_`{|}~"} {
+		if err := validateScope(scope); err != nil {
+			t.Errorf("%q: %v", scope, err)
+		}
+	}
+	for _, scope := range []string{`ach"read`, `ach\read`, "ach:réad"} {
+		if err := validateScope(scope); err == nil {
+			t.Errorf("%q: expected error", scope)
+		}
+	}
+
+	if v := normalizeScope("  b a\tb  c "); v != "a b c" {
+		t.Errorf("got %q", v)
+	}
+}
+
+func TestScope__allows(t *testing.T) {
+	cases := []struct {
+		allowed, requested string
+		expected           bool
+	}{
+		{"", "anything at all", true},
+		{"ach:read ach:write", "", true},
+		{"ach:read ach:write", "ach:read", true},
+		{"ach:read ach:write", "ach:write ach:read", true},
+		{"ach:read", "ach:read ach:write", false},
+		{"ach:read", "ach", false},
+	}
+	for _, tc := range cases {
+		if v := scopeAllows(tc.allowed, tc.requested); v != tc.expected {
+			t.Errorf("allowed=%q requested=%q: got %v", tc.allowed, tc.requested, v)
+		}
+	}
+}
+
+func writeScopeRules(t *testing.T, contents string) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "scope-rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "rules")
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestScope__rules(t *testing.T) {
+	path := writeScopeRules(t, `
+# method  path              scope
+GET       /v1/ach           ach:read
+*         /v1/ach           ach:write
+post      /v1/ach/files/    ach:files
+*         /v1/customers     customers
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	rules, err := readScopeRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 4 {
+		t.Fatalf("got %d rules", len(rules))
+	}
+	o := &oauth{scopeRules: rules}
+
+	cases := []struct {
+		method, uri, expected string
+	}{
+		{"GET", "/v1/ach/files", "ach:read"},
+		{"PUT", "/v1/ach/files", "ach:write"},
+		{"POST", "/v1/ach/files/abc?foo=bar", "ach:files"},
+		{"POST", "/v1/ach", "ach:write"},
+		{"GET", "/v1/achx", ""},
+		{"DELETE", "/v1/customers/foo", "customers"},
+		{"GET", "/v1/paygate", ""},
+		{"GET", "", ""},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest("GET", "/auth/check", nil)
+		r.Header.Set("X-Forwarded-Method", tc.method)
+		if tc.uri != "" {
+			r.Header.Set("X-Forwarded-Uri", tc.uri)
+		}
+		if v := o.requiredScope(r); v != tc.expected {
+			t.Errorf("%s %s: got %q expected %q", tc.method, tc.uri, v, tc.expected)
+		}
+	}
+
+	// no rules
+	if rules, err := readScopeRules(""); err != nil || rules != nil {
+		t.Errorf("rules=%v err=%v", rules, err)
+	}
+
+	// invalid rules
+	for _, contents := range []string{"GET /v1/ach", "GET v1/ach ach:read", `GET /v1/ach ach"read`} {
+		path := writeScopeRules(t, contents)
+		defer os.RemoveAll(filepath.Dir(path))
+
+		if _, err := readScopeRules(path); err == nil {
+			t.Errorf("%q: expected error", contents)
+		}
+	}
+}
+
+func TestScope__createClient(t *testing.T) {
+	o, err := createTestOAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.cleanup()
+
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+
+	u := &User{ID: generateID(), Email: "test@moov.io", EmailVerified: true, CreatedAt: base.NewTime(time.Now())}
+	if err := repo.upsert(u); err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := createCookie(u.ID, auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	create := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/oauth2/client", strings.NewReader(body))
+		r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+		o.svc.createClientHandler(auth, repo)(w, r)
+		w.Flush()
+		return w
+	}
+
+	if w := create(`{"scope": "ach\"read"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	w := create(`{"scope": "ach:write ach:read ach:read"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	var clients []*client
+	if err := json.NewDecoder(w.Body).Decode(&clients); err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) != 1 || clients[0].Scope != "ach:read ach:write" {
+		t.Fatalf("unexpected clients: %#v", clients)
+	}
+	if scope, err := o.svc.clientStore.GetScope(clients[0].ClientID); err != nil || scope != "ach:read ach:write" {
+		t.Errorf("scope=%q err=%v", scope, err)
+	}
+
+	// without a body clients are unrestricted
+	if w := create(""); w.Code != http.StatusOK || strings.Contains(w.Body.String(), "scope") {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestScope__tokenRequest(t *testing.T) {
+	o, err := createTestOAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.cleanup()
+
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	userId := generateID()
+	cookie, err := createCookie(userId, auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _ := createOAuthClient(t, o, userId)
+	if err := o.svc.clientStore.SetScope(client.ID, "ach:read ach:write"); err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(scope string) *httptest.ResponseRecorder {
+		url := fmt.Sprintf("/oauth2/token?grant_type=client_credentials&client_id=%s&client_secret=%s&scope=%s", client.ID, client.Secret, scope)
+		req := httptest.NewRequest("POST", url, nil)
+		req.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+
+		w := httptest.NewRecorder()
+		o.svc.tokenHandler(auth, nil)(w, req)
+		w.Flush()
+		return w
+	}
+	readScope := func(w *httptest.ResponseRecorder) string {
+		var resp struct {
+			Scope string `json:"scope"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Scope
+	}
+
+	// asking for more than allowed
+	if w := request("ach:read+admin"); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	// asking for less
+	w := request("ach:read")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if scope := readScope(w); scope != "ach:read" {
+		t.Errorf("got scope %q", scope)
+	}
+
+	// defaults to everything the client is allowed
+	w = request("")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if scope := readScope(w); scope != "ach:read ach:write" {
+		t.Errorf("got scope %q", scope)
+	}
+}
+
+func TestScope__refresh(t *testing.T) {
+	o, err := createTestOAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.cleanup()
+
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	userId := generateID()
+	cookie, err := createCookie(userId, auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _ := createOAuthClient(t, o, userId)
+	if err := o.svc.clientStore.SetScope(client.ID, "ach:read ach:write"); err != nil {
+		t.Fatal(err)
+	}
+
+	type tokenResponse struct {
+		RefreshToken string `json:"refresh_token"`
+		Scope        string `json:"scope"`
+	}
+	request := func(form url.Values) (*httptest.ResponseRecorder, tokenResponse) {
+		form.Set("client_id", client.ID)
+		form.Set("client_secret", client.Secret)
+		req := httptest.NewRequest("POST", "/oauth2/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+
+		w := httptest.NewRecorder()
+		o.svc.tokenHandler(auth, nil)(w, req)
+		w.Flush()
+
+		var resp tokenResponse
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w, resp
+	}
+
+	w, resp := request(url.Values{"grant_type": {"client_credentials"}, "scope": {"ach:read"}})
+	if w.Code != http.StatusOK || resp.Scope != "ach:read" {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	// wider than the client is allowed, or than the token was issued with
+	for _, scope := range []string{"admin ach:write", "ach:read ach:write"} {
+		w, _ := request(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {resp.RefreshToken}, "scope": {scope}})
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_scope") {
+			t.Errorf("scope %q: got %d: %s", scope, w.Code, w.Body.String())
+		}
+	}
+
+	// the refresh token wasn't used up by the rejected requests
+	w, resp = request(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {resp.RefreshToken}})
+	if w.Code != http.StatusOK || resp.Scope != "ach:read" {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestScope__checkAuth(t *testing.T) {
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	o, err := createTestOAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.cleanup()
+
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+
+	path := writeScopeRules(t, "GET /v1/ach ach:read\n* /v1/ach ach:write\n")
+	defer os.RemoveAll(filepath.Dir(path))
+	if o.svc.scopeRules, err = readScopeRules(path); err != nil {
+		t.Fatal(err)
+	}
+
+	u := &User{ID: generateID(), Email: "test@moov.io", EmailVerified: true, CreatedAt: base.NewTime(time.Now())}
+	if err := repo.upsert(u); err != nil {
+		t.Fatal(err)
+	}
+	_, token := createOAuthClient(t, o, u.ID)
+	legacy := &models.Token{
+		ClientID:        token.ClientID,
+		UserID:          u.ID,
+		Access:          generateID(),
+		AccessCreateAt:  time.Now(),
+		AccessExpiresIn: time.Hour,
+	}
+	if err := o.tokenStore.Create(legacy); err != nil {
+		t.Fatal(err)
+	}
+	token.Access = generateID()
+	token.Scope = "ach:read"
+	if err := o.tokenStore.Create(token); err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := createCookie(u.ID, auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(method, uri string, setAuth func(r *http.Request)) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/auth/check", nil)
+		r.Header.Set("X-Forwarded-Method", method)
+		r.Header.Set("X-Forwarded-Uri", uri)
+		setAuth(r)
+		checkAuth(log.NewNopLogger(), auth, o.svc, repo)(w, r)
+		w.Flush()
+		return w
+	}
+	bearer := func(access string) func(r *http.Request) {
+		return func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer "+access)
+		}
+	}
+
+	w := check("GET", "/v1/ach/files", bearer(token.Access))
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	if v := w.Header().Get("X-Scopes"); v != "ach:read" {
+		t.Errorf("X-Scopes: %q", v)
+	}
+
+	w = check("POST", "/v1/ach/files", bearer(token.Access))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+	if v := w.Header().Get("WWW-Authenticate"); !strings.Contains(v, `scope="ach:write"`) {
+		t.Errorf("WWW-Authenticate: %q", v)
+	}
+
+	// requests without a rule only need a valid token
+	if w := check("POST", "/v1/paygate", bearer(token.Access)); w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// tokens created before scopes don't have the scope a rule requires
+	if w := check("GET", "/v1/ach/files", bearer(legacy.Access)); w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+	w = check("POST", "/v1/paygate", bearer(legacy.Access))
+	if w.Code != http.StatusOK || w.Header().Get("X-Scopes") != "" {
+		t.Errorf("got %d, X-Scopes=%q", w.Code, w.Header().Get("X-Scopes"))
+	}
+
+	// cookies are unrestricted
+	w = check("POST", "/v1/ach/files", func(r *http.Request) {
+		r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+	})
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/moov-io/base"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+var (
+	errSessionNotFound = errors.New("session not found")
+)
+
+// session is a logged in browser, created on each login and identified by the moov_auth cookie.
+type session struct {
+	ID        string    `json:"id"`
+	UserAgent string    `json:"userAgent"`
+	IPAddress string    `json:"ipAddress"`
+	CreatedAt base.Time `json:"createdAt"`
+	LastSeen  base.Time `json:"lastSeen"`
+	ExpiresAt base.Time `json:"expiresAt"`
+
+	// Current is true for the session making the request
+	Current bool `json:"current"`
+
+	// data is the hashed cookie value
+	data string
+}
+
+func addSessionRoutes(r *mux.Router, logger log.Logger, auth authable) {
+	r.Methods("GET").Path("/users/{user_id}/sessions").HandlerFunc(listSessionsRoute(logger, auth))
+	r.Methods("DELETE").Path("/users/{user_id}/sessions/{session_id}").HandlerFunc(deleteSessionRoute(logger, auth))
+}
+
+func listSessionsRoute(logger log.Logger, auth authable) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "listSessionsRoute")
+
+		userId, err := extractUserId(auth, r)
+		if err != nil || userId != mux.Vars(r)["user_id"] {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		sessions, err := auth.listSessions(userId)
+		if err != nil {
+			internalError(w, fmt.Errorf("problem listing sessions: %v", err))
+			return
+		}
+		current, _ := hash(extractCookie(r).Value)
+		for i := range sessions {
+			sessions[i].Current = sessions[i].data == current
+		}
+		if sessions == nil {
+			sessions = []*session{} // render an empty array rather than null
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(sessions); err != nil {
+			internalError(w, err)
+			return
+		}
+	}
+}
+
+func deleteSessionRoute(logger log.Logger, auth authable) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "deleteSessionRoute")
+
+		userId, err := extractUserId(auth, r)
+		if err != nil || userId != mux.Vars(r)["user_id"] {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		sessionId := mux.Vars(r)["session_id"]
+		if err := auth.deleteSession(userId, sessionId); err != nil {
+			if err == errSessionNotFound {
+				problem(w, http.StatusNotFound, err)
+				return
+			}
+			internalError(w, fmt.Errorf("problem deleting session: %v", err))
+			return
+		}
+		authInactivations.With("method", "web").Add(1)
+		logger.Log("session", fmt.Sprintf("userId=%s deleted session %s", userId, sessionId))
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+func TestSessions__routes(t *testing.T) {
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	userId := generateID()
+
+	// login from two devices
+	r := httptest.NewRequest("POST", "/users/login", nil)
+	r.Header.Set("User-Agent", "laptop")
+	r.RemoteAddr = "203.0.113.9:4567"
+	laptop, err := createCookie(userId, auth, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("User-Agent", "phone")
+	phone, err := createCookie(userId, auth, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	addSessionRoutes(router, log.NewNopLogger(), auth)
+
+	list := func(cookie *http.Cookie) []*session {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", fmt.Sprintf("/users/%s/sessions", userId), nil)
+		r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+		router.ServeHTTP(w, r)
+		w.Flush()
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d: %s", w.Code, w.Body.String())
+		}
+		var sessions []*session
+		if err := json.NewDecoder(w.Body).Decode(&sessions); err != nil {
+			t.Fatal(err)
+		}
+		return sessions
+	}
+
+	sessions := list(laptop)
+	if len(sessions) != 2 {
+		t.Fatalf("got %d sessions", len(sessions))
+	}
+	var phoneSessionId string
+	for i := range sessions {
+		if sessions[i].IPAddress != "203.0.113.9" {
+			t.Errorf("unexpected IP: %q", sessions[i].IPAddress)
+		}
+		if sessions[i].CreatedAt.IsZero() || sessions[i].LastSeen.IsZero() {
+			t.Errorf("missing timestamps: %#v", sessions[i])
+		}
+		switch sessions[i].UserAgent {
+		case "laptop":
+			if !sessions[i].Current {
+				t.Error("expected laptop to be the current session")
+			}
+		case "phone":
+			phoneSessionId = sessions[i].ID
+			if sessions[i].Current {
+				t.Error("expected phone to not be the current session")
+			}
+		}
+	}
+
+	// other users can't see or delete our sessions
+	other, err := createCookie(generateID(), auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("DELETE", fmt.Sprintf("/users/%s/sessions/%s", userId, phoneSessionId), nil)
+	req.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", other.Value))
+	router.ServeHTTP(w, req)
+	w.Flush()
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	// delete the phone's session from the laptop
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("DELETE", fmt.Sprintf("/users/%s/sessions/%s", userId, phoneSessionId), nil)
+	req.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", laptop.Value))
+	router.ServeHTTP(w, req)
+	w.Flush()
+
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	if id, _ := auth.findUserId(phone.Value); id != "" {
+		t.Errorf("phone session still valid for userId=%s", id)
+	}
+	if sessions := list(laptop); len(sessions) != 1 {
+		t.Errorf("got %d sessions", len(sessions))
+	}
+
+	// deleting it again is a 404
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("DELETE", fmt.Sprintf("/users/%s/sessions/%s", userId, phoneSessionId), nil)
+	req.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", laptop.Value))
+	router.ServeHTTP(w, req)
+	w.Flush()
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+}
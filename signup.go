@@ -36,11 +36,11 @@ type signupRequest struct {
 	CompanyURL string `json:"companyUrl,omitempty"`
 }
 
-func addSignupRoutes(router *mux.Router, logger log.Logger, auth authable, userService userRepository) {
-	router.Methods("POST").Path("/users/create").HandlerFunc(signupRoute(auth, userService))
+func addSignupRoutes(router *mux.Router, logger log.Logger, auth authable, userService userRepository, mail mailer) {
+	router.Methods("POST").Path("/users/create").HandlerFunc(signupRoute(auth, userService, mail))
 }
 
-func signupRoute(auth authable, userService userRepository) func(w http.ResponseWriter, r *http.Request) {
+func signupRoute(auth authable, userService userRepository, mail mailer) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w = wrapResponseWriter(w, r, "signupRoute")
 
@@ -72,8 +72,9 @@ func signupRoute(auth authable, userService userRepository) func(w http.Response
 			}
 			return
 		}
-		if err := validatePassword(signup.Password); err != nil {
-			moovhttp.Problem(w, err)
+		personalInfo := &User{Email: signup.Email, FirstName: signup.FirstName, LastName: signup.LastName}
+		if err := passwordRules.check(auth, personalInfo, signup.Password); err != nil {
+			passwordProblem(w, err)
 			if requestID != "" && logger != nil {
 				logger.Log("signup", fmt.Sprintf("(requestID=%s) invalid password: %v", requestID, err))
 			}
@@ -126,12 +127,16 @@ func signupRoute(auth authable, userService userRepository) func(w http.Response
 				return
 			}
 
+			// users can't login until they click the link we've emailed them
+			if err := sendApprovalEmail(userService, mail, u); err != nil {
+				internalError(w, fmt.Errorf("problem sending approval email: %v", err))
+				return
+			}
+
 			// signup worked, yay!
 			w.Header().Set("Content-Type", "application/json; charset=utf-8")
 			w.WriteHeader(http.StatusOK)
 			w.Write([]byte("{}"))
-
-			// TODO(adam): email approval link and clickthrough
 		} else {
 			// user found, so reject signup
 			moovhttp.Problem(w, fmt.Errorf("user already exists - %s", signup.Email))
@@ -8,7 +8,12 @@ import (
 	"database/sql"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
 )
 
 func TestSqlite__basic(t *testing.T) {
@@ -31,3 +36,110 @@ func TestSqlite__basic(t *testing.T) {
 	}
 	res.Close()
 }
+
+func TestDatabase__version(t *testing.T) {
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	if v, err := auth.db.version(); err != nil || !strings.HasPrefix(v, "3.") {
+		t.Errorf("version=%q err=%v", v, err)
+	}
+}
+
+func TestMigrations__userCookies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth-migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a database created before migrations were versioned, with someone logged in
+	dsn := "file:" + filepath.Join(dir, "auth.db")
+	db, err := openDatabase(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, query := range migrations[0].Up["sqlite3"] {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	userId, cookie := generateID(), generateID()
+	data, err := hash(cookie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validUntil := time.Now().Add(time.Hour).Format(serializedTimestampFormat)
+	if _, err := db.Exec(`insert into user_cookies (user_id, data, valid_until) values (?, ?, ?)`, userId, data, validUntil); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := setupUserStore(dsn, log.NewNopLogger(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+	if id, err := store.findUserId(cookie); err != nil || id != userId {
+		t.Errorf("user was logged out: id=%q err=%v", id, err)
+	}
+	var n int
+	if err := db.QueryRow(`select count(*) from sqlite_master where type = 'table' and name = 'user_cookies'`).Scan(&n); err != nil || n != 0 {
+		t.Errorf("expected user_cookies to be dropped: n=%d err=%v", n, err)
+	}
+
+	// rolling back keeps the session as a cookie
+	m := newUserMigrator(db, nil)
+	m.ForceDown = true // past converting timestamps to UTC
+	if err := m.Down(len(migrations) - 2); err != nil {
+		t.Fatal(err)
+	}
+	var found string
+	if err := db.QueryRow(`select user_id from user_cookies where data = ?`, data).Scan(&found); err != nil || found != userId {
+		t.Errorf("found=%q err=%v", found, err)
+	}
+}
+
+func TestMigrations__utc(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth-migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := openDatabase("file:" + filepath.Join(dir, "auth.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// a session written by an instance west of UTC before timestamps were converted
+	m := newUserMigrator(db, nil)
+	m.Migrations = migrations[:len(migrations)-1]
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	when := time.Date(2020, time.November, 1, 1, 30, 0, 0, time.FixedZone("PDT", -7*60*60))
+	local := when.Format(serializedTimestampFormat)
+	query := `insert into user_sessions (session_id, user_id, data, created_at, last_seen, user_agent, ip_address, valid_until) values (?, ?, ?, ?, ?, '', '', 'never')`
+	if _, err := db.Exec(query, generateID(), generateID(), generateID(), local, local); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrate(db, log.NewNopLogger()); err != nil {
+		t.Fatal(err)
+	}
+	var createdAt, validUntil string
+	if err := db.QueryRow(`select created_at, valid_until from user_sessions`).Scan(&createdAt, &validUntil); err != nil {
+		t.Fatal(err)
+	}
+	if createdAt != "2020-11-01 08:30:00 +0000 UTC" {
+		t.Errorf("created_at=%q", createdAt)
+	}
+	if validUntil != "never" {
+		t.Errorf("unparsable timestamp was changed: %q", validUntil)
+	}
+}
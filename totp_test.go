@@ -0,0 +1,79 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTOTP__code(t *testing.T) {
+	// SHA1 test vectors from RFC 6238 Appendix B, truncated to 6 digits
+	secret := []byte("12345678901234567890")
+	cases := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for i := range cases {
+		if code := totpCode(secret, totpStep(time.Unix(cases[i].unix, 0))); code != cases[i].code {
+			t.Errorf("T=%d: got %s, expected %s", cases[i].unix, code, cases[i].code)
+		}
+	}
+}
+
+func TestTOTP__validate(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := totpEncoding.DecodeString(secret)
+	if len(key) != 20 {
+		t.Errorf("got %d byte secret", len(key))
+	}
+
+	now := time.Now()
+	step := totpStep(now)
+
+	// current and adjacent codes are accepted
+	for _, s := range []int64{step - 1, step, step + 1} {
+		if n, err := validateTOTP(secret, totpCode(key, s), now); err != nil || n != s {
+			t.Errorf("step=%d: n=%d err=%v", s, n, err)
+		}
+	}
+	// but not older/newer ones
+	for _, s := range []int64{step - 2, step + 2} {
+		if n, err := validateTOTP(secret, totpCode(key, s), now); err != nil || n != 0 {
+			t.Errorf("step=%d: n=%d err=%v", s, n, err)
+		}
+	}
+	if n, err := validateTOTP(secret, "12345", now); err != nil || n != 0 {
+		t.Errorf("n=%d err=%v", n, err)
+	}
+	if _, err := validateTOTP("not base32!", "123456", now); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestTOTP__uri(t *testing.T) {
+	u, err := url.Parse(totpURI("JBSWY3DPEHPK3PXP", "jane@moov.io"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Moov:jane@moov.io" {
+		t.Errorf("unexpected URI: %s", u)
+	}
+	q := u.Query()
+	if q.Get("secret") != "JBSWY3DPEHPK3PXP" || q.Get("issuer") != "Moov" || q.Get("digits") != "6" || q.Get("period") != "30" {
+		t.Errorf("unexpected query: %v", q)
+	}
+}
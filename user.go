@@ -5,9 +5,10 @@
 package main
 
 import (
+	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
-	"database/sql"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -22,13 +23,8 @@ import (
 
 	"github.com/go-kit/kit/log"
 	"github.com/gorilla/mux"
-	"golang.org/x/crypto/bcrypt"
 )
 
-// TODO(adam): validate email (by sending with approval_code) [probably diff file]
-
-// TODO(adam): having a row in user_approval_codes means user isn't verified. Delete on email approval.
-
 type User struct {
 	ID         string    `json:"id"`
 	Email      string    `json:"email"`
@@ -37,6 +33,18 @@ type User struct {
 	Phone      string    `json:"phone"`
 	CompanyURL string    `json:"companyUrl"`
 	CreatedAt  base.Time `json:"createdAt"`
+
+	// EmailVerified is false while the user has an outstanding row in user_approval_codes.
+	// It's read-only and ignored by upsert.
+	EmailVerified bool `json:"emailVerified"`
+
+	// MFAEnabled is true when the user must present a second factor to login.
+	// It's stored by authable and only populated on login responses.
+	MFAEnabled bool `json:"mfaEnabled"`
+
+	// RecoveryCodesRemaining is how many unused MFA recovery codes the user has.
+	// Like MFAEnabled it's only populated on login responses.
+	RecoveryCodesRemaining int `json:"recoveryCodesRemaining"`
 }
 
 var (
@@ -49,10 +57,19 @@ var (
 const (
 	bcryptCostFactor = 10
 
+	// sessionLastSeenInterval is how often a session's last_seen column is updated
+	sessionLastSeenInterval = 1 * time.Minute
+
 	// from 'go doc time Time.String', format used in sqlite columns
 	serializedTimestampFormat = "2006-01-02 15:04:05.999999999 -0700 MST"
 )
 
+// formatTimestamp returns t as it's stored and compared in our tables. Timestamps are
+// kept in UTC so they sort in order as text, whatever the time zone of each instance.
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format(serializedTimestampFormat)
+}
+
 func (u *User) cleanEmail() string {
 	return cleanEmail(u.Email)
 }
@@ -163,19 +180,28 @@ type userRepository interface {
 	lookupByEmail(email string) (*User, error)
 
 	upsert(*User) error
+
+	// writeApprovalCode saves the code a user must present to verify their email address.
+	// Any previous code for the user is replaced.
+	writeApprovalCode(userId string, code string, validUntil time.Time) error
+
+	// consumeApprovalCode marks the user owning code as verified and returns their userId.
+	// An empty userId is returned if the code doesn't exist or has expired.
+	consumeApprovalCode(code string) (string, error)
 }
 
-type sqliteUserRepository struct {
-	db  *sql.DB
+type sqlUserRepository struct {
+	db  *database
 	log log.Logger
 }
 
-func (repo sqliteUserRepository) close() error {
+func (repo sqlUserRepository) close() error {
 	return repo.db.Close()
 }
 
-func (s *sqliteUserRepository) lookupByUserId(userId string) (*User, error) {
-	query := `select u.email, u.created_at, ud.first_name, ud.last_name, ud.phone, ud.company_url
+func (s *sqlUserRepository) lookupByUserId(userId string) (*User, error) {
+	query := `select u.email, u.created_at, ud.first_name, ud.last_name, ud.phone, ud.company_url,
+(select count(*) from user_approval_codes as uac where uac.user_id = u.user_id) as unverified
 from users as u
 inner join user_details as ud
 on u.user_id = ud.user_id
@@ -192,7 +218,8 @@ limit 1`
 	u := &User{}
 	u.ID = userId
 	var createdAt string // needs parsing
-	err = row.Scan(&u.Email, &createdAt, &u.FirstName, &u.LastName, &u.Phone, &u.CompanyURL)
+	var unverified int
+	err = row.Scan(&u.Email, &createdAt, &u.FirstName, &u.LastName, &u.Phone, &u.CompanyURL, &unverified)
 	if err != nil {
 		if strings.Contains(err.Error(), "no rows in result set") {
 			return nil, nil // no user found
@@ -205,13 +232,14 @@ limit 1`
 		s.log.Log("user", fmt.Sprintf("bad users.created_at format %q: %v", createdAt, err))
 	}
 	u.CreatedAt = base.NewTime(t)
+	u.EmailVerified = unverified == 0
 	if u.Email == "" {
 		return nil, nil
 	}
 	return u, nil
 }
 
-func (s *sqliteUserRepository) lookupByEmail(email string) (*User, error) {
+func (s *sqlUserRepository) lookupByEmail(email string) (*User, error) {
 	query := `select user_id from users where clean_email = ?`
 	stmt, err := s.db.Prepare(query)
 	if err != nil {
@@ -236,20 +264,20 @@ func (s *sqliteUserRepository) lookupByEmail(email string) (*User, error) {
 	return s.lookupByUserId(userId)
 }
 
-func (s *sqliteUserRepository) upsert(inc *User) error {
+func (s *sqlUserRepository) upsert(inc *User) error {
 	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
 
 	// insert/update into 'users'
-	query := `replace into users (user_id, email, clean_email, created_at) values (?, ?, ?, ?)`
+	query := s.db.upsert("users", []string{"user_id"}, "user_id", "email", "clean_email", "created_at")
 	stmt, err := tx.Prepare(query)
 	if err != nil {
 		e := tx.Rollback()
 		return fmt.Errorf("problem preparing users query userId=%s, err=%v, rollback err=%v", inc.ID, err, e)
 	}
-	_, err = stmt.Exec(inc.ID, inc.Email, inc.cleanEmail(), inc.CreatedAt.Format(serializedTimestampFormat))
+	_, err = stmt.Exec(inc.ID, inc.Email, inc.cleanEmail(), formatTimestamp(inc.CreatedAt.Time))
 	if err != nil {
 		stmt.Close()
 		e := tx.Rollback()
@@ -258,7 +286,7 @@ func (s *sqliteUserRepository) upsert(inc *User) error {
 	stmt.Close()
 
 	// insert/update into 'user_details'
-	query = `replace into user_details (user_id, first_name, last_name, phone, company_url) values (?, ?, ?, ?, ?)`
+	query = s.db.upsert("user_details", []string{"user_id"}, "user_id", "first_name", "last_name", "phone", "company_url")
 	stmt, err = tx.Prepare(query)
 	if err != nil {
 		e := tx.Rollback()
@@ -275,23 +303,189 @@ func (s *sqliteUserRepository) upsert(inc *User) error {
 	return tx.Commit()
 }
 
+func (s *sqlUserRepository) writeApprovalCode(userId string, code string, validUntil time.Time) error {
+	// the SHA256 checksum is stored, not the actual code.
+	code, err := hash(code)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := s.db.Prepare(s.db.upsert("user_approval_codes", []string{"user_id"}, "user_id", "code", "valid_until"))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(userId, code, formatTimestamp(validUntil))
+	return err
+}
+
+func (s *sqlUserRepository) consumeApprovalCode(code string) (string, error) {
+	code, err := hash(code)
+	if err != nil {
+		return "", err
+	}
+
+	stmt, err := s.db.Prepare(`select user_id, valid_until from user_approval_codes where code = ? limit 1`)
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+
+	var userId, validUntil string
+	if err := stmt.QueryRow(code).Scan(&userId, &validUntil); err != nil {
+		if strings.Contains(err.Error(), "no rows in result set") {
+			return "", nil // no code found
+		}
+		return "", err
+	}
+	t, err := time.Parse(serializedTimestampFormat, validUntil)
+	if err != nil || time.Now().After(t) {
+		return "", nil // expired
+	}
+
+	// having a row in user_approval_codes means the user isn't verified, so delete it.
+	// Codes are single use, only the request which deletes this one may use it.
+	stmt, err = s.db.Prepare(`delete from user_approval_codes where code = ? and valid_until > ?`)
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(code, formatTimestamp(time.Now()))
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return "", nil // used by a concurrent request or just expired
+	}
+	return userId, nil
+}
+
 // authable represents the interactions of a user's authentication
 // status. This boils down to password comparison and cookie data.
 type authable interface {
+	// findUserId returns the userId of the live session identified by the cookie data.
+	// The session's last seen timestamp is updated.
 	findUserId(data string) (string, error)
+
+	// invalidateCookie removes the session identified by the cookie data.
+	invalidateCookie(data string) error
+
+	// invalidateCookies removes every session for userId.
 	invalidateCookies(userId string) error
-	writeCookie(userId string, cookie *http.Cookie) error
+
+	// invalidateOtherCookies removes every session for userId except the one identified by the cookie data.
+	invalidateOtherCookies(userId string, data string) error
+
+	// listSessions returns the live sessions for userId, most recently seen first.
+	listSessions(userId string) ([]*session, error)
+
+	// deleteSession removes one of the user's sessions. errSessionNotFound is
+	// returned if the session doesn't exist or belongs to another user.
+	deleteSession(userId string, sessionId string) error
+
+	// writeCookie saves a new session for userId which is identified by the cookie's value.
+	// userAgent and ipAddress describe the client logging in and can be empty.
+	writeCookie(userId string, cookie *http.Cookie, userAgent, ipAddress string) error
 
 	// checkPassword compares the provided password for the user.
 	// a non-nil error is returned if the passwords don't match
 	// or that the userId doesn't exist.
 	checkPassword(userId string, pass string) error
 	writePassword(userId string, pass string) error
+
+	// passwordUsedRecently returns true if pass matches the user's current password or
+	// one of their previous n-1 passwords.
+	passwordUsedRecently(userId string, pass string, n int) (bool, error)
+
+	// writePasswordResetToken saves a token which allows the user to set a new password
+	// without knowing their current one.
+	writePasswordResetToken(userId string, token string, validUntil time.Time) error
+
+	// findPasswordResetToken returns the userId for a valid token without using it.
+	// An empty userId is returned for unknown or expired tokens.
+	findPasswordResetToken(token string) (string, error)
+
+	// consumePasswordResetToken returns the userId for a valid token and removes every
+	// reset token for that user. An empty userId is returned for unknown or expired tokens.
+	consumePasswordResetToken(token string) (string, error)
+
+	// writeTOTP saves an unconfirmed TOTP secret for userId, replacing any existing enrollment.
+	writeTOTP(userId string, secret string) error
+
+	// readTOTP returns the user's TOTP enrollment. nil is returned if the user has none.
+	readTOTP(userId string) (*totpEnrollment, error)
+
+	// confirmTOTP enables the user's TOTP enrollment after a code from step was accepted.
+	confirmTOTP(userId string, step int64) error
+
+	// useTOTPStep records step as the last accepted for the user. false is returned if
+	// a code from step (or later) was already accepted.
+	useTOTPStep(userId string, step int64) (bool, error)
+
+	deleteTOTP(userId string) error
+
+	// writeMFAChallenge saves a challenge issued after a user with MFA enabled presented their password.
+	writeMFAChallenge(userId string, challenge string, validUntil time.Time) error
+
+	// findMFAChallenge returns the userId for a challenge which hasn't expired or
+	// had too many failed attempts. An empty userId is returned otherwise.
+	findMFAChallenge(challenge string) (string, error)
+
+	// failMFAChallenge records a wrong code presented for the challenge.
+	failMFAChallenge(challenge string) error
+
+	deleteMFAChallenge(challenge string) error
+
+	// writeRecoveryCodes replaces the user's MFA recovery codes. An empty slice removes them all.
+	writeRecoveryCodes(userId string, codes []string) error
+
+	// useRecoveryCode removes code from the user's recovery codes, returning false if it wasn't found.
+	useRecoveryCode(userId string, code string) (bool, error)
+
+	countRecoveryCodes(userId string) (int, error)
+
+	// writeWebAuthnChallenge saves a challenge for a WebAuthn ceremony. userId is empty
+	// for passwordless logins where the user isn't known yet.
+	writeWebAuthnChallenge(userId string, challenge string, ceremony string, validUntil time.Time) error
+
+	// consumeWebAuthnChallenge removes the challenge and returns the userId it was issued for.
+	// ok is false if the challenge doesn't exist, has expired or was for another ceremony.
+	consumeWebAuthnChallenge(challenge string, ceremony string) (userId string, ok bool, err error)
+
+	writeWebAuthnCredential(cred *webauthnCredential) error
+
+	// readWebAuthnCredential returns the credential with the given base64url encoded ID,
+	// nil is returned if it doesn't exist.
+	readWebAuthnCredential(credentialId string) (*webauthnCredential, error)
+
+	listWebAuthnCredentials(userId string) ([]*webauthnCredential, error)
+
+	// updateWebAuthnCredential saves the credential's signature counter after a successful login.
+	updateWebAuthnCredential(credentialId string, signCount uint32) error
+
+	// deleteWebAuthnCredential removes one of the user's credentials. errWebAuthnCredentialNotFound
+	// is returned if the credential doesn't exist or belongs to another user.
+	deleteWebAuthnCredential(userId string, credentialId string) error
+
+	// readLoginAttempts returns the failed logins for key, nil is returned if there are none.
+	readLoginAttempts(key string) (*loginAttempts, error)
+
+	// addLoginFailure atomically counts a failed login at now for key, starting over when the
+	// last failure was longer than window ago. lockout returns how long the new count of failures
+	// locks key out for, which is saved along with it.
+	addLoginFailure(key string, now time.Time, window time.Duration, lockout func(failures int) time.Duration) (*loginAttempts, error)
+
+	deleteLoginAttempts(key string) error
 }
 
 type auth struct {
-	db  *sql.DB
+	db  *database
 	log log.Logger
+
+	// mfaKey encrypts TOTP secrets, MFA enrollment is disabled when nil
+	mfaKey cipher.AEAD
 }
 
 // findUserId takes cookie data and returns the userId associated
@@ -307,33 +501,86 @@ func (a *auth) findUserId(data string) (string, error) {
 		return "", err
 	}
 
-	query := `select user_id from user_cookies where data == ? and valid_until > ?`
+	query := `select session_id, user_id, last_seen from user_sessions where data = ? and valid_until > ?`
 	stmt, err := a.db.Prepare(query)
 	if err != nil {
 		return "", err
 	}
 	defer stmt.Close()
 
-	rows, err := stmt.Query(data, time.Now().Format(serializedTimestampFormat))
+	rows, err := stmt.Query(data, formatTimestamp(time.Now()))
 	if err != nil {
 		return "", err
 	}
 	defer rows.Close()
 
-	var userId string
+	var sessionId, userId, lastSeen string
 	for rows.Next() {
-		if err := rows.Scan(&userId); err != nil {
+		if err := rows.Scan(&sessionId, &userId, &lastSeen); err != nil {
 			return "", err
 		}
 		if userId != "" {
-			return userId, nil
+			break
+		}
+	}
+	if err := rows.Err(); err != nil || userId == "" {
+		return "", err
+	}
+	rows.Close()
+
+	// Avoid writing on every request by only updating last_seen periodically
+	if t, err := time.Parse(serializedTimestampFormat, lastSeen); err != nil || time.Since(t) > sessionLastSeenInterval {
+		if err := a.touchSession(sessionId, userId); err != nil {
+			a.log.Log("user", fmt.Sprintf("problem updating session last_seen for userId=%s: %v", userId, err))
 		}
 	}
-	return "", rows.Err()
+	return userId, nil
+}
+
+func (a *auth) touchSession(sessionId, userId string) error {
+	stmt, err := a.db.Prepare(`update user_sessions set last_seen = ? where session_id = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	now := time.Now()
+	if _, err = stmt.Exec(formatTimestamp(now), sessionId); err != nil {
+		return err
+	}
+	return a.writeActivity(userId, now)
+}
+
+// writeActivity records when userId last logged in or used a session
+func (a *auth) writeActivity(userId string, when time.Time) error {
+	stmt, err := a.db.Prepare(a.db.upsert("user_activity", []string{"user_id"}, "user_id", "last_active_at"))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(userId, formatTimestamp(when))
+	return err
+}
+
+func (a *auth) invalidateCookie(data string) error {
+	data, err := hash(strings.TrimSpace(data))
+	if err != nil {
+		return err
+	}
+
+	stmt, err := a.db.Prepare(`delete from user_sessions where data = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(data)
+	return err
 }
 
 func (a *auth) invalidateCookies(userId string) error {
-	stmt, err := a.db.Prepare(`delete from user_cookies where user_id = ?`)
+	stmt, err := a.db.Prepare(`delete from user_sessions where user_id = ?`)
 	if err != nil {
 		return err
 	}
@@ -348,8 +595,82 @@ func (a *auth) invalidateCookies(userId string) error {
 	return nil
 }
 
-func (a *auth) writeCookie(userId string, cookie *http.Cookie) error {
-	query := `insert or replace into user_cookies (user_id, data, valid_until) values (?, ?, ?)`
+func (a *auth) invalidateOtherCookies(userId string, data string) error {
+	data, err := hash(strings.TrimSpace(data))
+	if err != nil {
+		return err
+	}
+
+	stmt, err := a.db.Prepare(`delete from user_sessions where user_id = ? and data <> ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(userId, data)
+	if err != nil {
+		return err
+	}
+	n, _ := res.RowsAffected()
+	a.log.Log("user", fmt.Sprintf("deleted %d other cookies for userId=%s", n, userId))
+	return nil
+}
+
+func (a *auth) listSessions(userId string) ([]*session, error) {
+	query := `select session_id, data, created_at, last_seen, user_agent, ip_address, valid_until from user_sessions
+where user_id = ? and valid_until > ? order by last_seen desc`
+	stmt, err := a.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(userId, formatTimestamp(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*session
+	for rows.Next() {
+		var sess session
+		var createdAt, lastSeen, validUntil string // needs parsing
+		if err := rows.Scan(&sess.ID, &sess.data, &createdAt, &lastSeen, &sess.UserAgent, &sess.IPAddress, &validUntil); err != nil {
+			return nil, err
+		}
+		if t, err := time.Parse(serializedTimestampFormat, createdAt); err == nil {
+			sess.CreatedAt = base.NewTime(t)
+		}
+		if t, err := time.Parse(serializedTimestampFormat, lastSeen); err == nil {
+			sess.LastSeen = base.NewTime(t)
+		}
+		if t, err := time.Parse(serializedTimestampFormat, validUntil); err == nil {
+			sess.ExpiresAt = base.NewTime(t)
+		}
+		sessions = append(sessions, &sess)
+	}
+	return sessions, rows.Err()
+}
+
+func (a *auth) deleteSession(userId string, sessionId string) error {
+	stmt, err := a.db.Prepare(`delete from user_sessions where user_id = ? and session_id = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(userId, sessionId)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errSessionNotFound
+	}
+	return nil
+}
+
+func (a *auth) writeCookie(userId string, cookie *http.Cookie, userAgent, ipAddress string) error {
+	query := `insert into user_sessions (session_id, user_id, data, created_at, last_seen, user_agent, ip_address, valid_until) values (?, ?, ?, ?, ?, ?, ?, ?)`
 	stmt, err := a.db.Prepare(query)
 	if err != nil {
 		return err
@@ -361,25 +682,22 @@ func (a *auth) writeCookie(userId string, cookie *http.Cookie) error {
 	if err != nil {
 		return err
 	}
-	validUntil := cookie.Expires.Format(serializedTimestampFormat)
+	now := time.Now()
+	createdAt := formatTimestamp(now)
+	validUntil := formatTimestamp(cookie.Expires)
 
 	// write row
-	stmt.Exec(userId, data, validUntil)
-	return nil
-}
-
-// fakeBcryptRounds just performs a bcrypt.GenerateFromPassword and then
-// a bcrypto.CompareHashAndPassword afterwords. In an attempt to make happy
-// and sad paths take "approximately" the same.
-func (a *auth) fakeBcryptRounds() {
-	id := generateID()
-	bcrypt.CompareHashAndPassword([]byte(id), []byte(id))
+	_, err = stmt.Exec(generateID(), userId, data, createdAt, createdAt, userAgent, ipAddress, validUntil)
+	if err != nil {
+		return err
+	}
+	return a.writeActivity(userId, now)
 }
 
 func (a *auth) checkPassword(userId string, incoming string) error {
 	stmt, err := a.db.Prepare(`select password, salt from user_passwords where user_id = ?`)
 	if err != nil {
-		a.fakeBcryptRounds()
+		fakePasswordCheck()
 		return err
 	}
 	defer stmt.Close()
@@ -387,44 +705,657 @@ func (a *auth) checkPassword(userId string, incoming string) error {
 	row := stmt.QueryRow(userId)
 	var storedPassword, storedSalt string
 	if err := row.Scan(&storedPassword, &storedSalt); err != nil {
-		a.fakeBcryptRounds()
+		fakePasswordCheck()
+		return err
+	}
+	if err := verifyPassword(storedPassword, storedSalt, incoming); err != nil {
 		return err
 	}
 
-	return bcrypt.CompareHashAndPassword([]byte(storedPassword), []byte(incoming+storedSalt))
+	// upgrade old or weak hashes now that we have the password
+	if passwordHashing.needsRehash(storedPassword, storedSalt) {
+		if err := a.rehashPassword(userId, storedPassword, incoming); err != nil {
+			a.log.Log("user", fmt.Sprintf("problem upgrading password hash for userId=%s: %v", userId, err))
+		}
+	}
+	return nil
 }
 
-// writePassword saves a user's password. This function performs no authn/z and generates a new
-// salt (which is also saved).
-func (a *auth) writePassword(userId string, pass string) error {
-	salt := generateID()
-	incomingPassword, err := bcrypt.GenerateFromPassword([]byte(pass+salt), bcryptCostFactor)
+// rehashPassword replaces the user's password hash with one using the configured settings.
+// Nothing is written if the password was changed since it was read.
+func (a *auth) rehashPassword(userId string, storedPassword string, pass string) error {
+	hashed, err := passwordHashing.hash(pass)
 	if err != nil {
 		return err
 	}
-
-	stmt, err := a.db.Prepare(`replace into user_passwords (user_id, password, salt) values (?, ?, ?)`)
+	stmt, err := a.db.Prepare(`update user_passwords set password = ?, salt = '' where user_id = ? and password = ?`)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(userId, string(incomingPassword), salt)
+	_, err = stmt.Exec(hashed, userId, storedPassword)
+	return err
+}
+
+// writePassword saves a user's password hashed according to passwordHashing. This function
+// performs no authn/z. The previous password is kept in the user's password history.
+func (a *auth) writePassword(userId string, pass string) error {
+	hashed, err := passwordHashing.hash(pass)
+	if err != nil {
+		return err
+	}
+
+	tx, err := a.db.Begin()
 	if err != nil {
 		return err
 	}
+
+	now := formatTimestamp(time.Now())
+	query := `insert into user_password_history (user_id, password, salt, created_at) select user_id, password, salt, ? from user_passwords where user_id = ?`
+	if _, err := tx.Exec(query, now, userId); err != nil {
+		tx.Rollback()
+		return err
+	}
+	query = `delete from user_password_history where user_id = ? and created_at < (select created_at from user_password_history where user_id = ? order by created_at desc limit 1 offset ?)`
+	if _, err := tx.Exec(query, userId, userId, passwordHistoryMax-2); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(a.db.upsert("user_passwords", []string{"user_id"}, "user_id", "password", "salt"), userId, hashed, ""); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
 	a.log.Log("user", fmt.Sprintf("userId=%s updated password", userId))
 	return nil
 }
 
-func hash(in string) (string, error) {
-	ss := sha256.New()
-	n, err := ss.Write([]byte(in))
+func (a *auth) passwordUsedRecently(userId string, pass string, n int) (bool, error) {
+	if n <= 0 {
+		return false, nil
+	}
+	query := `select password, salt from user_passwords where user_id = ?
+union all
+select password, salt from (select password, salt from user_password_history where user_id = ? order by created_at desc limit ?) as history`
+	stmt, err := a.db.Prepare(query)
+	if err != nil {
+		return false, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(userId, userId, n-1)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var storedPassword, storedSalt string
+		if err := rows.Scan(&storedPassword, &storedSalt); err != nil {
+			return false, err
+		}
+		if verifyPassword(storedPassword, storedSalt, pass) == nil {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+func (a *auth) writePasswordResetToken(userId string, token string, validUntil time.Time) error {
+	// the SHA256 checksum is stored, not the actual token.
+	token, err := hash(token)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := a.db.Prepare(`insert into user_password_resets (token, user_id, valid_until) values (?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(token, userId, formatTimestamp(validUntil))
+	return err
+}
+
+func (a *auth) findPasswordResetToken(token string) (string, error) {
+	token, err := hash(token)
 	if err != nil {
 		return "", err
 	}
-	if n == 0 {
+
+	stmt, err := a.db.Prepare(`select user_id, valid_until from user_password_resets where token = ? limit 1`)
+	if err != nil {
 		return "", err
 	}
-	return hex.EncodeToString(ss.Sum(nil)), nil
+	defer stmt.Close()
+
+	var userId, validUntil string
+	if err := stmt.QueryRow(token).Scan(&userId, &validUntil); err != nil {
+		if strings.Contains(err.Error(), "no rows in result set") {
+			return "", nil // no token found
+		}
+		return "", err
+	}
+	t, err := time.Parse(serializedTimestampFormat, validUntil)
+	if err != nil || time.Now().After(t) {
+		return "", nil // expired
+	}
+	return userId, nil
+}
+
+func (a *auth) consumePasswordResetToken(token string) (string, error) {
+	userId, err := a.findPasswordResetToken(token)
+	if err != nil || userId == "" {
+		return "", err
+	}
+	hashed, err := hash(token)
+	if err != nil {
+		return "", err
+	}
+
+	// tokens are single use, only the request which deletes this one may use it
+	stmt, err := a.db.Prepare(`delete from user_password_resets where token = ? and valid_until > ?`)
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(hashed, formatTimestamp(time.Now()))
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return "", nil // used by a concurrent request or just expired
+	}
+
+	// drop any other tokens for the user
+	stmt, err = a.db.Prepare(`delete from user_password_resets where user_id = ?`)
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+
+	if _, err := stmt.Exec(userId); err != nil {
+		return "", err
+	}
+	return userId, nil
+}
+
+func (a *auth) writeTOTP(userId string, secret string) error {
+	secret, err := sealSecret(a.mfaKey, userId, secret)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := a.db.Prepare(a.db.upsert("user_totp", []string{"user_id"}, "user_id", "secret", "confirmed", "last_step", "created_at"))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(userId, secret, 0, 0, formatTimestamp(time.Now()))
+	return err
+}
+
+func (a *auth) readTOTP(userId string) (*totpEnrollment, error) {
+	stmt, err := a.db.Prepare(`select secret, confirmed, last_step from user_totp where user_id = ? limit 1`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	var enrollment totpEnrollment
+	var secret string
+	if err := stmt.QueryRow(userId).Scan(&secret, &enrollment.confirmed, &enrollment.lastStep); err != nil {
+		if strings.Contains(err.Error(), "no rows in result set") {
+			return nil, nil // not enrolled
+		}
+		return nil, err
+	}
+	enrollment.secret, err = openSecret(a.mfaKey, userId, secret)
+	if err != nil {
+		return nil, err
+	}
+	return &enrollment, nil
+}
+
+func (a *auth) confirmTOTP(userId string, step int64) error {
+	stmt, err := a.db.Prepare(`update user_totp set confirmed = 1, last_step = ? where user_id = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(step, userId)
+	return err
+}
+
+func (a *auth) useTOTPStep(userId string, step int64) (bool, error) {
+	stmt, err := a.db.Prepare(`update user_totp set last_step = ? where user_id = ? and last_step < ?`)
+	if err != nil {
+		return false, err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(step, userId, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (a *auth) deleteTOTP(userId string) error {
+	stmt, err := a.db.Prepare(`delete from user_totp where user_id = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(userId)
+	return err
+}
+
+func (a *auth) writeMFAChallenge(userId string, challenge string, validUntil time.Time) error {
+	// the SHA256 checksum is stored, not the actual challenge.
+	challenge, err := hash(challenge)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := a.db.Prepare(`insert into user_mfa_challenges (challenge, user_id, attempts, valid_until) values (?, ?, 0, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(challenge, userId, formatTimestamp(validUntil))
+	return err
+}
+
+func (a *auth) findMFAChallenge(challenge string) (string, error) {
+	challenge, err := hash(challenge)
+	if err != nil {
+		return "", err
+	}
+
+	stmt, err := a.db.Prepare(`select user_id, valid_until from user_mfa_challenges where challenge = ? and attempts < ? limit 1`)
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+
+	var userId, validUntil string
+	if err := stmt.QueryRow(challenge, mfaChallengeMaxAttempts).Scan(&userId, &validUntil); err != nil {
+		if strings.Contains(err.Error(), "no rows in result set") {
+			return "", nil // no challenge found
+		}
+		return "", err
+	}
+	t, err := time.Parse(serializedTimestampFormat, validUntil)
+	if err != nil || time.Now().After(t) {
+		return "", nil // expired
+	}
+	return userId, nil
+}
+
+func (a *auth) failMFAChallenge(challenge string) error {
+	challenge, err := hash(challenge)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := a.db.Prepare(`update user_mfa_challenges set attempts = attempts + 1 where challenge = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(challenge)
+	return err
+}
+
+func (a *auth) deleteMFAChallenge(challenge string) error {
+	challenge, err := hash(challenge)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := a.db.Prepare(`delete from user_mfa_challenges where challenge = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(challenge)
+	return err
+}
+
+func (a *auth) writeRecoveryCodes(userId string, codes []string) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// drop the existing codes
+	stmt, err := tx.Prepare(`delete from user_recovery_codes where user_id = ?`)
+	if err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("problem preparing user_recovery_codes delete userId=%s, err=%v, rollback err=%v", userId, err, e)
+	}
+	if _, err := stmt.Exec(userId); err != nil {
+		stmt.Close()
+		e := tx.Rollback()
+		return fmt.Errorf("problem deleting user_recovery_codes userId=%s, err=%v, rollback err=%v", userId, err, e)
+	}
+	stmt.Close()
+
+	// the SHA256 checksum of each code is stored, not the actual code.
+	stmt, err = tx.Prepare(`insert into user_recovery_codes (user_id, code, created_at) values (?, ?, ?)`)
+	if err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("problem preparing user_recovery_codes insert userId=%s, err=%v, rollback err=%v", userId, err, e)
+	}
+	defer stmt.Close()
+
+	now := formatTimestamp(time.Now())
+	for i := range codes {
+		code, err := hash(codes[i])
+		if err != nil {
+			e := tx.Rollback()
+			return fmt.Errorf("problem hashing recovery code userId=%s, err=%v, rollback err=%v", userId, err, e)
+		}
+		if _, err := stmt.Exec(userId, code, now); err != nil {
+			e := tx.Rollback()
+			return fmt.Errorf("problem inserting user_recovery_codes userId=%s, err=%v, rollback err=%v", userId, err, e)
+		}
+	}
+	return tx.Commit()
+}
+
+func (a *auth) useRecoveryCode(userId string, code string) (bool, error) {
+	code, err := hash(code)
+	if err != nil || code == "" {
+		return false, err
+	}
+
+	stmt, err := a.db.Prepare(`delete from user_recovery_codes where user_id = ? and code = ?`)
+	if err != nil {
+		return false, err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(userId, code)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (a *auth) countRecoveryCodes(userId string) (int, error) {
+	stmt, err := a.db.Prepare(`select count(*) from user_recovery_codes where user_id = ?`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	var n int
+	if err := stmt.QueryRow(userId).Scan(&n); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (a *auth) writeWebAuthnChallenge(userId string, challenge string, ceremony string, validUntil time.Time) error {
+	// the SHA256 checksum is stored, not the actual challenge.
+	challenge, err := hash(challenge)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := a.db.Prepare(`insert into user_webauthn_challenges (challenge, user_id, ceremony, valid_until) values (?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(challenge, userId, ceremony, formatTimestamp(validUntil))
+	return err
+}
+
+func (a *auth) consumeWebAuthnChallenge(challenge string, ceremony string) (string, bool, error) {
+	challenge, err := hash(challenge)
+	if err != nil {
+		return "", false, err
+	}
+
+	stmt, err := a.db.Prepare(`select user_id, valid_until from user_webauthn_challenges where challenge = ? and ceremony = ? limit 1`)
+	if err != nil {
+		return "", false, err
+	}
+	defer stmt.Close()
+
+	var userId, validUntil string
+	if err := stmt.QueryRow(challenge, ceremony).Scan(&userId, &validUntil); err != nil {
+		if strings.Contains(err.Error(), "no rows in result set") {
+			return "", false, nil // no challenge found
+		}
+		return "", false, err
+	}
+
+	// challenges are single use
+	stmt, err = a.db.Prepare(`delete from user_webauthn_challenges where challenge = ?`)
+	if err != nil {
+		return "", false, err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(challenge)
+	if err != nil {
+		return "", false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "", false, nil // used by a concurrent request
+	}
+
+	t, err := time.Parse(serializedTimestampFormat, validUntil)
+	if err != nil || time.Now().After(t) {
+		return "", false, nil // expired
+	}
+	return userId, true, nil
+}
+
+func (a *auth) writeWebAuthnCredential(cred *webauthnCredential) error {
+	query := `insert into user_webauthn_credentials (credential_id, user_id, name, public_key, sign_count, created_at, last_used) values (?, ?, ?, ?, ?, ?, ?)`
+	stmt, err := a.db.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	createdAt := formatTimestamp(cred.CreatedAt.Time)
+	_, err = stmt.Exec(cred.ID, cred.userId, cred.Name, base64.StdEncoding.EncodeToString(cred.publicKey), cred.signCount, createdAt, createdAt)
+	return err
+}
+
+// scanWebAuthnCredential reads the columns selected by readWebAuthnCredential and listWebAuthnCredentials
+func scanWebAuthnCredential(scan func(dest ...interface{}) error) (*webauthnCredential, error) {
+	var cred webauthnCredential
+	var publicKey, createdAt, lastUsed string // needs parsing
+	if err := scan(&cred.ID, &cred.userId, &cred.Name, &publicKey, &cred.signCount, &createdAt, &lastUsed); err != nil {
+		return nil, err
+	}
+	bs, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key for WebAuthn credential %s: %v", cred.ID, err)
+	}
+	cred.publicKey = bs
+	if t, err := time.Parse(serializedTimestampFormat, createdAt); err == nil {
+		cred.CreatedAt = base.NewTime(t)
+	}
+	if t, err := time.Parse(serializedTimestampFormat, lastUsed); err == nil {
+		cred.LastUsed = base.NewTime(t)
+	}
+	return &cred, nil
+}
+
+func (a *auth) readWebAuthnCredential(credentialId string) (*webauthnCredential, error) {
+	query := `select credential_id, user_id, name, public_key, sign_count, created_at, last_used from user_webauthn_credentials where credential_id = ? limit 1`
+	stmt, err := a.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	cred, err := scanWebAuthnCredential(stmt.QueryRow(credentialId).Scan)
+	if err != nil {
+		if strings.Contains(err.Error(), "no rows in result set") {
+			return nil, nil // no credential found
+		}
+		return nil, err
+	}
+	return cred, nil
+}
+
+func (a *auth) listWebAuthnCredentials(userId string) ([]*webauthnCredential, error) {
+	query := `select credential_id, user_id, name, public_key, sign_count, created_at, last_used from user_webauthn_credentials where user_id = ? order by created_at`
+	stmt, err := a.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var credentials []*webauthnCredential
+	for rows.Next() {
+		cred, err := scanWebAuthnCredential(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, cred)
+	}
+	return credentials, rows.Err()
+}
+
+func (a *auth) updateWebAuthnCredential(credentialId string, signCount uint32) error {
+	stmt, err := a.db.Prepare(`update user_webauthn_credentials set sign_count = ?, last_used = ? where credential_id = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(signCount, formatTimestamp(time.Now()), credentialId)
+	return err
+}
+
+func (a *auth) deleteWebAuthnCredential(userId string, credentialId string) error {
+	stmt, err := a.db.Prepare(`delete from user_webauthn_credentials where user_id = ? and credential_id = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(userId, credentialId)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errWebAuthnCredentialNotFound
+	}
+	return nil
+}
+
+func hash(in string) (string, error) {
+	ss := sha256.New()
+	n, err := ss.Write([]byte(in))
+	if err != nil {
+		return "", err
+	}
+	if n == 0 {
+		return "", err
+	}
+	return hex.EncodeToString(ss.Sum(nil)), nil
+}
+
+func (a *auth) readLoginAttempts(key string) (*loginAttempts, error) {
+	stmt, err := a.db.Prepare(`select failures, last_failure, locked_until from login_attempts where attempt_key = ? limit 1`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	var attempts loginAttempts
+	var lastFailure, lockedUntil string // needs parsing
+	if err := stmt.QueryRow(key).Scan(&attempts.failures, &lastFailure, &lockedUntil); err != nil {
+		if strings.Contains(err.Error(), "no rows in result set") {
+			return nil, nil // no failed logins
+		}
+		return nil, err
+	}
+	if t, err := time.Parse(serializedTimestampFormat, lastFailure); err == nil {
+		attempts.lastFailure = t
+	}
+	if t, err := time.Parse(serializedTimestampFormat, lockedUntil); err == nil {
+		attempts.lockedUntil = t
+	}
+	return &attempts, nil
+}
+
+func (a *auth) addLoginFailure(key string, now time.Time, window time.Duration, lockout func(failures int) time.Duration) (*loginAttempts, error) {
+	lastFailure := formatTimestamp(now)
+	windowStart := formatTimestamp(now.Add(-window))
+
+	// The upsert holds the row's write lock until we commit, so concurrent failures
+	// are counted one after another rather than overwriting each other.
+	tx, err := a.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	query := `insert into login_attempts (attempt_key, failures, last_failure, locked_until) values (?, 1, ?, '')
+on conflict (attempt_key) do update set
+failures = case when login_attempts.last_failure < ? then 1 else login_attempts.failures + 1 end,
+last_failure = excluded.last_failure`
+	if _, err := tx.Exec(query, key, lastFailure, windowStart); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	attempts := &loginAttempts{lastFailure: now}
+	var lockedUntil string
+	if err := tx.QueryRow(`select failures, locked_until from login_attempts where attempt_key = ?`, key).Scan(&attempts.failures, &lockedUntil); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if t, err := time.Parse(serializedTimestampFormat, lockedUntil); err == nil {
+		attempts.lockedUntil = t
+	}
+	if dur := lockout(attempts.failures); dur > 0 {
+		attempts.lockedUntil = now.Add(dur)
+		if _, err := tx.Exec(`update login_attempts set locked_until = ? where attempt_key = ?`, formatTimestamp(attempts.lockedUntil), key); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	return attempts, tx.Commit()
+}
+
+func (a *auth) deleteLoginAttempts(key string) error {
+	stmt, err := a.db.Prepare(`delete from login_attempts where attempt_key = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(key)
+	return err
 }
@@ -52,23 +52,23 @@ func createTestAuthable() (*testAuth, error) {
 		return nil, err
 	}
 
-	return &testAuth{auth{db, logger}, dir}, nil
+	return &testAuth{auth{db: db, log: logger, mfaKey: testMFAKey}, dir}, nil
 }
 
 type testUserRepository struct {
-	sqliteUserRepository
+	sqlUserRepository
 
 	dir string
 }
 
 func (repo *testUserRepository) cleanup() error {
-	if err := repo.sqliteUserRepository.close(); err != nil {
+	if err := repo.sqlUserRepository.close(); err != nil {
 		return err
 	}
 	return os.RemoveAll(repo.dir)
 }
 
-// createTestUserRepository returns a sqliteUserRepository wrapped with cleanup
+// createTestUserRepository returns a sqlUserRepository wrapped with cleanup
 // for our test database.
 func createTestUserRepository() (*testUserRepository, error) {
 	dir, err := ioutil.TempDir("", "userRepository")
@@ -86,7 +86,7 @@ func createTestUserRepository() (*testUserRepository, error) {
 		return nil, err
 	}
 
-	return &testUserRepository{sqliteUserRepository{db, logger}, dir}, nil
+	return &testUserRepository{sqlUserRepository{db, logger}, dir}, nil
 }
 
 func TestUser__cleanEmail(t *testing.T) {
@@ -230,11 +230,11 @@ func TestUser__update(t *testing.T) {
 	}
 
 	// Create test cookie
-	cookie, err := createCookie(userId, auth)
+	cookie, err := createCookie(userId, auth, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := auth.writeCookie(userId, cookie); err != nil {
+	if err := auth.writeCookie(userId, cookie, "", ""); err != nil {
 		t.Fatal(err)
 	}
 
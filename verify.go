@@ -0,0 +1,114 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	moovhttp "github.com/moov-io/base/http"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+const (
+	approvalCodeTTL = 24 * time.Hour
+)
+
+var (
+	errEmailNotVerified = errors.New("email address has not been verified")
+)
+
+func addVerifyRoutes(router *mux.Router, logger log.Logger, userService userRepository, mail mailer) {
+	router.Methods("GET").Path("/users/verify").HandlerFunc(verifyEmailRoute(logger, userService))
+	router.Methods("POST").Path("/users/verify/resend").HandlerFunc(resendVerifyEmailRoute(logger, userService, mail))
+}
+
+// sendApprovalEmail generates a new approval code for u and emails the user a link
+// to verify their email address.
+func sendApprovalEmail(userService userRepository, mail mailer, u *User) error {
+	code := generateID()
+	if code == "" {
+		return errors.New("unable to generate approval code")
+	}
+	if err := userService.writeApprovalCode(u.ID, code, time.Now().Add(approvalCodeTTL)); err != nil {
+		return err
+	}
+	return mail.send(&email{
+		to:      u.Email,
+		subject: "Verify your email address",
+		body: fmt.Sprintf("Please verify your email address by visiting the following link:\n\n  %s/users/verify?code=%s\n\nThis link expires in %v.",
+			PublicURL, code, approvalCodeTTL),
+	})
+}
+
+func verifyEmailRoute(logger log.Logger, userService userRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "verifyEmailRoute")
+
+		code := r.URL.Query().Get("code")
+		if code == "" {
+			moovhttp.Problem(w, errors.New("missing code"))
+			return
+		}
+
+		userId, err := userService.consumeApprovalCode(code)
+		if err != nil {
+			internalError(w, fmt.Errorf("problem verifying approval code: %v", err))
+			return
+		}
+		if userId == "" {
+			moovhttp.Problem(w, errors.New("invalid or expired code"))
+			return
+		}
+		logger.Log("verify", fmt.Sprintf("userId=%s verified their email address", userId))
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("{}"))
+	}
+}
+
+type resendVerifyRequest struct {
+	Email string `json:"email"`
+}
+
+// resendVerifyEmailRoute sends a fresh approval code to unverified users. The response
+// is the same whether or not the email exists so it can't be used to discover users.
+func resendVerifyEmailRoute(logger log.Logger, userService userRepository, mail mailer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "resendVerifyEmailRoute")
+
+		var req resendVerifyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := validateEmail(req.Email); err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+
+		u, err := userService.lookupByEmail(req.Email)
+		if err != nil {
+			internalError(w, fmt.Errorf("problem looking up user email %q: %v", req.Email, err))
+			return
+		}
+		if u != nil && !u.EmailVerified {
+			if err := sendApprovalEmail(userService, mail, u); err != nil {
+				internalError(w, fmt.Errorf("problem sending approval email: %v", err))
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("{}"))
+	}
+}
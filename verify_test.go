@@ -0,0 +1,151 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moov-io/base"
+
+	"github.com/go-kit/kit/log"
+)
+
+// codeFromEmail pulls the approval code out of the link in msg
+func codeFromEmail(t *testing.T, msg *email) string {
+	t.Helper()
+
+	if msg == nil {
+		t.Fatal("no email sent")
+	}
+	idx := strings.Index(msg.body, "/users/verify?")
+	if idx < 0 {
+		t.Fatalf("no link in %q", msg.body)
+	}
+	link := strings.Fields(msg.body[idx:])[0]
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Query().Get("code")
+}
+
+func TestVerify__approvalCodes(t *testing.T) {
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+
+	u := &User{
+		ID:        generateID(),
+		Email:     "test@moov.io",
+		CreatedAt: base.NewTime(time.Now()),
+	}
+	if err := repo.upsert(u); err != nil {
+		t.Fatal(err)
+	}
+
+	// expired codes don't verify the user
+	code := generateID()
+	if err := repo.writeApprovalCode(u.ID, code, time.Now().Add(-1*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if userId, err := repo.consumeApprovalCode(code); err != nil || userId != "" {
+		t.Errorf("userId=%q err=%v", userId, err)
+	}
+	if uu, _ := repo.lookupByUserId(u.ID); uu == nil || uu.EmailVerified {
+		t.Fatalf("expected unverified user: %#v", uu)
+	}
+
+	// replace the code and verify
+	code = generateID()
+	if err := repo.writeApprovalCode(u.ID, code, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if userId, err := repo.consumeApprovalCode(code); err != nil || userId != u.ID {
+		t.Errorf("userId=%q err=%v", userId, err)
+	}
+	if uu, _ := repo.lookupByUserId(u.ID); uu == nil || !uu.EmailVerified {
+		t.Fatalf("expected verified user: %#v", uu)
+	}
+
+	// codes are single use
+	if userId, err := repo.consumeApprovalCode(code); err != nil || userId != "" {
+		t.Errorf("userId=%q err=%v", userId, err)
+	}
+}
+
+func TestVerify__routes(t *testing.T) {
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+
+	u := &User{
+		ID:        generateID(),
+		Email:     "test@moov.io",
+		CreatedAt: base.NewTime(time.Now()),
+	}
+	if err := repo.upsert(u); err != nil {
+		t.Fatal(err)
+	}
+
+	mail := &testMailer{}
+	if err := sendApprovalEmail(repo, mail, u); err != nil {
+		t.Fatal(err)
+	}
+	first := codeFromEmail(t, mail.last())
+
+	// resend, which replaces the first code
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/users/verify/resend", strings.NewReader(`{"email": "test@moov.io"}`))
+	resendVerifyEmailRoute(log.NewNopLogger(), repo, mail)(w, r)
+	w.Flush()
+
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	if len(mail.sent) != 2 {
+		t.Fatalf("got %d emails", len(mail.sent))
+	}
+
+	// unknown emails get the same response
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/users/verify/resend", strings.NewReader(`{"email": "other@moov.io"}`))
+	resendVerifyEmailRoute(log.NewNopLogger(), repo, mail)(w, r)
+	w.Flush()
+
+	if w.Code != http.StatusOK || len(mail.sent) != 2 {
+		t.Errorf("got %d (%d emails)", w.Code, len(mail.sent))
+	}
+
+	// the first code is no longer valid
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/users/verify?code="+first, nil)
+	verifyEmailRoute(log.NewNopLogger(), repo)(w, r)
+	w.Flush()
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/users/verify?code="+codeFromEmail(t, mail.last()), nil)
+	verifyEmailRoute(log.NewNopLogger(), repo)(w, r)
+	w.Flush()
+
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	if uu, _ := repo.lookupByUserId(u.ID); uu == nil || !uu.EmailVerified {
+		t.Fatalf("expected verified user: %#v", uu)
+	}
+}
@@ -0,0 +1,848 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/moov-io/base"
+	moovhttp "github.com/moov-io/base/http"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+// WebAuthn registration and assertion ceremonies, which let users login with security keys
+// and passkeys either instead of their password or as a second factor.
+//
+// Only the "none" attestation format is accepted, we don't make trust decisions about
+// the authenticator's make or model.
+//
+// https://www.w3.org/TR/webauthn/
+const (
+	webauthnChallengeTTL = 5 * time.Minute
+	webauthnTimeout      = 60000 // milliseconds, sent to browsers
+
+	webauthnCeremonyCreate = "webauthn.create"
+	webauthnCeremonyGet    = "webauthn.get"
+
+	// authenticator data flags
+	authDataUserPresent        = 0x01
+	authDataUserVerified       = 0x04
+	authDataAttestedCredential = 0x40
+	authDataExtensions         = 0x80
+
+	// COSE algorithm identifiers
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+)
+
+var (
+	errWebAuthnCredentialNotFound = errors.New("WebAuthn credential not found")
+	errInvalidWebAuthnChallenge   = errors.New("invalid or expired WebAuthn challenge")
+	errInvalidWebAuthnResponse    = errors.New("invalid WebAuthn response")
+)
+
+// webauthnRPID returns the relying party ID credentials are scoped to. It must be the
+// domain users register from, or a parent of it, and is read from WEBAUTHN_RP_ID (default: $DOMAIN).
+func webauthnRPID() string {
+	if v := os.Getenv("WEBAUTHN_RP_ID"); v != "" {
+		return v
+	}
+	return Domain
+}
+
+// webauthnOrigin returns the origin browsers must report in clientDataJSON. It's read from
+// WEBAUTHN_ORIGIN and defaults to the scheme and host of PUBLIC_URL.
+func webauthnOrigin() string {
+	if v := os.Getenv("WEBAUTHN_ORIGIN"); v != "" {
+		return strings.TrimSuffix(v, "/")
+	}
+	u, err := url.Parse(PublicURL)
+	if err != nil {
+		return PublicURL
+	}
+	return fmt.Sprintf("%s://%s", u.Scheme, u.Host)
+}
+
+// webauthnCredential is a public key registered by one of the user's authenticators.
+type webauthnCredential struct {
+	ID        string    `json:"id"` // base64url encoded credential ID
+	Name      string    `json:"name"`
+	CreatedAt base.Time `json:"createdAt"`
+	LastUsed  base.Time `json:"lastUsed"`
+
+	userId    string
+	publicKey []byte // COSE_Key encoded
+	signCount uint32
+}
+
+// base64URL is binary data sent as base64url text, which is how WebAuthn client
+// libraries serialize ArrayBuffers. Padding and the standard alphabet are also accepted.
+type base64URL []byte
+
+func (b base64URL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *base64URL) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	s = strings.TrimRight(s, "=")
+	bs, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		if bs, err = base64.RawStdEncoding.DecodeString(s); err != nil {
+			return fmt.Errorf("invalid base64url: %v", err)
+		}
+	}
+	*b = bs
+	return nil
+}
+
+// generateWebAuthnChallenge returns a random base64url encoded challenge
+func generateWebAuthnChallenge() (string, error) {
+	bs := make([]byte, 32)
+	if _, err := rand.Read(bs); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bs), nil
+}
+
+type webauthnClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// parseClientData reads the clientDataJSON signed by an authenticator and checks it was
+// created for the expected ceremony on our origin.
+func parseClientData(raw []byte, ceremony string) (*webauthnClientData, error) {
+	var cd webauthnClientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return nil, fmt.Errorf("invalid clientDataJSON: %v", err)
+	}
+	if cd.Type != ceremony {
+		return nil, fmt.Errorf("unexpected clientDataJSON type %q", cd.Type)
+	}
+	if cd.Origin != webauthnOrigin() {
+		return nil, fmt.Errorf("unexpected origin %q", cd.Origin)
+	}
+	if cd.Challenge == "" {
+		return nil, errors.New("missing challenge")
+	}
+	return &cd, nil
+}
+
+type authenticatorData struct {
+	rpIDHash  []byte
+	flags     byte
+	signCount uint32
+
+	// only set during registration
+	credentialID []byte
+	publicKey    []byte // COSE_Key encoded
+}
+
+// parseAuthenticatorData reads the binary authenticator data structure.
+//
+// https://www.w3.org/TR/webauthn/#sctn-authenticator-data
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, errors.New("authenticator data is too short")
+	}
+	ad := &authenticatorData{
+		rpIDHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	rest := data[37:]
+
+	if ad.flags&authDataAttestedCredential != 0 {
+		if len(rest) < 18 {
+			return nil, errors.New("attested credential data is too short")
+		}
+		// skip the 16 byte AAGUID
+		n := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if n == 0 || len(rest) < n {
+			return nil, errors.New("invalid credential ID length")
+		}
+		ad.credentialID, rest = rest[:n], rest[n:]
+
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid credential public key: %v", err)
+		}
+		ad.publicKey, rest = rest[:len(rest)-len(after)], after
+	}
+	if ad.flags&authDataExtensions != 0 {
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid extensions: %v", err)
+		}
+		rest = after
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("unexpected trailing authenticator data")
+	}
+	return ad, nil
+}
+
+// verify checks the authenticator data was produced for our RP ID and with the user present.
+func (ad *authenticatorData) verify(requireUserVerification bool) error {
+	expected := sha256.Sum256([]byte(webauthnRPID()))
+	if !bytes.Equal(ad.rpIDHash, expected[:]) {
+		return errors.New("RP ID hash mismatch")
+	}
+	if ad.flags&authDataUserPresent == 0 {
+		return errors.New("user not present")
+	}
+	if requireUserVerification && ad.flags&authDataUserVerified == 0 {
+		return errors.New("user not verified")
+	}
+	return nil
+}
+
+// parseAttestationObject returns the authenticator data from a "none" attestation.
+func parseAttestationObject(raw []byte) (*authenticatorData, error) {
+	v, rest, err := decodeCBOR(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid attestationObject: %v", err)
+	}
+	obj, ok := v.(map[interface{}]interface{})
+	if !ok || len(rest) > 0 {
+		return nil, errors.New("invalid attestationObject")
+	}
+	if format, _ := obj["fmt"].(string); format != "none" {
+		return nil, fmt.Errorf("unsupported attestation format %q, request 'none' attestation", format)
+	}
+	if stmt, ok := obj["attStmt"].(map[interface{}]interface{}); !ok || len(stmt) > 0 {
+		return nil, errors.New("invalid attestation statement")
+	}
+	authData, ok := obj["authData"].([]byte)
+	if !ok {
+		return nil, errors.New("missing authData")
+	}
+	ad, err := parseAuthenticatorData(authData)
+	if err != nil {
+		return nil, err
+	}
+	if ad.credentialID == nil {
+		return nil, errors.New("missing attested credential data")
+	}
+	return ad, nil
+}
+
+// parseCOSEKey decodes a COSE_Key (RFC 8152) into a public key we can verify signatures with.
+// ES256 (P-256), EdDSA (Ed25519) and RS256 keys are supported.
+func parseCOSEKey(raw []byte) (crypto.PublicKey, error) {
+	v, _, err := decodeCBOR(raw)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("COSE key is not a map")
+	}
+	param := func(label int64) []byte {
+		bs, _ := key[label].([]byte)
+		return bs
+	}
+	kty, _ := key[int64(1)].(int64)
+	alg, _ := key[int64(3)].(int64)
+	crv, _ := key[int64(-1)].(int64)
+
+	switch {
+	case kty == 2 && alg == coseAlgES256 && crv == 1: // EC2, P-256
+		x, y := param(-2), param(-3)
+		if len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("invalid P-256 coordinates")
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("P-256 point is not on the curve")
+		}
+		return pub, nil
+
+	case kty == 1 && alg == coseAlgEdDSA && crv == 6: // OKP, Ed25519
+		x := param(-2)
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+
+	case kty == 3 && alg == coseAlgRS256:
+		n, e := param(-1), param(-2)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA key")
+		}
+		exp := 0
+		for _, b := range e {
+			exp = exp<<8 | int(b)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exp}, nil
+	}
+	return nil, fmt.Errorf("unsupported COSE key kty=%d alg=%d crv=%d", kty, alg, crv)
+}
+
+// verifyWebAuthnSignature checks sig over data was made by the COSE encoded public key.
+func verifyWebAuthnSignature(coseKey []byte, data, sig []byte) error {
+	pub, err := parseCOSEKey(coseKey)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(data)
+
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		var esig struct {
+			R, S *big.Int
+		}
+		if rest, err := asn1.Unmarshal(sig, &esig); err != nil || len(rest) > 0 {
+			return errors.New("invalid ECDSA signature encoding")
+		}
+		if !ecdsa.Verify(pub, digest[:], esig.R, esig.S) {
+			return errors.New("invalid ECDSA signature")
+		}
+		return nil
+
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, data, sig) {
+			return errors.New("invalid Ed25519 signature")
+		}
+		return nil
+
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig)
+	}
+	return fmt.Errorf("unsupported public key %T", pub)
+}
+
+func addWebAuthnRoutes(router *mux.Router, logger log.Logger, auth authable, userService userRepository) {
+	router.Methods("POST").Path("/users/login/webauthn").HandlerFunc(beginWebAuthnLoginRoute(logger, auth, userService))
+	router.Methods("POST").Path("/users/login/webauthn/finish").HandlerFunc(finishWebAuthnLoginRoute(logger, auth, userService))
+
+	router.Methods("POST").Path("/users/{user_id}/webauthn/register").HandlerFunc(beginWebAuthnRegistrationRoute(logger, auth, userService))
+	router.Methods("POST").Path("/users/{user_id}/webauthn/register/finish").HandlerFunc(finishWebAuthnRegistrationRoute(logger, auth))
+	router.Methods("GET").Path("/users/{user_id}/webauthn/credentials").HandlerFunc(listWebAuthnCredentialsRoute(logger, auth))
+	router.Methods("DELETE").Path("/users/{user_id}/webauthn/credentials/{credential_id}").HandlerFunc(deleteWebAuthnCredentialRoute(logger, auth))
+}
+
+type webauthnEntity struct {
+	ID          string `json:"id,omitempty"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName,omitempty"`
+}
+
+type webauthnCredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type webauthnCredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type webauthnAuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// webauthnCreationOptions is passed to navigator.credentials.create() after decoding
+// the challenge and IDs from base64url.
+type webauthnCreationOptions struct {
+	Challenge              string                         `json:"challenge"`
+	RP                     webauthnEntity                 `json:"rp"`
+	User                   webauthnEntity                 `json:"user"`
+	PubKeyCredParams       []webauthnCredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int                            `json:"timeout"`
+	Attestation            string                         `json:"attestation"`
+	ExcludeCredentials     []webauthnCredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection webauthnAuthenticatorSelection `json:"authenticatorSelection"`
+}
+
+// webauthnRequestOptions is passed to navigator.credentials.get() after decoding
+// the challenge and IDs from base64url.
+type webauthnRequestOptions struct {
+	Challenge        string                         `json:"challenge"`
+	RPID             string                         `json:"rpId"`
+	Timeout          int                            `json:"timeout"`
+	AllowCredentials []webauthnCredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                         `json:"userVerification"`
+}
+
+func credentialDescriptors(credentials []*webauthnCredential) []webauthnCredentialDescriptor {
+	out := make([]webauthnCredentialDescriptor, 0, len(credentials))
+	for i := range credentials {
+		out = append(out, webauthnCredentialDescriptor{Type: "public-key", ID: credentials[i].ID})
+	}
+	return out
+}
+
+// startWebAuthnChallenge saves a new challenge for the ceremony and returns it
+func startWebAuthnChallenge(auth authable, userId string, ceremony string) (string, error) {
+	challenge, err := generateWebAuthnChallenge()
+	if err != nil {
+		return "", err
+	}
+	if err := auth.writeWebAuthnChallenge(userId, challenge, ceremony, time.Now().Add(webauthnChallengeTTL)); err != nil {
+		return "", err
+	}
+	return challenge, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		internalError(w, err)
+		return
+	}
+}
+
+// beginWebAuthnRegistrationRoute returns the options for registering a new authenticator.
+func beginWebAuthnRegistrationRoute(logger log.Logger, auth authable, userService userRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "beginWebAuthnRegistrationRoute")
+
+		u, err := getUserFromCookie(auth, userService, r)
+		if err != nil || u == nil || u.ID != mux.Vars(r)["user_id"] {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		existing, err := auth.listWebAuthnCredentials(u.ID)
+		if err != nil {
+			internalError(w, fmt.Errorf("problem listing WebAuthn credentials: %v", err))
+			return
+		}
+		challenge, err := startWebAuthnChallenge(auth, u.ID, webauthnCeremonyCreate)
+		if err != nil {
+			internalError(w, fmt.Errorf("problem writing WebAuthn challenge: %v", err))
+			return
+		}
+
+		displayName := strings.TrimSpace(fmt.Sprintf("%s %s", u.FirstName, u.LastName))
+		if displayName == "" {
+			displayName = u.Email
+		}
+		writeJSON(w, webauthnCreationOptions{
+			Challenge: challenge,
+			RP:        webauthnEntity{ID: webauthnRPID(), Name: totpIssuer},
+			User: webauthnEntity{
+				ID:          base64.RawURLEncoding.EncodeToString([]byte(u.ID)),
+				Name:        u.Email,
+				DisplayName: displayName,
+			},
+			PubKeyCredParams: []webauthnCredentialParameter{
+				{Type: "public-key", Alg: coseAlgES256},
+				{Type: "public-key", Alg: coseAlgEdDSA},
+				{Type: "public-key", Alg: coseAlgRS256},
+			},
+			Timeout:            webauthnTimeout,
+			Attestation:        "none",
+			ExcludeCredentials: credentialDescriptors(existing),
+			AuthenticatorSelection: webauthnAuthenticatorSelection{
+				ResidentKey:      "preferred",
+				UserVerification: "preferred",
+			},
+		})
+	}
+}
+
+type webauthnRegistrationRequest struct {
+	// Name is a label for the user to recognize the authenticator by
+	Name string `json:"name"`
+
+	RawID    base64URL `json:"rawId"`
+	Response struct {
+		ClientDataJSON    base64URL `json:"clientDataJSON"`
+		AttestationObject base64URL `json:"attestationObject"`
+	} `json:"response"`
+}
+
+type webauthnRegistrationResponse struct {
+	Credential *webauthnCredential `json:"credential"`
+
+	// RecoveryCodes are returned when this is the user's first second factor
+	RecoveryCodes []string `json:"recoveryCodes,omitempty"`
+}
+
+// finishWebAuthnRegistrationRoute verifies the authenticator's response and saves the new credential.
+func finishWebAuthnRegistrationRoute(logger log.Logger, auth authable) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "finishWebAuthnRegistrationRoute")
+
+		userId, err := extractUserId(auth, r)
+		if err != nil || userId != mux.Vars(r)["user_id"] {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		var req webauthnRegistrationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+
+		cd, err := parseClientData(req.Response.ClientDataJSON, webauthnCeremonyCreate)
+		if err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+		challengeUserId, ok, err := auth.consumeWebAuthnChallenge(cd.Challenge, webauthnCeremonyCreate)
+		if err != nil {
+			internalError(w, fmt.Errorf("problem reading WebAuthn challenge: %v", err))
+			return
+		}
+		if !ok || challengeUserId != userId {
+			moovhttp.Problem(w, errInvalidWebAuthnChallenge)
+			return
+		}
+
+		ad, err := parseAttestationObject(req.Response.AttestationObject)
+		if err == nil {
+			err = ad.verify(false)
+		}
+		if err == nil {
+			_, err = parseCOSEKey(ad.publicKey)
+		}
+		if err != nil {
+			logger.Log("webauthn", fmt.Sprintf("userId=%s registration failed: %v", userId, err))
+			moovhttp.Problem(w, err)
+			return
+		}
+		if len(req.RawID) > 0 && !bytes.Equal(req.RawID, ad.credentialID) {
+			moovhttp.Problem(w, errors.New("rawId doesn't match the attested credential"))
+			return
+		}
+
+		cred := &webauthnCredential{
+			ID:        base64.RawURLEncoding.EncodeToString(ad.credentialID),
+			Name:      strings.TrimSpace(req.Name),
+			CreatedAt: base.NewTime(time.Now()),
+			userId:    userId,
+			publicKey: ad.publicKey,
+			signCount: ad.signCount,
+		}
+		if cred.Name == "" {
+			cred.Name = "Security key"
+		}
+		if existing, err := auth.readWebAuthnCredential(cred.ID); err != nil || existing != nil {
+			if err != nil {
+				internalError(w, fmt.Errorf("problem reading WebAuthn credential: %v", err))
+				return
+			}
+			problem(w, http.StatusConflict, errors.New("credential is already registered"))
+			return
+		}
+
+		// first second factor? give them recovery codes too
+		var recoveryCodes []string
+		if n, err := auth.countRecoveryCodes(userId); err != nil || n == 0 {
+			if err != nil {
+				internalError(w, fmt.Errorf("problem counting recovery codes: %v", err))
+				return
+			}
+			if recoveryCodes, err = replaceRecoveryCodes(auth, userId); err != nil {
+				internalError(w, err)
+				return
+			}
+		}
+
+		if err := auth.writeWebAuthnCredential(cred); err != nil {
+			internalError(w, fmt.Errorf("problem writing WebAuthn credential: %v", err))
+			return
+		}
+		logger.Log("webauthn", fmt.Sprintf("userId=%s registered WebAuthn credential %s", userId, cred.ID))
+
+		writeJSON(w, webauthnRegistrationResponse{Credential: cred, RecoveryCodes: recoveryCodes})
+	}
+}
+
+func listWebAuthnCredentialsRoute(logger log.Logger, auth authable) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "listWebAuthnCredentialsRoute")
+
+		userId, err := extractUserId(auth, r)
+		if err != nil || userId != mux.Vars(r)["user_id"] {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		credentials, err := auth.listWebAuthnCredentials(userId)
+		if err != nil {
+			internalError(w, fmt.Errorf("problem listing WebAuthn credentials: %v", err))
+			return
+		}
+		if credentials == nil {
+			credentials = []*webauthnCredential{} // render an empty array rather than null
+		}
+		writeJSON(w, credentials)
+	}
+}
+
+func deleteWebAuthnCredentialRoute(logger log.Logger, auth authable) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "deleteWebAuthnCredentialRoute")
+
+		userId, err := extractUserId(auth, r)
+		if err != nil || userId != mux.Vars(r)["user_id"] {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		credentialId := mux.Vars(r)["credential_id"]
+		if err := auth.deleteWebAuthnCredential(userId, credentialId); err != nil {
+			if err == errWebAuthnCredentialNotFound {
+				problem(w, http.StatusNotFound, err)
+				return
+			}
+			internalError(w, fmt.Errorf("problem deleting WebAuthn credential: %v", err))
+			return
+		}
+		if err := removeUnusedRecoveryCodes(auth, userId); err != nil {
+			internalError(w, fmt.Errorf("problem deleting recovery codes: %v", err))
+			return
+		}
+		logger.Log("webauthn", fmt.Sprintf("userId=%s deleted WebAuthn credential %s", userId, credentialId))
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+type webauthnLoginRequest struct {
+	// Email limits the allowed credentials to the user's. It's optional as passkeys
+	// can identify the user themselves.
+	Email string `json:"email"`
+
+	// MFAChallenge is set when WebAuthn is used as a second factor after the
+	// user's password was accepted by /users/login.
+	MFAChallenge string `json:"mfaChallenge"`
+}
+
+// beginWebAuthnLoginRoute returns the options for an assertion, either as a passwordless
+// login or as the second factor of a password login.
+func beginWebAuthnLoginRoute(logger log.Logger, auth authable, userService userRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "beginWebAuthnLoginRoute")
+
+		var req webauthnLoginRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var userId string
+		userVerification := "required"
+		switch {
+		case req.MFAChallenge != "":
+			id, err := auth.findMFAChallenge(req.MFAChallenge)
+			if err != nil {
+				internalError(w, fmt.Errorf("problem reading MFA challenge: %v", err))
+				return
+			}
+			if id == "" {
+				problem(w, http.StatusForbidden, errInvalidMFAChallenge)
+				return
+			}
+			userId, userVerification = id, "discouraged" // the password was the first factor
+
+		case req.Email != "":
+			u, err := userService.lookupByEmail(req.Email)
+			if err != nil {
+				internalError(w, fmt.Errorf("problem looking up user email %q: %v", req.Email, err))
+				return
+			}
+			if u != nil {
+				userId = u.ID
+			}
+		}
+
+		var allowed []*webauthnCredential
+		if userId != "" {
+			credentials, err := auth.listWebAuthnCredentials(userId)
+			if err != nil {
+				internalError(w, fmt.Errorf("problem listing WebAuthn credentials: %v", err))
+				return
+			}
+			allowed = credentials
+		}
+
+		challenge, err := startWebAuthnChallenge(auth, userId, webauthnCeremonyGet)
+		if err != nil {
+			internalError(w, fmt.Errorf("problem writing WebAuthn challenge: %v", err))
+			return
+		}
+		writeJSON(w, webauthnRequestOptions{
+			Challenge:        challenge,
+			RPID:             webauthnRPID(),
+			Timeout:          webauthnTimeout,
+			AllowCredentials: credentialDescriptors(allowed),
+			UserVerification: userVerification,
+		})
+	}
+}
+
+type webauthnAssertionRequest struct {
+	MFAChallenge string `json:"mfaChallenge"`
+
+	RawID    base64URL `json:"rawId"`
+	Response struct {
+		ClientDataJSON    base64URL `json:"clientDataJSON"`
+		AuthenticatorData base64URL `json:"authenticatorData"`
+		Signature         base64URL `json:"signature"`
+		UserHandle        base64URL `json:"userHandle"`
+	} `json:"response"`
+}
+
+// verifyAssertion checks an authenticator's signature and counter against the stored credential,
+// returning the new signature counter.
+//
+// https://www.w3.org/TR/webauthn/#sctn-verifying-assertion
+func verifyAssertion(cred *webauthnCredential, req *webauthnAssertionRequest, requireUserVerification bool) (uint32, error) {
+	ad, err := parseAuthenticatorData(req.Response.AuthenticatorData)
+	if err != nil {
+		return 0, err
+	}
+	if err := ad.verify(requireUserVerification); err != nil {
+		return 0, err
+	}
+
+	clientDataHash := sha256.Sum256(req.Response.ClientDataJSON)
+	signed := append(append([]byte{}, req.Response.AuthenticatorData...), clientDataHash[:]...)
+	if err := verifyWebAuthnSignature(cred.publicKey, signed, req.Response.Signature); err != nil {
+		return 0, err
+	}
+
+	// Authenticators which don't implement counters always send zero, otherwise the
+	// counter must increase or the credential may have been cloned.
+	if (ad.signCount != 0 || cred.signCount != 0) && ad.signCount <= cred.signCount {
+		return 0, fmt.Errorf("signature counter went from %d to %d, possible cloned authenticator", cred.signCount, ad.signCount)
+	}
+	return ad.signCount, nil
+}
+
+// finishWebAuthnLoginRoute verifies an assertion and logs the user in.
+func finishWebAuthnLoginRoute(logger log.Logger, auth authable, userService userRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "finishWebAuthnLoginRoute")
+
+		var req webauthnAssertionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+
+		fail := func(userId string, err error) {
+			authFailures.With("method", "webauthn").Add(1)
+			logger.Log("login", fmt.Sprintf("userId=%s failed WebAuthn login: %v", userId, err))
+			if req.MFAChallenge != "" {
+				if err := auth.failMFAChallenge(req.MFAChallenge); err != nil {
+					logger.Log("login", fmt.Sprintf("problem recording failed MFA challenge for userId=%s: %v", userId, err))
+				}
+			}
+			problem(w, http.StatusForbidden, errInvalidWebAuthnResponse)
+		}
+
+		cd, err := parseClientData(req.Response.ClientDataJSON, webauthnCeremonyGet)
+		if err != nil {
+			fail("", err)
+			return
+		}
+		challengeUserId, ok, err := auth.consumeWebAuthnChallenge(cd.Challenge, webauthnCeremonyGet)
+		if err != nil {
+			internalError(w, fmt.Errorf("problem reading WebAuthn challenge: %v", err))
+			return
+		}
+		if !ok {
+			fail("", errInvalidWebAuthnChallenge)
+			return
+		}
+
+		cred, err := auth.readWebAuthnCredential(base64.RawURLEncoding.EncodeToString(req.RawID))
+		if err != nil {
+			internalError(w, fmt.Errorf("problem reading WebAuthn credential: %v", err))
+			return
+		}
+		if cred == nil {
+			fail(challengeUserId, errWebAuthnCredentialNotFound)
+			return
+		}
+		if challengeUserId != "" && challengeUserId != cred.userId {
+			fail(cred.userId, errors.New("credential belongs to another user"))
+			return
+		}
+		// authenticators return the user.id we registered the credential with (section 7.2 step 6)
+		if len(req.Response.UserHandle) > 0 && string(req.Response.UserHandle) != cred.userId {
+			fail(cred.userId, errors.New("userHandle doesn't match the credential's user"))
+			return
+		}
+
+		// As a second factor the MFA challenge must belong to the credential's user
+		if req.MFAChallenge != "" {
+			mfaUserId, err := auth.findMFAChallenge(req.MFAChallenge)
+			if err != nil {
+				internalError(w, fmt.Errorf("problem reading MFA challenge: %v", err))
+				return
+			}
+			if mfaUserId != cred.userId {
+				fail(cred.userId, errInvalidMFAChallenge)
+				return
+			}
+		}
+
+		signCount, err := verifyAssertion(cred, &req, req.MFAChallenge == "")
+		if err != nil {
+			fail(cred.userId, err)
+			return
+		}
+		if err := auth.updateWebAuthnCredential(cred.ID, signCount); err != nil {
+			internalError(w, fmt.Errorf("problem updating WebAuthn credential: %v", err))
+			return
+		}
+		if req.MFAChallenge != "" {
+			if err := auth.deleteMFAChallenge(req.MFAChallenge); err != nil {
+				internalError(w, fmt.Errorf("problem deleting MFA challenge: %v", err))
+				return
+			}
+		}
+
+		u, err := userService.lookupByUserId(cred.userId)
+		if err != nil || u == nil {
+			internalError(w, fmt.Errorf("problem looking up userId=%s: %v", cred.userId, err))
+			return
+		}
+		if !u.EmailVerified {
+			authFailures.With("method", "webauthn").Add(1)
+			problem(w, http.StatusForbidden, errEmailNotVerified)
+			return
+		}
+		completeLogin(w, r, logger, auth, u)
+	}
+}
@@ -0,0 +1,628 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moov-io/base"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+// encodeCBOR is the inverse of decodeCBOR, used to build authenticator responses in tests
+func encodeCBOR(v interface{}) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n <= 0xff:
+			return []byte{major<<5 | 24, byte(n)}
+		case n <= 0xffff:
+			bs := []byte{major<<5 | 25, 0, 0}
+			binary.BigEndian.PutUint16(bs[1:], uint16(n))
+			return bs
+		case n <= 0xffffffff:
+			bs := []byte{major<<5 | 26, 0, 0, 0, 0}
+			binary.BigEndian.PutUint32(bs[1:], uint32(n))
+			return bs
+		}
+		bs := []byte{major<<5 | 27, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint64(bs[1:], n)
+		return bs
+	}
+
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case []interface{}:
+		out := head(4, uint64(len(v)))
+		for i := range v {
+			out = append(out, encodeCBOR(v[i])...)
+		}
+		return out
+	case map[interface{}]interface{}:
+		out := head(5, uint64(len(v)))
+		for key, value := range v {
+			out = append(out, encodeCBOR(key)...)
+			out = append(out, encodeCBOR(value)...)
+		}
+		return out
+	case bool:
+		if v {
+			return []byte{0xf5}
+		}
+		return []byte{0xf4}
+	case nil:
+		return []byte{0xf6}
+	}
+	panic(fmt.Sprintf("encodeCBOR: unsupported type %T", v))
+}
+
+// softAuthenticator is a WebAuthn authenticator implemented in software so the
+// registration and login ceremonies can be tested without hardware.
+type softAuthenticator struct {
+	credentialID []byte
+	signer       crypto.Signer
+	signCount    uint32
+	noCounter    bool
+
+	// flags set on authenticator data
+	userPresent  bool
+	userVerified bool
+
+	origin string
+	rpID   string
+}
+
+func newSoftAuthenticator(t *testing.T, alg int) *softAuthenticator {
+	t.Helper()
+
+	a := &softAuthenticator{
+		credentialID: make([]byte, 16),
+		userPresent:  true,
+		userVerified: true,
+		origin:       webauthnOrigin(),
+		rpID:         webauthnRPID(),
+	}
+	rand.Read(a.credentialID)
+
+	var err error
+	switch alg {
+	case coseAlgES256:
+		a.signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case coseAlgEdDSA:
+		_, a.signer, err = ed25519.GenerateKey(rand.Reader)
+	case coseAlgRS256:
+		a.signer, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil || a.signer == nil {
+		t.Fatalf("problem creating alg=%d key: %v", alg, err)
+	}
+	return a
+}
+
+func (a *softAuthenticator) coseKey() []byte {
+	switch pub := a.signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		x, y := make([]byte, 32), make([]byte, 32)
+		copy(x[32-len(pub.X.Bytes()):], pub.X.Bytes())
+		copy(y[32-len(pub.Y.Bytes()):], pub.Y.Bytes())
+		return encodeCBOR(map[interface{}]interface{}{1: 2, 3: coseAlgES256, -1: 1, -2: x, -3: y})
+	case ed25519.PublicKey:
+		return encodeCBOR(map[interface{}]interface{}{1: 1, 3: coseAlgEdDSA, -1: 6, -2: []byte(pub)})
+	case *rsa.PublicKey:
+		return encodeCBOR(map[interface{}]interface{}{1: 3, 3: coseAlgRS256, -1: pub.N.Bytes(), -2: big.NewInt(int64(pub.E)).Bytes()})
+	}
+	panic("unknown key type")
+}
+
+func (a *softAuthenticator) authData(attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	out := append([]byte{}, rpIDHash[:]...)
+
+	var flags byte
+	if a.userPresent {
+		flags |= authDataUserPresent
+	}
+	if a.userVerified {
+		flags |= authDataUserVerified
+	}
+	if attested {
+		flags |= authDataAttestedCredential
+	}
+	out = append(out, flags)
+
+	counter := make([]byte, 4)
+	binary.BigEndian.PutUint32(counter, a.signCount)
+	out = append(out, counter...)
+
+	if attested {
+		out = append(out, make([]byte, 16)...) // AAGUID
+		n := make([]byte, 2)
+		binary.BigEndian.PutUint16(n, uint16(len(a.credentialID)))
+		out = append(out, n...)
+		out = append(out, a.credentialID...)
+		out = append(out, a.coseKey()...)
+	}
+	return out
+}
+
+func (a *softAuthenticator) clientData(ceremony, challenge string) []byte {
+	bs, _ := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": challenge,
+		"origin":    a.origin,
+	})
+	return bs
+}
+
+// register responds to the creation options like navigator.credentials.create()
+func (a *softAuthenticator) register(challenge string) *webauthnRegistrationRequest {
+	req := &webauthnRegistrationRequest{
+		Name:  "soft key",
+		RawID: a.credentialID,
+	}
+	req.Response.ClientDataJSON = a.clientData(webauthnCeremonyCreate, challenge)
+	req.Response.AttestationObject = encodeCBOR(map[interface{}]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[interface{}]interface{}{},
+		"authData": a.authData(true),
+	})
+	return req
+}
+
+// assert responds to the request options like navigator.credentials.get()
+func (a *softAuthenticator) assert(t *testing.T, challenge string) *webauthnAssertionRequest {
+	t.Helper()
+
+	if !a.noCounter {
+		a.signCount++
+	}
+	req := &webauthnAssertionRequest{RawID: a.credentialID}
+	req.Response.ClientDataJSON = a.clientData(webauthnCeremonyGet, challenge)
+	req.Response.AuthenticatorData = a.authData(false)
+
+	clientDataHash := sha256.Sum256(req.Response.ClientDataJSON)
+	signed := append(append([]byte{}, req.Response.AuthenticatorData...), clientDataHash[:]...)
+
+	var err error
+	if _, ok := a.signer.(ed25519.PrivateKey); ok {
+		req.Response.Signature, err = a.signer.Sign(rand.Reader, signed, crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256(signed)
+		req.Response.Signature, err = a.signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestWebAuthn__base64URL(t *testing.T) {
+	var out struct {
+		A base64URL `json:"a"`
+		B base64URL `json:"b"`
+	}
+	if err := json.Unmarshal([]byte(`{"a": "-_8", "b": "+/8="}`), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.A, []byte{0xfb, 0xff}) || !bytes.Equal(out.B, []byte{0xfb, 0xff}) {
+		t.Errorf("a=%x b=%x", out.A, out.B)
+	}
+	bs, _ := json.Marshal(out)
+	if string(bs) != `{"a":"-_8","b":"-_8"}` {
+		t.Errorf("got %s", bs)
+	}
+	if err := json.Unmarshal([]byte(`{"a": "!!"}`), &out); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestWebAuthn__signatures(t *testing.T) {
+	for _, alg := range []int{coseAlgES256, coseAlgEdDSA, coseAlgRS256} {
+		a := newSoftAuthenticator(t, alg)
+		req := a.assert(t, "challenge")
+
+		cred := &webauthnCredential{publicKey: a.coseKey()}
+		signCount, err := verifyAssertion(cred, req, true)
+		if err != nil {
+			t.Errorf("alg=%d: %v", alg, err)
+		}
+		if signCount != 1 {
+			t.Errorf("alg=%d: signCount=%d", alg, signCount)
+		}
+
+		// tampered data
+		req.Response.ClientDataJSON = a.clientData(webauthnCeremonyGet, "other")
+		if _, err := verifyAssertion(cred, req, true); err == nil {
+			t.Errorf("alg=%d: expected error", alg)
+		}
+	}
+
+	// unsupported keys
+	if _, err := parseCOSEKey(encodeCBOR(map[interface{}]interface{}{1: 2, 3: -35, -1: 2})); err == nil {
+		t.Error("expected error")
+	}
+	// points off the curve
+	if _, err := parseCOSEKey(encodeCBOR(map[interface{}]interface{}{1: 2, 3: coseAlgES256, -1: 1, -2: make([]byte, 32), -3: make([]byte, 32)})); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestWebAuthn__verifyAssertion(t *testing.T) {
+	a := newSoftAuthenticator(t, coseAlgES256)
+	cred := &webauthnCredential{publicKey: a.coseKey(), signCount: 5}
+
+	// counter must increase
+	a.signCount = 4
+	if _, err := verifyAssertion(cred, a.assert(t, "challenge"), true); err == nil {
+		t.Error("expected error")
+	}
+	if n, err := verifyAssertion(cred, a.assert(t, "challenge"), true); err != nil || n != 6 {
+		t.Errorf("n=%d err=%v", n, err)
+	}
+
+	// authenticators without counters always send zero
+	a.noCounter, a.signCount = true, 0
+	cred.signCount = 0
+	for i := 0; i < 2; i++ {
+		if n, err := verifyAssertion(cred, a.assert(t, "challenge"), true); err != nil || n != 0 {
+			t.Errorf("n=%d err=%v", n, err)
+		}
+	}
+
+	// user verification
+	a.userVerified = false
+	if _, err := verifyAssertion(cred, a.assert(t, "challenge"), true); err == nil {
+		t.Error("expected error")
+	}
+	if _, err := verifyAssertion(cred, a.assert(t, "challenge"), false); err != nil {
+		t.Error(err)
+	}
+
+	// wrong RP ID
+	a.rpID = "example.com"
+	if _, err := verifyAssertion(cred, a.assert(t, "challenge"), false); err == nil {
+		t.Error("expected error")
+	}
+}
+
+type webauthnTest struct {
+	t      *testing.T
+	auth   *testAuth
+	repo   *testUserRepository
+	router *mux.Router
+	user   *User
+	cookie *http.Cookie
+}
+
+func setupWebAuthnTest(t *testing.T) *webauthnTest {
+	t.Helper()
+
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := &User{
+		ID:        generateID(),
+		Email:     "test@moov.io",
+		CreatedAt: base.NewTime(time.Now()),
+	}
+	if err := repo.upsert(u); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.writePassword(u.ID, "superlongpassword"); err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := createCookie(u.ID, auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	addLoginRoutes(router, log.NewNopLogger(), auth, repo)
+	addMFARoutes(router, log.NewNopLogger(), auth, repo)
+	addWebAuthnRoutes(router, log.NewNopLogger(), auth, repo)
+
+	return &webauthnTest{t: t, auth: auth, repo: repo, router: router, user: u, cookie: cookie}
+}
+
+func (wt *webauthnTest) cleanup() {
+	wt.auth.cleanup()
+	wt.repo.cleanup()
+}
+
+func (wt *webauthnTest) call(method, path string, body interface{}) *httptest.ResponseRecorder {
+	wt.t.Helper()
+
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			wt.t.Fatal(err)
+		}
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, path, &buf)
+	r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", wt.cookie.Value))
+	wt.router.ServeHTTP(w, r)
+	w.Flush()
+	return w
+}
+
+func (wt *webauthnTest) decode(w *httptest.ResponseRecorder, v interface{}) {
+	wt.t.Helper()
+
+	if w.Code != http.StatusOK {
+		wt.t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+		wt.t.Fatal(err)
+	}
+}
+
+func (wt *webauthnTest) register(a *softAuthenticator) *webauthnRegistrationResponse {
+	wt.t.Helper()
+
+	var options webauthnCreationOptions
+	wt.decode(wt.call("POST", fmt.Sprintf("/users/%s/webauthn/register", wt.user.ID), nil), &options)
+	if options.RP.ID != a.rpID || options.Attestation != "none" {
+		wt.t.Fatalf("unexpected options: %#v", options)
+	}
+
+	var resp webauthnRegistrationResponse
+	wt.decode(wt.call("POST", fmt.Sprintf("/users/%s/webauthn/register/finish", wt.user.ID), a.register(options.Challenge)), &resp)
+	return &resp
+}
+
+func TestWebAuthn__passwordless(t *testing.T) {
+	wt := setupWebAuthnTest(t)
+	defer wt.cleanup()
+
+	a := newSoftAuthenticator(t, coseAlgES256)
+	resp := wt.register(a)
+	if resp.Credential.ID != base64.RawURLEncoding.EncodeToString(a.credentialID) || resp.Credential.Name != "soft key" {
+		t.Errorf("unexpected credential: %#v", resp.Credential)
+	}
+	if len(resp.RecoveryCodes) != recoveryCodeCount {
+		t.Errorf("got %d recovery codes", len(resp.RecoveryCodes))
+	}
+
+	// registering the same authenticator again is rejected
+	var options webauthnCreationOptions
+	wt.decode(wt.call("POST", fmt.Sprintf("/users/%s/webauthn/register", wt.user.ID), nil), &options)
+	if len(options.ExcludeCredentials) != 1 || options.ExcludeCredentials[0].ID != resp.Credential.ID {
+		t.Errorf("unexpected excludeCredentials: %#v", options.ExcludeCredentials)
+	}
+	if w := wt.call("POST", fmt.Sprintf("/users/%s/webauthn/register/finish", wt.user.ID), a.register(options.Challenge)); w.Code != http.StatusConflict {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	var credentials []*webauthnCredential
+	wt.decode(wt.call("GET", fmt.Sprintf("/users/%s/webauthn/credentials", wt.user.ID), nil), &credentials)
+	if len(credentials) != 1 || credentials[0].ID != resp.Credential.ID {
+		t.Errorf("unexpected credentials: %#v", credentials)
+	}
+
+	// login with the email
+	var request webauthnRequestOptions
+	wt.decode(wt.call("POST", "/users/login/webauthn", webauthnLoginRequest{Email: wt.user.Email}), &request)
+	if len(request.AllowCredentials) != 1 || request.UserVerification != "required" {
+		t.Errorf("unexpected options: %#v", request)
+	}
+	assertion := a.assert(t, request.Challenge)
+	w := wt.call("POST", "/users/login/webauthn/finish", assertion)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Header().Get("Set-Cookie"), "moov_auth=") {
+		t.Errorf("expected cookie, got %q", w.Header().Get("Set-Cookie"))
+	}
+
+	// challenges are single use
+	if w := wt.call("POST", "/users/login/webauthn/finish", assertion); w.Code != http.StatusForbidden {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	// login without an email, passkeys identify the user
+	wt.decode(wt.call("POST", "/users/login/webauthn", webauthnLoginRequest{}), &request)
+	if len(request.AllowCredentials) != 0 {
+		t.Errorf("unexpected allowCredentials: %#v", request.AllowCredentials)
+	}
+	assertion = a.assert(t, request.Challenge)
+	assertion.Response.UserHandle = []byte(wt.user.ID)
+	if w := wt.call("POST", "/users/login/webauthn/finish", assertion); w.Code != http.StatusOK {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	// the userHandle must be the credential's user
+	wt.decode(wt.call("POST", "/users/login/webauthn", webauthnLoginRequest{}), &request)
+	assertion = a.assert(t, request.Challenge)
+	assertion.Response.UserHandle = []byte(generateID())
+	if w := wt.call("POST", "/users/login/webauthn/finish", assertion); w.Code != http.StatusForbidden {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	// a cloned authenticator with an old counter is rejected
+	a.signCount = 0
+	wt.decode(wt.call("POST", "/users/login/webauthn", webauthnLoginRequest{}), &request)
+	if w := wt.call("POST", "/users/login/webauthn/finish", a.assert(t, request.Challenge)); w.Code != http.StatusForbidden {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	// passwordless login requires user verification
+	a.signCount = 10
+	a.userVerified = false
+	wt.decode(wt.call("POST", "/users/login/webauthn", webauthnLoginRequest{}), &request)
+	if w := wt.call("POST", "/users/login/webauthn/finish", a.assert(t, request.Challenge)); w.Code != http.StatusForbidden {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	// unknown authenticators can't login
+	other := newSoftAuthenticator(t, coseAlgEdDSA)
+	wt.decode(wt.call("POST", "/users/login/webauthn", webauthnLoginRequest{}), &request)
+	if w := wt.call("POST", "/users/login/webauthn/finish", other.assert(t, request.Challenge)); w.Code != http.StatusForbidden {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestWebAuthn__secondFactor(t *testing.T) {
+	wt := setupWebAuthnTest(t)
+	defer wt.cleanup()
+
+	a := newSoftAuthenticator(t, coseAlgEdDSA)
+	a.userVerified = false // e.g. a security key without a PIN
+	resp := wt.register(a)
+
+	login := func() *mfaChallengeResponse {
+		w := wt.call("POST", "/users/login", map[string]string{"email": wt.user.Email, "password": "superlongpassword"})
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("got %d: %s", w.Code, w.Body.String())
+		}
+		var challenge mfaChallengeResponse
+		if err := json.NewDecoder(w.Body).Decode(&challenge); err != nil {
+			t.Fatal(err)
+		}
+		return &challenge
+	}
+
+	challenge := login()
+	if len(challenge.Methods) != 1 || challenge.Methods[0] != "webauthn" {
+		t.Errorf("unexpected methods: %v", challenge.Methods)
+	}
+
+	var request webauthnRequestOptions
+	wt.decode(wt.call("POST", "/users/login/webauthn", webauthnLoginRequest{MFAChallenge: challenge.Challenge}), &request)
+	if len(request.AllowCredentials) != 1 || request.UserVerification != "discouraged" {
+		t.Errorf("unexpected options: %#v", request)
+	}
+	assertion := a.assert(t, request.Challenge)
+	assertion.MFAChallenge = challenge.Challenge
+	w := wt.call("POST", "/users/login/webauthn/finish", assertion)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	var user User
+	if err := json.NewDecoder(w.Body).Decode(&user); err != nil {
+		t.Fatal(err)
+	}
+	if !user.MFAEnabled || user.RecoveryCodesRemaining != recoveryCodeCount {
+		t.Errorf("mfaEnabled=%v recoveryCodesRemaining=%d", user.MFAEnabled, user.RecoveryCodesRemaining)
+	}
+
+	// the MFA challenge was used up
+	wt.decode(wt.call("POST", "/users/login/webauthn", webauthnLoginRequest{}), &request)
+	assertion = a.assert(t, request.Challenge)
+	assertion.MFAChallenge = challenge.Challenge
+	if w := wt.call("POST", "/users/login/webauthn/finish", assertion); w.Code != http.StatusForbidden {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	// recovery codes work for WebAuthn users too
+	challenge = login()
+	body := map[string]string{"challenge": challenge.Challenge, "code": "not-a-code"}
+	if w := wt.call("POST", "/users/login/mfa", body); w.Code != http.StatusForbidden {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	body["code"] = resp.RecoveryCodes[0]
+	if w := wt.call("POST", "/users/login/mfa", body); w.Code != http.StatusOK {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	// removing the only credential disables MFA
+	if w := wt.call("DELETE", fmt.Sprintf("/users/%s/webauthn/credentials/%s", wt.user.ID, resp.Credential.ID), nil); w.Code != http.StatusOK {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	if w := wt.call("DELETE", fmt.Sprintf("/users/%s/webauthn/credentials/%s", wt.user.ID, resp.Credential.ID), nil); w.Code != http.StatusNotFound {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	if n, err := wt.auth.countRecoveryCodes(wt.user.ID); err != nil || n != 0 {
+		t.Errorf("n=%d err=%v", n, err)
+	}
+	w = wt.call("POST", "/users/login", map[string]string{"email": wt.user.Email, "password": "superlongpassword"})
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestWebAuthn__registrationErrors(t *testing.T) {
+	wt := setupWebAuthnTest(t)
+	defer wt.cleanup()
+
+	begin := func() string {
+		var options webauthnCreationOptions
+		wt.decode(wt.call("POST", fmt.Sprintf("/users/%s/webauthn/register", wt.user.ID), nil), &options)
+		return options.Challenge
+	}
+	finish := func(req *webauthnRegistrationRequest) *httptest.ResponseRecorder {
+		return wt.call("POST", fmt.Sprintf("/users/%s/webauthn/register/finish", wt.user.ID), req)
+	}
+
+	// wrong origin
+	a := newSoftAuthenticator(t, coseAlgES256)
+	a.origin = "https://evil.example.com"
+	if w := finish(a.register(begin())); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	// unknown challenge
+	a = newSoftAuthenticator(t, coseAlgES256)
+	if w := finish(a.register("made-up")); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	// other attestation formats
+	req := a.register(begin())
+	req.Response.AttestationObject = encodeCBOR(map[interface{}]interface{}{
+		"fmt":      "packed",
+		"attStmt":  map[interface{}]interface{}{"alg": coseAlgES256},
+		"authData": a.authData(true),
+	})
+	if w := finish(req); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	// user must be present
+	a.userPresent = false
+	if w := finish(a.register(begin())); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	// another user's path
+	w := wt.call("POST", fmt.Sprintf("/users/%s/webauthn/register", generateID()), nil)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+}